@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"fido2-hmac-deriver/internal/agekey"
+	"fido2-hmac-deriver/internal/backend/libfido2"
+	"fido2-hmac-deriver/internal/secretagent"
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/ui"
+	"fido2-hmac-deriver/internal/virtual"
+)
+
+// defaultCommand runs when no command is given on the command line.
+const defaultCommand = "derive"
+
+// errUsage reports invalid command line usage. The flag package has already
+// printed the problem and the command's help text, so main only sets the exit code.
+var errUsage = errors.New("invalid usage")
+
+// command describes a subcommand of the CLI.
+type command struct {
+	name    string                    // Name used on the command line
+	summary string                    // One-line description shown in the command overview
+	run     func(args []string) error // Parses the command's flags and executes it
+}
+
+// commands returns all subcommands in the order they are listed in the help text.
+func commands() []*command {
+	return []*command{
+		{name: "derive", summary: "Derive the HMAC secret from the enrolled credential (default)", run: runDerive},
+		{name: "enroll", summary: "Create a credential on a device and store it", run: runEnroll},
+		{name: "list", summary: "List the connected FIDO2 devices", run: runList},
+		{name: "info", summary: "Show the capabilities of a device", run: runInfo},
+		{name: "pin", summary: "Show the PIN status of a device, or set or change its PIN", run: runPin},
+		{name: "credentials", summary: "List or remove stored credentials or the credentials on a device", run: runCredentials},
+		{name: "verify", summary: "Check a secret against the stored check values", run: runVerify},
+		{name: "encrypt", summary: "Encrypt a file with a key derived from the secret", run: runEncrypt},
+		{name: "decrypt", summary: "Decrypt a file written by encrypt", run: runDecrypt},
+		{name: "wrap", summary: "Generate data encryption keys wrapped with the secret", run: runWrap},
+		{name: "unwrap", summary: "Unwrap data encryption keys from the keyring", run: runUnwrap},
+		{name: "vault", summary: "Share a master key between several authenticators", run: runVault},
+		{name: "ssh-key", summary: "Derive an Ed25519 SSH key from the secret", run: runSSHKey},
+		{name: "agent", summary: "Cache the secret in a background agent, or serve SSH keys", run: runAgent},
+		{name: "age-plugin", summary: "Serve the age plugin protocol (run by age as " + agekey.PluginBinary + ")", run: runAgePlugin},
+		{name: "git-filter", summary: "Encrypt or decrypt file contents as a git clean/smudge filter", run: runGitFilter},
+		{name: "git-setup", summary: "Configure the git filter in a repository", run: runGitSetup},
+		{name: "help", summary: "Show help for a command", run: runHelp},
+	}
+}
+
+// findCommand returns the command with the given name, or nil if there is none.
+func findCommand(name string) *command {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// printUsage writes the command overview.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: fido2-hmac-deriver [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'fido2-hmac-deriver help <command>' for the flags of a command.")
+}
+
+// runHelp shows the command overview or the help text of a single command.
+func runHelp(args []string) error {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return nil
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil || cmd.name == "help" {
+		fmt.Fprintf(os.Stderr, "Error: unknown command '%s'\n\n", args[0])
+		printUsage(os.Stderr)
+		return errUsage
+	}
+	return cmd.run([]string{"-help"})
+}
+
+// newFlagSet creates the flag set of a command with its help text.
+//
+// Parameters:
+//   - name: The command name
+//   - arguments: Positional arguments shown in the usage line (may be empty)
+//   - description: What the command does, shown above the flags
+func newFlagSet(name, arguments, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "Usage: fido2-hmac-deriver %s\n\n%s\n\nFlags:\n",
+			strings.TrimSpace(name+" [flags] "+arguments), description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses the arguments of a command, mapping parse errors to errUsage.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	return nil
+}
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// options holds the flags shared by several commands.
+// Each command registers only the groups it uses.
+type options struct {
+	backend      string // Device backend name
+	virtualSeed  string // Seed of the virtual authenticator
+	virtualState string // State file of the virtual authenticator
+	virtualPIN   string // Initial PIN of the virtual authenticator
+
+	fidoDevice string // Specific FIDO device path (optional)
+	pinEnvVar  string // Environment variable name for PIN (optional)
+	pinentry   string // Pinentry program asking for the PIN (optional)
+	pinFD      int    // File descriptor to read the PIN from (-1 if not given)
+	pinFile    string // File to read the PIN from (optional)
+	pinStdin   bool   // Read the PIN from stdin
+	noAgent    bool   // Do not use the secret cached by the agent
+
+	saltMode       string // Salt derivation mode
+	saltContext    string // Context label for the context salt
+	legacySaltPath string // Device path for the legacy path-based salt
+	saltGeneration int    // Key rotation generation of the salt
+	noDiscover     bool   // Only use stored credentials, never discover them on the device
+
+	storeDir string // Credential store directory
+	quiet    bool   // Suppress progress messages
+
+	output         string // Output format
+	encoding       string // Default encoding of binary fields in structured output
+	fieldEncodings string // Per-field encoding overrides
+}
+
+// defaultOptions returns the options used when a flag is not given or not registered.
+func defaultOptions() *options {
+	return &options{
+		backend:     libfido2.Name,
+		pinFD:       -1,
+		virtualSeed: "fido2-hmac-deriver",
+		output:      string(types.OutputText),
+		encoding:    string(types.EncodingBase64),
+	}
+}
+
+// commonFlags registers the flags every command accepts.
+func (o *options) commonFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.quiet, "quiet", o.quiet, "Suppress progress messages on stderr (prompts, warnings and errors are still shown)")
+}
+
+// backendFlags registers the flags selecting and configuring the device backend.
+func (o *options) backendFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.backend, "backend", o.backend, "Device backend: libfido2 for physical devices, virtual for a software authenticator (for testing)")
+	fs.StringVar(&o.virtualSeed, "virtual-seed", o.virtualSeed, "Seed the virtual authenticator derives all key material from")
+	fs.StringVar(&o.virtualState, "virtual-state", o.virtualState, "File to persist the virtual authenticator's PIN and resident credentials in")
+	fs.StringVar(&o.virtualPIN, "virtual-pin", o.virtualPIN, "PIN to configure on the virtual authenticator if it has none yet")
+}
+
+// deviceFlags registers the flags for non-interactive device selection and PIN entry.
+func (o *options) deviceFlags(fs *flag.FlagSet, withPIN bool) {
+	fs.StringVar(&o.fidoDevice, "fido-device", o.fidoDevice, "Specify FIDO device path (e.g., /dev/hidraw10) to skip device selection")
+	if withPIN {
+		fs.StringVar(&o.pinEnvVar, "pin-environment-variable", o.pinEnvVar, "Environment variable name containing the PIN (for non-interactive mode)")
+		fs.StringVar(&o.pinentry, "pinentry", o.pinentry, "Pinentry program to ask for the PIN with (e.g., pinentry-gnome3 or pinentry-curses)")
+		fs.IntVar(&o.pinFD, "pin-fd", o.pinFD, "Read the PIN from the first line of this open file descriptor")
+		fs.StringVar(&o.pinFile, "pin-file", o.pinFile, "Read the PIN from the first line of this file, which other users must not be able to read")
+		fs.BoolVar(&o.pinStdin, "pin-stdin", o.pinStdin, "Read the PIN from the first line of stdin")
+		fs.BoolVar(&o.noAgent, "no-agent", o.noAgent, "Do not use the secret cached by the agent (see 'fido2-hmac-deriver help agent')")
+	}
+}
+
+// saltFlags registers the flags controlling how the credential is found and how the
+// salt is built.
+func (o *options) saltFlags(fs *flag.FlagSet) {
+	o.saltInputFlags(fs)
+	fs.BoolVar(&o.noDiscover, "no-discover", o.noDiscover, "Only use credentials in the store, do not look up the resident credential on the device")
+}
+
+// saltInputFlags registers the flags selecting the inputs of the salt, for commands
+// that rebuild the salt of stored credentials without the device.
+func (o *options) saltInputFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.saltMode, "salt-mode", o.saltMode, "Salt derivation mode: identity, context or legacy-path (default: chosen from the stored credential)")
+	fs.StringVar(&o.saltContext, "salt-context", o.saltContext, "Context label to derive the salt from instead of the device identity")
+	fs.StringVar(&o.legacySaltPath, "legacy-salt-path", o.legacySaltPath, "Device path the legacy path-based salt was created with (e.g., /dev/hidraw10)")
+	fs.IntVar(&o.saltGeneration, "salt-generation", o.saltGeneration, "Key rotation generation of the salt (0 is the original salt)")
+}
+
+// storeFlags registers the flag selecting the credential store.
+func (o *options) storeFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.storeDir, "store-dir", o.storeDir, "Directory of the credential store (default: $XDG_DATA_HOME/fido2-hmac-deriver)")
+}
+
+// outputFlags registers the flags selecting the output format and the encodings of binary fields.
+func (o *options) outputFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.output, "output", o.output, "Output format: text, json, yaml, key (the key as one encoded line), raw (the key bytes),\n"+
+		"age (an age identity) or age-plugin (an identity for age-plugin-fido2hmac)")
+	fs.StringVar(&o.encoding, "encoding", o.encoding, "Encoding of binary fields in json, yaml and key output: base64, base64url or hex")
+	fs.StringVar(&o.fieldEncodings, "field-encoding", o.fieldEncodings, "Per-field encodings for json and yaml output (e.g., secret=hex,credential_id=base64url)")
+}
+
+// outputOptions validates the output flags.
+func (o *options) outputOptions() (*types.OutputOptions, error) {
+	return ui.ParseOutputOptions(o.output, o.encoding, o.fieldEncodings)
+}
+
+// storeDirectory returns the store directory given with --store-dir or the default one.
+func (o *options) storeDirectory() (string, error) {
+	if o.storeDir != "" {
+		return o.storeDir, nil
+	}
+	return store.DefaultDir()
+}
+
+// pinSource returns the source of the PIN selected with the PIN flags, or nil to
+// prompt on the terminal. At most one source may be selected.
+func (o *options) pinSource() (ui.PINSource, error) {
+	var sources []ui.PINSource
+	if o.pinEnvVar != "" {
+		sources = append(sources, ui.EnvironmentPIN(o.pinEnvVar))
+	}
+	if o.pinentry != "" {
+		sources = append(sources, &ui.PinentryPIN{Program: o.pinentry, Stderr: os.Stderr})
+	}
+	if o.pinFD >= 0 {
+		sources = append(sources, &ui.FDPIN{FD: o.pinFD})
+	}
+	if o.pinFile != "" {
+		sources = append(sources, ui.FilePIN(o.pinFile))
+	}
+	if o.pinStdin {
+		sources = append(sources, ui.NewStdinPIN())
+	}
+
+	switch len(sources) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sources[0], nil
+	default:
+		return nil, errors.New("only one of --pin-environment-variable, --pinentry, --pin-fd, --pin-file and --pin-stdin may be given")
+	}
+}
+
+// hasPINSource reports whether a PIN flag replaces the terminal prompt.
+func (o *options) hasPINSource() bool {
+	return o.pinEnvVar != "" || o.pinentry != "" || o.pinFD >= 0 || o.pinFile != "" || o.pinStdin
+}
+
+// readsPINFromStdin reports whether the PIN is read from stdin.
+func (o *options) readsPINFromStdin() bool {
+	return o.pinStdin || o.pinFD == 0
+}
+
+// application creates the application configured by the options.
+func (o *options) application() (*Application, error) {
+	backend, err := newBackend(o.backend, virtual.Options{
+		Seed:      []byte(o.virtualSeed),
+		PIN:       o.virtualPIN,
+		StatePath: o.virtualState,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	storeDir, err := o.storeDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	display := ui.NewDisplay()
+	display.SetQuiet(o.quiet)
+
+	app := NewApplication(display, backend, store.New(storeDir))
+	app.fidoDevice = o.fidoDevice
+	app.pinSource, err = o.pinSource()
+	if err != nil {
+		return nil, err
+	}
+	if !o.noAgent {
+		app.agentSocket = secretagent.DefaultSocketPath()
+	}
+	app.config.SaltMode = types.SaltMode(o.saltMode)
+	app.config.SaltContext = o.saltContext
+	app.config.LegacySaltPath = o.legacySaltPath
+	app.config.SaltGeneration = o.saltGeneration
+	app.config.DiscoverCredentials = !o.noDiscover
+	return app, nil
+}
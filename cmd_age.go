@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"fido2-hmac-deriver/internal/agekey"
+	"fido2-hmac-deriver/internal/types"
+
+	"filippo.io/age"
+)
+
+// runAgePlugin serves the age plugin protocol. age runs the binary as
+// age-plugin-fido2hmac with --age-plugin=recipient-v1 or identity-v1, which main
+// dispatches here; the command can also be run through a wrapper script to pass flags.
+func runAgePlugin(args []string) error {
+	opts := defaultOptions()
+	opts.quiet = true
+	fs := newFlagSet("age-plugin", "",
+		"Serve the age plugin protocol on stdin and stdout, for identities written by\n"+
+			"'fido2-hmac-deriver derive --output=age-plugin'. age runs it when the binary\n"+
+			"is installed as "+agekey.PluginBinary+" in $PATH. Encryption to the plugin\n"+
+			"recipient works without the authenticator; decryption asks age for the PIN\n"+
+			"unless another PIN source such as --pin-file or --pinentry is given.")
+	phase := fs.String("age-plugin", "", "State machine to run: recipient-v1 or identity-v1 (set by age)")
+	opts.deviceFlags(fs, true)
+	opts.backendFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if opts.readsPINFromStdin() {
+		return errors.New("stdin carries the age plugin protocol and cannot provide the PIN")
+	}
+
+	switch *phase {
+	case "recipient-v1":
+		return agekey.RunRecipient(os.Stdin, os.Stdout)
+	case "identity-v1":
+		app, err := opts.application()
+		if err != nil {
+			return err
+		}
+		return agekey.RunIdentity(os.Stdin, os.Stdout, app.ageIdentity)
+	case "":
+		return fmt.Errorf("no state machine given, this command is run by age (see 'fido2-hmac-deriver help age-plugin')")
+	default:
+		return fmt.Errorf("unsupported age plugin state machine '%s' (expected recipient-v1 or identity-v1)", *phase)
+	}
+}
+
+// isAgeOutput reports whether the output format writes an age identity.
+func isAgeOutput(format types.OutputFormat) bool {
+	return format == types.OutputAge || format == types.OutputAgePlugin
+}
+
+// outputAgeIdentity writes the age identity derived from the secret: the X25519
+// identity itself, or a plugin identity referencing the credential and salt.
+func (app *Application) outputAgeIdentity(result *types.HMACResult, format types.OutputFormat) error {
+	identity := &types.AgeIdentity{Created: result.Timestamp}
+	if identity.Created.IsZero() {
+		identity.Created = time.Now()
+	}
+
+	if format == types.OutputAge {
+		x25519, err := agekey.Identity(result.Secret)
+		if err != nil {
+			return err
+		}
+		identity.Identity = x25519.String()
+		identity.Recipient = x25519.Recipient().String()
+		return app.ui.OutputAgeIdentity(identity)
+	}
+
+	var err error
+	identity.Identity, err = agekey.PluginIdentity(&agekey.Reference{
+		RelyingPartyID: result.RelyingParty,
+		CredentialID:   result.CredentialID,
+		Salt:           result.Salt,
+	})
+	if err != nil {
+		return err
+	}
+	identity.Recipient, err = agekey.PluginRecipient(result.Secret)
+	if err != nil {
+		return err
+	}
+	return app.ui.OutputAgeIdentity(identity)
+}
+
+// ageIdentity derives the identity a plugin identity references, with the connected
+// device holding its credential. Stdin carries the plugin protocol, so the PIN is
+// requested through age unless another PIN source is given.
+func (app *Application) ageIdentity(ref *agekey.Reference, client *agekey.Client) (*age.X25519Identity, error) {
+	app.config.RelyingPartyID = ref.RelyingPartyID
+	selectedDevice, err := app.findCredentialDevice([][]byte{ref.CredentialID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := app.checkDevice(selectedDevice); err != nil {
+		return nil, err
+	}
+
+	var pin string
+	if app.pinSource != nil {
+		pin, err = app.readPIN()
+	} else {
+		pin, err = client.RequestSecret(fmt.Sprintf("Enter the PIN of %s:", selectedDevice.Name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pin == "" {
+		return nil, errors.New("no PIN provided, a PIN is required for FIDO2 operations")
+	}
+
+	if err := client.Message(fmt.Sprintf("Touch %s to decrypt", selectedDevice.Name)); err != nil {
+		return nil, err
+	}
+	result, err := app.cryptoProvider.DeriveHMACSecretWithSalt(selectedDevice, pin, app.config, ref.CredentialID, ref.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("HMAC secret derivation failed: %w", err)
+	}
+	return agekey.Identity(result.Secret)
+}
+
+// errNoCredentialDevice reports that no connected device holds the credential.
+var errNoCredentialDevice = errors.New("none of the connected devices holds the credential")
+
+// findCredentialDevice returns the device given with --fido-device, or the first
+// connected device holding one of the candidate credentials. Devices cannot be selected
+// interactively, since stdin is not available for prompts.
+func (app *Application) findCredentialDevice(candidates [][]byte) (*types.DeviceInfo, error) {
+	if app.fidoDevice != "" {
+		selectedDevice, err := app.selectDevice()
+		if err != nil {
+			return nil, err
+		}
+		found, err := app.cryptoProvider.FindCredential(selectedDevice, app.config, candidates)
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			return nil, fmt.Errorf("%s does not hold the credential", selectedDevice.Name)
+		}
+		return selectedDevice, nil
+	}
+
+	devices, err := app.deviceMgr.ListDevices()
+	if err != nil {
+		return nil, fmt.Errorf("device discovery failed: %w", err)
+	}
+	for _, device := range devices {
+		found, err := app.cryptoProvider.FindCredential(device, app.config, candidates)
+		if err != nil || found == nil {
+			continue
+		}
+		if err := app.deviceMgr.ValidateDevice(device); err != nil {
+			return nil, fmt.Errorf("device validation failed: %w", err)
+		}
+		return device, nil
+	}
+	return nil, errNoCredentialDevice
+}
+
+// enrolledDevice returns the device given with --fido-device, or the connected device
+// holding a stored credential of the relying party, for commands that cannot ask the
+// user to select a device. Device paths change when devices are reconnected, so the
+// credential identifies the device. If no connected device holds a stored credential,
+// e.g. on a machine that discovers the credential on the device, the only connected
+// device is used.
+func (app *Application) enrolledDevice() (*types.DeviceInfo, error) {
+	if app.fidoDevice != "" {
+		return app.selectDevice()
+	}
+
+	records, err := app.credentials.List()
+	if err != nil {
+		return nil, err
+	}
+	var candidates [][]byte
+	for _, record := range records {
+		if record.RelyingPartyID == app.config.RelyingPartyID {
+			candidates = append(candidates, record.CredentialID)
+		}
+	}
+	if len(candidates) > 0 {
+		selectedDevice, err := app.findCredentialDevice(candidates)
+		if !errors.Is(err, errNoCredentialDevice) {
+			return selectedDevice, err
+		}
+	}
+
+	devices, err := app.deviceMgr.ListDevices()
+	if err != nil {
+		return nil, fmt.Errorf("device discovery failed: %w", err)
+	}
+	if len(devices) != 1 {
+		return nil, fmt.Errorf("%d devices are connected and none holds a stored credential of '%s', connect only the enrolled one or pass --fido-device",
+			len(devices), app.config.RelyingPartyID)
+	}
+	if err := app.deviceMgr.ValidateDevice(devices[0]); err != nil {
+		return nil, fmt.Errorf("device validation failed: %w", err)
+	}
+	return devices[0], nil
+}
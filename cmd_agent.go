@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"fido2-hmac-deriver/internal/secretagent"
+	"fido2-hmac-deriver/internal/sshagent"
+	"fido2-hmac-deriver/internal/sshkey"
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/unixsocket"
+)
+
+// Defaults of agent start.
+const (
+	defaultAgentIdleTimeout = 15 * time.Minute
+	defaultAgentLifetime    = 8 * time.Hour
+)
+
+// agentStartTimeout is how long agent start waits for a new agent to listen.
+const agentStartTimeout = 5 * time.Second
+
+// runAgent manages the agent caching the secret, or runs an ssh-agent.
+func runAgent(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("agent", "start | stop | status | lock | serve | ssh",
+		"'start' derives the secret once and caches it in a background agent, which other\n"+
+			"commands use instead of the device while it is unlocked. The agent forgets the\n"+
+			"secret after --idle-timeout without use, after --lifetime, or with 'lock', and\n"+
+			"exits with 'stop'. 'status' shows whether it holds a secret. 'serve' runs the\n"+
+			"agent in the foreground, e.g. as a service, without a secret until 'start'.\n\n"+
+			"'ssh' derives SSH keys (see 'fido2-hmac-deriver ssh-key') and serves them as an\n"+
+			"ssh-agent in the foreground until interrupted, holding them only in memory. It\n"+
+			"writes the command setting SSH_AUTH_SOCK to stdout.")
+	socket := fs.String("socket", secretagent.DefaultSocketPath(), "Unix socket of the agent caching the secret (default: $"+secretagent.SocketEnvironment+" or in $XDG_RUNTIME_DIR)")
+	idleTimeout := fs.Duration("idle-timeout", defaultAgentIdleTimeout, "Forget the cached secret when it has not been used for this duration")
+	lifetime := fs.Duration("lifetime", 0, "Forget the secret or the SSH keys after this duration (default: 8h for start, no limit for ssh)")
+	sshSocket := fs.String("ssh-socket", unixsocket.RuntimePath("ssh-agent.sock"), "Unix socket of the ssh-agent")
+	var labels stringList
+	fs.Var(&labels, "label", "Label of an SSH key to serve (may be repeated, default: "+sshkey.DefaultLabel+")")
+	confirm := fs.Bool("confirm", false, "Ask on the ssh-agent's terminal before each signature")
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Flags may also follow the action, so parse the remaining arguments again
+	if fs.NArg() == 0 {
+		return errors.New("no agent action given (expected start, stop, status, lock, serve or ssh)")
+	}
+	action := fs.Arg(0)
+	if err := parseFlags(fs, fs.Args()[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if *idleTimeout <= 0 || *lifetime < 0 {
+		return errors.New("--idle-timeout must be positive and --lifetime must not be negative")
+	}
+	if len(labels) == 0 {
+		labels = stringList{sshkey.DefaultLabel}
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "start":
+		if *lifetime == 0 {
+			*lifetime = defaultAgentLifetime
+		}
+		return app.StartAgent(*socket, *idleTimeout, *lifetime)
+	case "stop":
+		return app.StopAgent(*socket)
+	case "status":
+		return app.AgentStatus(*socket)
+	case "lock":
+		return app.LockAgent(*socket)
+	case "serve":
+		return app.ServeAgent(*socket)
+	case "ssh":
+		return app.SSHAgent(*sshSocket, labels, *lifetime, *confirm)
+	default:
+		return fmt.Errorf("unknown agent action '%s' (expected start, stop, status, lock, serve or ssh)", action)
+	}
+}
+
+// StartAgent starts the agent in the background unless it is running, derives the
+// secret and caches it in the agent.
+func (app *Application) StartAgent(socket string, idleTimeout, lifetime time.Duration) error {
+	if _, err := secretagent.GetStatus(socket); err != nil {
+		if !secretagent.IsNotRunning(err) {
+			return err
+		}
+		if err := spawnAgent(socket); err != nil {
+			return fmt.Errorf("failed to start the agent: %w", err)
+		}
+	}
+
+	// The secret has to come from the device, not from the agent being replaced
+	app.agentSocket = ""
+	result, err := app.deriveSecret()
+	if err != nil {
+		return err
+	}
+	if err := secretagent.Load(socket, result, app.configQuery(""), idleTimeout, lifetime); err != nil {
+		return err
+	}
+	clear(result.Secret)
+
+	if socket != secretagent.DefaultSocketPath() {
+		app.ui.OutputEnvironment(secretagent.SocketEnvironment, socket)
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("The agent caches the secret for up to %s, or until unused for %s", lifetime, idleTimeout))
+	return nil
+}
+
+// spawnAgent runs 'agent serve' detached from the terminal and waits until it listens.
+func spawnAgent(socket string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, "agent", "serve", "--quiet", "--socket="+socket)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	var stderr bytes.Buffer // Tells why the agent could not start
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.Now().Add(agentStartTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				return fmt.Errorf("the agent exited: %s", strings.TrimPrefix(message, "[!] "))
+			}
+			return fmt.Errorf("the agent exited: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, err := secretagent.GetStatus(socket); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("the agent is not listening on %s after %s", socket, agentStartTimeout)
+}
+
+// ServeAgent runs the agent caching the secret in the foreground until it is stopped
+// or interrupted.
+func (app *Application) ServeAgent(socket string) error {
+	listener, err := unixsocket.Listen(socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+
+	server, err := secretagent.NewServer(listener)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	stopOnSignal(func() { listener.Close() })
+
+	app.ui.DisplaySuccess(fmt.Sprintf("Agent listening on %s", socket))
+	if err := server.Serve(); err != nil {
+		return fmt.Errorf("agent failed: %w", err)
+	}
+	app.ui.DisplayInfo("Agent stopped")
+	return nil
+}
+
+// AgentStatus shows whether the agent holds a secret.
+func (app *Application) AgentStatus(socket string) error {
+	status, err := secretagent.GetStatus(socket)
+	if err != nil {
+		return agentError(socket, err)
+	}
+	app.ui.DisplayAgentStatus(socket, status)
+	return nil
+}
+
+// LockAgent makes the agent forget the secret.
+func (app *Application) LockAgent(socket string) error {
+	if err := secretagent.Lock(socket); err != nil {
+		return agentError(socket, err)
+	}
+	app.ui.DisplaySuccess("The agent forgot the secret")
+	return nil
+}
+
+// StopAgent makes the agent forget the secret and exit.
+func (app *Application) StopAgent(socket string) error {
+	if err := secretagent.Stop(socket); err != nil {
+		return agentError(socket, err)
+	}
+	app.ui.DisplaySuccess("The agent stopped")
+	return nil
+}
+
+// agentError explains an error talking to the agent.
+func agentError(socket string, err error) error {
+	if secretagent.IsNotRunning(err) {
+		return fmt.Errorf("no agent is running on %s", socket)
+	}
+	return err
+}
+
+// cachedSecret returns the secret cached by the agent if it matches the query, or nil
+// if no agent is running, it is locked or it holds another secret.
+func (app *Application) cachedSecret(query *secretagent.Query) *types.HMACResult {
+	if app.agentSocket == "" {
+		return nil
+	}
+	result, err := secretagent.Secret(app.agentSocket, query)
+	if err != nil {
+		if !secretagent.IsNotRunning(err) {
+			app.ui.DisplayWarning(fmt.Sprintf("Not using the agent: %v", err))
+		}
+		return nil
+	}
+	if result != nil {
+		app.ui.DisplayInfo("Using the secret cached by the agent")
+	}
+	return result
+}
+
+// configQuery returns the query for the secret derived with the stored credential
+// and the configured salt, on the device with the given path or any device.
+func (app *Application) configQuery(devicePath string) *secretagent.Query {
+	return &secretagent.Query{
+		RelyingPartyID: app.config.RelyingPartyID,
+		SaltMode:       app.config.SaltMode,
+		SaltContext:    app.config.SaltContext,
+		LegacySaltPath: app.config.LegacySaltPath,
+		SaltGeneration: app.config.SaltGeneration,
+		DevicePath:     devicePath,
+	}
+}
+
+// SSHAgent derives the SSH keys with the given labels and serves them on the socket
+// until the agent is interrupted or its lifetime has passed.
+func (app *Application) SSHAgent(socket string, labels []string, lifetime time.Duration, confirm bool) error {
+	result, err := app.deriveSecret()
+	if err != nil {
+		return err
+	}
+
+	var confirmFunc sshagent.ConfirmFunc
+	if confirm {
+		confirmFunc = func(comment, fingerprint string) bool {
+			return app.ui.ConfirmAction(fmt.Sprintf("Allow a signature with %s (%s)?", comment, fingerprint))
+		}
+	}
+	agent := sshagent.New(confirmFunc)
+	for _, label := range labels {
+		privateKey, err := sshkey.Derive(result.Secret, label)
+		if err != nil {
+			return err
+		}
+		if err := agent.AddKey(privateKey, sshkey.DefaultComment(label), lifetime); err != nil {
+			return err
+		}
+	}
+	clear(result.Secret)
+
+	listener, err := unixsocket.Listen(socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+
+	stopOnSignal(func() { listener.Close() })
+	if lifetime > 0 {
+		time.AfterFunc(lifetime, func() { listener.Close() })
+	}
+
+	app.ui.OutputEnvironment("SSH_AUTH_SOCK", socket)
+	app.ui.DisplaySuccess(fmt.Sprintf("Serving %d SSH key(s) on %s", len(labels), socket))
+	if err := sshagent.Serve(listener, agent); err != nil {
+		return fmt.Errorf("agent failed: %w", err)
+	}
+	app.ui.DisplayInfo("Agent stopped")
+	return nil
+}
+
+// stopOnSignal calls stop when the process is interrupted, terminated or hung up.
+func stopOnSignal(stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-signals
+		stop()
+	}()
+}
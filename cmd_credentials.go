@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"fido2-hmac-deriver/internal/keyring"
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/vault"
+)
+
+// runCredentials manages the records in the credential store, or the resident
+// credentials on a device.
+func runCredentials(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("credentials", "[list | remove <fingerprint>... | prune | rename <fingerprint> <display name>]",
+		"Manage the credential store. 'list' (the default) shows the stored credentials,\n"+
+			"'remove' deletes the records with the given fingerprints from the store. Removing\n"+
+			"a record does not delete the credential from the device.\n\n"+
+			"With --on-device, the resident credentials on the device are managed instead, with\n"+
+			"credential management and the PIN: 'list' shows them for all relying parties and\n"+
+			"which ones the store knows, 'remove' deletes them from the device and the store.\n"+
+			"'prune' deletes the credentials of this application that neither the store nor the\n"+
+			"vault or keyring use, e.g. left over by enrolling again, and 'rename' changes the\n"+
+			"user display name. Renaming needs a CTAP 2.1 device and is not supported by the\n"+
+			"libfido2 backend.")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation before removing records or credentials")
+	onDevice := fs.Bool("on-device", false, "Manage the resident credentials on the device instead of the store")
+	vaultPath := fs.String("vault", "", "Vault whose authenticators' credentials are in use (default: vault.json in the store directory)")
+	keyringPath := fs.String("keyring", "", "Keyring whose keys' credentials are in use (default: keyring.json in the store directory)")
+	opts.deviceFlags(fs, true)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Flags may also follow the action, so parse the remaining arguments again
+	action := "list"
+	if fs.NArg() > 0 {
+		action = fs.Arg(0)
+		if err := parseFlags(fs, fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	var users credentialUsers
+	if users.vaultPath, err = opts.vaultPath(*vaultPath); err != nil {
+		return err
+	}
+	if users.keyringPath, err = opts.keyringPath(*keyringPath); err != nil {
+		return err
+	}
+
+	switch action {
+	case "list":
+		if fs.NArg() > 0 {
+			return fmt.Errorf("unexpected arguments: %v", fs.Args())
+		}
+		if *onDevice {
+			return app.ListDeviceCredentials(users)
+		}
+		return app.ListCredentials()
+	case "remove":
+		if fs.NArg() == 0 {
+			return errors.New("no credential fingerprint given (see 'fido2-hmac-deriver credentials list')")
+		}
+		if *onDevice {
+			return app.RemoveDeviceCredentials(fs.Args(), users, *yes)
+		}
+		return app.RemoveCredentials(fs.Args(), *yes)
+	case "prune", "rename":
+		if !*onDevice {
+			return fmt.Errorf("'%s' manages the credentials on the device, pass --on-device", action)
+		}
+		if action == "prune" {
+			if fs.NArg() > 0 {
+				return fmt.Errorf("unexpected arguments: %v", fs.Args())
+			}
+			return app.PruneDeviceCredentials(users, *yes)
+		}
+		if fs.NArg() != 2 {
+			return errors.New("rename needs the fingerprint of the credential and the new display name")
+		}
+		return app.RenameDeviceCredential(fs.Arg(0), fs.Arg(1), users)
+	default:
+		return fmt.Errorf("unknown credentials action '%s' (expected list, remove, prune or rename)", action)
+	}
+}
+
+// ListCredentials shows all records in the credential store.
+func (app *Application) ListCredentials() error {
+	records, err := app.credentials.List()
+	if err != nil {
+		return err
+	}
+	app.ui.DisplayCredentials(records)
+	return nil
+}
+
+// RemoveCredentials deletes the records with the given fingerprints from the store.
+// A unique prefix of a fingerprint is accepted as well.
+func (app *Application) RemoveCredentials(fingerprints []string, skipConfirmation bool) error {
+	records, err := app.credentials.List()
+	if err != nil {
+		return err
+	}
+
+	var selected []*types.CredentialRecord
+	for _, fingerprint := range fingerprints {
+		record, err := findRecord(records, fingerprint)
+		if err != nil {
+			return err
+		}
+		selected = append(selected, record)
+	}
+
+	app.ui.DisplayCredentials(selected)
+	if !skipConfirmation && !app.ui.ConfirmAction(fmt.Sprintf("Remove %d credential record(s) from the store?", len(selected))) {
+		return errors.New("removal cancelled")
+	}
+
+	for _, record := range selected {
+		if err := app.credentials.Delete(record); err != nil {
+			return err
+		}
+		app.ui.DisplaySuccess(fmt.Sprintf("Removed credential record %s", store.Fingerprint(record.CredentialID)))
+	}
+	return nil
+}
+
+// ListDeviceCredentials shows the resident credentials on the device and which ones
+// the store knows.
+func (app *Application) ListDeviceCredentials(users credentialUsers) error {
+	selectedDevice, _, credentials, err := app.deviceCredentials(users)
+	if err != nil {
+		return err
+	}
+	app.ui.DisplayResidentCredentials(selectedDevice, credentials, app.config.RelyingPartyID)
+	return nil
+}
+
+// RemoveDeviceCredentials deletes the resident credentials with the given
+// fingerprints from the device, and their records from the store.
+func (app *Application) RemoveDeviceCredentials(fingerprints []string, users credentialUsers, skipConfirmation bool) error {
+	selectedDevice, pin, credentials, err := app.deviceCredentials(users)
+	if err != nil {
+		return err
+	}
+
+	var selected []*types.ResidentCredential
+	for _, fingerprint := range fingerprints {
+		credential, err := findResidentCredential(credentials, fingerprint)
+		if err != nil {
+			return err
+		}
+		selected = append(selected, credential)
+	}
+	return app.deleteDeviceCredentials(selectedDevice, pin, selected, skipConfirmation)
+}
+
+// PruneDeviceCredentials deletes the resident credentials of the relying party that
+// neither the store, the vault nor the keyring know from the device.
+func (app *Application) PruneDeviceCredentials(users credentialUsers, skipConfirmation bool) error {
+	selectedDevice, pin, credentials, err := app.deviceCredentials(users)
+	if err != nil {
+		return err
+	}
+
+	var orphans []*types.ResidentCredential
+	kept := 0
+	for _, credential := range credentials {
+		if credential.RelyingParty.ID != app.config.RelyingPartyID || credential.Record != nil {
+			continue
+		}
+		if len(credential.UsedBy) > 0 {
+			kept++
+			continue
+		}
+		orphans = append(orphans, credential)
+	}
+	if kept > 0 {
+		app.ui.DisplayInfo(fmt.Sprintf("Keeping %d credential(s) not in the store that the vault or the keyring use", kept))
+	}
+	if len(orphans) == 0 {
+		app.ui.DisplaySuccess(fmt.Sprintf("No unused credentials of '%s' on %s", app.config.RelyingPartyID, selectedDevice.Name))
+		return nil
+	}
+
+	app.ui.DisplayWarning("Credentials enrolled with another store, e.g. on another machine, are not in this one")
+	return app.deleteDeviceCredentials(selectedDevice, pin, orphans, skipConfirmation)
+}
+
+// RenameDeviceCredential changes the user display name of a resident credential,
+// and of its stored record.
+func (app *Application) RenameDeviceCredential(fingerprint, displayName string, users credentialUsers) error {
+	selectedDevice, err := app.selectDevice()
+	if err != nil {
+		return err
+	}
+	// Checked before the PIN is asked for, since not every backend or device can rename
+	if err := app.deviceMgr.CheckResidentUserUpdate(selectedDevice); err != nil {
+		return err
+	}
+	pin, credentials, err := app.credentialsOn(selectedDevice, users)
+	if err != nil {
+		return err
+	}
+	credential, err := findResidentCredential(credentials, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	user := credential.User
+	user.DisplayName = displayName
+	if err := app.deviceMgr.UpdateResidentUser(selectedDevice, credential.ID, user, pin); err != nil {
+		return err
+	}
+	if record := credential.Record; record != nil {
+		record.UserDisplayName = displayName
+		if err := app.credentials.Save(record); err != nil {
+			return fmt.Errorf("failed to update the stored record: %w", err)
+		}
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Renamed credential %s to '%s'", store.Fingerprint(credential.ID), displayName))
+	return nil
+}
+
+// deleteDeviceCredentials deletes resident credentials from the device after the
+// user confirmed it, and their records from the store.
+func (app *Application) deleteDeviceCredentials(device *types.DeviceInfo, pin string, credentials []*types.ResidentCredential, skipConfirmation bool) error {
+	app.ui.DisplayResidentCredentials(device, credentials, app.config.RelyingPartyID)
+	app.ui.DisplayWarning("Secrets derived with deleted credentials can never be derived again")
+	for _, credential := range credentials {
+		if len(credential.UsedBy) > 0 {
+			app.ui.DisplayWarning(fmt.Sprintf("Credential %s is used by %s, which can no longer be unlocked with it",
+				store.Fingerprint(credential.ID), strings.Join(credential.UsedBy, ", ")))
+		}
+	}
+	if !skipConfirmation && !app.ui.ConfirmAction(fmt.Sprintf("Delete %d credential(s) from %s?", len(credentials), device.Name)) {
+		return errors.New("deletion cancelled")
+	}
+
+	for _, credential := range credentials {
+		if err := app.deviceMgr.DeleteResidentCredential(device, credential.ID, pin); err != nil {
+			return err
+		}
+		if credential.Record != nil {
+			if err := app.credentials.Delete(credential.Record); err != nil {
+				return err
+			}
+		}
+		app.ui.DisplaySuccess(fmt.Sprintf("Deleted credential %s", store.Fingerprint(credential.ID)))
+	}
+	return nil
+}
+
+// deviceCredentials selects the device, reads the PIN and lists the resident
+// credentials, linked to their stored records and to what uses them.
+func (app *Application) deviceCredentials(users credentialUsers) (*types.DeviceInfo, string, []*types.ResidentCredential, error) {
+	selectedDevice, err := app.selectDevice()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	pin, credentials, err := app.credentialsOn(selectedDevice, users)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return selectedDevice, pin, credentials, nil
+}
+
+// credentialsOn reads the PIN and lists the resident credentials of the device,
+// linked to their stored records and to what uses them.
+func (app *Application) credentialsOn(device *types.DeviceInfo, users credentialUsers) (string, []*types.ResidentCredential, error) {
+	usedBy, err := users.load()
+	if err != nil {
+		return "", nil, err
+	}
+	pin, err := app.readPIN()
+	if err != nil {
+		return "", nil, err
+	}
+
+	credentials, err := app.deviceMgr.ResidentCredentials(device, pin)
+	if err != nil {
+		return "", nil, err
+	}
+	records, err := app.credentials.List()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, credential := range credentials {
+		credential.UsedBy = usedBy[string(credential.ID)]
+		for _, record := range records {
+			if bytes.Equal(record.CredentialID, credential.ID) && record.RelyingPartyID == credential.RelyingParty.ID {
+				credential.Record = record
+			}
+		}
+	}
+	return pin, credentials, nil
+}
+
+// credentialUsers names the vault and keyring files, whose keys are wrapped with
+// secrets of device credentials: a credential they use is needed even if the store
+// does not know it, e.g. for a vault copied from another machine.
+type credentialUsers struct {
+	vaultPath   string
+	keyringPath string
+}
+
+// load describes what uses each credential, keyed by credential ID. Missing files
+// use none.
+func (u credentialUsers) load() (map[string][]string, error) {
+	usedBy := make(map[string][]string)
+	add := func(credentialID []byte, user string) {
+		usedBy[string(credentialID)] = append(usedBy[string(credentialID)], user)
+	}
+
+	if _, err := os.Stat(u.vaultPath); err == nil {
+		v, err := vault.Load(u.vaultPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range v.Slots {
+			add(slot.Source.CredentialID, fmt.Sprintf("vault slot '%s'", slot.Name))
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ring, err := keyring.Load(u.keyringPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range ring.Keys {
+		add(key.Source.CredentialID, fmt.Sprintf("keyring key '%s'", key.Name))
+	}
+	return usedBy, nil
+}
+
+// findResidentCredential returns the resident credential whose fingerprint starts
+// with the given prefix.
+func findResidentCredential(credentials []*types.ResidentCredential, prefix string) (*types.ResidentCredential, error) {
+	var found *types.ResidentCredential
+	for _, credential := range credentials {
+		if !strings.HasPrefix(store.Fingerprint(credential.ID), strings.ToLower(prefix)) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("fingerprint '%s' matches several credentials, please give more digits", prefix)
+		}
+		found = credential
+	}
+	if found == nil {
+		return nil, fmt.Errorf("the device has no credential with the fingerprint '%s'", prefix)
+	}
+	return found, nil
+}
+
+// findRecord returns the record whose fingerprint starts with the given prefix.
+func findRecord(records []*types.CredentialRecord, prefix string) (*types.CredentialRecord, error) {
+	var found *types.CredentialRecord
+	for _, record := range records {
+		if !strings.HasPrefix(store.Fingerprint(record.CredentialID), strings.ToLower(prefix)) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("fingerprint '%s' matches several credentials, please give more digits", prefix)
+		}
+		found = record
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no stored credential has the fingerprint '%s'", prefix)
+	}
+	return found, nil
+}
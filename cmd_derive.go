@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+
+	"fido2-hmac-deriver/internal/crypto"
+	"fido2-hmac-deriver/internal/types"
+)
+
+// runDerive derives the HMAC secret from the credential enrolled on a device.
+func runDerive(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("derive", "", "Derive the HMAC secret from the credential enrolled on a FIDO2 device.\n"+
+		"The device has to be enrolled first, see 'fido2-hmac-deriver enroll'.")
+	keyOnly := fs.Bool("key-only", false, "Output only the derived key to stdout (useful for scripting)")
+	var subkeySpecs stringList
+	fs.Var(&subkeySpecs, "derive-subkey", "Derive a subkey with HKDF from the secret: label[,length=N][,hash=sha256|sha512] (may be repeated)")
+	withNext := fs.Bool("with-next", false, "Also derive the secret of the next salt generation in the same touch (for key rotation)")
+	subkeyHash := fs.String("subkey-hash", string(types.SubkeyHashSHA256), "Hash function for subkeys without one: sha256 or sha512")
+	opts.outputFlags(fs)
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	output, err := opts.outputOptions()
+	if err != nil {
+		return err
+	}
+	if *keyOnly && output.Format != types.OutputText {
+		return fmt.Errorf("--key-only cannot be combined with --output=%s", output.Format)
+	}
+
+	subkeys := make([]types.SubkeyRequest, 0, len(subkeySpecs))
+	for _, spec := range subkeySpecs {
+		request, err := crypto.ParseSubkeyRequest(spec, types.SubkeyHash(*subkeyHash))
+		if err != nil {
+			return err
+		}
+		subkeys = append(subkeys, request)
+	}
+	if err := crypto.ValidateSubkeyRequests(subkeys); err != nil {
+		return err
+	}
+	if *keyOnly && len(subkeys) > 0 {
+		return fmt.Errorf("--key-only cannot be combined with --derive-subkey, use --output=key instead")
+	}
+
+	if *keyOnly && *withNext {
+		return fmt.Errorf("--key-only cannot be combined with --with-next, use --output=key instead")
+	}
+
+	if isAgeOutput(output.Format) && (len(subkeys) > 0 || *withNext) {
+		return fmt.Errorf("--output=%s cannot be combined with --derive-subkey or --with-next", output.Format)
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	app.config.DeriveNextSecret = *withNext
+	return app.Derive(*keyOnly, output, subkeys)
+}
+
+// Derive executes the derivation workflow: device selection, PIN entry, the
+// assertion with the stored credential and the derivation of the requested subkeys.
+func (app *Application) Derive(keyOnly bool, output *types.OutputOptions, subkeys []types.SubkeyRequest) error {
+	app.ui.DisplayWelcome()
+
+	// The agent does not cache the secret of the next generation
+	var result *types.HMACResult
+	if !app.config.DeriveNextSecret {
+		result = app.cachedSecret(app.configQuery(app.fidoDevice))
+	}
+	if result == nil {
+		var err error
+		if result, err = app.assertSecret(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if len(subkeys) > 0 {
+		result.Subkeys, err = app.cryptoProvider.DeriveSubkeys(result.Secret, subkeys)
+		if err != nil {
+			return fmt.Errorf("subkey derivation failed: %w", err)
+		}
+		if result.NextSecret != nil {
+			result.NextSubkeys, err = app.cryptoProvider.DeriveSubkeys(result.NextSecret, subkeys)
+			if err != nil {
+				return fmt.Errorf("subkey derivation failed: %w", err)
+			}
+		}
+	}
+
+	switch {
+	case keyOnly:
+		app.ui.OutputKeyOnly(result)
+	case isAgeOutput(output.Format):
+		if err := app.outputAgeIdentity(result, output.Format); err != nil {
+			return fmt.Errorf("failed to write age identity: %w", err)
+		}
+	case output.Format != types.OutputText:
+		if err := app.ui.OutputResult(result, output); err != nil {
+			return fmt.Errorf("failed to write result: %w", err)
+		}
+	default:
+		app.ui.DisplayResults(result)
+	}
+
+	return nil
+}
+
+// assertSecret selects the device, reads the PIN and derives the secret with an
+// assertion, telling the user to touch the device.
+func (app *Application) assertSecret() (*types.HMACResult, error) {
+	selectedDevice, err := app.selectDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := app.openDevice(selectedDevice)
+	if err != nil {
+		return nil, err
+	}
+
+	app.ui.DisplayInfo("Starting HMAC secret derivation process...")
+	app.ui.DisplayInfo("You will need to touch your FIDO2 device when it blinks")
+	return session.derive(app.config)
+}
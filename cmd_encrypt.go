@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"fido2-hmac-deriver/internal/fileenc"
+	"fido2-hmac-deriver/internal/secretagent"
+	"fido2-hmac-deriver/internal/store"
+
+	"golang.org/x/term"
+)
+
+// runEncrypt encrypts a file with a key derived from the secret.
+func runEncrypt(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("encrypt", "[input]",
+		"Encrypt a file (default: stdin) with a key derived from the HMAC secret. The header\n"+
+			"of the encrypted file records the relying party, credential and salt, so\n"+
+			"'fido2-hmac-deriver decrypt' derives the right secret without further options.")
+	out := fs.String("out", "", "File to write the encrypted data to (default: stdout)")
+	cipher := fs.String("cipher", string(fileenc.CipherXChaCha20Poly1305), "Cipher: xchacha20-poly1305 or aes-256-gcm")
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	input, err := parseFileArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := fileenc.CheckCipher(fileenc.Cipher(*cipher)); err != nil {
+		return err
+	}
+	if input == "" {
+		if err := opts.checkNonInteractive("encrypt from stdin"); err != nil {
+			return err
+		}
+	}
+	if *out == "" && term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("refusing to write encrypted data to a terminal, redirect stdout or use --out")
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	return app.Encrypt(input, *out, fileenc.Cipher(*cipher))
+}
+
+// Encrypt derives the secret and encrypts the input file (or stdin) to the output file (or stdout).
+func (app *Application) Encrypt(input, output string, cipher fileenc.Cipher) error {
+	in, err := openInput(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	result, err := app.deriveSecret()
+	if err != nil {
+		return err
+	}
+
+	header, err := fileenc.NewHeader(cipher, result.RelyingParty, result.CredentialID, result.Device.AAGUID, result.Salt)
+	if err != nil {
+		return err
+	}
+	err = writeOutput(output, 0644, func(w io.Writer) error {
+		return fileenc.Encrypt(w, in, header, result.Secret)
+	})
+	if err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	}
+
+	if output != "" {
+		app.ui.DisplaySuccess(fmt.Sprintf("Encrypted %s to %s", orStdin(input), output))
+	}
+	return nil
+}
+
+// runDecrypt decrypts a file encrypted by the encrypt command.
+func runDecrypt(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("decrypt", "[input]",
+		"Decrypt a file (default: stdin) written by 'fido2-hmac-deriver encrypt'. The secret\n"+
+			"is derived with the relying party, credential and salt recorded in its header.\n"+
+			"When writing to stdout, output may be incomplete if decryption fails; use --out\n"+
+			"to only create the file once the whole input has been authenticated.")
+	out := fs.String("out", "", "File to write the decrypted data to (default: stdout)")
+	opts.deviceFlags(fs, true)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	input, err := parseFileArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if input == "" {
+		if err := opts.checkNonInteractive("decrypt from stdin"); err != nil {
+			return err
+		}
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	return app.Decrypt(input, *out)
+}
+
+// Decrypt reads the header of the input file (or stdin), derives the secret it
+// records and decrypts the file to the output file (or stdout).
+func (app *Application) Decrypt(input, output string) error {
+	in, err := openInput(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	reader := bufio.NewReader(in)
+	header, err := fileenc.ReadHeader(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", orStdin(input), err)
+	}
+	app.ui.DisplayProgress(fmt.Sprintf("Encrypted for relying party '%s' with credential %s (%s)",
+		header.RelyingPartyID, store.Fingerprint(header.CredentialID), header.Cipher))
+
+	app.config.RelyingPartyID = header.RelyingPartyID
+	result := app.cachedSecret(&secretagent.Query{
+		RelyingPartyID: header.RelyingPartyID,
+		CredentialID:   header.CredentialID,
+		Salt:           header.Salt,
+	})
+	if result == nil {
+		selectedDevice, err := app.selectDevice()
+		if err != nil {
+			return err
+		}
+
+		result, err = app.deriveSecretOn(selectedDevice, header.CredentialID, header.Salt)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeOutput(output, 0600, func(w io.Writer) error {
+		return fileenc.Decrypt(w, reader, header, result.Secret)
+	})
+	if err != nil {
+		return err
+	}
+
+	if output != "" {
+		app.ui.DisplaySuccess(fmt.Sprintf("Decrypted %s to %s", orStdin(input), output))
+	}
+	return nil
+}
+
+// parseFileArgs parses the flags of a command taking one optional input file,
+// which may also be given before the flags. "-" or no file selects stdin.
+func parseFileArgs(fs *flag.FlagSet, args []string) (string, error) {
+	if err := parseFlags(fs, args); err != nil {
+		return "", err
+	}
+	if fs.NArg() == 0 {
+		return "", nil
+	}
+	input := fs.Arg(0)
+	if err := parseFlags(fs, fs.Args()[1:]); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if input == "-" {
+		input = ""
+	}
+	return input, nil
+}
+
+// openInput opens the input file, or stdin if path is empty.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// writeOutput streams to the output file, which is only created if write succeeds,
+// or to stdout if path is empty.
+func writeOutput(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	if path == "" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := write(w); err != nil {
+			w.Flush()
+			return err
+		}
+		return w.Flush()
+	}
+	return store.WriteAtomic(path, perm, write)
+}
@@ -0,0 +1,55 @@
+package main
+
+import "fmt"
+
+// runEnroll creates a credential on a device and stores it.
+func runEnroll(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("enroll", "", "Create a resident credential with the hmac-secret extension on a FIDO2 device\n"+
+		"and store it in the credential store. Enrollment requires two touches: one to\n"+
+		"create the credential and one to derive the first secret for its check value.")
+	force := fs.Bool("force", false, "Replace the credential already enrolled on the device (its secrets are lost)")
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	return app.Enroll(*force)
+}
+
+// Enroll executes the enrollment workflow: device selection, PIN entry and the
+// creation of the credential.
+func (app *Application) Enroll(force bool) error {
+	app.ui.DisplayWelcome()
+
+	selectedDevice, err := app.selectDevice()
+	if err != nil {
+		return err
+	}
+
+	session, err := app.openDevice(selectedDevice)
+	if err != nil {
+		return err
+	}
+
+	app.ui.DisplayInfo("Starting enrollment, you will need to touch your FIDO2 device twice")
+
+	result, err := app.cryptoProvider.EnrollCredential(selectedDevice, session.pin, app.config, force)
+	if err != nil {
+		return fmt.Errorf("enrollment failed: %w", err)
+	}
+
+	app.ui.DisplayInfo(fmt.Sprintf("Run 'fido2-hmac-deriver derive' to derive the secret (salt mode: %s)", result.SaltMode))
+	return nil
+}
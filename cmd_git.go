@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"fido2-hmac-deriver/internal/gitfilter"
+)
+
+// gitSetupFlags lists the git-setup flags that are not passed on to the filter. The
+// device path changes when devices are reconnected, so the filter finds the device
+// holding the credential instead.
+var gitSetupFlags = map[string]bool{"driver": true, "repository": true, "fido-device": true}
+
+// pathFlags lists the flags holding paths, which are made absolute when passed on,
+// since git runs filters from the top-level directory of the repository.
+var pathFlags = map[string]bool{"store-dir": true, "virtual-state": true, "pin-file": true}
+
+// runGitFilter runs the clean, smudge or textconv filter for git.
+func runGitFilter(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("git-filter", "clean|smudge|textconv|process [path]",
+		"Encrypt (clean) or decrypt (smudge) file contents between stdin and stdout, or\n"+
+			"decrypt the file at path to stdout (textconv), for use as a git filter. 'process'\n"+
+			"speaks git's long-running filter protocol, so a checkout derives the secret once.\n"+
+			"Stdin carries the file contents, so the PIN has to be given with a PIN source\n"+
+			"other than stdin, such as --pin-file, and the device is the connected one holding\n"+
+			"a stored credential unless --fido-device is given. See 'fido2-hmac-deriver git-setup'.")
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Flags may also follow the action, so parse the remaining arguments again
+	if fs.NArg() == 0 {
+		return errors.New("no filter action given (expected clean, smudge, textconv or process)")
+	}
+	action := fs.Arg(0)
+	if err := parseFlags(fs, fs.Args()[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args()[1:])
+	}
+	path := fs.Arg(0)
+
+	switch action {
+	case "clean", "smudge", "process":
+	case "textconv":
+		if path == "" {
+			return errors.New("textconv needs the path of the file to decrypt")
+		}
+	default:
+		return fmt.Errorf("unknown filter action '%s' (expected clean, smudge, textconv or process)", action)
+	}
+	if err := opts.checkNonInteractivePIN("git-filter"); err != nil {
+		return err
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	return app.GitFilter(action, path)
+}
+
+// GitFilter derives the filter keys and runs a filter action on stdin and stdout,
+// or on the file at path for textconv.
+func (app *Application) GitFilter(action, path string) error {
+	if action == "process" {
+		return app.GitFilterProcess()
+	}
+
+	cipher, err := app.gitCipher()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "clean":
+		if err := cipher.Clean(os.Stdout, os.Stdin); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", orStdin(path), err)
+		}
+	case "smudge":
+		if err := cipher.Smudge(os.Stdout, os.Stdin); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", orStdin(path), err)
+		}
+	case "textconv":
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := cipher.Smudge(os.Stdout, f); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// GitFilterProcess serves git's long-running filter protocol on stdin and stdout.
+// The secret is derived when the first blob needs a key and used for all others.
+func (app *Application) GitFilterProcess() error {
+	process := gitfilter.NewProcess(os.Stdin, os.Stdout, app.gitCipher, func(command, pathname string, err error) {
+		app.ui.DisplayError(fmt.Errorf("git filter failed to %s %s: %w", command, pathname, err))
+	})
+	return process.Serve()
+}
+
+// gitCipher derives the HMAC secret and creates the git filter cipher from it.
+func (app *Application) gitCipher() (*gitfilter.Cipher, error) {
+	result := app.cachedSecret(app.configQuery(app.fidoDevice))
+	if result == nil {
+		selectedDevice, err := app.enrolledDevice()
+		if err != nil {
+			return nil, err
+		}
+		if result, err = app.deriveSecretOn(selectedDevice, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	subkeys, err := app.cryptoProvider.DeriveSubkeys(result.Secret, gitfilter.SubkeyRequests())
+	if err != nil {
+		return nil, fmt.Errorf("subkey derivation failed: %w", err)
+	}
+	return gitfilter.NewCipher(subkeys)
+}
+
+// orStdin returns the path for messages, or "stdin" if git passed none.
+func orStdin(path string) string {
+	if path == "" {
+		return "stdin"
+	}
+	return path
+}
+
+// runGitSetup configures the git filter in a repository.
+func runGitSetup(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("git-setup", "<pattern>...",
+		"Configure the git filter in a repository: the clean/smudge filter and the textconv\n"+
+			"diff driver in .git/config, and a .gitattributes line for every pattern, e.g.\n"+
+			"'secrets/**' or '*.key'. The PIN, salt, store and backend flags given here are\n"+
+			"passed on to the filter command. The device is not: the filter uses the connected\n"+
+			"device holding the enrolled credential, whatever its path.")
+	driver := fs.String("driver", gitfilter.DefaultDriver, "Name of the filter and diff driver")
+	repository := fs.String("repository", ".", "Directory inside the git repository to configure")
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := opts.checkNonInteractivePIN("git-setup"); err != nil {
+		return err
+	}
+	if opts.pinFD >= 0 {
+		return errors.New("git runs the filter later without the file descriptor, pass the PIN with --pin-file, --pin-environment-variable or --pinentry")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine the path of this program: %w", err)
+	}
+	forwarded, err := forwardedFlags(fs, gitSetupFlags)
+	if err != nil {
+		return err
+	}
+	command := append([]string{executable, "git-filter"}, forwarded...)
+
+	result, err := gitfilter.Setup(*repository, &gitfilter.SetupOptions{
+		Driver:   *driver,
+		Command:  command,
+		Patterns: fs.Args(),
+	})
+	if err != nil {
+		return err
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	if opts.fidoDevice != "" {
+		app.ui.DisplayWarning("--fido-device is not passed on, the filter finds the device holding the enrolled credential")
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Configured the '%s' filter in %s", *driver, result.RepositoryRoot))
+	for _, line := range result.Added {
+		app.ui.DisplayInfo(fmt.Sprintf("Added to %s: %s", result.Attributes, line))
+	}
+	if fs.NArg() == 0 {
+		app.ui.DisplayInfo(fmt.Sprintf("No patterns given, select files with 'filter=%s diff=%s' in .gitattributes", *driver, *driver))
+	}
+	return nil
+}
+
+// checkNonInteractive returns an error unless the device and the PIN are given by
+// flags, for commands whose stdin is not available for prompts.
+func (o *options) checkNonInteractive(name string) error {
+	if o.fidoDevice == "" || !o.hasPINSource() {
+		return fmt.Errorf("%s cannot ask for the device or the PIN, pass --fido-device and --pin-environment-variable, --pin-file, --pin-fd or --pinentry", name)
+	}
+	return o.checkNonInteractivePIN(name)
+}
+
+// checkNonInteractivePIN returns an error unless the PIN is given by flags, for
+// commands whose stdin is not available for prompts and that find the device
+// without asking.
+func (o *options) checkNonInteractivePIN(name string) error {
+	if !o.hasPINSource() {
+		return fmt.Errorf("%s cannot ask for the PIN, pass --pin-environment-variable, --pin-file, --pin-fd or --pinentry", name)
+	}
+	if o.readsPINFromStdin() {
+		return fmt.Errorf("%s reads data from stdin, pass the PIN with --pin-environment-variable, --pin-file, --pin-fd or --pinentry", name)
+	}
+	return nil
+}
+
+// forwardedFlags returns the flags set on the command line as arguments, except the
+// excluded ones. Relative paths in the flags listed in pathFlags are made absolute.
+func forwardedFlags(fs *flag.FlagSet, excluded map[string]bool) ([]string, error) {
+	var args []string
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if excluded[f.Name] || err != nil {
+			return
+		}
+		value := f.Value.String()
+		if pathFlags[f.Name] && value != "" {
+			value, err = filepath.Abs(value)
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, value))
+	})
+	return args, err
+}
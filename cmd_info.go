@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+
+// runInfo shows the capabilities of a device.
+func runInfo(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("info", "", "Show the capabilities of a FIDO2 device, such as hmac-secret and resident key support.")
+	opts.deviceFlags(fs, false)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+
+	selectedDevice, err := app.selectDevice()
+	if err != nil {
+		return err
+	}
+
+	capabilities, err := app.deviceMgr.GetDeviceCapabilities(selectedDevice)
+	if err != nil {
+		return fmt.Errorf("failed to query device capabilities: %w", err)
+	}
+	app.ui.DisplayCapabilities(selectedDevice, capabilities)
+	return nil
+}
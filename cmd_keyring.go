@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"fido2-hmac-deriver/internal/keyring"
+	"fido2-hmac-deriver/internal/types"
+)
+
+// runWrap generates data encryption keys and wraps them with the secret.
+func runWrap(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("wrap", "<name>...",
+		"Generate random data encryption keys and store them in the keyring, wrapped with a\n"+
+			"key derived from the HMAC secret. With --rewrap, wrap existing keys again with the\n"+
+			"current secret, e.g. after rotating the credential or the salt generation; the old\n"+
+			"and the new credential have to be on the selected device.")
+	keyringPath := fs.String("keyring", "", "Keyring file (default: keyring.json in the store directory)")
+	algorithm := fs.String("algorithm", string(keyring.AlgorithmXChaCha20Poly1305), "Wrapping algorithm: xchacha20-poly1305 or aes-kw")
+	length := fs.Int("length", keyring.DefaultKeyLength, "Length of the generated keys in bytes")
+	rewrap := fs.Bool("rewrap", false, "Wrap the named keys (default: all keys) again with the current secret instead of generating new ones")
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	names := fs.Args()
+
+	if !*rewrap {
+		if len(names) == 0 {
+			return errors.New("at least one key name is required")
+		}
+		if err := keyring.CheckAlgorithm(keyring.Algorithm(*algorithm)); err != nil {
+			return err
+		}
+		if err := keyring.CheckKeyLength(keyring.Algorithm(*algorithm), *length); err != nil {
+			return err
+		}
+	}
+
+	path, err := opts.keyringPath(*keyringPath)
+	if err != nil {
+		return err
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	if *rewrap {
+		return app.Rewrap(path, names)
+	}
+	return app.Wrap(path, names, keyring.Algorithm(*algorithm), *length)
+}
+
+// runUnwrap unwraps data encryption keys from the keyring.
+func runUnwrap(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("unwrap", "<name>...",
+		"Unwrap data encryption keys from the keyring and write them to stdout, one per line\n"+
+			"or as raw bytes. Each key is unwrapped with the secret of the relying party,\n"+
+			"credential and salt it was wrapped with, so no salt options are needed.")
+	keyringPath := fs.String("keyring", "", "Keyring file (default: keyring.json in the store directory)")
+	output := fs.String("output", string(types.OutputKey), "Output format: key (each key as one encoded line) or raw (the key bytes)")
+	encoding := fs.String("encoding", string(types.EncodingBase64), "Encoding of keys in key output: base64, base64url or hex")
+	opts.deviceFlags(fs, true)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("at least one key name is required")
+	}
+
+	opts.output, opts.encoding = *output, *encoding
+	outputOptions, err := opts.outputOptions()
+	if err != nil {
+		return err
+	}
+	if outputOptions.Format != types.OutputKey && outputOptions.Format != types.OutputRaw {
+		return fmt.Errorf("unwrap cannot write the %s format (expected %s or %s)", outputOptions.Format, types.OutputKey, types.OutputRaw)
+	}
+
+	path, err := opts.keyringPath(*keyringPath)
+	if err != nil {
+		return err
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	return app.Unwrap(path, fs.Args(), outputOptions)
+}
+
+// Wrap generates a key for each name, wraps it with the current secret and adds it to the keyring.
+func (app *Application) Wrap(path string, names []string, algorithm keyring.Algorithm, length int) error {
+	ring, err := keyring.Load(path)
+	if err != nil {
+		return err
+	}
+	// Check the names before the user has to touch the device
+	for _, name := range names {
+		if ring.Find(name) != nil {
+			return fmt.Errorf("the keyring already holds a key named '%s', use --rewrap to wrap it again", name)
+		}
+	}
+
+	result, err := app.deriveSecret()
+	if err != nil {
+		return err
+	}
+	kek, err := keyring.DeriveKEK(result.Secret)
+	if err != nil {
+		return err
+	}
+
+	source := keyring.SourceOf(result)
+	for _, name := range names {
+		dek, err := keyring.GenerateKey(length)
+		if err != nil {
+			return err
+		}
+		key, err := keyring.Wrap(name, algorithm, dek, kek, source)
+		if err != nil {
+			return err
+		}
+		if err := ring.Add(key); err != nil {
+			return err
+		}
+	}
+
+	if err := ring.Save(path); err != nil {
+		return err
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Wrapped %d new key(s) in %s", len(names), path))
+	return nil
+}
+
+// Rewrap unwraps the named keys (or all keys) with the secrets they were wrapped with
+// and wraps them again with the current secret.
+func (app *Application) Rewrap(path string, names []string) error {
+	ring, err := keyring.Load(path)
+	if err != nil {
+		return err
+	}
+	keys := ring.Keys
+	if len(names) > 0 {
+		if keys, err = findKeys(ring, names); err != nil {
+			return err
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("the keyring %s holds no keys", path)
+	}
+
+	unlocker, err := app.newKeyUnlocker()
+	if err != nil {
+		return err
+	}
+
+	app.ui.DisplayProgress("Deriving the current secret...")
+	result, err := unlocker.session.derive(app.config)
+	if err != nil {
+		return err
+	}
+	kek, err := keyring.DeriveKEK(result.Secret)
+	if err != nil {
+		return err
+	}
+	source := keyring.SourceOf(result)
+
+	rewrapped := 0
+	for _, key := range keys {
+		if key.Source.Equal(source) {
+			continue
+		}
+		dek, err := unlocker.unwrap(key)
+		if err != nil {
+			return err
+		}
+		if err := key.Rewrap(dek, kek, source); err != nil {
+			return err
+		}
+		rewrapped++
+	}
+
+	if rewrapped == 0 {
+		app.ui.DisplaySuccess("All keys are already wrapped with the current secret")
+		return nil
+	}
+	if err := ring.Save(path); err != nil {
+		return err
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Rewrapped %d key(s) in %s", rewrapped, path))
+	return nil
+}
+
+// Unwrap unwraps the named keys and writes them in the given output format.
+func (app *Application) Unwrap(path string, names []string, output *types.OutputOptions) error {
+	ring, err := keyring.Load(path)
+	if err != nil {
+		return err
+	}
+	keys, err := findKeys(ring, names)
+	if err != nil {
+		return err
+	}
+
+	unlocker, err := app.newKeyUnlocker()
+	if err != nil {
+		return err
+	}
+
+	deks := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		dek, err := unlocker.unwrap(key)
+		if err != nil {
+			return err
+		}
+		deks = append(deks, dek)
+	}
+
+	if err := app.ui.OutputKeys(deks, output); err != nil {
+		return fmt.Errorf("failed to write keys: %w", err)
+	}
+	return nil
+}
+
+// keyringPath returns the keyring file given with --keyring or the default one in the store directory.
+func (o *options) keyringPath(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	storeDir, err := o.storeDirectory()
+	if err != nil {
+		return "", err
+	}
+	return keyring.DefaultPath(storeDir), nil
+}
+
+// findKeys returns the keys with the given names.
+func findKeys(ring *keyring.Keyring, names []string) ([]*keyring.WrappedKey, error) {
+	keys := make([]*keyring.WrappedKey, 0, len(names))
+	for _, name := range names {
+		key := ring.Find(name)
+		if key == nil {
+			return nil, fmt.Errorf("the keyring holds no key named '%s'", name)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// keyUnlocker unwraps keys on one device, deriving the secret once per source.
+type keyUnlocker struct {
+	session *deviceSession
+
+	sources []keyring.Source // Sources derived so far
+	keks    [][]byte         // KEKs of the sources
+}
+
+// newKeyUnlocker selects the device and reads the PIN.
+func (app *Application) newKeyUnlocker() (*keyUnlocker, error) {
+	selectedDevice, err := app.selectDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := app.openDevice(selectedDevice)
+	if err != nil {
+		return nil, err
+	}
+	return &keyUnlocker{session: session}, nil
+}
+
+// unwrap returns the DEK of a wrapped key.
+func (u *keyUnlocker) unwrap(key *keyring.WrappedKey) ([]byte, error) {
+	kek, err := u.kek(key.Source)
+	if err != nil {
+		return nil, err
+	}
+	return key.Unwrap(kek)
+}
+
+// kek returns the KEK of a source, deriving its secret if it has not been derived yet.
+func (u *keyUnlocker) kek(source keyring.Source) ([]byte, error) {
+	for i, known := range u.sources {
+		if known.Equal(source) {
+			return u.keks[i], nil
+		}
+	}
+
+	config := *u.session.app.config
+	config.RelyingPartyID = source.RelyingPartyID
+	result, err := u.session.deriveWithSalt(&config, source.CredentialID, source.Salt)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := keyring.DeriveKEK(result.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	u.sources = append(u.sources, source)
+	u.keks = append(u.keks, kek)
+	return kek, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// runList lists the connected FIDO2 devices.
+func runList(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("list", "", "List the FIDO2 devices connected to the system.")
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+
+	devices, err := app.deviceMgr.ListDevices()
+	if err != nil {
+		return err
+	}
+	app.ui.OutputDevices(devices)
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/ui"
+)
+
+// PIN policy limits of CTAP2: no device accepts fewer than 4 code points or more
+// than 63 bytes. Devices may require longer PINs without the backend reporting it.
+const (
+	defaultMinPINLength = 4
+	maxPINLength        = 63
+)
+
+// pinRetriesWarning is the number of attempts left from which on a warning is shown.
+const pinRetriesWarning = 3
+
+// runPin shows the PIN status of a device, or sets or changes its PIN.
+func runPin(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("pin", "[status | set | change]",
+		"Manage the PIN of a FIDO2 device. 'status' (the default) shows whether a PIN is set,\n"+
+			"its minimum length and the PIN and user verification attempts left. 'set' sets\n"+
+			"the PIN of a device that has none, 'change' replaces it after asking for the\n"+
+			"current one. The new PIN is asked for twice, on the terminal or with --pinentry;\n"+
+			"'set' takes it from another PIN source such as --pin-file if one is given.")
+	opts.deviceFlags(fs, true)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Flags may also follow the action, so parse the remaining arguments again
+	action := "status"
+	if fs.NArg() > 0 {
+		action = fs.Arg(0)
+		if err := parseFlags(fs, fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "status":
+		return app.PINStatus()
+	case "set":
+		return app.SetPIN()
+	case "change":
+		return app.ChangePIN()
+	default:
+		return fmt.Errorf("unknown pin action '%s' (expected status, set or change)", action)
+	}
+}
+
+// PINStatus shows whether the device has a PIN and how many attempts are left.
+func (app *Application) PINStatus() error {
+	selectedDevice, capabilities, err := app.pinDevice()
+	if err != nil {
+		return err
+	}
+	app.ui.DisplayPINStatus(selectedDevice, capabilities)
+	app.warnRetries(selectedDevice, capabilities)
+	return nil
+}
+
+// SetPIN sets the PIN of a device that has none.
+func (app *Application) SetPIN() error {
+	selectedDevice, capabilities, err := app.pinDevice()
+	if err != nil {
+		return err
+	}
+	if pinSet, _ := capabilities.Option("clientPin"); pinSet {
+		return fmt.Errorf("%s already has a PIN, use 'fido2-hmac-deriver pin change' to replace it", selectedDevice.Name)
+	}
+
+	var pin string
+	if _, isPinentry := app.pinSource.(*ui.PinentryPIN); app.pinSource != nil && !isPinentry {
+		// A non-interactive source provides the new PIN, since there is no current one
+		if pin, err = app.readPIN(); err == nil {
+			err = checkPINPolicy(pin, minPINLength(capabilities))
+		}
+	} else {
+		pin, err = app.readNewPIN(capabilities)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := app.deviceMgr.SetPIN(selectedDevice, pin, ""); err != nil {
+		return withPINPolicyHint(err, selectedDevice, capabilities)
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Set the PIN of %s", selectedDevice.Name))
+	return nil
+}
+
+// ChangePIN replaces the PIN of a device after verifying the current one.
+func (app *Application) ChangePIN() error {
+	selectedDevice, capabilities, err := app.pinDevice()
+	if err != nil {
+		return err
+	}
+	if pinSet, _ := capabilities.Option("clientPin"); !pinSet {
+		return fmt.Errorf("%s has no PIN yet, use 'fido2-hmac-deriver pin set' to set one", selectedDevice.Name)
+	}
+	if capabilities.PINRetries == 0 {
+		return fmt.Errorf("the PIN of %s is blocked, the device has to be reset, which deletes all its credentials", selectedDevice.Name)
+	}
+	app.warnRetries(selectedDevice, capabilities)
+
+	oldPIN, err := app.readPIN()
+	if err != nil {
+		return err
+	}
+	pin, err := app.readNewPIN(capabilities)
+	if err != nil {
+		return err
+	}
+	if pin == oldPIN {
+		return errors.New("the new PIN is the same as the current one")
+	}
+
+	if err := app.deviceMgr.SetPIN(selectedDevice, pin, oldPIN); err != nil {
+		// A wrong current PIN costs an attempt, so show how many are left
+		if capabilities, capErr := app.deviceMgr.GetDeviceCapabilities(selectedDevice); capErr == nil {
+			app.warnRetries(selectedDevice, capabilities)
+		}
+		return withPINPolicyHint(err, selectedDevice, capabilities)
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Changed the PIN of %s", selectedDevice.Name))
+	return nil
+}
+
+// pinDevice selects the device and queries its capabilities, failing if it does
+// not support a PIN.
+func (app *Application) pinDevice() (*types.DeviceInfo, *types.DeviceCapabilities, error) {
+	selectedDevice, err := app.selectDevice()
+	if err != nil {
+		return nil, nil, err
+	}
+	capabilities, err := app.deviceMgr.GetDeviceCapabilities(selectedDevice)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query device capabilities: %w", err)
+	}
+	if _, supported := capabilities.Option("clientPin"); !supported {
+		return nil, nil, fmt.Errorf("%s does not support a PIN", selectedDevice.Name)
+	}
+	return selectedDevice, capabilities, nil
+}
+
+// readNewPIN asks for the new PIN twice, with the pinentry program if one is given
+// or on the terminal, and checks it against the PIN policy.
+func (app *Application) readNewPIN(capabilities *types.DeviceCapabilities) (string, error) {
+	minLength := minPINLength(capabilities)
+	ask := func(prompt string) (string, error) {
+		if pinentry, ok := app.pinSource.(*ui.PinentryPIN); ok {
+			return pinentry.ReadPIN(prompt)
+		}
+		pin := app.ui.GetPIN(prompt + " ")
+		if pin == "" {
+			return "", errors.New("no PIN provided")
+		}
+		return pin, nil
+	}
+
+	prompt := fmt.Sprintf("Enter the new PIN (at least %d characters):", minLength)
+	if capabilities.MinPINLength <= 0 {
+		prompt = fmt.Sprintf("Enter the new PIN (at least %d characters, the device may require more):", minLength)
+	}
+	pin, err := ask(prompt)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPINPolicy(pin, minLength); err != nil {
+		return "", err
+	}
+	repeated, err := ask("Repeat the new PIN:")
+	if err != nil {
+		return "", err
+	}
+	if repeated != pin {
+		return "", errors.New("the PINs do not match")
+	}
+	return pin, nil
+}
+
+// minPINLength returns the minimum PIN length the device reports, or the CTAP2
+// minimum if the backend does not report it; the device then enforces its own.
+func minPINLength(capabilities *types.DeviceCapabilities) int {
+	if capabilities.MinPINLength > 0 {
+		return capabilities.MinPINLength
+	}
+	return defaultMinPINLength
+}
+
+// withPINPolicyHint explains a rejected new PIN when the device's minimum length is not
+// reported, since only the CTAP2 minimum was checked before sending it.
+func withPINPolicyHint(err error, device *types.DeviceInfo, capabilities *types.DeviceCapabilities) error {
+	if capabilities.MinPINLength > 0 {
+		return err
+	}
+	return fmt.Errorf("%w\n\nThe minimum PIN length of %s is not reported by this backend;\n"+
+		"if the device rejected the PIN as too short, choose a longer one", err, device.Name)
+}
+
+// checkPINPolicy checks the length of a new PIN, counted in code points as CTAP2 does.
+func checkPINPolicy(pin string, minLength int) error {
+	if !utf8.ValidString(pin) {
+		return errors.New("the PIN must be valid UTF-8")
+	}
+	if utf8.RuneCountInString(pin) < minLength {
+		return fmt.Errorf("the PIN must have at least %d characters", minLength)
+	}
+	if len(pin) > maxPINLength {
+		return fmt.Errorf("the PIN must not be longer than %d bytes", maxPINLength)
+	}
+	return nil
+}
+
+// warnRetries warns when few PIN or user verification attempts are left.
+func (app *Application) warnRetries(device *types.DeviceInfo, capabilities *types.DeviceCapabilities) {
+	switch retries := capabilities.PINRetries; {
+	case retries == 0:
+		app.ui.DisplayWarning(fmt.Sprintf("The PIN of %s is blocked; only a reset, which deletes all its credentials, makes it usable again", device.Name))
+	case retries > 0 && retries <= pinRetriesWarning:
+		app.ui.DisplayWarning(fmt.Sprintf("Only %d PIN attempt(s) left before %s locks; a locked device has to be reset, which deletes all its credentials", retries, device.Name))
+	}
+	if retries := capabilities.UVRetries; retries >= 0 && retries <= pinRetriesWarning {
+		app.ui.DisplayWarning(fmt.Sprintf("Only %d built-in user verification attempt(s) left before %s only accepts the PIN", retries, device.Name))
+	}
+}
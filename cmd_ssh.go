@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"fido2-hmac-deriver/internal/sshkey"
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+)
+
+// runSSHKey derives an Ed25519 SSH key from the secret.
+func runSSHKey(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("ssh-key", "",
+		"Derive an Ed25519 SSH key from the HMAC secret and write it as an OpenSSH private\n"+
+			"key file, or only its authorized_keys line with --public. The key only depends on\n"+
+			"the credential, the salt and --label, so it can be regenerated on a new machine.")
+	label := fs.String("label", sshkey.DefaultLabel, "Label the key is derived with; different labels yield independent keys")
+	comment := fs.String("comment", "", "Comment of the key (default: fido2-hmac-deriver:<label>)")
+	out := fs.String("out", "", "File to write the private key to, and the public key to <file>.pub (default: stdout)")
+	public := fs.Bool("public", false, "Write only the public key as an authorized_keys line")
+	force := fs.Bool("force", false, "Overwrite existing key files given with --out")
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if *label == "" {
+		return fmt.Errorf("--label must not be empty")
+	}
+	if *public && *out != "" {
+		return fmt.Errorf("--public cannot be combined with --out, which writes both keys")
+	}
+	if *out != "" && !*force {
+		for _, path := range []string{*out, *out + ".pub"} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+			}
+		}
+	}
+	if *comment == "" {
+		*comment = sshkey.DefaultComment(*label)
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	return app.SSHKey(*label, *comment, *out, *public)
+}
+
+// SSHKey derives the secret and the SSH key with the given label, and writes the key
+// files to out, or the private or public key to stdout if out is empty.
+func (app *Application) SSHKey(label, comment, out string, publicOnly bool) error {
+	result, err := app.deriveSecret()
+	if err != nil {
+		return err
+	}
+
+	key, err := app.sshKey(result.Secret, label, comment)
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		if err := app.ui.OutputSSHKey(key, publicOnly); err != nil {
+			return fmt.Errorf("failed to write SSH key: %w", err)
+		}
+		return nil
+	}
+
+	err = store.WriteAtomic(out, 0600, func(w io.Writer) error {
+		_, err := w.Write(key.PrivateKey)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	err = store.WriteAtomic(out+".pub", 0644, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, key.AuthorizedKey)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write public key: %w", err)
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Wrote %s and %s.pub (%s)", out, out, key.Fingerprint))
+	return nil
+}
+
+// sshKey derives the SSH key with the given label from the secret and encodes it.
+func (app *Application) sshKey(secret []byte, label, comment string) (*types.SSHKey, error) {
+	privateKey, err := sshkey.Derive(secret, label)
+	if err != nil {
+		return nil, err
+	}
+	key := &types.SSHKey{}
+	if key.PrivateKey, err = sshkey.MarshalPrivateKey(privateKey, comment); err != nil {
+		return nil, err
+	}
+	if key.AuthorizedKey, err = sshkey.AuthorizedKey(privateKey, comment); err != nil {
+		return nil, err
+	}
+	if key.Fingerprint, err = sshkey.Fingerprint(privateKey); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"fido2-hmac-deriver/internal/keyring"
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/vault"
+)
+
+// runVault manages a vault whose master key any of several authenticators can unlock.
+func runVault(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("vault", "create | add | revoke <label>... | list | unlock",
+		"Manage a vault: a random master key wrapped for several authenticators, so any of\n"+
+			"them can unlock it. 'create' creates the vault for the selected device, 'add'\n"+
+			"unlocks it with an enrolled device and adds the selected one, 'revoke' removes\n"+
+			"authenticators, 'list' shows them and 'unlock' writes the master key to stdout,\n"+
+			"using whichever enrolled authenticator is connected. Devices have to be enrolled\n"+
+			"with 'fido2-hmac-deriver enroll' before they can be added.\n\n"+
+			"Revoking keeps the master key: copies of the vault file made before still unlock\n"+
+			"with the revoked authenticators. To lock those out, create a new vault and move\n"+
+			"what the old master key protects to the new one.\n\n"+
+			"With --threshold, 'create' splits the master key into shares for --shares\n"+
+			"authenticators with Shamir's scheme, and unlocking takes that many of them.")
+	vaultPath := fs.String("vault", "", "Vault file (default: vault.json in the store directory)")
+	label := fs.String("label", "", "Label of the authenticator to create the vault for or add (default: the device name)")
+	unlockDevice := fs.String("unlock-device", "", "Device path of an enrolled authenticator to unlock the vault with when adding (default: found automatically)")
+	threshold := fs.Int("threshold", 0, "Number of authenticators needed to unlock a new vault (default: any single one)")
+	count := fs.Int("shares", 0, "Number of authenticators to split the master key of a new threshold vault between (default: the threshold)")
+	var shareDevices stringList
+	fs.Var(&shareDevices, "share-device", "Device path of an authenticator of a new threshold vault, in order (may be repeated; default: selected interactively)")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation before revoking authenticators")
+	output := fs.String("output", string(types.OutputKey), "Output format of unlock: key (the master key as one encoded line) or raw (the key bytes)")
+	encoding := fs.String("encoding", string(types.EncodingBase64), "Encoding of the master key in key output: base64, base64url or hex")
+	opts.deviceFlags(fs, true)
+	opts.saltFlags(fs)
+	opts.storeFlags(fs)
+	opts.backendFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Flags may also follow the action, so parse the remaining arguments again
+	if fs.NArg() == 0 {
+		return errors.New("no vault action given (expected create, add, revoke, list or unlock)")
+	}
+	action := fs.Arg(0)
+	if err := parseFlags(fs, fs.Args()[1:]); err != nil {
+		return err
+	}
+	if action != "revoke" && fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	opts.output, opts.encoding = *output, *encoding
+	outputOptions, err := opts.outputOptions()
+	if err != nil {
+		return err
+	}
+	if outputOptions.Format != types.OutputKey && outputOptions.Format != types.OutputRaw {
+		return fmt.Errorf("vault unlock cannot write the %s format (expected %s or %s)", outputOptions.Format, types.OutputKey, types.OutputRaw)
+	}
+
+	if *count == 0 {
+		*count = *threshold
+	}
+	if *threshold != 0 {
+		if *threshold < 2 || *count < *threshold {
+			return fmt.Errorf("invalid threshold %d of %d authenticators (need 2 <= threshold <= shares)", *threshold, *count)
+		}
+		if *label != "" {
+			return errors.New("--label cannot be combined with --threshold, authenticators are labeled with their device names")
+		}
+		if len(shareDevices) > 0 && len(shareDevices) != *count {
+			return fmt.Errorf("%d devices given with --share-device for %d shares", len(shareDevices), *count)
+		}
+	}
+
+	path, err := opts.vaultPath(*vaultPath)
+	if err != nil {
+		return err
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "create":
+		return app.CreateVault(path, *label, *threshold, *count, shareDevices)
+	case "add":
+		return app.AddToVault(path, *label, *unlockDevice)
+	case "revoke":
+		if fs.NArg() == 0 {
+			return errors.New("no authenticator label given (see 'fido2-hmac-deriver vault list')")
+		}
+		return app.RevokeFromVault(path, fs.Args(), *yes)
+	case "list":
+		return app.ListVault(path)
+	case "unlock":
+		return app.UnlockVault(path, outputOptions)
+	default:
+		return fmt.Errorf("unknown vault action '%s' (expected create, add, revoke, list or unlock)", action)
+	}
+}
+
+// CreateVault creates a vault with a new master key for the selected authenticator,
+// or a threshold vault whose master key is split between several authenticators.
+//
+// Parameters:
+//   - path: The vault file
+//   - label: The label of the authenticator (default: the device name), without threshold
+//   - threshold: The number of authenticators needed to unlock the vault, or 0 for any single one
+//   - count: The number of authenticators to split the master key between
+//   - devices: The device paths of the authenticators, in order (default: selected interactively)
+func (app *Application) CreateVault(path, label string, threshold, count int, devices []string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("a vault already exists at %s, use 'vault add' to enroll more authenticators", path)
+	}
+
+	if threshold == 0 {
+		v, masterKey, err := vault.New()
+		if err != nil {
+			return err
+		}
+		label, err = app.enrollInVault(v, masterKey, label, app.fidoDevice)
+		if err != nil {
+			return err
+		}
+
+		if err := v.Save(path); err != nil {
+			return err
+		}
+		app.ui.DisplaySuccess(fmt.Sprintf("Created vault %s for '%s'", path, label))
+		app.ui.DisplayInfo("Add a backup authenticator with 'fido2-hmac-deriver vault add', losing the only one loses the master key")
+		return nil
+	}
+
+	v, shares, err := vault.NewThreshold(threshold, count)
+	if err != nil {
+		return err
+	}
+	for i, share := range shares {
+		devicePath := ""
+		if len(devices) > 0 {
+			devicePath = devices[i]
+		} else if i > 0 && !app.ui.ConfirmAction(fmt.Sprintf("Connect authenticator %d of %d, continue?", i+1, count)) {
+			return errors.New("vault creation cancelled")
+		}
+
+		app.ui.DisplayInfo(fmt.Sprintf("Enrolling authenticator %d of %d...", i+1, count))
+		label, err := app.enrollInVault(v, share, "", devicePath)
+		if err != nil {
+			return err
+		}
+		app.ui.DisplaySuccess(fmt.Sprintf("Enrolled '%s'", label))
+	}
+
+	if err := v.Save(path); err != nil {
+		return err
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Created vault %s, %d of its %d authenticators unlock it", path, threshold, count))
+	return nil
+}
+
+// AddToVault unlocks the vault with an enrolled authenticator and wraps the master
+// key for the selected one.
+//
+// Parameters:
+//   - path: The vault file
+//   - label: The label of the new authenticator (default: the device name)
+//   - unlockDevice: The path of the enrolled authenticator (default: found automatically)
+func (app *Application) AddToVault(path, label, unlockDevice string) error {
+	v, err := vault.Load(path)
+	if err != nil {
+		return err
+	}
+
+	// A threshold vault gets a new share, the other vaults the master key itself
+	var key []byte
+	if v.IsThreshold() {
+		app.ui.DisplayInfo(fmt.Sprintf("Collecting the shares of %d enrolled authenticators...", v.Threshold))
+		shares, err := app.collectShares(v, unlockDevice)
+		if err != nil {
+			return err
+		}
+		if key, err = v.NewShare(shares); err != nil {
+			return err
+		}
+	} else {
+		app.ui.DisplayInfo("Unlocking the vault with an enrolled authenticator...")
+		if key, err = app.unlockVault(v, unlockDevice); err != nil {
+			return err
+		}
+	}
+
+	if v.IsThreshold() && app.fidoDevice == "" &&
+		!app.ui.ConfirmAction("Connect the authenticator to add, continue?") {
+		return errors.New("adding the authenticator cancelled")
+	}
+	app.ui.DisplayInfo("Deriving the secret of the authenticator to add...")
+	label, err = app.enrollInVault(v, key, label, app.fidoDevice)
+	if err != nil {
+		return err
+	}
+
+	if err := v.Save(path); err != nil {
+		return err
+	}
+	if v.IsThreshold() {
+		app.ui.DisplaySuccess(fmt.Sprintf("Added '%s' to the vault, %d of its %d authenticators unlock it", label, v.Threshold, len(v.Slots)))
+	} else {
+		app.ui.DisplaySuccess(fmt.Sprintf("Added '%s' to the vault, %d authenticator(s) can unlock it", label, len(v.Slots)))
+	}
+	return nil
+}
+
+// RevokeFromVault removes the authenticators with the given labels from the vault
+// after the user confirmed it. The master key stays the same, so copies of the vault
+// file made before still unlock with the revoked authenticators.
+func (app *Application) RevokeFromVault(path string, labels []string, skipConfirmation bool) error {
+	v, err := vault.Load(path)
+	if err != nil {
+		return err
+	}
+
+	// Check every label first, so that all unknown ones are reported together
+	var selected, quoted, unknown []string
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		if seen[label] {
+			continue
+		}
+		seen[label] = true
+		if v.Find(label) == nil {
+			unknown = append(unknown, fmt.Sprintf("'%s'", label))
+			continue
+		}
+		selected = append(selected, label)
+		quoted = append(quoted, fmt.Sprintf("'%s'", label))
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("the vault has no authenticator labeled %s (see 'fido2-hmac-deriver vault list')", strings.Join(unknown, ", "))
+	}
+
+	app.ui.DisplayWarning("The master key does not change: copies of the vault file made before the revocation " +
+		"can still be unlocked with the revoked authenticators")
+	if !skipConfirmation && !app.ui.ConfirmAction(fmt.Sprintf("Revoke %s from the vault?", strings.Join(quoted, ", "))) {
+		return errors.New("revocation cancelled")
+	}
+
+	for _, label := range selected {
+		if err := v.Remove(label); err != nil {
+			return err
+		}
+	}
+	if err := v.Save(path); err != nil {
+		return err
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Revoked %d authenticator(s), %d remain enrolled in the vault", len(selected), len(v.Slots)))
+	return nil
+}
+
+// ListVault shows the authenticators enrolled in the vault.
+func (app *Application) ListVault(path string) error {
+	v, err := vault.Load(path)
+	if err != nil {
+		return err
+	}
+	app.ui.DisplayVault(path, v.Threshold, v.Describe())
+	return nil
+}
+
+// UnlockVault unlocks the vault with a connected authenticator and writes the master key.
+func (app *Application) UnlockVault(path string, output *types.OutputOptions) error {
+	v, err := vault.Load(path)
+	if err != nil {
+		return err
+	}
+
+	masterKey, err := app.unlockVault(v, app.fidoDevice)
+	if err != nil {
+		return err
+	}
+
+	if err := app.ui.OutputKeys([][]byte{masterKey}, output); err != nil {
+		return fmt.Errorf("failed to write master key: %w", err)
+	}
+	return nil
+}
+
+// enrollInVault derives the secret of the authenticator at the given device path
+// (or an interactively selected one) with its stored credential and adds its slot
+// holding the key to the vault. Returns the label of the slot.
+func (app *Application) enrollInVault(v *vault.Vault, key []byte, label, devicePath string) (string, error) {
+	selectedDevice, err := app.selectDeviceAt(devicePath)
+	if err != nil {
+		return "", err
+	}
+	// The device may hold the credential of a slot besides its current one, e.g.
+	// after 'enroll --force', and one authenticator must not count as two
+	existing, err := app.vaultSlotOn(v, selectedDevice, nil)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", fmt.Errorf("%s is already enrolled in the vault as '%s'", selectedDevice.Name, existing.Name)
+	}
+
+	result, err := app.deriveSecretOn(selectedDevice, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if existing := v.FindCredential(result.CredentialID); existing != nil {
+		return "", fmt.Errorf("%s is already enrolled in the vault as '%s'", result.Device.Name, existing.Name)
+	}
+
+	if label == "" {
+		label = result.Device.Name
+		if v.Find(label) != nil {
+			label = fmt.Sprintf("%s (%s)", label, store.Fingerprint(result.CredentialID))
+		}
+	}
+
+	kek, err := keyring.DeriveKEK(result.Secret)
+	if err != nil {
+		return "", err
+	}
+	if err := v.Add(label, key, kek, keyring.SourceOf(result)); err != nil {
+		return "", err
+	}
+	return label, nil
+}
+
+// unlockVault unwraps the master key with an enrolled authenticator, or recovers it
+// from the shares of Threshold authenticators for a threshold vault.
+func (app *Application) unlockVault(v *vault.Vault, devicePath string) ([]byte, error) {
+	if v.IsThreshold() {
+		shares, err := app.collectShares(v, devicePath)
+		if err != nil {
+			return nil, err
+		}
+		masterKey, err := v.Combine(shares)
+		if err != nil {
+			return nil, err
+		}
+		app.ui.DisplaySuccess("Unlocked the vault")
+		return masterKey, nil
+	}
+
+	slot, masterKey, err := app.unlockSlot(v, devicePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	app.ui.DisplaySuccess(fmt.Sprintf("Unlocked the vault with '%s'", slot.Name))
+	return masterKey, nil
+}
+
+// collectShares unwraps the shares of a threshold vault from Threshold distinct
+// authenticators. The device path, if given, selects the first one; the others are
+// found among the connected devices. In interactive mode the user is asked to connect
+// the next authenticator when no further enrolled one is connected.
+func (app *Application) collectShares(v *vault.Vault, devicePath string) ([][]byte, error) {
+	used := &usedShares{slots: make(map[string]bool), devices: make(map[string]bool)}
+	shares := make([][]byte, 0, v.Threshold)
+	app.ui.DisplayShareProgress(0, v.Threshold, "")
+
+	for len(shares) < v.Threshold {
+		slot, share, err := app.unlockSlot(v, devicePath, used)
+		if errors.Is(err, errNoVaultDevice) && app.pinSource == nil &&
+			app.ui.ConfirmAction(fmt.Sprintf("Connect another authenticator of the vault (%d of %d collected), continue?", len(shares), v.Threshold)) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("collected %d of %d shares: %w", len(shares), v.Threshold, err)
+		}
+
+		devicePath = ""
+		shares = append(shares, share)
+		app.ui.DisplayShareProgress(len(shares), v.Threshold, slot.Name)
+	}
+	return shares, nil
+}
+
+// usedShares records what the shares of a threshold vault were unwrapped with, so
+// that each share comes from another authenticator.
+type usedShares struct {
+	slots   map[string]bool // Names of the slots taken, or held by a device taken
+	devices map[string]bool // Paths of the devices taken
+}
+
+func (u *usedShares) hasSlot(name string) bool {
+	return u != nil && u.slots[name]
+}
+
+func (u *usedShares) hasDevice(path string) bool {
+	return u != nil && u.devices[path]
+}
+
+// unlockSlot finds a connected authenticator enrolled in a slot that is not in used,
+// derives the secret of the slot and unwraps the key it holds. The slot and the
+// device are added to used, with the other slots whose credentials the device holds.
+func (app *Application) unlockSlot(v *vault.Vault, devicePath string, used *usedShares) (*keyring.WrappedKey, []byte, error) {
+	selectedDevice, credentialID, err := app.findVaultDevice(v, devicePath, used)
+	if err != nil {
+		return nil, nil, err
+	}
+	slot := v.FindCredential(credentialID)
+
+	result, err := app.deriveSecretOn(selectedDevice, credentialID, slot.Source.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	kek, err := keyring.DeriveKEK(result.Secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := slot.Unwrap(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if used != nil {
+		used.slots[slot.Name] = true
+		used.devices[selectedDevice.Path] = true
+		for {
+			other, err := app.vaultSlotOn(v, selectedDevice, used)
+			if err != nil || other == nil {
+				break
+			}
+			used.slots[other.Name] = true
+		}
+	}
+	return slot, key, nil
+}
+
+// vaultSlotOn returns a slot of the vault, not in used, whose credential the device
+// holds, or nil if it holds none.
+func (app *Application) vaultSlotOn(v *vault.Vault, device *types.DeviceInfo, used *usedShares) (*keyring.WrappedKey, error) {
+	var candidates [][]byte
+	for _, slot := range v.Slots {
+		if slot.Source.RelyingPartyID == app.config.RelyingPartyID && !used.hasSlot(slot.Name) {
+			candidates = append(candidates, slot.Source.CredentialID)
+		}
+	}
+	credentialID, err := app.cryptoProvider.FindCredential(device, app.config, candidates)
+	if err != nil || credentialID == nil {
+		return nil, err
+	}
+	return v.FindCredential(credentialID), nil
+}
+
+// errNoVaultDevice reports that no connected device holds a credential of the vault.
+var errNoVaultDevice = errors.New("none of the connected devices is enrolled in the vault")
+
+// findVaultDevice returns a connected device not in used holding the credential of a
+// vault slot that is not in used either, and the credential. The device with the given
+// path is checked; without a path, all connected devices are, and the user selects
+// one if several are enrolled.
+func (app *Application) findVaultDevice(v *vault.Vault, path string, used *usedShares) (*types.DeviceInfo, []byte, error) {
+	var candidates [][]byte
+	for _, slot := range v.Slots {
+		if slot.Source.RelyingPartyID == app.config.RelyingPartyID && !used.hasSlot(slot.Name) {
+			candidates = append(candidates, slot.Source.CredentialID)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("the vault has no further authenticators for relying party '%s'", app.config.RelyingPartyID)
+	}
+
+	if path != "" {
+		selectedDevice, err := app.selectDeviceAt(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		credentialID, err := app.cryptoProvider.FindCredential(selectedDevice, app.config, candidates)
+		if err != nil {
+			return nil, nil, err
+		}
+		if credentialID == nil {
+			return nil, nil, fmt.Errorf("%s is not enrolled in the vault (see 'fido2-hmac-deriver vault list')", selectedDevice.Name)
+		}
+		return selectedDevice, credentialID, nil
+	}
+
+	app.ui.DisplayProgress("Searching for enrolled FIDO2 devices...")
+	devices, err := app.deviceMgr.ListDevices()
+	if err != nil {
+		return nil, nil, fmt.Errorf("device discovery failed: %w", err)
+	}
+
+	var enrolled []*types.DeviceInfo
+	var credentialIDs [][]byte
+	for _, device := range devices {
+		if used.hasDevice(device.Path) {
+			continue
+		}
+		credentialID, err := app.cryptoProvider.FindCredential(device, app.config, candidates)
+		if err != nil {
+			app.ui.DisplayWarning(fmt.Sprintf("Skipping %s: %v", device.Name, err))
+			continue
+		}
+		if credentialID != nil {
+			enrolled = append(enrolled, device)
+			credentialIDs = append(credentialIDs, credentialID)
+		}
+	}
+	if len(enrolled) == 0 {
+		return nil, nil, fmt.Errorf("%w\n\nPlease:\n"+
+			"- Connect one of the authenticators shown by 'fido2-hmac-deriver vault list'\n"+
+			"- Check that --vault and --store-dir point to the vault used for enrollment", errNoVaultDevice)
+	}
+
+	selected := 0
+	if len(enrolled) > 1 {
+		selectedDevice, err := app.deviceMgr.SelectDevice(enrolled)
+		if err != nil {
+			return nil, nil, fmt.Errorf("device selection failed: %w", err)
+		}
+		for i, device := range enrolled {
+			if device == selectedDevice {
+				selected = i
+			}
+		}
+	} else {
+		app.ui.DisplaySuccess(fmt.Sprintf("Found enrolled device %s", enrolled[0].Name))
+	}
+
+	app.ui.DisplayProgress("Validating device accessibility...")
+	if err := app.deviceMgr.ValidateDevice(enrolled[selected]); err != nil {
+		return nil, nil, fmt.Errorf("device validation failed: %w", err)
+	}
+	return enrolled[selected], credentialIDs[selected], nil
+}
+
+// vaultPath returns the vault file given with --vault or the default one in the store directory.
+func (o *options) vaultPath(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	storeDir, err := o.storeDirectory()
+	if err != nil {
+		return "", err
+	}
+	return vault.DefaultPath(storeDir), nil
+}
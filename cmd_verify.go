@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/ui"
+)
+
+// runVerify checks a secret against the check values in the credential store.
+func runVerify(args []string) error {
+	opts := defaultOptions()
+	fs := newFlagSet("verify", "", "Check a secret against the check values recorded for the stored credentials,\n"+
+		"without using the device. The secret is read from --secret or from stdin, which\n"+
+		"also accepts the output of 'derive --key-only'. Exits with status 1 if it does not match.")
+	secret := fs.String("secret", "", "Secret to check (default: read from stdin)")
+	encoding := fs.String("encoding", string(types.EncodingBase64), "Encoding of the secret: base64, base64url or hex")
+	opts.saltInputFlags(fs)
+	opts.storeFlags(fs)
+	opts.commonFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	opts.output, opts.encoding = string(types.OutputKey), *encoding
+	output, err := opts.outputOptions()
+	if err != nil {
+		return err
+	}
+
+	encoded := *secret
+	if encoded == "" {
+		if encoded, err = readSecret(); err != nil {
+			return err
+		}
+	}
+
+	decoded, err := ui.DecodeBytes(encoded, output.Encoding)
+	if err != nil {
+		return fmt.Errorf("failed to decode secret as %s: %w", output.Encoding, err)
+	}
+
+	app, err := opts.application()
+	if err != nil {
+		return err
+	}
+	return app.Verify(decoded)
+}
+
+// Verify checks a secret against the stored check values.
+func (app *Application) Verify(secret []byte) error {
+	if err := app.validateConfiguration(); err != nil {
+		return err
+	}
+
+	record, err := app.cryptoProvider.VerifySecret(secret, app.config)
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+
+	app.ui.DisplaySuccess(fmt.Sprintf("The secret matches credential %s (%s on %s)",
+		store.Fingerprint(record.CredentialID), record.RelyingPartyID, record.DeviceName))
+	return nil
+}
+
+// readSecret reads the secret from stdin. If the input contains the block written
+// by 'derive --key-only', the key inside it is used; otherwise the first non-empty line.
+func readSecret() (string, error) {
+	var first string
+	inBlock := false
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "----- BEGIN"):
+			inBlock = true
+		case inBlock:
+			return line, nil
+		case first == "":
+			first = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read secret from stdin: %w", err)
+	}
+	if first == "" {
+		return "", errors.New("no secret given, pass --secret or write it to stdin")
+	}
+	return first, nil
+}
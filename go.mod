@@ -3,8 +3,11 @@ module fido2-hmac-deriver
 go 1.24.0
 
 require (
+	filippo.io/age v1.2.1
 	github.com/fatih/color v1.18.0
 	github.com/keys-pub/go-libfido2 v1.5.3
+	golang.org/x/crypto v0.36.0
+	golang.org/x/sys v0.31.0
 	golang.org/x/term v0.30.0
 )
 
@@ -12,5 +15,4 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/sys v0.31.0 // indirect
 )
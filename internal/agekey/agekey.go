@@ -0,0 +1,155 @@
+// Package agekey turns the FIDO2 secret into an age X25519 identity and implements
+// the age plugin protocol (age-plugin-fido2hmac), so age can decrypt files with the
+// authenticator without the identity ever being written to disk.
+//
+// The identity is derived from the secret with HKDF, so the same credential and
+// salt always yield the same identity and recipient.
+package agekey
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"golang.org/x/crypto/curve25519"
+)
+
+// PluginName is the name of the age plugin. age runs it as "age-plugin-" + PluginName
+// for recipients starting with "age1fido2hmac1" and identities starting with
+// "AGE-PLUGIN-FIDO2HMAC-1".
+const PluginName = "fido2hmac"
+
+// PluginBinary is the executable name age looks for in $PATH.
+const PluginBinary = "age-plugin-" + PluginName
+
+// identityInfo is the HKDF info parameter of the X25519 scalar.
+const identityInfo = "fido2-hmac-deriver:age:v1:x25519"
+
+// referenceVersion is the version of the data encoded in plugin identities.
+const referenceVersion = 1
+
+// Identity derives the X25519 age identity from an HMAC secret.
+func Identity(secret []byte) (*age.X25519Identity, error) {
+	scalar, err := deriveScalar(secret)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := bech32Encode("AGE-SECRET-KEY-", scalar)
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Identity(encoded)
+}
+
+// PluginRecipient returns the plugin recipient of the identity derived from an HMAC
+// secret. The plugin wraps file keys for it as for the native recipient, so files
+// can be decrypted with the plugin and with the native identity alike.
+func PluginRecipient(secret []byte) (string, error) {
+	scalar, err := deriveScalar(secret)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return plugin.EncodeRecipient(PluginName, publicKey), nil
+}
+
+// deriveScalar derives the X25519 scalar of the identity from an HMAC secret.
+func deriveScalar(secret []byte) ([]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot derive an age identity from an empty secret")
+	}
+	return hkdf.Key(sha256.New, secret, nil, identityInfo, curve25519.ScalarSize)
+}
+
+// Reference identifies the secret a plugin identity is derived from. It holds no
+// secret, so plugin identities can be stored and shared like recipients.
+type Reference struct {
+	RelyingPartyID string
+	CredentialID   []byte
+	Salt           []byte
+}
+
+// PluginIdentity returns the plugin identity referencing the secret.
+func PluginIdentity(ref *Reference) (string, error) {
+	if len(ref.RelyingPartyID) > 255 || len(ref.CredentialID) > 65535 || len(ref.Salt) > 255 {
+		return "", errors.New("relying party, credential ID or salt too long for a plugin identity")
+	}
+	data := []byte{referenceVersion, byte(len(ref.RelyingPartyID))}
+	data = append(data, ref.RelyingPartyID...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(ref.CredentialID)))
+	data = append(data, ref.CredentialID...)
+	data = append(data, byte(len(ref.Salt)))
+	data = append(data, ref.Salt...)
+	return plugin.EncodeIdentity(PluginName, data), nil
+}
+
+// ParsePluginIdentity decodes a plugin identity returned by PluginIdentity.
+func ParsePluginIdentity(s string) (*Reference, error) {
+	name, data, err := plugin.ParseIdentity(s)
+	if err != nil {
+		return nil, err
+	}
+	if name != PluginName {
+		return nil, fmt.Errorf("identity of plugin '%s' instead of '%s'", name, PluginName)
+	}
+	if len(data) == 0 || data[0] != referenceVersion {
+		return nil, errors.New("unsupported plugin identity version")
+	}
+
+	r := &reader{data: data[1:]}
+	ref := &Reference{
+		RelyingPartyID: string(r.next(int(r.byte()))),
+		CredentialID:   r.next(int(r.uint16())),
+		Salt:           r.next(int(r.byte())),
+	}
+	if r.err != nil || len(r.data) != 0 || ref.RelyingPartyID == "" || len(ref.CredentialID) == 0 || len(ref.Salt) == 0 {
+		return nil, errors.New("malformed plugin identity")
+	}
+	return ref, nil
+}
+
+// recipientFromKey returns the native recipient of an X25519 public key.
+func recipientFromKey(publicKey []byte) (*age.X25519Recipient, error) {
+	encoded, err := bech32Encode("age", publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Recipient(encoded)
+}
+
+// reader decodes length-prefixed fields, remembering the first error.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	field := r.data[:n]
+	r.data = r.data[n:]
+	return append([]byte(nil), field...)
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
@@ -0,0 +1,103 @@
+package agekey
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestBech32Encode(t *testing.T) {
+	// The data of the last vector is the 5-bit values 0 to 31, regrouped to bytes
+	values := make([]byte, 32)
+	for i := range values {
+		values[i] = byte(i)
+	}
+	allValues, err := convertBits(values, 5, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Valid checksums of BIP 173
+	tests := []struct {
+		hrp  string
+		data []byte
+		want string
+	}{
+		{"A", nil, "A12UEL5L"},
+		{"a", nil, "a12uel5l"},
+		{"abcdef", allValues, "abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, err := bech32Encode(tt.hrp, tt.data)
+			if err != nil {
+				t.Fatalf("bech32Encode: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("bech32Encode = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertBits(t *testing.T) {
+	data := []byte{0xff, 0x00, 0xa5}
+	values, err := convertBits(data, 8, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{31, 28, 0, 10, 10} // 24 bits padded to 25
+	if !bytes.Equal(values, want) {
+		t.Fatalf("convertBits(8, 5) = %v, want %v", values, want)
+	}
+
+	if _, err := convertBits([]byte{32}, 5, 8); err == nil {
+		t.Error("convertBits accepted a value wider than 5 bits")
+	}
+}
+
+func TestRecipientMatchesAge(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x17}, 32)
+	identity, err := Identity(secret)
+	if err != nil {
+		t.Fatalf("Identity: %v", err)
+	}
+
+	// age encodes the recipient of the identity with its own bech32 implementation
+	scalar, err := deriveScalar(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := recipientFromKey(publicKey)
+	if err != nil {
+		t.Fatalf("recipientFromKey: %v", err)
+	}
+	if recipient.String() != identity.Recipient().String() {
+		t.Errorf("recipient %s, want %s", recipient, identity.Recipient())
+	}
+}
+
+func TestPluginIdentityRoundTrip(t *testing.T) {
+	ref := &Reference{
+		RelyingPartyID: "e2e-git",
+		CredentialID:   bytes.Repeat([]byte{0xc1}, 34),
+		Salt:           bytes.Repeat([]byte{0x5a}, 32),
+	}
+	encoded, err := PluginIdentity(ref)
+	if err != nil {
+		t.Fatalf("PluginIdentity: %v", err)
+	}
+	parsed, err := ParsePluginIdentity(encoded)
+	if err != nil {
+		t.Fatalf("ParsePluginIdentity: %v", err)
+	}
+	if parsed.RelyingPartyID != ref.RelyingPartyID || !bytes.Equal(parsed.CredentialID, ref.CredentialID) ||
+		!bytes.Equal(parsed.Salt, ref.Salt) {
+		t.Errorf("ParsePluginIdentity = %+v, want %+v", parsed, ref)
+	}
+}
@@ -0,0 +1,220 @@
+package agekey
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+// IdentitySource derives the identity a plugin identity references. It may use the
+// client to show messages or to ask for the PIN.
+type IdentitySource func(ref *Reference, client *Client) (*age.X25519Identity, error)
+
+// Client lets the plugin interact with the user through the age client.
+type Client struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// Message shows a message to the user.
+func (c *Client) Message(message string) error {
+	_, err := c.command(&stanza{Type: "msg", Body: []byte(message)})
+	return err
+}
+
+// RequestSecret asks the user for a secret, such as the PIN.
+func (c *Client) RequestSecret(prompt string) (string, error) {
+	reply, err := c.command(&stanza{Type: "request-secret", Body: []byte(prompt)})
+	if err != nil {
+		return "", err
+	}
+	return string(reply.Body), nil
+}
+
+// command sends a stanza and reads the client's answer, failing unless it is "ok".
+func (c *Client) command(s *stanza) (*stanza, error) {
+	reply, err := c.call(s)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != "ok" {
+		return nil, fmt.Errorf("age client answered %s to %s", reply.Type, s.Type)
+	}
+	return reply, nil
+}
+
+// call sends a stanza and reads the client's answer.
+func (c *Client) call(s *stanza) (*stanza, error) {
+	if err := s.marshal(c.w); err != nil {
+		return nil, err
+	}
+	return readStanza(c.r)
+}
+
+// sendError reports an error to the client.
+func (c *Client) sendError(body string, args ...string) error {
+	_, err := c.call(&stanza{Type: "error", Args: args, Body: []byte(body)})
+	return err
+}
+
+// RunRecipient serves the recipient-v1 state machine: it wraps file keys for plugin
+// recipients into native X25519 stanzas, so encryption never needs the authenticator.
+func RunRecipient(r io.Reader, w io.Writer) error {
+	c := &Client{r: bufio.NewReader(r), w: w}
+
+	// Phase 1: the client sends recipients, identities and file keys
+	var recipients []string
+	var identities int
+	var fileKeys [][]byte
+	for {
+		s, err := readStanza(c.r)
+		if err != nil {
+			return err
+		}
+		if s.Type == "done" {
+			break
+		}
+		switch s.Type {
+		case "add-recipient":
+			if len(s.Args) != 1 {
+				return fmt.Errorf("malformed %s stanza", s.Type)
+			}
+			recipients = append(recipients, s.Args[0])
+		case "add-identity":
+			identities++
+		case "wrap-file-key":
+			fileKeys = append(fileKeys, s.Body)
+		}
+	}
+
+	// Phase 2: the plugin answers with a stanza per recipient and file key
+	if identities > 0 {
+		// Encrypting to a plugin identity would need the authenticator
+		return c.sendError("encrypt to the recipient of the identity instead", "identity", "0")
+	}
+	var wrappers []*age.X25519Recipient
+	for i, recipient := range recipients {
+		recipient, err := parsePluginRecipient(recipient)
+		if err != nil {
+			return c.sendError(err.Error(), "recipient", strconv.Itoa(i))
+		}
+		wrappers = append(wrappers, recipient)
+	}
+
+	for i, fileKey := range fileKeys {
+		for _, recipient := range wrappers {
+			stanzas, err := recipient.Wrap(fileKey)
+			if err != nil {
+				return c.sendError(err.Error(), "internal")
+			}
+			for _, s := range stanzas {
+				args := append([]string{strconv.Itoa(i), s.Type}, s.Args...)
+				if _, err := c.command(&stanza{Type: "recipient-stanza", Args: args, Body: s.Body}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return (&stanza{Type: "done"}).marshal(c.w)
+}
+
+// RunIdentity serves the identity-v1 state machine: it derives the identities of the
+// plugin identities and unwraps the X25519 stanzas of each file with them. The source
+// is only called when a file has X25519 stanzas.
+func RunIdentity(r io.Reader, w io.Writer, source IdentitySource) error {
+	c := &Client{r: bufio.NewReader(r), w: w}
+
+	// Phase 1: the client sends identities and the stanzas of each file
+	var references []*Reference
+	var identityErrors []error
+	files := map[int][]*age.Stanza{}
+	var order []int
+	for {
+		s, err := readStanza(c.r)
+		if err != nil {
+			return err
+		}
+		if s.Type == "done" {
+			break
+		}
+		switch s.Type {
+		case "add-identity":
+			if len(s.Args) != 1 {
+				return fmt.Errorf("malformed %s stanza", s.Type)
+			}
+			ref, err := ParsePluginIdentity(s.Args[0])
+			references = append(references, ref)
+			identityErrors = append(identityErrors, err)
+		case "recipient-stanza":
+			if len(s.Args) < 2 {
+				return fmt.Errorf("malformed %s stanza", s.Type)
+			}
+			file, err := strconv.Atoi(s.Args[0])
+			if err != nil || file < 0 {
+				return fmt.Errorf("malformed %s stanza", s.Type)
+			}
+			if _, ok := files[file]; !ok {
+				order = append(order, file)
+			}
+			files[file] = append(files[file], &age.Stanza{Type: s.Args[1], Args: s.Args[2:], Body: s.Body})
+		}
+	}
+
+	// Phase 2: the plugin derives the identities and returns the file keys it unwraps
+	for i, err := range identityErrors {
+		if err != nil {
+			return c.sendError(err.Error(), "identity", strconv.Itoa(i))
+		}
+	}
+	identities := make([]*age.X25519Identity, len(references))
+	for _, file := range order {
+		var stanzas []*age.Stanza
+		for _, s := range files[file] {
+			if s.Type == "X25519" {
+				stanzas = append(stanzas, s)
+			}
+		}
+		if len(stanzas) == 0 {
+			continue
+		}
+
+		for i, ref := range references {
+			if identities[i] == nil {
+				identity, err := source(ref, c)
+				if err != nil {
+					return c.sendError(err.Error(), "identity", strconv.Itoa(i))
+				}
+				identities[i] = identity
+			}
+			fileKey, err := identities[i].Unwrap(stanzas)
+			if errors.Is(err, age.ErrIncorrectIdentity) {
+				continue
+			}
+			if err != nil {
+				return c.sendError(err.Error(), "internal")
+			}
+			if _, err := c.command(&stanza{Type: "file-key", Args: []string{strconv.Itoa(file)}, Body: fileKey}); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return (&stanza{Type: "done"}).marshal(c.w)
+}
+
+// parsePluginRecipient returns the native recipient of a plugin recipient.
+func parsePluginRecipient(s string) (*age.X25519Recipient, error) {
+	name, publicKey, err := plugin.ParseRecipient(s)
+	if err != nil {
+		return nil, err
+	}
+	if name != PluginName {
+		return nil, fmt.Errorf("recipient of plugin '%s' instead of '%s'", name, PluginName)
+	}
+	return recipientFromKey(publicKey)
+}
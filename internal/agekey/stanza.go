@@ -0,0 +1,70 @@
+package agekey
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// columnsPerLine is the width of wrapped stanza bodies.
+const columnsPerLine = 64
+
+// bytesPerLine is the number of body bytes encoded on a full line.
+const bytesPerLine = columnsPerLine / 4 * 3
+
+// stanza is a message of the age plugin protocol: a type, arguments and a body.
+type stanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+// marshal writes the stanza. The body is unpadded base64 wrapped at 64 columns and
+// always ends with a short, possibly empty, line.
+func (s *stanza) marshal(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("-> ")
+	b.WriteString(strings.Join(append([]string{s.Type}, s.Args...), " "))
+	b.WriteByte('\n')
+	encoded := base64.RawStdEncoding.EncodeToString(s.Body)
+	for len(encoded) >= columnsPerLine {
+		b.WriteString(encoded[:columnsPerLine])
+		b.WriteByte('\n')
+		encoded = encoded[columnsPerLine:]
+	}
+	b.WriteString(encoded)
+	b.WriteByte('\n')
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readStanza reads the next stanza.
+func readStanza(r *bufio.Reader) (*stanza, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stanza: %w", err)
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\n"), " ")
+	if len(fields) < 2 || fields[0] != "->" || fields[1] == "" {
+		return nil, fmt.Errorf("malformed stanza %q", line)
+	}
+	s := &stanza{Type: fields[1], Args: fields[2:]}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stanza body: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		data, err := base64.RawStdEncoding.Strict().DecodeString(line)
+		if err != nil || len(data) > bytesPerLine {
+			return nil, fmt.Errorf("malformed stanza body line %q", line)
+		}
+		s.Body = append(s.Body, data...)
+		if len(data) < bytesPerLine {
+			return s, nil
+		}
+	}
+}
@@ -0,0 +1,221 @@
+//go:build cgo
+
+// Package libfido2 implements the device backend for physical FIDO2 devices.
+// It is the only package that depends on the libfido2 C library (via cgo);
+// everything else works with the backend-neutral types.Authenticator interface.
+// Without cgo the backend is a stub that reports it is unavailable, so the rest
+// of the application still builds and works with the virtual backend.
+package libfido2
+
+import (
+	"errors"
+	"fmt"
+
+	"fido2-hmac-deriver/internal/types"
+
+	fido "github.com/keys-pub/go-libfido2"
+)
+
+// Name is the identifier used to select this backend.
+const Name = "libfido2"
+
+// Backend implements the types.Backend interface using libfido2.
+type Backend struct{}
+
+// New creates a new libfido2 backend.
+func New() *Backend {
+	return &Backend{}
+}
+
+// Name returns the identifier of this backend.
+func (b *Backend) Name() string {
+	return Name
+}
+
+// ListDevices discovers all FIDO2 devices connected to the system.
+func (b *Backend) ListDevices() ([]*types.DeviceInfo, error) {
+	locations, err := fido.DeviceLocations()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]*types.DeviceInfo, len(locations))
+	for i, location := range locations {
+		devices[i] = toDeviceInfo(location, i+1) // 1-based indexing for user display
+	}
+	return devices, nil
+}
+
+// Open returns an Authenticator for the device at the given path.
+// libfido2 opens the device lazily for every operation, so this does not
+// guarantee the device is reachable.
+func (b *Backend) Open(path string) (types.Authenticator, error) {
+	dev, err := fido.NewDevice(path)
+	if err != nil {
+		return nil, err
+	}
+	return &authenticator{dev: dev}, nil
+}
+
+// toDeviceInfo converts a libfido2 device location to our internal DeviceInfo structure.
+// This provides a clean separation between external library types and our internal types.
+func toDeviceInfo(location *fido.DeviceLocation, index int) *types.DeviceInfo {
+	return &types.DeviceInfo{
+		Name:         location.Product,
+		Manufacturer: location.Manufacturer,
+		Path:         location.Path,
+		Index:        index,
+	}
+}
+
+// authenticator implements the types.Authenticator interface for a libfido2 device.
+type authenticator struct {
+	dev *fido.Device
+}
+
+// Info returns the authenticatorGetInfo response of the device.
+// The binding does not expose maxCredentialCount, minPINLength or firmwareVersion,
+// so the firmware version is taken from the CTAPHID device version instead and
+// the other fields are left unknown.
+func (a *authenticator) Info() (*types.AuthenticatorInfo, error) {
+	info, err := a.dev.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	options := make(map[string]bool, len(info.Options))
+	for _, option := range info.Options {
+		options[option.Name] = option.Value == fido.True
+	}
+
+	firmware := ""
+	if hid, err := a.dev.CTAPHIDInfo(); err == nil {
+		firmware = fmt.Sprintf("%d.%d.%d", hid.Major, hid.Minor, hid.Build)
+	}
+
+	return &types.AuthenticatorInfo{
+		Versions:        info.Versions,
+		Extensions:      info.Extensions,
+		AAGUID:          info.AAGUID,
+		Options:         options,
+		PINProtocols:    info.Protocols,
+		FirmwareVersion: firmware,
+	}, nil
+}
+
+// PINRetries returns the number of PIN attempts left.
+func (a *authenticator) PINRetries() (int, error) {
+	return a.dev.RetryCount()
+}
+
+// UVRetries fails: the binding does not expose the UV retry counter of libfido2.
+func (a *authenticator) UVRetries() (int, error) {
+	return 0, errors.New("the libfido2 binding cannot query the UV retry counter")
+}
+
+// SetPIN sets the initial PIN, or changes it if oldPIN is not empty.
+func (a *authenticator) SetPIN(pin, oldPIN string) error {
+	return a.dev.SetPIN(pin, oldPIN)
+}
+
+// MakeCredential creates a new ES256 credential on the device.
+func (a *authenticator) MakeCredential(req *types.MakeCredentialRequest) (*types.Attestation, error) {
+	opts := &fido.MakeCredentialOpts{}
+	if req.HMACSecret {
+		opts.Extensions = []fido.Extension{fido.HMACSecretExtension}
+	}
+	if req.ResidentKey {
+		opts.RK = fido.True
+	}
+
+	attestation, err := a.dev.MakeCredential(
+		req.ClientDataHash,
+		fido.RelyingParty{ID: req.RelyingParty.ID, Name: req.RelyingParty.Name},
+		fido.User{ID: req.User.ID, Name: req.User.Name, DisplayName: req.User.DisplayName},
+		fido.ES256, // Use ES256 algorithm (ECDSA with SHA-256)
+		req.PIN,
+		opts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Attestation{
+		CredentialID: attestation.CredentialID,
+		PublicKey:    attestation.PubKey,
+		AuthData:     attestation.AuthData,
+		Format:       attestation.Format,
+	}, nil
+}
+
+// Assertion performs an assertion with one of the allowed credentials.
+func (a *authenticator) Assertion(req *types.AssertionRequest) (*types.Assertion, error) {
+	// User presence is set explicitly, the device default would require a touch
+	opts := &fido.AssertionOpts{UP: fido.False}
+	if req.HMACSalt != nil {
+		opts.Extensions = []fido.Extension{fido.HMACSecretExtension}
+		opts.HMACSalt = req.HMACSalt
+	}
+	if req.UserPresence {
+		opts.UP = fido.True
+	}
+
+	assertion, err := a.dev.Assertion(req.RelyingPartyID, req.ClientDataHash, req.AllowList, req.PIN, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Assertion{
+		CredentialID: assertion.CredentialID,
+		AuthData:     assertion.AuthDataCBOR,
+		Signature:    assertion.Sig,
+		HMACSecret:   assertion.HMACSecret,
+		User:         types.User{ID: assertion.User.ID, Name: assertion.User.Name, DisplayName: assertion.User.DisplayName},
+	}, nil
+}
+
+// RelyingParties lists the relying parties with resident credentials on the device.
+func (a *authenticator) RelyingParties(pin string) ([]*types.RelyingParty, error) {
+	rps, err := a.dev.RelyingParties(pin)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*types.RelyingParty, len(rps))
+	for i, rp := range rps {
+		result[i] = &types.RelyingParty{ID: rp.ID, Name: rp.Name}
+	}
+	return result, nil
+}
+
+// Credentials lists the resident credentials of a relying party.
+func (a *authenticator) Credentials(rpID string, pin string) ([]*types.DeviceCredential, error) {
+	credentials, err := a.dev.Credentials(rpID, pin)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*types.DeviceCredential, len(credentials))
+	for i, credential := range credentials {
+		result[i] = &types.DeviceCredential{
+			ID:   credential.ID,
+			User: types.User{ID: credential.User.ID, Name: credential.User.Name, DisplayName: credential.User.DisplayName},
+		}
+	}
+	return result, nil
+}
+
+// DeleteCredential removes a resident credential from the device.
+func (a *authenticator) DeleteCredential(credentialID []byte, pin string) error {
+	return a.dev.DeleteCredential(credentialID, pin)
+}
+
+// UpdateUser fails: the binding does not expose updateUserInformation of libfido2.
+func (a *authenticator) UpdateUser(credentialID []byte, user types.User, pin string) error {
+	return errors.New("the libfido2 binding cannot update the user of a resident credential")
+}
+
+// CanUpdateUser reports that UpdateUser is not implemented.
+func (a *authenticator) CanUpdateUser() bool {
+	return false
+}
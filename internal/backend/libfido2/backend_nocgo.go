@@ -0,0 +1,41 @@
+//go:build !cgo
+
+package libfido2
+
+import (
+	"errors"
+
+	"fido2-hmac-deriver/internal/types"
+)
+
+// Name is the identifier used to select this backend.
+const Name = "libfido2"
+
+// errUnavailable is returned by every operation of a build without cgo.
+var errUnavailable = errors.New("the libfido2 backend is not available in this build, which was compiled without cgo\n\nPlease:\n" +
+	"- Rebuild with CGO_ENABLED=1 and the libfido2 development libraries installed\n" +
+	"- Or use --backend=virtual for testing")
+
+// Backend is the stub of the libfido2 backend in builds without cgo. It finds no
+// devices and opens none.
+type Backend struct{}
+
+// New creates the stub of the libfido2 backend.
+func New() *Backend {
+	return &Backend{}
+}
+
+// Name returns the identifier of this backend.
+func (b *Backend) Name() string {
+	return Name
+}
+
+// ListDevices reports that the backend is unavailable.
+func (b *Backend) ListDevices() ([]*types.DeviceInfo, error) {
+	return nil, errUnavailable
+}
+
+// Open reports that the backend is unavailable.
+func (b *Backend) Open(path string) (types.Authenticator, error) {
+	return nil, errUnavailable
+}
@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"fmt"
+
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+)
+
+// EnrollCredential creates a new credential on the device and stores it.
+// The first secret is derived right away, so the record is saved with its check
+// value and the user learns immediately whether the device works as expected.
+//
+// The process involves several steps:
+//  1. Connect to the FIDO2 device and query its identity (AAGUID)
+//  2. Refuse to continue if a credential is already enrolled, unless replace is set
+//  3. Create a resident credential with the HMAC secret extension
+//  4. Derive the first secret and record its check value
+//  5. Save the credential and drop the record of the credential it replaced
+//
+// Parameters:
+//   - device: Information about the FIDO2 device to use
+//   - pin: The device PIN for authentication
+//   - config: Application configuration including relying party details
+//   - replace: Whether an existing credential for this device may be replaced
+//
+// Returns:
+//   - HMACResult for the first secret derived with the new credential
+//   - An error if a credential already exists or any step of the process fails
+func (p *Provider) EnrollCredential(device *types.DeviceInfo, pin string, config *types.Configuration, replace bool) (*types.HMACResult, error) {
+	// Step 1: Connect to the FIDO2 device
+	dev, err := p.connect(device)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 2: Check for an existing credential
+	existing, err := p.findCredential(dev, device, config)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if !replace {
+			return nil, fmt.Errorf("credential %s for relying party '%s' is already enrolled on %s\n\nPlease:\n"+
+				"- Run 'fido2-hmac-deriver derive' to use the existing credential\n"+
+				"- Pass --force to replace it (secrets derived from it can no longer be reproduced)",
+				store.Fingerprint(existing.CredentialID), config.RelyingPartyID, device.Name)
+		}
+		p.ui.DisplayWarning(fmt.Sprintf("Replacing credential %s, secrets derived from it can no longer be reproduced",
+			store.Fingerprint(existing.CredentialID)))
+	}
+
+	// Step 3: Create the credential
+	p.ui.DisplayProgress("Creating FIDO2 credential (please touch your device when it blinks)...")
+	attestation, err := p.createCredential(dev, pin, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create FIDO2 credential: %w", err)
+	}
+	record := p.newCredentialRecord(attestation.CredentialID, device, config)
+
+	// Step 4: Derive the first secret, which records the check value
+	result, _, err := p.derive(dev, device, record, pin, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 5: Save the credential; the device overwrote the resident credential it replaced
+	if err := p.credentials.Save(record); err != nil {
+		return nil, fmt.Errorf("failed to save credential: %w", err)
+	}
+	p.ui.DisplaySuccess(fmt.Sprintf("Enrolled credential %s", store.Fingerprint(record.CredentialID)))
+
+	if existing != nil {
+		if err := p.credentials.Delete(existing); err != nil {
+			p.ui.DisplayError(fmt.Errorf("failed to remove replaced credential: %w", err))
+		}
+	}
+	return result, nil
+}
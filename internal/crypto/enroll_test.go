@@ -0,0 +1,148 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/ui"
+	"fido2-hmac-deriver/internal/virtual"
+)
+
+const testPIN = "123456"
+
+// newTestProvider creates a provider for a virtual authenticator and an empty store.
+func newTestProvider(t *testing.T) (*Provider, *types.DeviceInfo) {
+	t.Helper()
+	auth, err := virtual.New(virtual.Options{Seed: []byte("fido2-hmac-deriver"), PIN: testPIN})
+	if err != nil {
+		t.Fatalf("virtual.New: %v", err)
+	}
+	backend := virtual.NewBackend(auth)
+	devices, err := backend.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	display := ui.NewDisplay()
+	display.SetQuiet(true)
+	return NewProvider(display, backend, store.New(t.TempDir())), devices[0]
+}
+
+func TestEnrollDeriveVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*types.Configuration)
+	}{
+		{"default", func(*types.Configuration) {}},
+		{"context salt", func(c *types.Configuration) {
+			c.SaltMode = types.SaltModeContext
+			c.SaltContext = "work laptop"
+		}},
+		{"second generation", func(c *types.Configuration) { c.SaltGeneration = 1 }},
+		{"other relying party", func(c *types.Configuration) { c.RelyingPartyID = "backup" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, device := newTestProvider(t)
+			config := types.DefaultConfiguration()
+			tt.config(config)
+
+			enrolled, err := p.EnrollCredential(device, testPIN, config, false)
+			if err != nil {
+				t.Fatalf("EnrollCredential: %v", err)
+			}
+			if len(enrolled.Secret) != 32 {
+				t.Fatalf("secret of %d bytes, want 32", len(enrolled.Secret))
+			}
+
+			derived, err := p.DeriveHMACSecret(device, testPIN, config)
+			if err != nil {
+				t.Fatalf("DeriveHMACSecret: %v", err)
+			}
+			if !bytes.Equal(derived.Secret, enrolled.Secret) || !bytes.Equal(derived.Salt, enrolled.Salt) {
+				t.Error("derive does not reproduce the secret of enroll")
+			}
+			if !bytes.Equal(derived.CredentialID, enrolled.CredentialID) {
+				t.Error("derive used another credential")
+			}
+
+			record, err := p.VerifySecret(derived.Secret, config)
+			if err != nil {
+				t.Fatalf("VerifySecret: %v", err)
+			}
+			if !bytes.Equal(record.CredentialID, enrolled.CredentialID) {
+				t.Error("VerifySecret matched another credential")
+			}
+
+			wrong := append([]byte(nil), derived.Secret...)
+			wrong[0] ^= 1
+			if _, err := p.VerifySecret(wrong, config); err == nil {
+				t.Error("VerifySecret accepted a wrong secret")
+			}
+		})
+	}
+}
+
+func TestSaltOptionsChangeTheSecret(t *testing.T) {
+	p, device := newTestProvider(t)
+	config := types.DefaultConfiguration()
+	enrolled, err := p.EnrollCredential(device, testPIN, config, false)
+	if err != nil {
+		t.Fatalf("EnrollCredential: %v", err)
+	}
+
+	next := *config
+	next.SaltGeneration = 1
+	rotated, err := p.DeriveHMACSecret(device, testPIN, &next)
+	if err != nil {
+		t.Fatalf("DeriveHMACSecret of the next generation: %v", err)
+	}
+	if bytes.Equal(rotated.Secret, enrolled.Secret) {
+		t.Error("the next salt generation yields the same secret")
+	}
+
+	withNext := *config
+	withNext.DeriveNextSecret = true
+	both, err := p.DeriveHMACSecret(device, testPIN, &withNext)
+	if err != nil {
+		t.Fatalf("DeriveHMACSecret with the next secret: %v", err)
+	}
+	if !bytes.Equal(both.Secret, enrolled.Secret) || !bytes.Equal(both.NextSecret, rotated.Secret) {
+		t.Error("deriving both secrets in one assertion does not match deriving them separately")
+	}
+}
+
+func TestEnrollRequiresForceToReplace(t *testing.T) {
+	p, device := newTestProvider(t)
+	config := types.DefaultConfiguration()
+	first, err := p.EnrollCredential(device, testPIN, config, false)
+	if err != nil {
+		t.Fatalf("EnrollCredential: %v", err)
+	}
+	if _, err := p.EnrollCredential(device, testPIN, config, false); err == nil {
+		t.Fatal("a second enrollment succeeded without replace")
+	}
+
+	second, err := p.EnrollCredential(device, testPIN, config, true)
+	if err != nil {
+		t.Fatalf("EnrollCredential with replace: %v", err)
+	}
+	if bytes.Equal(first.Secret, second.Secret) {
+		t.Error("the replacing credential yields the same secret")
+	}
+	if _, err := p.VerifySecret(first.Secret, config); err == nil {
+		t.Error("the secret of the replaced credential still verifies")
+	}
+}
+
+func TestDeriveRequiresEnrollment(t *testing.T) {
+	p, device := newTestProvider(t)
+	config := types.DefaultConfiguration()
+	config.DiscoverCredentials = false
+	if _, err := p.DeriveHMACSecret(device, testPIN, config); err == nil {
+		t.Error("DeriveHMACSecret succeeded without an enrolled credential")
+	}
+}
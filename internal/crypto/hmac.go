@@ -4,40 +4,46 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
+	"fido2-hmac-deriver/internal/store"
 	"fido2-hmac-deriver/internal/types"
-
-	"github.com/keys-pub/go-libfido2"
 )
 
 // Provider implements the CryptoProvider interface for FIDO2 HMAC operations.
 // It handles the complete process of creating credentials and deriving HMAC secrets.
 type Provider struct {
-	ui types.UIProvider // UI provider for user interaction and progress updates
+	ui          types.UIProvider      // UI provider for user interaction and progress updates
+	backend     types.Backend         // Backend used to open devices
+	credentials types.CredentialStore // Store for the credentials created on devices
 }
 
-// NewProvider creates a new crypto provider with the given UI provider.
+// NewProvider creates a new crypto provider with the given UI provider, backend and credential store.
 // The UI provider is used to show progress and interact with the user during operations.
-func NewProvider(ui types.UIProvider) *Provider {
+func NewProvider(ui types.UIProvider, backend types.Backend, credentials types.CredentialStore) *Provider {
 	return &Provider{
-		ui: ui,
+		ui:          ui,
+		backend:     backend,
+		credentials: credentials,
 	}
 }
 
-// DeriveHMACSecret performs the complete HMAC secret derivation process.
-// This is the main function that orchestrates the entire FIDO2 HMAC derivation workflow.
+// DeriveHMACSecret derives the HMAC secret from the credential enrolled on the device.
+// This is the main function that orchestrates the FIDO2 HMAC derivation workflow;
+// credentials are created by EnrollCredential.
 //
 // The process involves several steps:
-//  1. Connect to the FIDO2 device
-//  2. Generate a random salt for HMAC derivation
-//  3. Create a new FIDO2 credential with HMAC secret extension
-//  4. Use the credential to derive an HMAC secret
+//  1. Connect to the FIDO2 device and query its identity (AAGUID)
+//  2. Find the stored credential for this device
+//  3. Generate a deterministic salt and derive the HMAC secret with the credential
+//  4. Record the check value and the salt mode if a legacy credential was migrated
 //  5. Return all the derivation results
 //
 // Parameters:
@@ -47,56 +53,91 @@ func NewProvider(ui types.UIProvider) *Provider {
 //
 // Returns:
 //   - HMACResult containing the derived secret and metadata
-//   - An error if any step of the process fails
+//   - An error if no credential is enrolled or any step of the process fails
 func (p *Provider) DeriveHMACSecret(device *types.DeviceInfo, pin string, config *types.Configuration) (*types.HMACResult, error) {
 	// Step 1: Connect to the FIDO2 device
-	p.ui.DisplayProgress("Connecting to FIDO2 device...")
-	dev, err := libfido2.NewDevice(device.Path)
+	dev, err := p.connect(device)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to device %s: %w\n\nTroubleshooting:\n"+
-			"- Ensure the device is still connected\n"+
-			"- Check that no other application is using the device\n"+
-			"- Try unplugging and reconnecting the device", device.Name, err)
+		return nil, err
 	}
 
-	// Step 2: Generate a deterministic salt for HMAC derivation
-	p.ui.DisplayProgress("Generating deterministic salt...")
-	salt, err := p.generateDeterministicSalt(config.SaltSize, device, config)
+	// Step 2: Find the stored credential for this device
+	record, err := p.findCredential(dev, device, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate salt: %w", err)
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("no credential for relying party '%s' is enrolled on %s\n\nPlease:\n"+
+			"- Run 'fido2-hmac-deriver enroll' to create a credential on this device\n"+
+			"- Check that --store-dir points to the credential store used for enrollment\n"+
+			"- Run 'fido2-hmac-deriver credentials list' to see the stored credentials",
+			config.RelyingPartyID, device.Name)
 	}
+	p.ui.DisplayProgress(fmt.Sprintf("Using stored credential %s...", store.Fingerprint(record.CredentialID)))
+	storedMode := record.SaltMode
 
-	// Step 3: Try to load existing credential or create a new one
-	var credentialID []byte
-	existingCredentialID, err := p.loadCredentialID(device, config)
+	// Step 3: Derive the HMAC secret using the credential
+	result, changed, err := p.derive(dev, device, record, pin, config)
 	if err != nil {
-		// No existing credential found, create a new one
-		p.ui.DisplayProgress("Creating FIDO2 credential (please touch your device when it blinks)...")
-		attestation, err := p.createCredential(dev, pin, config)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create FIDO2 credential: %w", err)
-		}
-		credentialID = attestation.CredentialID
+		return nil, err
+	}
 
-		// Save the credential ID for future use
-		err = p.saveCredentialID(credentialID, device, config)
-		if err != nil {
-			p.ui.DisplayError(fmt.Errorf("failed to save credential ID: %w", err))
+	// Step 4: Record the check value and the salt mode if a legacy credential was migrated
+	if storedMode == types.SaltModeLegacyPath && result.SaltMode != types.SaltModeLegacyPath {
+		record.SaltMode = result.SaltMode
+		changed = true
+	}
+	if changed {
+		if err := p.credentials.Save(record); err != nil {
+			p.ui.DisplayError(fmt.Errorf("failed to update credential record: %w", err))
 		}
-	} else {
-		// Use existing credential
-		credentialID = existingCredentialID
-		p.ui.DisplayProgress("Using existing credential...")
 	}
 
-	// Step 4: Derive the HMAC secret using the credential
+	// Step 5: Return the result
+	p.ui.DisplaySuccess("HMAC secret derived successfully!")
+	return result, nil
+}
+
+// DeriveHMACSecretWithSalt derives the HMAC secret of a given credential for an
+// explicit salt, such as the ones recorded in the header of an encrypted file. The
+// salt is used as is, so the salt options of the configuration do not apply.
+//
+// The credential does not have to be in the credential store, since the device
+// only needs its ID. If it is stored, the secret is compared with the check value
+// recorded for the salt.
+//
+// Parameters:
+//   - device: Information about the FIDO2 device to use
+//   - pin: The device PIN for authentication
+//   - config: Application configuration including the relying party
+//   - credentialID: The credential to derive the secret with
+//   - salt: The salt to derive the secret for
+//
+// Returns:
+//   - HMACResult containing the derived secret and metadata
+//   - An error if the device does not hold the credential or derivation fails
+func (p *Provider) DeriveHMACSecretWithSalt(device *types.DeviceInfo, pin string, config *types.Configuration, credentialID, salt []byte) (*types.HMACResult, error) {
+	dev, err := p.connect(device)
+	if err != nil {
+		return nil, err
+	}
+
+	// Probe first, so a wrong device is reported before the user has to touch it
+	candidate := &types.CredentialRecord{CredentialID: credentialID}
+	if p.probeCredential(dev, []*types.CredentialRecord{candidate}, config) == nil {
+		return nil, fmt.Errorf("credential %s for relying party '%s' is not on %s\n\nPlease:\n"+
+			"- Connect the device the data was encrypted with\n"+
+			"- Run 'fido2-hmac-deriver credentials list' to see the stored credentials",
+			store.Fingerprint(credentialID), config.RelyingPartyID, device.Name)
+	}
+	p.ui.DisplayProgress(fmt.Sprintf("Using credential %s...", store.Fingerprint(credentialID)))
+
 	p.ui.DisplayProgress("Deriving HMAC secret (please touch your device when it blinks)...")
-	secret, err := p.deriveSecret(dev, credentialID, salt, pin, config)
+	secret, _, err := p.deriveSecret(dev, credentialID, salt, nil, pin, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to derive HMAC secret: %w", err)
 	}
 
-	// Step 5: Create and return the result
 	result := &types.HMACResult{
 		Secret:       secret,
 		Salt:         salt,
@@ -106,28 +147,222 @@ func (p *Provider) DeriveHMACSecret(device *types.DeviceInfo, pin string, config
 		RelyingParty: config.RelyingPartyID,
 	}
 
+	records, err := p.credentials.Find(device.AAGUID, config.RelyingPartyID)
+	if err != nil {
+		p.ui.DisplayError(fmt.Errorf("failed to read credential store: %w", err))
+	}
+	for _, record := range records {
+		if !bytes.Equal(record.CredentialID, credentialID) {
+			continue
+		}
+		result.SaltMode = record.SaltMode
+		if matches, known := checkSecret(record, salt, secret); known && !matches {
+			p.ui.DisplayWarning("The derived secret does not match the check value recorded for this credential.\n" +
+				"    The device may have been reset, or user verification settings have changed.")
+		}
+	}
+
 	p.ui.DisplaySuccess("HMAC secret derived successfully!")
 	return result, nil
 }
 
-// generateSalt creates a deterministic salt based on device and relying party.
+// FindCredential checks which of the given credentials the device holds, with an
+// assertion without user presence, so neither the PIN nor a touch is needed.
+//
+// Parameters:
+//   - device: Information about the FIDO2 device to check
+//   - config: Application configuration including the relying party
+//   - credentialIDs: The candidate credentials of the relying party
+//
+// Returns:
+//   - The ID of the credential the device holds, or nil if it holds none of them
+//   - An error if the device cannot be opened
+func (p *Provider) FindCredential(device *types.DeviceInfo, config *types.Configuration, credentialIDs [][]byte) ([]byte, error) {
+	if len(credentialIDs) == 0 {
+		return nil, nil
+	}
+	dev, err := p.connect(device)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]*types.CredentialRecord, len(credentialIDs))
+	for i, credentialID := range credentialIDs {
+		candidates[i] = &types.CredentialRecord{CredentialID: credentialID}
+	}
+	if record := p.probeCredential(dev, candidates, config); record != nil {
+		return record.CredentialID, nil
+	}
+	return nil, nil
+}
+
+// connect opens the device and queries its identity (AAGUID), which the
+// credential store and the identity salt are keyed by.
+func (p *Provider) connect(device *types.DeviceInfo) (types.Authenticator, error) {
+	p.ui.DisplayProgress("Connecting to FIDO2 device...")
+	dev, err := p.backend.Open(device.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to device %s: %w\n\nTroubleshooting:\n"+
+			"- Ensure the device is still connected\n"+
+			"- Check that no other application is using the device\n"+
+			"- Try unplugging and reconnecting the device", device.Name, err)
+	}
+
+	info, err := dev.Info()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device %s: %w", device.Name, err)
+	}
+	device.AAGUID = info.AAGUID
+	return dev, nil
+}
+
+// derive generates the deterministic salt for a credential and derives its HMAC secret.
+// The check value of the secret is compared with the one stored in the record, or
+// added to the record if it has none for this salt yet.
+//
+// Returns:
+//   - HMACResult containing the derived secret and metadata
+//   - Whether the record was changed and needs to be saved
+//   - An error if salt generation or derivation fails
+func (p *Provider) derive(dev types.Authenticator, device *types.DeviceInfo, record *types.CredentialRecord, pin string, config *types.Configuration) (*types.HMACResult, bool, error) {
+	saltMode := p.resolveSaltMode(config, record.SaltMode)
+	if saltMode == types.SaltModeLegacyPath && config.SaltMode == types.SaltModeAuto {
+		p.ui.DisplayInfo("This credential was created with the legacy path-based salt, so its secret changes\n" +
+			"    whenever the device path changes. Pass --salt-mode=identity to migrate to a salt\n" +
+			"    bound to the authenticator itself (this yields a new secret, re-encrypt your data first).")
+	}
+
+	p.ui.DisplayProgress("Generating deterministic salt...")
+	salt, err := p.salt(saltMode, device, record.CredentialID, config, config.SaltGeneration)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	// The next generation's salt is sent along, so both secrets take a single touch
+	var nextSalt []byte
+	if config.DeriveNextSecret {
+		nextSalt, err = p.salt(saltMode, device, record.CredentialID, config, config.SaltGeneration+1)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to generate salt: %w", err)
+		}
+	}
+
+	p.ui.DisplayProgress("Deriving HMAC secret (please touch your device when it blinks)...")
+	secret, nextSecret, err := p.deriveSecret(dev, record.CredentialID, salt, nextSalt, pin, config)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to derive HMAC secret: %w", err)
+	}
+
+	changed := false
+	switch matches, known := checkSecret(record, salt, secret); {
+	case !known:
+		setCheckValue(record, salt, secret)
+		changed = true
+	case !matches:
+		p.ui.DisplayWarning("The derived secret does not match the check value recorded for this credential.\n" +
+			"    The device may have been reset, or user verification settings have changed.")
+	}
+	if nextSecret != nil {
+		if _, known := checkSecret(record, nextSalt, nextSecret); !known {
+			setCheckValue(record, nextSalt, nextSecret)
+			changed = true
+		}
+	}
+
+	return &types.HMACResult{
+		Secret:         secret,
+		Salt:           salt,
+		NextSecret:     nextSecret,
+		NextSalt:       nextSalt,
+		SaltGeneration: config.SaltGeneration,
+		CredentialID:   record.CredentialID,
+		Device:         device,
+		Timestamp:      time.Now(),
+		RelyingParty:   config.RelyingPartyID,
+		SaltMode:       saltMode,
+	}, changed, nil
+}
+
+// salt builds the deterministic salt of a salt generation (see saltInput).
+func (p *Provider) salt(mode types.SaltMode, device *types.DeviceInfo, credentialID []byte, config *types.Configuration, generation int) ([]byte, error) {
+	saltInput, err := p.saltInput(mode, device, credentialID, config)
+	if err != nil {
+		return nil, err
+	}
+	if generation > 0 {
+		// Generation 0 keeps the salt input unchanged, so secrets from before rotation stay valid
+		saltInput = fmt.Sprintf("%s:generation=%d", saltInput, generation)
+	}
+	return p.generateDeterministicSalt(config.SaltSize, saltInput)
+}
+
+// resolveSaltMode determines the salt mode to use for a derivation.
+// An explicitly configured mode always wins; otherwise a context label selects
+// SaltModeContext and the mode recorded with the credential is used.
+func (p *Provider) resolveSaltMode(config *types.Configuration, storedMode types.SaltMode) types.SaltMode {
+	if config.SaltMode != types.SaltModeAuto {
+		return config.SaltMode
+	}
+	if config.SaltContext != "" {
+		return types.SaltModeContext
+	}
+	return storedMode
+}
+
+// saltInput builds the string that is hashed into the deterministic salt.
+// Every mode uses a distinct prefix so that the salts of different modes never collide.
+//
+// Parameters:
+//   - mode: The salt mode to build the input for
+//   - device: Device information, providing the AAGUID and path
+//   - credentialID: The credential the salt is used with
+//   - config: Configuration containing relying party information and the context label
+//
+// Returns:
+//   - The salt input string
+//   - An error if the inputs required by the mode are missing
+func (p *Provider) saltInput(mode types.SaltMode, device *types.DeviceInfo, credentialID []byte, config *types.Configuration) (string, error) {
+	switch mode {
+	case types.SaltModeIdentity:
+		if len(device.AAGUID) == 0 || len(credentialID) == 0 {
+			return "", fmt.Errorf("device AAGUID and credential ID are required for the identity salt")
+		}
+		return fmt.Sprintf("fido2-hmac-deriver:v2:identity:%s:%s:%s",
+			config.RelyingPartyID, hex.EncodeToString(device.AAGUID), hex.EncodeToString(credentialID)), nil
+
+	case types.SaltModeContext:
+		if config.SaltContext == "" {
+			return "", fmt.Errorf("a salt context label is required for the context salt (pass --salt-context)")
+		}
+		return fmt.Sprintf("fido2-hmac-deriver:v2:context:%s:%s", config.RelyingPartyID, config.SaltContext), nil
+
+	case types.SaltModeLegacyPath:
+		// Kept byte-for-byte identical to earlier releases so existing secrets can be reproduced
+		path := device.Path
+		if config.LegacySaltPath != "" {
+			path = config.LegacySaltPath
+		}
+		return fmt.Sprintf("%s:%s", path, config.RelyingPartyID), nil
+
+	default:
+		return "", fmt.Errorf("unknown salt mode '%s'", mode)
+	}
+}
+
+// generateDeterministicSalt creates a deterministic salt from the given salt input.
 // For deterministic key derivation, the salt must be the same for the same device
 // and relying party combination. This ensures repeatable results.
 //
 // Parameters:
 //   - size: The size of the salt in bytes (typically 32 for 256-bit security)
-//   - device: Device information to include in salt derivation
-//   - config: Configuration containing relying party information
+//   - saltInput: The string to derive the salt from (see saltInput)
 //
 // Returns:
 //   - A byte slice containing the deterministic salt
 //   - An error if salt generation fails
-func (p *Provider) generateDeterministicSalt(size int, device *types.DeviceInfo, config *types.Configuration) ([]byte, error) {
-	// Create a deterministic salt by hashing device path + relying party ID
-	// This ensures the same device + same relying party = same salt = same key
-	saltInput := fmt.Sprintf("%s:%s", device.Path, config.RelyingPartyID)
-
+func (p *Provider) generateDeterministicSalt(size int, saltInput string) ([]byte, error) {
 	// Use SHA-256 to create a deterministic hash
+	// This ensures the same salt input = same salt = same key
 	hash := sha256.Sum256([]byte(saltInput))
 
 	// If we need more than 32 bytes, we can extend by hashing again
@@ -170,7 +405,7 @@ func (p *Provider) generateDeterministicSalt(size int, device *types.DeviceInfo,
 // Returns:
 //   - The created attestation
 //   - An error if credential creation fails
-func (p *Provider) createCredential(dev *libfido2.Device, pin string, config *types.Configuration) (*libfido2.Attestation, error) {
+func (p *Provider) createCredential(dev types.Authenticator, pin string, config *types.Configuration) (*types.Attestation, error) {
 	// Generate a deterministic client data hash based on relying party ID
 	// This ensures the same credential is created each time for the same RP
 	clientDataInput := fmt.Sprintf("fido2-hmac-credential:%s", config.RelyingPartyID)
@@ -179,14 +414,14 @@ func (p *Provider) createCredential(dev *libfido2.Device, pin string, config *ty
 
 	// Set up the relying party information
 	// This identifies our application to the FIDO2 device
-	relyingParty := libfido2.RelyingParty{
+	relyingParty := types.RelyingParty{
 		ID:   config.RelyingPartyID,
 		Name: config.RelyingPartyName,
 	}
 
 	// Set up the user information
 	// This represents the user account for which we're creating the credential
-	user := libfido2.User{
+	user := types.User{
 		ID:          config.UserID,
 		Name:        config.UserName,
 		DisplayName: config.UserDisplayName,
@@ -194,17 +429,14 @@ func (p *Provider) createCredential(dev *libfido2.Device, pin string, config *ty
 
 	// Create the credential with HMAC secret extension
 	// The HMAC secret extension is crucial - it enables HMAC secret derivation
-	credential, err := dev.MakeCredential(
-		clientDataHash,
-		relyingParty,
-		user,
-		libfido2.ES256, // Use ES256 algorithm (ECDSA with SHA-256)
-		pin,
-		&libfido2.MakeCredentialOpts{
-			Extensions: []libfido2.Extension{libfido2.HMACSecretExtension}, // Enable HMAC secret extension
-			RK:         libfido2.True,                                      // Enable resident key (stores credential on device)
-		},
-	)
+	credential, err := dev.MakeCredential(&types.MakeCredentialRequest{
+		ClientDataHash: clientDataHash,
+		RelyingParty:   relyingParty,
+		User:           user,
+		PIN:            pin,
+		HMACSecret:     true, // Enable HMAC secret extension
+		ResidentKey:    true, // Enable resident key (stores credential on device)
+	})
 
 	if err != nil {
 		return nil, fmt.Errorf("credential creation failed: %w\n\nPossible causes:\n"+
@@ -221,37 +453,48 @@ func (p *Provider) createCredential(dev *libfido2.Device, pin string, config *ty
 // This function performs the actual HMAC secret derivation using the FIDO2
 // assertion operation with the HMAC secret extension.
 //
+// The hmac-secret extension accepts one or two 32-byte salts and returns one
+// output per salt. If nextSalt is given, both salts are sent in the same
+// assertion, so the current and the next secret take a single touch.
+//
 // Parameters:
 //   - dev: The FIDO2 device to use
 //   - credentialID: The ID of the credential to use for derivation
 //   - salt: The salt to use for HMAC derivation
+//   - nextSalt: The salt of the next generation, or nil
 //   - pin: The device PIN for authentication
 //   - config: Application configuration
 //
 // Returns:
 //   - The derived HMAC secret as a byte slice
+//   - The secret for nextSalt, or nil if no next salt was given
 //   - An error if derivation fails
-func (p *Provider) deriveSecret(dev *libfido2.Device, credentialID, salt []byte, pin string, config *types.Configuration) ([]byte, error) {
+func (p *Provider) deriveSecret(dev types.Authenticator, credentialID, salt, nextSalt []byte, pin string, config *types.Configuration) ([]byte, []byte, error) {
+	hmacSalt := salt
+	if nextSalt != nil {
+		if len(salt) != 32 || len(nextSalt) != 32 {
+			return nil, nil, fmt.Errorf("two hmac-secret salts must be 32 bytes each, got %d and %d", len(salt), len(nextSalt))
+		}
+		hmacSalt = append(append(make([]byte, 0, 64), salt...), nextSalt...)
+	}
+
 	// Create a client data hash from the salt
 	// This links the salt to the FIDO2 operation
 	clientDataHash := sha256.Sum256(salt)
 
 	// Perform the FIDO2 assertion with HMAC secret extension
 	// This is where the actual HMAC secret derivation happens
-	assertion, err := dev.Assertion(
-		config.RelyingPartyID,
-		clientDataHash[:],
-		[][]byte{credentialID}, // Use the credential we just created
-		pin,
-		&libfido2.AssertionOpts{
-			Extensions: []libfido2.Extension{libfido2.HMACSecretExtension}, // Enable HMAC secret extension
-			HMACSalt:   salt,                                               // Provide the salt for HMAC derivation
-			UP:         libfido2.True,                                      // Require user presence (touch)
-		},
-	)
+	assertion, err := dev.Assertion(&types.AssertionRequest{
+		RelyingPartyID: config.RelyingPartyID,
+		ClientDataHash: clientDataHash[:],
+		AllowList:      [][]byte{credentialID}, // Use the credential we just created
+		PIN:            pin,
+		HMACSalt:       hmacSalt, // Provide the salt(s) for HMAC derivation
+		UserPresence:   true,     // Require user presence (touch)
+	})
 
 	if err != nil {
-		return nil, fmt.Errorf("HMAC secret derivation failed: %w\n\nPossible causes:\n"+
+		return nil, nil, fmt.Errorf("HMAC secret derivation failed: %w\n\nPossible causes:\n"+
 			"- Incorrect PIN entered\n"+
 			"- User didn't touch the device when prompted\n"+
 			"- Credential is not valid or has been removed\n"+
@@ -260,13 +503,20 @@ func (p *Provider) deriveSecret(dev *libfido2.Device, credentialID, salt []byte,
 
 	// Validate that we actually got an HMAC secret
 	if len(assertion.HMACSecret) == 0 {
-		return nil, fmt.Errorf("device returned empty HMAC secret\n\nThis may indicate:\n" +
+		return nil, nil, fmt.Errorf("device returned empty HMAC secret\n\nThis may indicate:\n" +
 			"- The device doesn't properly support HMAC secret extension\n" +
 			"- The credential wasn't created with HMAC secret extension\n" +
 			"- A device firmware issue")
 	}
 
-	return assertion.HMACSecret, nil
+	if nextSalt == nil {
+		return assertion.HMACSecret, nil, nil
+	}
+	if len(assertion.HMACSecret) != 64 {
+		return nil, nil, fmt.Errorf("device returned %d bytes of HMAC secret for two salts, expected 64\n\n"+
+			"The device may not support two hmac-secret salts in one assertion", len(assertion.HMACSecret))
+	}
+	return assertion.HMACSecret[:32], assertion.HMACSecret[32:], nil
 }
 
 // ValidateConfiguration checks if the provided configuration is valid.
@@ -306,61 +556,190 @@ func (p *Provider) ValidateConfiguration(config *types.Configuration) error {
 		return fmt.Errorf("salt size should be at least 16 bytes for security, got %d", config.SaltSize)
 	}
 
+	if config.SaltGeneration < 0 {
+		return fmt.Errorf("salt generation cannot be negative, got %d", config.SaltGeneration)
+	}
+
+	if config.DeriveNextSecret && config.SaltSize != 32 {
+		return fmt.Errorf("deriving the next secret requires 32-byte salts, got %d", config.SaltSize)
+	}
+
+	switch config.SaltMode {
+	case types.SaltModeAuto, types.SaltModeIdentity, types.SaltModeLegacyPath:
+	case types.SaltModeContext:
+		if config.SaltContext == "" {
+			return fmt.Errorf("salt mode '%s' requires a salt context label", config.SaltMode)
+		}
+	default:
+		return fmt.Errorf("unknown salt mode '%s' (expected %s, %s or %s)", config.SaltMode,
+			types.SaltModeIdentity, types.SaltModeContext, types.SaltModeLegacyPath)
+	}
+
 	return nil
 }
 
-// getCredentialFilename generates a filename for storing credential ID based on device and config.
-// Uses the first 16 characters of the base64-encoded credential ID as requested.
-func (p *Provider) getCredentialFilename(credentialID []byte) string {
-	base64Cred := base64.StdEncoding.EncodeToString(credentialID)
-	if len(base64Cred) > 16 {
-		base64Cred = base64Cred[:16]
-	}
-	// Replace characters that might be problematic in filenames
-	filename := strings.ReplaceAll(base64Cred, "/", "_")
-	filename = strings.ReplaceAll(filename, "+", "-")
-	return filename + ".cred"
+// findCredential looks up the stored credential that belongs to the device.
+// Several devices of the same model share an AAGUID, so all records for the model
+// and relying party are offered to the device in a silent assertion (no touch
+// required) and the one it recognises is used. If the store has no candidates,
+// credential files written by earlier releases are imported from the current directory.
+// If none of them is on the device either, the resident credential is discovered on
+// the device itself (see discoverCredential) and added to the store.
+//
+// Returns:
+//   - The credential record, or nil if the device has no known credential
+//   - An error if the credential store cannot be read or written
+func (p *Provider) findCredential(dev types.Authenticator, device *types.DeviceInfo, config *types.Configuration) (*types.CredentialRecord, error) {
+	records, err := p.credentials.Find(device.AAGUID, config.RelyingPartyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential store: %w", err)
+	}
+
+	imported := false
+	if len(records) == 0 {
+		records = p.legacyCredentials(device, config)
+		imported = true
+	}
+
+	if len(records) > 0 {
+		if record := p.probeCredential(dev, records, config); record != nil {
+			if imported {
+				if err := p.credentials.Save(record); err != nil {
+					return nil, fmt.Errorf("failed to import legacy credential: %w", err)
+				}
+				p.ui.DisplayInfo(fmt.Sprintf("Imported legacy credential file into the credential store as %s", store.Fingerprint(record.CredentialID)))
+			}
+			return record, nil
+		}
+	}
+
+	if !config.DiscoverCredentials {
+		return nil, nil
+	}
+	record := p.discoverCredential(dev, device, config)
+	if record == nil {
+		return nil, nil
+	}
+	if err := p.credentials.Save(record); err != nil {
+		return nil, fmt.Errorf("failed to store discovered credential: %w", err)
+	}
+	p.ui.DisplayInfo(fmt.Sprintf("Found credential %s on %s and added it to the credential store", store.Fingerprint(record.CredentialID), device.Name))
+	return record, nil
 }
 
-// saveCredentialID saves a credential ID to a file in the current directory.
-func (p *Provider) saveCredentialID(credentialID []byte, device *types.DeviceInfo, config *types.Configuration) error {
-	filename := p.getCredentialFilename(credentialID)
-	credentialData := base64.StdEncoding.EncodeToString(credentialID)
+// discoverCredential asks the device for its resident credential of the relying
+// party, with a silent assertion without an allow list. This finds a credential
+// enrolled on another machine, so a machine without its record derives the same
+// secret. Enrollment always uses the same user, so the device holds at most one
+// resident credential of the relying party for it.
+func (p *Provider) discoverCredential(dev types.Authenticator, device *types.DeviceInfo, config *types.Configuration) *types.CredentialRecord {
+	clientDataHash := sha256.Sum256([]byte("fido2-hmac-discover:" + config.RelyingPartyID))
+	assertion, err := dev.Assertion(&types.AssertionRequest{
+		RelyingPartyID: config.RelyingPartyID,
+		ClientDataHash: clientDataHash[:],
+		UserPresence:   false, // Silent check, the user does not need to touch the device
+	})
+	if err != nil || len(assertion.CredentialID) == 0 {
+		return nil
+	}
+	if userID := assertion.User.ID; len(userID) > 0 && !bytes.Equal(userID, config.UserID) {
+		return nil
+	}
 
-	err := os.WriteFile(filename, []byte(credentialData), 0644)
+	record := p.newCredentialRecord(assertion.CredentialID, device, config)
+	if assertion.User.Name != "" {
+		record.UserName = assertion.User.Name
+	}
+	if assertion.User.DisplayName != "" {
+		record.UserDisplayName = assertion.User.DisplayName
+	}
+	return record
+}
+
+// probeCredential performs an assertion without user presence to find out which of
+// the candidate credentials the device holds.
+func (p *Provider) probeCredential(dev types.Authenticator, records []*types.CredentialRecord, config *types.Configuration) *types.CredentialRecord {
+	allowList := make([][]byte, len(records))
+	for i, record := range records {
+		allowList[i] = record.CredentialID
+	}
+
+	clientDataHash := sha256.Sum256([]byte("fido2-hmac-probe:" + config.RelyingPartyID))
+	assertion, err := dev.Assertion(&types.AssertionRequest{
+		RelyingPartyID: config.RelyingPartyID,
+		ClientDataHash: clientDataHash[:],
+		AllowList:      allowList,
+		UserPresence:   false, // Silent check, the user does not need to touch the device
+	})
 	if err != nil {
-		return fmt.Errorf("failed to save credential ID to %s: %w", filename, err)
+		return nil
 	}
 
-	p.ui.DisplayInfo(fmt.Sprintf("Saved credential ID to %s", filename))
+	for _, record := range records {
+		if bytes.Equal(record.CredentialID, assertion.CredentialID) {
+			return record
+		}
+	}
+	if len(records) == 1 && len(assertion.CredentialID) == 0 {
+		// Some devices omit the credential ID if the allow list has a single entry
+		return records[0]
+	}
 	return nil
 }
 
-// loadCredentialID attempts to load an existing credential ID from file.
-func (p *Provider) loadCredentialID(device *types.DeviceInfo, config *types.Configuration) ([]byte, error) {
-	// We need to find the credential file by trying to match device/config combination
-	// For now, we'll look for any .cred files and try to use them
+// newCredentialRecord creates the record for a freshly created credential.
+func (p *Provider) newCredentialRecord(credentialID []byte, device *types.DeviceInfo, config *types.Configuration) *types.CredentialRecord {
+	return &types.CredentialRecord{
+		CredentialID:     credentialID,
+		AAGUID:           device.AAGUID,
+		RelyingPartyID:   config.RelyingPartyID,
+		RelyingPartyName: config.RelyingPartyName,
+		UserName:         config.UserName,
+		UserDisplayName:  config.UserDisplayName,
+		Algorithm:        "es256",
+		SaltMode:         p.resolveSaltMode(config, types.SaltModeIdentity),
+		DeviceName:       device.Name,
+		CreatedAt:        time.Now(),
+	}
+}
+
+// legacyCredentials reads the .cred files earlier releases wrote to the current directory.
+// The first line holds the base64-encoded credential ID; files without a second
+// "salt-mode=" line predate salt modes and use the legacy path-based salt.
+// The files carry no device or relying party information, so the caller has to
+// check which of them belong to the device.
+func (p *Provider) legacyCredentials(device *types.DeviceInfo, config *types.Configuration) []*types.CredentialRecord {
 	files, err := os.ReadDir(".")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read current directory: %w", err)
+		return nil
 	}
 
+	var records []*types.CredentialRecord
 	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".cred") {
-			data, err := os.ReadFile(file.Name())
-			if err != nil {
-				continue
-			}
+		if !strings.HasSuffix(file.Name(), ".cred") {
+			continue
+		}
 
-			credentialID, err := base64.StdEncoding.DecodeString(string(data))
-			if err != nil {
-				continue
-			}
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			continue
+		}
 
-			p.ui.DisplayInfo(fmt.Sprintf("Found existing credential in %s", file.Name()))
-			return credentialID, nil
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		credentialID, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[0]))
+		if err != nil {
+			continue
 		}
-	}
 
-	return nil, fmt.Errorf("no existing credential found")
+		record := p.newCredentialRecord(credentialID, device, config)
+		record.SaltMode = types.SaltModeLegacyPath
+		if len(lines) > 1 {
+			record.SaltMode = types.SaltMode(strings.TrimPrefix(strings.TrimSpace(lines[1]), "salt-mode="))
+		}
+		if info, err := file.Info(); err == nil {
+			record.CreatedAt = info.ModTime()
+		}
+		records = append(records, record)
+	}
+	return records
 }
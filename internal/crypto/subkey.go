@@ -0,0 +1,186 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"fido2-hmac-deriver/internal/types"
+)
+
+// DefaultSubkeyLength is the length of a subkey if none is requested.
+const DefaultSubkeyLength = 32
+
+// DeriveSubkeys derives subkeys from an HMAC secret with HKDF (RFC 5869).
+// The secret is used as input keying material without a salt, since it is already
+// uniformly random, and the label of each request is the info parameter. The
+// subkeys can therefore be reproduced with any HKDF implementation.
+//
+// Parameters:
+//   - secret: The HMAC secret derived from the device
+//   - requests: The subkeys to derive; labels must be unique
+//
+// Returns:
+//   - The subkeys in the order of the requests
+//   - An error if a request is invalid
+func (p *Provider) DeriveSubkeys(secret []byte, requests []types.SubkeyRequest) ([]types.Subkey, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("cannot derive subkeys from an empty secret")
+	}
+
+	if err := ValidateSubkeyRequests(requests); err != nil {
+		return nil, err
+	}
+
+	subkeys := make([]types.Subkey, 0, len(requests))
+	for _, request := range requests {
+		key, err := hkdfKey(request.Hash, secret, request.Label, request.Length)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive subkey '%s': %w", request.Label, err)
+		}
+		subkeys = append(subkeys, types.Subkey{Label: request.Label, Hash: request.Hash, Key: key})
+	}
+	return subkeys, nil
+}
+
+// ValidateSubkeyRequests checks subkey requests without deriving anything, so
+// invalid requests are rejected before the user has to touch the device.
+func ValidateSubkeyRequests(requests []types.SubkeyRequest) error {
+	labels := make(map[string]bool, len(requests))
+	for _, request := range requests {
+		if request.Label == "" {
+			return fmt.Errorf("subkey label cannot be empty")
+		}
+		if labels[request.Label] {
+			return fmt.Errorf("subkey label '%s' is requested twice, the keys would be identical", request.Label)
+		}
+		labels[request.Label] = true
+
+		var size int
+		switch request.Hash {
+		case types.SubkeyHashSHA256:
+			size = sha256.Size
+		case types.SubkeyHashSHA512:
+			size = sha512.Size
+		default:
+			return fmt.Errorf("unknown hash function '%s' for subkey '%s' (expected %s or %s)",
+				request.Hash, request.Label, types.SubkeyHashSHA256, types.SubkeyHashSHA512)
+		}
+		if request.Length <= 0 || request.Length > 255*size {
+			return fmt.Errorf("subkey '%s' length must be between 1 and %d bytes for %s, got %d",
+				request.Label, 255*size, request.Hash, request.Length)
+		}
+	}
+	return nil
+}
+
+// hkdfKey runs HKDF with the given hash function over the secret.
+func hkdfKey(hash types.SubkeyHash, secret []byte, info string, length int) ([]byte, error) {
+	switch hash {
+	case types.SubkeyHashSHA256:
+		return hkdf.Key(sha256.New, secret, nil, info, length)
+	case types.SubkeyHashSHA512:
+		return hkdf.Key(sha512.New, secret, nil, info, length)
+	default:
+		return nil, fmt.Errorf("unknown hash function '%s' (expected %s or %s)", hash, types.SubkeyHashSHA256, types.SubkeyHashSHA512)
+	}
+}
+
+// ParseSubkeyRequest parses a subkey specification of the form
+// label[,length=N][,hash=H], e.g. "git-crypt", "mac,length=64" or
+// "encryption,length=32,hash=sha512". The label is everything before the first
+// comma and may contain colons, but no commas.
+//
+// Labels ending in ":<number>" or ":<hash>" are rejected, since earlier releases
+// read such parts as the length and hash; requesting them as part of the label
+// would silently derive different keys.
+//
+// Parameters:
+//   - spec: The subkey specification
+//   - hash: The hash function used if the specification names none
+//
+// Returns:
+//   - The parsed SubkeyRequest
+//   - An error if the specification is malformed or ambiguous
+func ParseSubkeyRequest(spec string, hash types.SubkeyHash) (types.SubkeyRequest, error) {
+	request := types.SubkeyRequest{Length: DefaultSubkeyLength, Hash: hash}
+
+	label, options, hasOptions := strings.Cut(spec, ",")
+	if label == "" {
+		return request, fmt.Errorf("invalid subkey '%s': the label cannot be empty", spec)
+	}
+	if i := strings.LastIndex(label, ":"); i >= 0 {
+		if suffix := label[i+1:]; isHashName(suffix) || isNumber(suffix) {
+			hint := fmt.Sprintf("Write '%s' to derive the key earlier releases derived for it", explicitSubkeySpec(label))
+			if explicitSubkeySpec(label) == label {
+				// Earlier releases kept a hash without a length in the label
+				hint = fmt.Sprintf("Write '%s,hash=%s' to use %s, or choose a label without this ending", label[:i], suffix, suffix)
+			}
+			return request, fmt.Errorf("invalid subkey '%s': the label ends in ':%s', which is ambiguous with the\n"+
+				"label[:length[:hash]] syntax of earlier releases\n\nPlease:\n- %s", spec, suffix, hint)
+		}
+	}
+	request.Label = label
+
+	if !hasOptions {
+		return request, nil
+	}
+	seen := make(map[string]bool)
+	for _, option := range strings.Split(options, ",") {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok || value == "" {
+			return request, fmt.Errorf("invalid subkey '%s': expected length=N or hash=H, got '%s'", spec, option)
+		}
+		if seen[key] {
+			return request, fmt.Errorf("invalid subkey '%s': %s is given twice", spec, key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "length":
+			length, err := strconv.Atoi(value)
+			if err != nil {
+				return request, fmt.Errorf("invalid subkey '%s': length '%s' is not a number", spec, value)
+			}
+			request.Length = length
+		case "hash":
+			if !isHashName(value) {
+				return request, fmt.Errorf("invalid subkey '%s': unknown hash function '%s' (expected %s or %s)",
+					spec, value, types.SubkeyHashSHA256, types.SubkeyHashSHA512)
+			}
+			request.Hash = types.SubkeyHash(value)
+		default:
+			return request, fmt.Errorf("invalid subkey '%s': unknown option '%s' (expected length or hash)", spec, key)
+		}
+	}
+	return request, nil
+}
+
+// isHashName reports whether s names a supported HKDF hash function.
+func isHashName(s string) bool {
+	return s == string(types.SubkeyHashSHA256) || s == string(types.SubkeyHashSHA512)
+}
+
+// isNumber reports whether s consists of decimal digits only.
+func isNumber(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// explicitSubkeySpec rewrites a specification in the label[:length[:hash]] syntax of
+// earlier releases into the explicit syntax.
+func explicitSubkeySpec(spec string) string {
+	parts := strings.Split(spec, ":")
+	var options []string
+	if n := len(parts); n >= 3 && isHashName(parts[n-1]) {
+		options = append(options, "hash="+parts[n-1])
+		parts = parts[:n-1]
+	}
+	if n := len(parts); n >= 2 && isNumber(parts[n-1]) {
+		options = append([]string{"length=" + parts[n-1]}, options...)
+		parts = parts[:n-1]
+	}
+	return strings.Join(append([]string{strings.Join(parts, ":")}, options...), ",")
+}
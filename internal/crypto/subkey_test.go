@@ -0,0 +1,107 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"fido2-hmac-deriver/internal/types"
+)
+
+func TestParseSubkeyRequest(t *testing.T) {
+	tests := []struct {
+		spec string
+		want types.SubkeyRequest
+	}{
+		{"git-crypt", types.SubkeyRequest{Label: "git-crypt", Length: 32, Hash: types.SubkeyHashSHA256}},
+		{"mac,length=64", types.SubkeyRequest{Label: "mac", Length: 64, Hash: types.SubkeyHashSHA256}},
+		{"enc,hash=sha512", types.SubkeyRequest{Label: "enc", Length: 32, Hash: types.SubkeyHashSHA512}},
+		{"enc,length=16,hash=sha512", types.SubkeyRequest{Label: "enc", Length: 16, Hash: types.SubkeyHashSHA512}},
+		{"enc,hash=sha512,length=16", types.SubkeyRequest{Label: "enc", Length: 16, Hash: types.SubkeyHashSHA512}},
+		{"app:v1:signing", types.SubkeyRequest{Label: "app:v1:signing", Length: 32, Hash: types.SubkeyHashSHA256}},
+		{"app:2024a", types.SubkeyRequest{Label: "app:2024a", Length: 32, Hash: types.SubkeyHashSHA256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseSubkeyRequest(tt.spec, types.SubkeyHashSHA256)
+			if err != nil {
+				t.Fatalf("ParseSubkeyRequest: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSubkeyRequest = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSubkeyRequestRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+	}{
+		{"empty", ""},
+		{"empty label", ",length=16"},
+		{"old length syntax", "app:2024"},
+		{"old hash syntax", "label:sha512"},
+		{"old length and hash syntax", "encryption:32:sha512"},
+		{"trailing comma", "app,"},
+		{"option without value", "app,length"},
+		{"empty value", "app,length="},
+		{"length not a number", "app,length=big"},
+		{"unknown hash", "app,hash=md5"},
+		{"unknown option", "app,salt=x"},
+		{"repeated option", "app,length=16,length=32"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ParseSubkeyRequest(tt.spec, types.SubkeyHashSHA256); err == nil {
+				t.Errorf("ParseSubkeyRequest(%q) = %+v, want an error", tt.spec, got)
+			}
+		})
+	}
+}
+
+func TestDeriveSubkeys(t *testing.T) {
+	p := &Provider{}
+	secret := bytes.Repeat([]byte{0x0b}, 32)
+
+	// RFC 5869 test case 3: HKDF-SHA256 without salt and info
+	key, err := hkdfKey(types.SubkeyHashSHA256, bytes.Repeat([]byte{0x0b}, 22), "", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8"
+	if got := hex.EncodeToString(key); got != want {
+		t.Errorf("HKDF-SHA256 = %s, want %s", got, want)
+	}
+
+	requests := []types.SubkeyRequest{
+		{Label: "a", Length: 32, Hash: types.SubkeyHashSHA256},
+		{Label: "b", Length: 64, Hash: types.SubkeyHashSHA512},
+	}
+	subkeys, err := p.DeriveSubkeys(secret, requests)
+	if err != nil {
+		t.Fatalf("DeriveSubkeys: %v", err)
+	}
+	if len(subkeys[0].Key) != 32 || len(subkeys[1].Key) != 64 || bytes.Equal(subkeys[0].Key, subkeys[1].Key[:32]) {
+		t.Error("subkeys do not have the requested lengths or are not independent")
+	}
+
+	if _, err := p.DeriveSubkeys(secret, append(requests, requests[0])); err == nil {
+		t.Error("DeriveSubkeys accepted a repeated label")
+	}
+}
+
+func TestExplicitSubkeySpec(t *testing.T) {
+	tests := map[string]string{
+		"app:2024":             "app,length=2024",
+		"encryption:32:sha512": "encryption,length=32,hash=sha512",
+		"a:b:16":               "a:b,length=16",
+		"label:sha512":         "label:sha512", // Earlier releases kept a hash without a length in the label
+	}
+	for spec, want := range tests {
+		if got := explicitSubkeySpec(spec); got != want {
+			t.Errorf("explicitSubkeySpec(%q) = %q, want %q", spec, got, want)
+		}
+	}
+}
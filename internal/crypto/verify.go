@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+)
+
+// checkValueLabel is the message MACed with a secret to obtain its check value.
+const checkValueLabel = "fido2-hmac-deriver:v1:check-value"
+
+// checkValueSize is the size of a check value in bytes. The value is truncated
+// so that it identifies a secret without being usable in its place.
+const checkValueSize = 16
+
+// VerifySecret checks a secret against the check values of the stored credentials.
+// The salt of every credential for the relying party is rebuilt from the record and
+// the configuration, so no device is needed.
+//
+// Parameters:
+//   - secret: The secret to check
+//   - config: Configuration containing relying party information and salt options
+//
+// Returns:
+//   - The credential record the secret was derived from
+//   - An error if no stored credential matches the secret
+func (p *Provider) VerifySecret(secret []byte, config *types.Configuration) (*types.CredentialRecord, error) {
+	records, err := p.credentials.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential store: %w", err)
+	}
+
+	checked := 0
+	for _, record := range records {
+		if record.RelyingPartyID != config.RelyingPartyID {
+			continue
+		}
+
+		// The legacy salt uses the device path, which is only known if given explicitly
+		device := &types.DeviceInfo{AAGUID: record.AAGUID, Path: config.LegacySaltPath}
+		salt, err := p.salt(p.resolveSaltMode(config, record.SaltMode), device, record.CredentialID, config, config.SaltGeneration)
+		if err != nil {
+			continue
+		}
+
+		matches, known := checkSecret(record, salt, secret)
+		if !known {
+			continue
+		}
+		checked++
+		if matches {
+			return record, nil
+		}
+	}
+
+	if checked == 0 {
+		return nil, fmt.Errorf("no check value is stored for relying party '%s' with these salt options\n\nPlease:\n"+
+			"- Pass the same --salt-mode, --salt-context and --salt-generation the secret was derived with\n"+
+			"- Pass --legacy-salt-path for credentials using the legacy path-based salt\n"+
+			"- Run 'fido2-hmac-deriver derive' once to record the check value", config.RelyingPartyID)
+	}
+	return nil, fmt.Errorf("the secret does not match any of the %d stored check value(s)", checked)
+}
+
+// checkValue computes the check value of a secret.
+func checkValue(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(checkValueLabel))
+	return mac.Sum(nil)[:checkValueSize]
+}
+
+// checkSecret compares a secret with the check value recorded for the salt.
+// known reports whether the record has a check value for the salt at all.
+func checkSecret(record *types.CredentialRecord, salt, secret []byte) (matches, known bool) {
+	expected, known := record.CheckValues[store.Fingerprint(salt)]
+	if !known {
+		return false, false
+	}
+	return hmac.Equal(expected, checkValue(secret)), true
+}
+
+// setCheckValue records the check value of a secret derived with the given salt.
+func setCheckValue(record *types.CredentialRecord, salt, secret []byte) {
+	if record.CheckValues == nil {
+		record.CheckValues = make(map[string][]byte)
+	}
+	record.CheckValues[store.Fingerprint(salt)] = checkValue(secret)
+}
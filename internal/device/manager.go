@@ -6,28 +6,29 @@ package device
 import (
 	"errors"
 	"fmt"
+	"slices"
 
 	"fido2-hmac-deriver/internal/types"
-
-	"github.com/keys-pub/go-libfido2"
 )
 
 // Manager implements the DeviceManager interface for FIDO2 device operations.
-// It uses the libfido2 library to discover and interact with FIDO2 devices.
+// It uses the configured backend to discover and interact with FIDO2 devices.
 type Manager struct {
-	ui types.UIProvider // UI provider for user interaction
+	ui      types.UIProvider // UI provider for user interaction
+	backend types.Backend    // Backend used to discover and open devices
 }
 
-// NewManager creates a new device manager with the provided UI provider.
+// NewManager creates a new device manager with the provided UI provider and backend.
 // The UI provider is used for displaying devices and getting user input.
-func NewManager(ui types.UIProvider) *Manager {
+func NewManager(ui types.UIProvider, backend types.Backend) *Manager {
 	return &Manager{
-		ui: ui,
+		ui:      ui,
+		backend: backend,
 	}
 }
 
 // ListDevices discovers all FIDO2 devices connected to the system.
-// It uses libfido2 to enumerate devices and converts them to our internal format.
+// It uses the backend to enumerate devices in our internal format.
 //
 // Returns:
 //   - A slice of DeviceInfo structures containing device details
@@ -38,8 +39,8 @@ func NewManager(ui types.UIProvider) *Manager {
 //   - Permission errors: when the application lacks permission to access devices
 //   - System errors: when the underlying FIDO2 library encounters issues
 func (m *Manager) ListDevices() ([]*types.DeviceInfo, error) {
-	// Use libfido2 to discover all connected FIDO2 devices
-	locations, err := libfido2.DeviceLocations()
+	// Use the backend to discover all connected FIDO2 devices
+	devices, err := m.backend.ListDevices()
 	if err != nil {
 		return nil, fmt.Errorf("failed to discover FIDO2 devices: %w\n\nTroubleshooting:\n"+
 			"- Ensure your FIDO2 device is connected via USB\n"+
@@ -49,21 +50,13 @@ func (m *Manager) ListDevices() ([]*types.DeviceInfo, error) {
 	}
 
 	// Check if any devices were found
-	if len(locations) == 0 {
+	if len(devices) == 0 {
 		return nil, errors.New("no FIDO2 devices found\n\nPlease:\n" +
 			"- Connect a FIDO2 device (YubiKey, SoloKey, etc.) via USB\n" +
 			"- Ensure the device is properly recognized by your system\n" +
 			"- Check that the device supports FIDO2 (not just U2F)")
 	}
 
-	// Convert libfido2 device locations to our internal DeviceInfo format
-	devices := make([]*types.DeviceInfo, len(locations))
-	for i, location := range locations {
-		// Wrap the libfido2 device and convert to our format
-		wrappedDevice := &types.LibFIDO2Device{DeviceLocation: location}
-		devices[i] = wrappedDevice.ToDeviceInfo(i + 1) // 1-based indexing for user display
-	}
-
 	return devices, nil
 }
 
@@ -163,7 +156,7 @@ func (m *Manager) ValidateDevice(device *types.DeviceInfo) error {
 	}
 
 	// Try to create a connection to the device to verify it's still accessible
-	_, err := libfido2.NewDevice(device.Path)
+	_, err := m.backend.Open(device.Path)
 	if err != nil {
 		return fmt.Errorf("device %s is no longer accessible: %w\n\nThe device may have been:\n"+
 			"- Disconnected from USB\n"+
@@ -171,49 +164,215 @@ func (m *Manager) ValidateDevice(device *types.DeviceInfo) error {
 			"- Put into an error state", device.Name, err)
 	}
 
-	// Device is accessible - connection is managed internally by libfido2
+	// Device is accessible - connection is managed internally by the backend
 	return nil
 }
 
-// GetDeviceCapabilities retrieves information about what a device supports.
-// This is useful for determining if a device supports the features we need.
+// GetDeviceCapabilities queries what a device supports.
+// The options, versions, extensions and limits come from the authenticatorGetInfo
+// response; the PIN retry counter is only queried if the device has a PIN set, and
+// the UV retry counter only if it has built-in user verification.
 //
 // Parameters:
 //   - device: The DeviceInfo to query
 //
 // Returns:
-//   - A map of capability names to boolean values
+//   - The capabilities reported by the device
 //   - An error if the device cannot be queried
-func (m *Manager) GetDeviceCapabilities(device *types.DeviceInfo) (map[string]bool, error) {
-	dev, err := libfido2.NewDevice(device.Path)
+func (m *Manager) GetDeviceCapabilities(device *types.DeviceInfo) (*types.DeviceCapabilities, error) {
+	dev, err := m.backend.Open(device.Path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to device: %w", err)
 	}
 
-	capabilities := make(map[string]bool)
-
-	// Check for HMAC secret extension support
-	// This is critical for our application
 	info, err := dev.Info()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get device info: %w", err)
 	}
+	device.AAGUID = info.AAGUID
 
-	// Check if the device supports the extensions we need
-	capabilities["hmac-secret"] = false
-	for _, ext := range info.Extensions {
-		if ext == "hmac-secret" {
-			capabilities["hmac-secret"] = true
-			break
-		}
+	capabilities := &types.DeviceCapabilities{
+		Versions:           info.Versions,
+		Extensions:         info.Extensions,
+		AAGUID:             info.AAGUID,
+		Options:            info.Options,
+		PINProtocols:       info.PINProtocols,
+		MaxCredentialCount: info.MaxCredentialCount,
+		MinPINLength:       info.MinPINLength,
+		FirmwareVersion:    info.FirmwareVersion,
+		PINRetries:         -1,
+		UVRetries:          -1,
 	}
 
-	// Add other useful capability checks based on available options
-	// Note: info.Options is a map[int]libfido2.Option, not map[string]bool
-	capabilities["resident-keys"] = len(info.Options) > 0 // Simplified check
-	capabilities["user-presence"] = true                  // Most FIDO2 devices support this
-	capabilities["user-verification"] = true              // Most FIDO2 devices support this
-	capabilities["pin-support"] = true                    // Most FIDO2 devices support this
+	// Devices without a PIN have no meaningful retry counter
+	if pinSet, _ := capabilities.Option("clientPin"); pinSet {
+		if retries, err := dev.PINRetries(); err == nil {
+			capabilities.PINRetries = retries
+		}
+	}
+	if _, hasUV := capabilities.Option("uv"); hasUV {
+		if retries, err := dev.UVRetries(); err == nil {
+			capabilities.UVRetries = retries
+		}
+	}
 
 	return capabilities, nil
 }
+
+// CheckDeviceSupport verifies that a device can be used for HMAC secret derivation.
+// This pre-flight check runs before the user is asked for the PIN, so unsuitable
+// devices are rejected before any touch is required.
+//
+// Parameters:
+//   - device: The DeviceInfo to check
+//
+// Returns:
+//   - An error describing what the device lacks, or nil if it is suitable
+func (m *Manager) CheckDeviceSupport(device *types.DeviceInfo) error {
+	capabilities, err := m.GetDeviceCapabilities(device)
+	if err != nil {
+		return err
+	}
+
+	if !capabilities.HasExtension("hmac-secret") {
+		return fmt.Errorf("device %s does not support the hmac-secret extension\n\nThis application requires:\n"+
+			"- A FIDO2 device with the hmac-secret extension (e.g., YubiKey 5 series, SoloKey)\n"+
+			"- Run 'fido2-hmac-deriver info' to see what the device supports", device.Name)
+	}
+
+	if capabilities.PINRetries == 0 {
+		return fmt.Errorf("the PIN of device %s is blocked\n\nNo PIN attempts are left. The device has to be reset,\n"+
+			"which deletes all its credentials", device.Name)
+	}
+
+	return nil
+}
+
+// SetPIN sets the initial PIN of a device, or changes it if oldPIN is not empty.
+// The device checks the PIN policy, e.g. its minimum length, and a wrong old PIN
+// costs one of the PIN attempts.
+//
+// Parameters:
+//   - device: The DeviceInfo to configure
+//   - pin: The new PIN
+//   - oldPIN: The current PIN, or empty if the device has none
+//
+// Returns:
+//   - An error if the device rejected the PIN or cannot be reached
+func (m *Manager) SetPIN(device *types.DeviceInfo, pin, oldPIN string) error {
+	dev, err := m.backend.Open(device.Path)
+	if err != nil {
+		return fmt.Errorf("failed to connect to device: %w", err)
+	}
+
+	if err := dev.SetPIN(pin, oldPIN); err != nil {
+		if oldPIN == "" {
+			return fmt.Errorf("failed to set the PIN of %s: %w", device.Name, err)
+		}
+		return fmt.Errorf("failed to change the PIN of %s: %w", device.Name, err)
+	}
+	return nil
+}
+
+// ResidentCredentials lists the resident credentials of all relying parties on a
+// device, using the CTAP 2.1 credential management command.
+//
+// Parameters:
+//   - device: The DeviceInfo to query
+//   - pin: The device PIN, which credential management requires
+//
+// Returns:
+//   - The resident credentials, grouped by relying party
+//   - An error if the device does not support credential management or rejects the PIN
+func (m *Manager) ResidentCredentials(device *types.DeviceInfo, pin string) ([]*types.ResidentCredential, error) {
+	dev, err := m.credentialManagement(device)
+	if err != nil {
+		return nil, err
+	}
+
+	rps, err := dev.RelyingParties(pin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the relying parties on %s: %w", device.Name, err)
+	}
+
+	var credentials []*types.ResidentCredential
+	for _, rp := range rps {
+		found, err := dev.Credentials(rp.ID, pin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the credentials of '%s' on %s: %w", rp.ID, device.Name, err)
+		}
+		for _, credential := range found {
+			credentials = append(credentials, &types.ResidentCredential{
+				RelyingParty: *rp,
+				ID:           credential.ID,
+				User:         credential.User,
+			})
+		}
+	}
+	return credentials, nil
+}
+
+// DeleteResidentCredential removes a resident credential from a device. Secrets
+// derived with it can no longer be reproduced.
+func (m *Manager) DeleteResidentCredential(device *types.DeviceInfo, credentialID []byte, pin string) error {
+	dev, err := m.credentialManagement(device)
+	if err != nil {
+		return err
+	}
+	if err := dev.DeleteCredential(credentialID, pin); err != nil {
+		return fmt.Errorf("failed to delete the credential from %s: %w", device.Name, err)
+	}
+	return nil
+}
+
+// UpdateResidentUser replaces the user name and display name of a resident credential.
+func (m *Manager) UpdateResidentUser(device *types.DeviceInfo, credentialID []byte, user types.User, pin string) error {
+	dev, err := m.credentialManagement(device)
+	if err != nil {
+		return err
+	}
+	if err := dev.UpdateUser(credentialID, user, pin); err != nil {
+		return fmt.Errorf("failed to update the credential on %s: %w", device.Name, err)
+	}
+	return nil
+}
+
+// CheckResidentUserUpdate returns an error unless the device supports updating the
+// user of a credential, which CTAP 2.1 added to credential management, and the
+// backend implements it.
+func (m *Manager) CheckResidentUserUpdate(device *types.DeviceInfo) error {
+	dev, err := m.credentialManagement(device)
+	if err != nil {
+		return err
+	}
+	if !dev.CanUpdateUser() {
+		return fmt.Errorf("the %s backend cannot update the user of a resident credential", m.backend.Name())
+	}
+
+	info, err := dev.Info()
+	if err != nil {
+		return fmt.Errorf("failed to get device info: %w", err)
+	}
+	if !info.Options["credMgmt"] || !slices.Contains(info.Versions, "FIDO_2_1") {
+		return fmt.Errorf("device %s does not support updating the user of a credential (CTAP 2.1 credential management)", device.Name)
+	}
+	return nil
+}
+
+// credentialManagement opens a device after checking that it supports credential
+// management, either as CTAP 2.1 credMgmt or as the preview of earlier firmware.
+func (m *Manager) credentialManagement(device *types.DeviceInfo) (types.Authenticator, error) {
+	dev, err := m.backend.Open(device.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to device: %w", err)
+	}
+
+	info, err := dev.Info()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device info: %w", err)
+	}
+	if !info.Options["credMgmt"] && !info.Options["credentialMgmtPreview"] {
+		return nil, fmt.Errorf("device %s does not support credential management", device.Name)
+	}
+	return dev, nil
+}
@@ -0,0 +1,326 @@
+// Package fileenc encrypts files with keys derived from the FIDO2 secret.
+// Encrypted files have the format
+//
+//	magic (8 bytes) | version (1 byte) | header length (4 bytes) | header (JSON) | chunks
+//
+// The header is self-describing: it records the relying party, the credential and
+// the salt the secret was derived with, so the right secret can be derived again
+// for decryption. Each file is encrypted with its own key, derived from the secret
+// with HKDF and a random salt stored in the header.
+//
+// The plaintext is split into chunks that are encrypted separately with the AEAD,
+// so files of any size can be streamed. The nonce of a chunk is its index and a
+// flag for the final chunk, which detects reordered, dropped and truncated chunks;
+// every chunk is bound to the header as additional data.
+package fileenc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher names an AEAD the file contents can be encrypted with.
+type Cipher string
+
+const (
+	// CipherXChaCha20Poly1305 is XChaCha20-Poly1305, the default.
+	CipherXChaCha20Poly1305 Cipher = "xchacha20-poly1305"
+
+	// CipherAES256GCM is AES-256 in Galois/Counter Mode, for hardware AES support.
+	CipherAES256GCM Cipher = "aes-256-gcm"
+)
+
+// FormatVersion is the version of the file format written by Encrypt.
+const FormatVersion = 1
+
+// DefaultChunkSize is the plaintext size of every chunk but the last.
+const DefaultChunkSize = 64 * 1024
+
+// maxChunkSize bounds the chunk size accepted from a header, to limit memory use.
+const maxChunkSize = 16 * 1024 * 1024
+
+// maxHeaderSize bounds the header length accepted from a file.
+const maxHeaderSize = 64 * 1024
+
+// saltSize is the size of an hmac-secret salt, the only size authenticators accept.
+const saltSize = 32
+
+// keyInfo is the HKDF info parameter of the file key.
+const keyInfo = "fido2-hmac-deriver:file:v1"
+
+// magic starts every encrypted file.
+var magic = []byte("FIDO2ENC")
+
+// Header describes how a file was encrypted.
+type Header struct {
+	Cipher         Cipher `json:"cipher"`
+	ChunkSize      int    `json:"chunk_size"`
+	RelyingPartyID string `json:"rp_id"`
+	CredentialID   []byte `json:"credential_id"`
+	AAGUID         []byte `json:"aaguid,omitempty"`
+	Salt           []byte `json:"salt"`     // Salt the HMAC secret was derived with
+	KeySalt        []byte `json:"key_salt"` // HKDF salt of the file key
+
+	raw []byte // Encoded header, authenticated with every chunk
+}
+
+// NewHeader creates the header for a new file with a random key salt.
+//
+// Parameters:
+//   - cipher: The AEAD to encrypt the file with
+//   - rpID: The relying party the secret was derived for
+//   - credentialID: The credential the secret was derived with
+//   - aaguid: The authenticator model holding the credential (informational)
+//   - salt: The salt the secret was derived with
+func NewHeader(cipher Cipher, rpID string, credentialID, aaguid, salt []byte) (*Header, error) {
+	if err := CheckCipher(cipher); err != nil {
+		return nil, err
+	}
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("salt must be %d bytes, got %d", saltSize, len(salt))
+	}
+	keySalt := make([]byte, 32)
+	if _, err := rand.Read(keySalt); err != nil {
+		return nil, fmt.Errorf("failed to generate key salt: %w", err)
+	}
+	return &Header{
+		Cipher:         cipher,
+		ChunkSize:      DefaultChunkSize,
+		RelyingPartyID: rpID,
+		CredentialID:   credentialID,
+		AAGUID:         aaguid,
+		Salt:           salt,
+		KeySalt:        keySalt,
+	}, nil
+}
+
+// CheckCipher returns an error for unknown ciphers.
+func CheckCipher(c Cipher) error {
+	switch c {
+	case CipherXChaCha20Poly1305, CipherAES256GCM:
+		return nil
+	default:
+		return fmt.Errorf("unknown cipher '%s' (expected %s or %s)", c, CipherXChaCha20Poly1305, CipherAES256GCM)
+	}
+}
+
+// ReadHeader reads the header of an encrypted file, leaving r at the first chunk.
+func ReadHeader(r io.Reader) (*Header, error) {
+	prefix := make([]byte, len(magic)+1+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, errors.New("not an encrypted file: too short")
+	}
+	if !bytes.Equal(prefix[:len(magic)], magic) {
+		return nil, errors.New("not an encrypted file: unknown format")
+	}
+	if version := prefix[len(magic)]; version != FormatVersion {
+		return nil, fmt.Errorf("unsupported file format version %d (expected %d)", version, FormatVersion)
+	}
+
+	length := binary.BigEndian.Uint32(prefix[len(magic)+1:])
+	if length > maxHeaderSize {
+		return nil, fmt.Errorf("invalid header length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.New("encrypted file is truncated in its header")
+	}
+
+	var header Header
+	if err := json.Unmarshal(body, &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if err := header.validate(); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	header.raw = append(prefix, body...)
+	return &header, nil
+}
+
+// validate checks the fields of a header read from a file.
+func (h *Header) validate() error {
+	if err := CheckCipher(h.Cipher); err != nil {
+		return err
+	}
+	if h.ChunkSize <= 0 || h.ChunkSize > maxChunkSize {
+		return fmt.Errorf("chunk size must be between 1 and %d bytes, got %d", maxChunkSize, h.ChunkSize)
+	}
+	if h.RelyingPartyID == "" || len(h.CredentialID) == 0 || len(h.Salt) == 0 || len(h.KeySalt) == 0 {
+		return errors.New("relying party, credential ID, salt and key salt are required")
+	}
+	if len(h.Salt) != saltSize {
+		return fmt.Errorf("salt must be %d bytes, got %d", saltSize, len(h.Salt))
+	}
+	return nil
+}
+
+// encode serializes the header and keeps the result for authentication.
+func (h *Header) encode() ([]byte, error) {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, 0, len(magic)+1+4+len(body))
+	raw = append(raw, magic...)
+	raw = append(raw, FormatVersion)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(body)))
+	h.raw = append(raw, body...)
+	return h.raw, nil
+}
+
+// newAEAD derives the file key from the secret and creates the header's AEAD.
+func (h *Header) newAEAD(secret []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, h.KeySalt, keyInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive file key: %w", err)
+	}
+
+	switch h.Cipher {
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, CheckCipher(h.Cipher)
+	}
+}
+
+// chunkNonce builds the nonce of a chunk: its index and the final chunk flag,
+// right-aligned in a nonce of the AEAD's size. The file key is unique, so the
+// index never repeats under the same key.
+func chunkNonce(size int, index uint64, final bool) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-9:size-1], index)
+	if final {
+		nonce[size-1] = 1
+	}
+	return nonce
+}
+
+// Encrypt writes the header and the encrypted contents of r to w.
+//
+// Parameters:
+//   - w: Where to write the encrypted file
+//   - r: The plaintext to encrypt
+//   - header: The header created by NewHeader
+//   - secret: The HMAC secret derived with the header's credential and salt
+func Encrypt(w io.Writer, r io.Reader, header *Header, secret []byte) error {
+	raw, err := header.encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode header: %w", err)
+	}
+	aead, err := header.newAEAD(secret)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+
+	buf := make([]byte, header.ChunkSize)
+	next := make([]byte, header.ChunkSize)
+	n, err := readChunk(r, buf)
+	if err != nil {
+		return err
+	}
+
+	var sealed []byte
+	for index := uint64(0); ; index++ {
+		// A full chunk is only the final one if nothing follows it
+		var m int
+		final := n < len(buf)
+		if !final {
+			if m, err = readChunk(r, next); err != nil {
+				return err
+			}
+			final = m == 0
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(aead.NonceSize(), index, final), buf[:n], raw)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		buf, next, n = next, buf, m
+	}
+}
+
+// Decrypt decrypts the chunks read from r, which must be positioned after the header,
+// and writes the plaintext to w. Chunks are written as soon as they are authenticated,
+// so if an error is returned, w may already hold part of the plaintext.
+//
+// Parameters:
+//   - w: Where to write the plaintext
+//   - r: The encrypted file after its header (see ReadHeader)
+//   - header: The header read by ReadHeader
+//   - secret: The HMAC secret derived with the header's credential and salt
+func Decrypt(w io.Writer, r io.Reader, header *Header, secret []byte) error {
+	aead, err := header.newAEAD(secret)
+	if err != nil {
+		return err
+	}
+
+	size := header.ChunkSize + aead.Overhead()
+	buf := make([]byte, size)
+	next := make([]byte, size)
+	n, err := readChunk(r, buf)
+	if err != nil {
+		return err
+	}
+
+	var opened []byte
+	for index := uint64(0); ; index++ {
+		var m int
+		final := n < size
+		if !final {
+			if m, err = readChunk(r, next); err != nil {
+				return err
+			}
+			final = m == 0
+		}
+
+		if n < aead.Overhead() {
+			return fmt.Errorf("decryption failed at chunk %d: the file is truncated", index)
+		}
+		opened, err = aead.Open(opened[:0], chunkNonce(aead.NonceSize(), index, final), buf[:n], header.raw)
+		if err != nil {
+			if index == 0 {
+				return errors.New("decryption failed: the file was encrypted with a different secret or has been modified")
+			}
+			return fmt.Errorf("decryption failed at chunk %d: the file is truncated or has been modified", index)
+		}
+		if _, err := w.Write(opened); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		buf, next, n = next, buf, m
+	}
+}
+
+// readChunk reads until buf is full or the input ends, and returns the number of bytes read.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, nil
+	}
+	return n, err
+}
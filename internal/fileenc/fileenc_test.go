@@ -0,0 +1,160 @@
+package fileenc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+var (
+	testSecret = bytes.Repeat([]byte{0x5e}, 32)
+	testSalt   = bytes.Repeat([]byte{0x5a}, 32)
+)
+
+// encrypt encrypts plaintext with a fresh header of the given cipher and chunk size.
+func encrypt(t *testing.T, cipher Cipher, chunkSize int, plaintext []byte) []byte {
+	t.Helper()
+	header, err := NewHeader(cipher, "e2e-git", []byte("credential"), nil, testSalt)
+	if err != nil {
+		t.Fatalf("NewHeader: %v", err)
+	}
+	header.ChunkSize = chunkSize
+
+	var out bytes.Buffer
+	if err := Encrypt(&out, bytes.NewReader(plaintext), header, testSecret); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	return out.Bytes()
+}
+
+// decrypt reads the header of an encrypted file and decrypts it.
+func decrypt(data, secret []byte) ([]byte, *Header, error) {
+	r := bytes.NewReader(data)
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var out bytes.Buffer
+	err = Decrypt(&out, r, header, secret)
+	return out.Bytes(), header, err
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 100)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		cipher    Cipher
+		chunkSize int
+		plaintext []byte
+	}{
+		{"empty", CipherXChaCha20Poly1305, 16, nil},
+		{"shorter than a chunk", CipherXChaCha20Poly1305, 16, []byte("hello")},
+		{"exactly one chunk", CipherXChaCha20Poly1305, 16, bytes.Repeat([]byte{1}, 16)},
+		{"several chunks", CipherXChaCha20Poly1305, 16, random},
+		{"multiple of the chunk size", CipherXChaCha20Poly1305, 20, random},
+		{"aes-256-gcm", CipherAES256GCM, 16, random},
+		{"default chunk size", CipherAES256GCM, DefaultChunkSize, random},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encrypt(t, tt.cipher, tt.chunkSize, tt.plaintext)
+			got, header, err := decrypt(data, testSecret)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if !bytes.Equal(got, tt.plaintext) {
+				t.Errorf("decrypted %x, want %x", got, tt.plaintext)
+			}
+			if header.Cipher != tt.cipher || header.RelyingPartyID != "e2e-git" || !bytes.Equal(header.Salt, testSalt) {
+				t.Errorf("header %+v does not match the one written", header)
+			}
+		})
+	}
+}
+
+func TestDecryptRejectsModifiedFiles(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("0123456789"), 5)
+	data := encrypt(t, CipherXChaCha20Poly1305, 16, plaintext)
+	r := bytes.NewReader(data)
+	if _, err := ReadHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	headerSize := len(data) - r.Len()
+	chunk := 16 + 16 // Chunk size and Poly1305 tag
+
+	otherSecret := bytes.Repeat([]byte{0x5f}, 32)
+	tests := []struct {
+		name   string
+		data   []byte
+		secret []byte
+	}{
+		{"different secret", data, otherSecret},
+		{"flipped bit in a chunk", flip(data, headerSize+chunk+3), testSecret},
+		{"flipped bit in the header", flip(data, headerSize-2), testSecret},
+		{"dropped final chunk", data[:headerSize+3*chunk], testSecret},
+		{"truncated chunk", data[:len(data)-1], testSecret},
+		{"swapped chunks", swap(data, headerSize, chunk), testSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decrypt(tt.data, tt.secret); err == nil {
+				t.Error("decrypt succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestReadHeaderRejectsOtherFiles(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("plain text, not encrypted"), []byte("FIDO2ENC\x09\x00\x00\x00\x02{}")} {
+		if _, err := ReadHeader(bytes.NewReader(data)); err == nil {
+			t.Errorf("ReadHeader(%q) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestNewHeaderRejectsUnknownCipher(t *testing.T) {
+	if _, err := NewHeader("rot13", "e2e-git", nil, nil, testSalt); err == nil {
+		t.Error("NewHeader accepted an unknown cipher")
+	}
+}
+
+func TestSaltMustBe32Bytes(t *testing.T) {
+	for _, salt := range [][]byte{nil, testSalt[:16], append(append([]byte(nil), testSalt...), 0)} {
+		if _, err := NewHeader(CipherXChaCha20Poly1305, "e2e-git", []byte("credential"), nil, salt); err == nil {
+			t.Errorf("NewHeader accepted a salt of %d bytes", len(salt))
+		}
+
+		// A header written with another salt length is rejected when read
+		header, err := NewHeader(CipherXChaCha20Poly1305, "e2e-git", []byte("credential"), nil, testSalt)
+		if err != nil {
+			t.Fatalf("NewHeader: %v", err)
+		}
+		header.Salt = salt
+		var out bytes.Buffer
+		if err := Encrypt(&out, bytes.NewReader([]byte("data")), header, testSecret); err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if _, err := ReadHeader(&out); err == nil {
+			t.Errorf("ReadHeader accepted a salt of %d bytes", len(salt))
+		}
+	}
+}
+
+func flip(data []byte, i int) []byte {
+	out := append([]byte(nil), data...)
+	out[i] ^= 1
+	return out
+}
+
+func swap(data []byte, offset, chunk int) []byte {
+	out := append([]byte(nil), data...)
+	copy(out[offset:], data[offset+chunk:offset+2*chunk])
+	copy(out[offset+chunk:], data[offset:offset+chunk])
+	return out
+}
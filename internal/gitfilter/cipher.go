@@ -0,0 +1,117 @@
+// Package gitfilter implements git clean/smudge filters that encrypt file contents
+// with keys derived from the FIDO2 secret, so repositories can be pushed to
+// untrusted remotes while the working tree holds the plaintext.
+//
+// Encrypted blobs have the format
+//
+//	magic (9 bytes) | version (1 byte) | nonce (24 bytes) | XChaCha20-Poly1305 ciphertext
+//
+// The nonce is an HMAC of the plaintext, so the same content always yields the
+// same blob. This keeps git from seeing unchanged files as modified, at the cost
+// of revealing which blobs have equal contents.
+package gitfilter
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"fido2-hmac-deriver/internal/types"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// EncryptionKeyLabel is the HKDF label of the AEAD key.
+	EncryptionKeyLabel = "fido2-hmac-deriver:git-filter:v1:encryption"
+
+	// NonceKeyLabel is the HKDF label of the key the deterministic nonces are derived with.
+	NonceKeyLabel = "fido2-hmac-deriver:git-filter:v1:nonce"
+
+	// KeySize is the size of both keys in bytes.
+	KeySize = chacha20poly1305.KeySize
+)
+
+// blobVersion is the version of the encrypted blob format.
+const blobVersion = 1
+
+// magic starts every encrypted blob. The leading NUL byte makes git treat
+// encrypted blobs as binary.
+var magic = []byte("\x00FIDO2GIT")
+
+// headerSize is the size of the magic and version that precede the nonce.
+var headerSize = len(magic) + 1
+
+// ErrNotEncrypted is returned when decrypting data that is not an encrypted blob.
+var ErrNotEncrypted = errors.New("data is not encrypted by the git filter")
+
+// Cipher encrypts and decrypts blobs deterministically.
+type Cipher struct {
+	aead     cipher.AEAD // XChaCha20-Poly1305 with the encryption key
+	nonceKey []byte      // Key for the HMAC that yields the nonce
+}
+
+// SubkeyRequests returns the subkeys a Cipher is created from, to be derived
+// from the HMAC secret with CryptoProvider.DeriveSubkeys.
+func SubkeyRequests() []types.SubkeyRequest {
+	return []types.SubkeyRequest{
+		{Label: EncryptionKeyLabel, Length: KeySize, Hash: types.SubkeyHashSHA256},
+		{Label: NonceKeyLabel, Length: KeySize, Hash: types.SubkeyHashSHA256},
+	}
+}
+
+// NewCipher creates a cipher from the subkeys requested by SubkeyRequests, in that order.
+func NewCipher(subkeys []types.Subkey) (*Cipher, error) {
+	if len(subkeys) != 2 || subkeys[0].Label != EncryptionKeyLabel || subkeys[1].Label != NonceKeyLabel {
+		return nil, fmt.Errorf("the git filter needs the subkeys '%s' and '%s'", EncryptionKeyLabel, NonceKeyLabel)
+	}
+
+	aead, err := chacha20poly1305.NewX(subkeys[0].Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return &Cipher{aead: aead, nonceKey: subkeys[1].Key}, nil
+}
+
+// IsEncrypted reports whether data starts like an encrypted blob.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Encrypt encrypts a file's contents into a blob. Equal plaintexts yield equal blobs.
+func (c *Cipher) Encrypt(plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	blob := make([]byte, 0, headerSize+len(nonce)+len(plaintext)+chacha20poly1305.Overhead)
+	blob = append(blob, magic...)
+	blob = append(blob, blobVersion)
+	blob = append(blob, nonce...)
+	return c.aead.Seal(blob, nonce, plaintext, blob[:headerSize])
+}
+
+// Decrypt decrypts a blob created by Encrypt.
+// Returns ErrNotEncrypted if data is not an encrypted blob, or an error if it was
+// encrypted with a different key or has been modified.
+func (c *Cipher) Decrypt(blob []byte) ([]byte, error) {
+	if !IsEncrypted(blob) {
+		return nil, ErrNotEncrypted
+	}
+	if len(blob) < headerSize+c.aead.NonceSize() {
+		return nil, errors.New("encrypted blob is truncated")
+	}
+	if version := blob[len(magic)]; version != blobVersion {
+		return nil, fmt.Errorf("unsupported encrypted blob version %d (expected %d)", version, blobVersion)
+	}
+
+	nonce := blob[headerSize : headerSize+c.aead.NonceSize()]
+	plaintext, err := c.aead.Open(nil, nonce, blob[headerSize+len(nonce):], blob[:headerSize])
+	if err != nil {
+		return nil, errors.New("failed to decrypt blob: it was encrypted with a different key or has been modified")
+	}
+	return plaintext, nil
+}
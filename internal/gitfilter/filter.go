@@ -0,0 +1,45 @@
+package gitfilter
+
+import (
+	"fmt"
+	"io"
+)
+
+// Clean encrypts the file contents read from r and writes the blob to w, as the
+// clean filter run when files are staged. Contents that are already a blob
+// encrypted with this key are passed through, so files checked out without the
+// smudge filter stay unchanged. Anything else is encrypted, even if it starts like
+// a blob, so that no plaintext reaches the repository.
+func (c *Cipher) Clean(w io.Writer, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read file contents: %w", err)
+	}
+	_, err = w.Write(c.clean(data))
+	return err
+}
+
+// clean returns data if it is a blob encrypted with this key, or else its encryption.
+func (c *Cipher) clean(data []byte) []byte {
+	if _, err := c.Decrypt(data); err == nil {
+		return data
+	}
+	return c.Encrypt(data)
+}
+
+// Smudge decrypts the blob read from r and writes the file contents to w, as the
+// smudge filter run on checkout. Blobs that are not encrypted, e.g. files committed
+// before the filter was set up, are passed through.
+func (c *Cipher) Smudge(w io.Writer, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read blob: %w", err)
+	}
+	if IsEncrypted(data) {
+		if data, err = c.Decrypt(data); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,164 @@
+package gitfilter
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"fido2-hmac-deriver/internal/types"
+)
+
+// newTestCipher creates a cipher from keys filled with the given byte.
+func newTestCipher(t *testing.T, fill byte) *Cipher {
+	t.Helper()
+	subkeys := SubkeyRequests()
+	keys := make([]types.Subkey, len(subkeys))
+	for i, request := range subkeys {
+		keys[i] = types.Subkey{Label: request.Label, Hash: request.Hash, Key: bytes.Repeat([]byte{fill + byte(i)}, request.Length)}
+	}
+	c, err := NewCipher(keys)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	return c
+}
+
+func clean(t *testing.T, c *Cipher, data []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := c.Clean(&out, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Clean: %v", err)
+	}
+	return out.Bytes()
+}
+
+func smudge(c *Cipher, data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	err := c.Smudge(&out, bytes.NewReader(data))
+	return out.Bytes(), err
+}
+
+func TestEncryptIsDeterministic(t *testing.T) {
+	c := newTestCipher(t, 1)
+	a, b := c.Encrypt([]byte("same")), c.Encrypt([]byte("same"))
+	if !bytes.Equal(a, b) {
+		t.Error("equal plaintexts yield different blobs")
+	}
+	if bytes.Equal(a, c.Encrypt([]byte("other"))) {
+		t.Error("different plaintexts yield the same blob")
+	}
+	if bytes.Equal(a, newTestCipher(t, 2).Encrypt([]byte("same"))) {
+		t.Error("different keys yield the same blob")
+	}
+	if !IsEncrypted(a) {
+		t.Error("blob does not start with the magic")
+	}
+}
+
+func TestCleanSmudge(t *testing.T) {
+	c := newTestCipher(t, 1)
+	other := newTestCipher(t, 2)
+
+	tests := []struct {
+		name        string
+		content     []byte // File contents staged with Clean
+		passThrough bool   // Whether Clean keeps the contents as they are
+	}{
+		{"text", []byte("password=hunter2\n"), false},
+		{"empty", nil, false},
+		{"binary", []byte{0, 1, 2, 255}, false},
+		{"own blob", c.Encrypt([]byte("checked out without smudge")), true},
+		{"blob of another key", other.Encrypt([]byte("foreign")), false},
+		{"magic followed by plaintext", append(append([]byte(nil), magic...), "\x01not really encrypted"...), false},
+		{"bare magic", append([]byte(nil), magic...), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blob := clean(t, c, tt.content)
+			if tt.passThrough != bytes.Equal(blob, tt.content) {
+				t.Fatalf("Clean passed the contents through: %t, want %t", !tt.passThrough, tt.passThrough)
+			}
+			if _, err := c.Decrypt(blob); err != nil {
+				t.Fatalf("Clean wrote a blob that does not decrypt: %v", err)
+			}
+
+			// Cleaning the blob again keeps it, so git sees no change
+			if again := clean(t, c, blob); !bytes.Equal(again, blob) {
+				t.Error("cleaning a blob again changed it")
+			}
+
+			got, err := smudge(c, blob)
+			if err != nil {
+				t.Fatalf("Smudge: %v", err)
+			}
+			want := tt.content
+			if tt.passThrough {
+				want, _ = c.Decrypt(tt.content)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Smudge = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSmudgePassesPlaintextThrough(t *testing.T) {
+	c := newTestCipher(t, 1)
+	content := []byte("committed before the filter was set up")
+	got, err := smudge(c, content)
+	if err != nil {
+		t.Fatalf("Smudge: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Smudge = %q, want %q", got, content)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	c := newTestCipher(t, 1)
+	blob := c.Encrypt([]byte("secret"))
+
+	modified := append([]byte(nil), blob...)
+	modified[len(modified)-1] ^= 1
+	version := append([]byte(nil), blob...)
+	version[len(magic)] = blobVersion + 1
+
+	tests := []struct {
+		name string
+		c    *Cipher
+		blob []byte
+	}{
+		{"different key", newTestCipher(t, 2), blob},
+		{"modified", c, modified},
+		{"unknown version", c, version},
+		{"truncated", c, blob[:headerSize+4]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.c.Decrypt(tt.blob); err == nil {
+				t.Error("Decrypt succeeded, want an error")
+			}
+			if _, err := smudge(tt.c, tt.blob); err == nil {
+				t.Error("Smudge succeeded, want an error")
+			}
+		})
+	}
+
+	if _, err := c.Decrypt([]byte("plain")); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Decrypt of plaintext = %v, want ErrNotEncrypted", err)
+	}
+}
+
+func TestNewCipherRequiresSubkeys(t *testing.T) {
+	if _, err := NewCipher(nil); err == nil {
+		t.Error("NewCipher accepted no subkeys")
+	}
+	swapped := []types.Subkey{
+		{Label: NonceKeyLabel, Key: make([]byte, KeySize)},
+		{Label: EncryptionKeyLabel, Key: make([]byte, KeySize)},
+	}
+	if _, err := NewCipher(swapped); err == nil {
+		t.Error("NewCipher accepted subkeys in the wrong order")
+	}
+}
@@ -0,0 +1,138 @@
+package gitfilter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxPacketData is the largest payload of a pkt-line: 65520 bytes minus the 4-byte length.
+const maxPacketData = 65516
+
+// errFlush is returned by readPacket for a flush packet ("0000").
+var errFlush = errors.New("flush packet")
+
+// pktReader reads git's pkt-line framing: every packet starts with its length,
+// including the length itself, as four hex digits, and "0000" is a flush packet.
+type pktReader struct {
+	r *bufio.Reader
+}
+
+// newPktReader creates a pkt-line reader.
+func newPktReader(r io.Reader) *pktReader {
+	return &pktReader{r: bufio.NewReader(r)}
+}
+
+// readPacket reads one packet. Returns errFlush for a flush packet and io.EOF
+// if the stream ends between packets.
+func (p *pktReader) readPacket() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(p.r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated pkt-line header")
+		}
+		return nil, err
+	}
+
+	length, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length '%s'", header)
+	}
+	switch {
+	case length == 0:
+		return nil, errFlush
+	case length < 4 || length-4 > maxPacketData:
+		return nil, fmt.Errorf("invalid pkt-line length %d", length)
+	}
+
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return nil, fmt.Errorf("truncated pkt-line: %w", err)
+	}
+	return data, nil
+}
+
+// readLines reads text packets up to the next flush packet, without their trailing newline.
+func (p *pktReader) readLines() ([]string, error) {
+	var lines []string
+	for {
+		data, err := p.readPacket()
+		if errors.Is(err, errFlush) {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+// readContent reads binary packets up to the next flush packet and returns their concatenation.
+func (p *pktReader) readContent() ([]byte, error) {
+	var content []byte
+	for {
+		data, err := p.readPacket()
+		if errors.Is(err, errFlush) {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, data...)
+	}
+}
+
+// pktWriter writes git's pkt-line framing. Output is buffered until flush is called.
+type pktWriter struct {
+	w *bufio.Writer
+}
+
+// newPktWriter creates a pkt-line writer.
+func newPktWriter(w io.Writer) *pktWriter {
+	return &pktWriter{w: bufio.NewWriter(w)}
+}
+
+// writePacket writes one packet of at most maxPacketData bytes.
+func (p *pktWriter) writePacket(data []byte) error {
+	if len(data) == 0 || len(data) > maxPacketData {
+		return fmt.Errorf("invalid pkt-line payload size %d", len(data))
+	}
+	if _, err := fmt.Fprintf(p.w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
+
+// writeLines writes text packets, each terminated by a newline, followed by a flush packet.
+func (p *pktWriter) writeLines(lines ...string) error {
+	for _, line := range lines {
+		if err := p.writePacket([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+	return p.flush()
+}
+
+// writeContent writes data split into packets, followed by a flush packet.
+func (p *pktWriter) writeContent(data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), maxPacketData)
+		if err := p.writePacket(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return p.flush()
+}
+
+// flush writes a flush packet and sends the buffered output.
+func (p *pktWriter) flush() error {
+	if _, err := p.w.WriteString("0000"); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
@@ -0,0 +1,97 @@
+package gitfilter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPktWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newPktWriter(&buf)
+	if err := w.writeLines("git-filter-server", "version=2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.writeContent([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	want := "0016git-filter-server\n000eversion=2\n0000" + "0007abc0000"
+	if got := buf.String(); got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestPktRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hello")},
+		{"one full packet", bytes.Repeat([]byte{'a'}, maxPacketData)},
+		{"split into packets", bytes.Repeat([]byte{0, 1, 2}, maxPacketData)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newPktWriter(&buf)
+			if err := w.writeLines("command=smudge", "pathname=a b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.writeContent(tt.content); err != nil {
+				t.Fatal(err)
+			}
+
+			r := newPktReader(&buf)
+			lines, err := r.readLines()
+			if err != nil {
+				t.Fatalf("readLines: %v", err)
+			}
+			if strings.Join(lines, "|") != "command=smudge|pathname=a b" {
+				t.Errorf("readLines = %q", lines)
+			}
+			content, err := r.readContent()
+			if err != nil {
+				t.Fatalf("readContent: %v", err)
+			}
+			if !bytes.Equal(content, tt.content) {
+				t.Errorf("readContent returned %d bytes, want %d", len(content), len(tt.content))
+			}
+			if _, err := r.readPacket(); !errors.Is(err, io.EOF) {
+				t.Errorf("readPacket at the end = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestPktReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"truncated header", "00"},
+		{"non-hex length", "00zz"},
+		{"length below header size", "0003"},
+		{"length above maximum", "fff1" + strings.Repeat("a", 0xfff1-4)},
+		{"truncated payload", "0008ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newPktReader(strings.NewReader(tt.input)).readPacket()
+			if err == nil || errors.Is(err, io.EOF) || errors.Is(err, errFlush) {
+				t.Errorf("readPacket = %v, want a framing error", err)
+			}
+		})
+	}
+}
+
+func TestPktWriterRejectsInvalidPayloads(t *testing.T) {
+	w := newPktWriter(io.Discard)
+	for _, size := range []int{0, maxPacketData + 1} {
+		if err := w.writePacket(make([]byte, size)); err == nil {
+			t.Errorf("writePacket of %d bytes succeeded, want an error", size)
+		}
+	}
+}
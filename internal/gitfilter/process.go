@@ -0,0 +1,213 @@
+package gitfilter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// CipherSource creates the cipher, typically by deriving the HMAC secret from the device.
+// A Process calls it at most once, when the first blob needs a key.
+type CipherSource func() (*Cipher, error)
+
+// ErrorHandler is told about every blob the process fails to filter.
+type ErrorHandler func(command, pathname string, err error)
+
+// processCapabilities lists the capabilities the process offers, in order.
+var processCapabilities = []string{"clean", "smudge", "delay"}
+
+// Process implements git's long-running filter protocol (filter.<driver>.process),
+// so a single process filters all blobs of a checkout and the secret is derived
+// once instead of once per file. See gitprotocol-common(5) and gitattributes(5).
+//
+// If git allows it, smudge requests are delayed while the secret is derived in the
+// background, so git can check out the other files in the meantime.
+type Process struct {
+	in      *pktReader
+	out     *pktWriter
+	source  CipherSource
+	onError ErrorHandler
+
+	capabilities map[string]bool   // Capabilities negotiated with git
+	delayed      map[string][]byte // Blobs of delayed smudge requests by pathname
+
+	once   sync.Once     // Guards the call of source
+	ready  chan struct{} // Closed once cipher and err are set
+	cipher *Cipher
+	err    error
+}
+
+// NewProcess creates a filter process that talks to git over r and w.
+func NewProcess(r io.Reader, w io.Writer, source CipherSource, onError ErrorHandler) *Process {
+	return &Process{
+		in:           newPktReader(r),
+		out:          newPktWriter(w),
+		source:       source,
+		onError:      onError,
+		capabilities: make(map[string]bool),
+		delayed:      make(map[string][]byte),
+		ready:        make(chan struct{}),
+	}
+}
+
+// Serve runs the handshake and handles requests until git closes the connection.
+// Failures to filter a blob are reported to git and the error handler; an error is
+// only returned if the protocol itself fails.
+func (p *Process) Serve() error {
+	if err := p.handshake(); err != nil {
+		return fmt.Errorf("git filter handshake failed: %w", err)
+	}
+
+	for {
+		lines, err := p.in.readLines()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		request := parseRequest(lines)
+		switch command := request["command"]; command {
+		case "clean", "smudge":
+			err = p.handleFilter(command, request)
+		case "list_available_blobs":
+			err = p.handleListAvailable()
+		default:
+			return fmt.Errorf("unknown git filter command '%s'", command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handshake exchanges the welcome messages and negotiates the capabilities.
+func (p *Process) handshake() error {
+	welcome, err := p.in.readLines()
+	if err != nil {
+		return err
+	}
+	if len(welcome) == 0 || welcome[0] != "git-filter-client" || !slices.Contains(welcome[1:], "version=2") {
+		return fmt.Errorf("unsupported client welcome %q (expected git-filter-client with version=2)", welcome)
+	}
+	if err := p.out.writeLines("git-filter-server", "version=2"); err != nil {
+		return err
+	}
+
+	offered, err := p.in.readLines()
+	if err != nil {
+		return err
+	}
+	var accepted []string
+	for _, capability := range processCapabilities {
+		if slices.Contains(offered, "capability="+capability) {
+			p.capabilities[capability] = true
+			accepted = append(accepted, "capability="+capability)
+		}
+	}
+	return p.out.writeLines(accepted...)
+}
+
+// handleFilter handles a clean or smudge request and its content.
+func (p *Process) handleFilter(command string, request map[string]string) error {
+	content, err := p.in.readContent()
+	if err != nil {
+		return err
+	}
+	pathname := request["pathname"]
+
+	if command == "smudge" {
+		// A delayed blob is requested again without content once it is available
+		if blob, ok := p.delayed[pathname]; ok && len(content) == 0 {
+			content = blob
+			delete(p.delayed, pathname)
+		} else if p.capabilities["delay"] && request["can-delay"] == "1" && IsEncrypted(content) && !p.isReady() {
+			p.delayed[pathname] = content
+			go p.derive()
+			return p.out.writeLines("status=delayed")
+		}
+	}
+
+	// Unencrypted blobs are passed through on smudge; every staged file needs the key,
+	// as only blobs that decrypt with it are kept as they are
+	result := content
+	if command == "clean" || IsEncrypted(content) {
+		cipher, err := p.getCipher()
+		if err != nil {
+			// Without a key no further blob can be filtered, and retrying would cost PIN attempts
+			p.onError(command, pathname, err)
+			return p.out.writeLines("status=abort")
+		}
+		if command == "clean" {
+			result = cipher.clean(content)
+		} else if result, err = cipher.Decrypt(content); err != nil {
+			p.onError(command, pathname, err)
+			return p.out.writeLines("status=error")
+		}
+	}
+
+	if err := p.out.writeLines("status=success"); err != nil {
+		return err
+	}
+	if err := p.out.writeContent(result); err != nil {
+		return err
+	}
+	// An empty list keeps the status sent before the content
+	return p.out.writeLines()
+}
+
+// handleListAvailable lists the delayed blobs, blocking until the secret is derived.
+func (p *Process) handleListAvailable() error {
+	if len(p.delayed) > 0 {
+		<-p.ready
+	}
+
+	pathnames := make([]string, 0, len(p.delayed))
+	for pathname := range p.delayed {
+		pathnames = append(pathnames, "pathname="+pathname)
+	}
+	slices.Sort(pathnames)
+	if err := p.out.writeLines(pathnames...); err != nil {
+		return err
+	}
+	return p.out.writeLines("status=success")
+}
+
+// derive calls the cipher source once. Concurrent callers wait for the first one.
+func (p *Process) derive() {
+	p.once.Do(func() {
+		p.cipher, p.err = p.source()
+		close(p.ready)
+	})
+}
+
+// getCipher returns the cipher, deriving it if necessary.
+func (p *Process) getCipher() (*Cipher, error) {
+	p.derive()
+	return p.cipher, p.err
+}
+
+// isReady reports whether the cipher source has returned.
+func (p *Process) isReady() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseRequest parses the key=value lines of a request.
+func parseRequest(lines []string) map[string]string {
+	request := make(map[string]string, len(lines))
+	for _, line := range lines {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			request[key] = value
+		}
+	}
+	return request
+}
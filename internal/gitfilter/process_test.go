@@ -0,0 +1,195 @@
+package gitfilter
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gitRequest is a request sent by the fake git client.
+type gitRequest struct {
+	lines   []string
+	content []byte
+	noBody  bool // The request has no content packets, like list_available_blobs
+}
+
+// runProcess serves the requests after the handshake and returns the response reader.
+func runProcess(t *testing.T, capabilities []string, requests []gitRequest, source CipherSource) (*pktReader, []string) {
+	t.Helper()
+	var input bytes.Buffer
+	w := newPktWriter(&input)
+	mustWrite(t, w.writeLines("git-filter-client", "version=2"))
+	mustWrite(t, w.writeLines(capabilities...))
+	for _, request := range requests {
+		mustWrite(t, w.writeLines(request.lines...))
+		if !request.noBody {
+			mustWrite(t, w.writeContent(request.content))
+		}
+	}
+
+	var output bytes.Buffer
+	var failures []string
+	process := NewProcess(&input, &output, source, func(command, pathname string, err error) {
+		failures = append(failures, command+" "+pathname)
+	})
+	if err := process.Serve(); err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+
+	r := newPktReader(&output)
+	expectLines(t, r, "git-filter-server", "version=2")
+	return r, failures
+}
+
+func mustWrite(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectLines(t *testing.T, r *pktReader, want ...string) {
+	t.Helper()
+	lines, err := r.readLines()
+	if err != nil {
+		t.Fatalf("readLines: %v", err)
+	}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Fatalf("response %q, want %q", lines, want)
+	}
+}
+
+// expectContent reads a successful response and returns its content.
+func expectContent(t *testing.T, r *pktReader) []byte {
+	t.Helper()
+	expectLines(t, r, "status=success")
+	content, err := r.readContent()
+	if err != nil {
+		t.Fatalf("readContent: %v", err)
+	}
+	expectLines(t, r)
+	return content
+}
+
+func TestProcessCleanSmudge(t *testing.T) {
+	c := newTestCipher(t, 1)
+	calls := 0
+	source := func() (*Cipher, error) {
+		calls++
+		return c, nil
+	}
+
+	requests := []gitRequest{
+		{lines: []string{"command=clean", "pathname=a.txt"}, content: []byte("secret a")},
+		{lines: []string{"command=clean", "pathname=b.txt"}, content: c.Encrypt([]byte("secret b"))},
+		{lines: []string{"command=smudge", "pathname=a.txt"}, content: c.Encrypt([]byte("secret a"))},
+		{lines: []string{"command=smudge", "pathname=plain.txt"}, content: []byte("plain")},
+	}
+	r, failures := runProcess(t, []string{"capability=clean", "capability=smudge"}, requests, source)
+	expectLines(t, r, "capability=clean", "capability=smudge")
+
+	if got := expectContent(t, r); !bytes.Equal(got, c.Encrypt([]byte("secret a"))) {
+		t.Errorf("clean of a.txt = %x", got)
+	}
+	if got := expectContent(t, r); !bytes.Equal(got, c.Encrypt([]byte("secret b"))) {
+		t.Errorf("clean of an encrypted blob changed it to %x", got)
+	}
+	if got := expectContent(t, r); string(got) != "secret a" {
+		t.Errorf("smudge of a.txt = %q", got)
+	}
+	if got := expectContent(t, r); string(got) != "plain" {
+		t.Errorf("smudge of plain.txt = %q", got)
+	}
+	if calls != 1 {
+		t.Errorf("cipher source called %d times, want 1", calls)
+	}
+	if len(failures) != 0 {
+		t.Errorf("unexpected failures %q", failures)
+	}
+}
+
+func TestProcessEncryptsForeignBlobs(t *testing.T) {
+	c := newTestCipher(t, 1)
+	foreign := newTestCipher(t, 2).Encrypt([]byte("foreign"))
+	requests := []gitRequest{
+		{lines: []string{"command=clean", "pathname=a.txt"}, content: foreign},
+	}
+	r, _ := runProcess(t, []string{"capability=clean"}, requests, func() (*Cipher, error) { return c, nil })
+	expectLines(t, r, "capability=clean")
+
+	blob := expectContent(t, r)
+	if bytes.Equal(blob, foreign) {
+		t.Fatal("a blob of another key was passed through")
+	}
+	if got, err := c.Decrypt(blob); err != nil || !bytes.Equal(got, foreign) {
+		t.Errorf("Decrypt = %x, %v, want the foreign blob", got, err)
+	}
+}
+
+func TestProcessErrors(t *testing.T) {
+	c := newTestCipher(t, 1)
+	requests := []gitRequest{
+		{lines: []string{"command=smudge", "pathname=other.txt"}, content: newTestCipher(t, 2).Encrypt([]byte("x"))},
+		{lines: []string{"command=smudge", "pathname=ok.txt"}, content: c.Encrypt([]byte("ok"))},
+	}
+	r, failures := runProcess(t, []string{"capability=smudge"}, requests, func() (*Cipher, error) { return c, nil })
+	expectLines(t, r, "capability=smudge")
+	expectLines(t, r, "status=error")
+	if got := expectContent(t, r); string(got) != "ok" {
+		t.Errorf("smudge of ok.txt = %q", got)
+	}
+	if strings.Join(failures, "|") != "smudge other.txt" {
+		t.Errorf("failures %q, want the blob of another key", failures)
+	}
+
+	// Without a key, git is told to stop using the filter
+	requests = []gitRequest{
+		{lines: []string{"command=clean", "pathname=a.txt"}, content: []byte("a")},
+	}
+	r, failures = runProcess(t, []string{"capability=clean"}, requests, func() (*Cipher, error) {
+		return nil, errors.New("no device")
+	})
+	expectLines(t, r, "capability=clean")
+	expectLines(t, r, "status=abort")
+	if len(failures) != 1 {
+		t.Errorf("failures %q, want one", failures)
+	}
+}
+
+func TestProcessDelay(t *testing.T) {
+	c := newTestCipher(t, 1)
+	requests := []gitRequest{
+		{lines: []string{"command=smudge", "pathname=b.txt", "can-delay=1"}, content: c.Encrypt([]byte("b"))},
+		{lines: []string{"command=smudge", "pathname=a.txt", "can-delay=1"}, content: c.Encrypt([]byte("a"))},
+		{lines: []string{"command=list_available_blobs"}, noBody: true},
+		{lines: []string{"command=smudge", "pathname=a.txt"}},
+		{lines: []string{"command=smudge", "pathname=b.txt"}},
+	}
+	// The derivation takes a moment, like touching a device
+	r, _ := runProcess(t, []string{"capability=clean", "capability=smudge", "capability=delay"}, requests,
+		func() (*Cipher, error) {
+			time.Sleep(50 * time.Millisecond)
+			return c, nil
+		})
+	expectLines(t, r, "capability=clean", "capability=smudge", "capability=delay")
+
+	expectLines(t, r, "status=delayed")
+	// The second blob is delayed too unless the background derivation has already finished
+	lines, err := r.readLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines[0] == "status=success" {
+		t.Skip("the cipher was ready before the second request")
+	}
+	expectLines(t, r, "pathname=a.txt", "pathname=b.txt")
+	expectLines(t, r, "status=success")
+	if got := expectContent(t, r); string(got) != "a" {
+		t.Errorf("delayed smudge of a.txt = %q", got)
+	}
+	if got := expectContent(t, r); string(got) != "b" {
+		t.Errorf("delayed smudge of b.txt = %q", got)
+	}
+}
@@ -0,0 +1,150 @@
+package gitfilter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultDriver is the name of the filter and diff driver written by Setup.
+const DefaultDriver = "fido2"
+
+// SetupOptions describes the filter configuration written by Setup.
+type SetupOptions struct {
+	Driver   string   // Name of the filter and diff driver (e.g., "fido2")
+	Command  []string // Filter command line without the action, e.g. the binary, "git-filter" and its flags
+	Patterns []string // File patterns to encrypt, added to .gitattributes
+}
+
+// SetupResult reports what Setup changed.
+type SetupResult struct {
+	RepositoryRoot string   // Top-level directory of the repository
+	Attributes     string   // Path of the .gitattributes file
+	Added          []string // Lines added to .gitattributes
+}
+
+// Setup configures the filter in the git repository containing dir: the long-running
+// filter process, the clean and smudge filter used by git versions without process
+// support, and the textconv diff driver in the local git config, and one
+// .gitattributes line per pattern selecting both. Lines already present in
+// .gitattributes are not added again.
+func Setup(dir string, options *SetupOptions) (*SetupResult, error) {
+	if options.Driver == "" || strings.ContainsAny(options.Driver, " \t.=") {
+		return nil, fmt.Errorf("invalid filter driver name '%s'", options.Driver)
+	}
+	if len(options.Command) == 0 {
+		return nil, fmt.Errorf("no filter command given")
+	}
+	for _, arg := range options.Command {
+		// git expands %f in filter commands, so a literal percent sign would be mangled
+		if strings.Contains(arg, "%") {
+			return nil, fmt.Errorf("invalid filter argument '%s': it cannot contain '%%'", arg)
+		}
+	}
+	for _, pattern := range options.Patterns {
+		if pattern == "" || strings.ContainsAny(pattern, " \t\n") {
+			return nil, fmt.Errorf("invalid pattern '%s': patterns cannot be empty or contain whitespace", pattern)
+		}
+	}
+
+	root, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("not a git repository: %w", err)
+	}
+
+	command := shellJoin(options.Command)
+	settings := [][2]string{
+		{"filter." + options.Driver + ".clean", command + " clean %f"},
+		{"filter." + options.Driver + ".smudge", command + " smudge %f"},
+		{"filter." + options.Driver + ".process", command + " process"},
+		{"filter." + options.Driver + ".required", "true"},
+		{"diff." + options.Driver + ".textconv", command + " textconv"},
+	}
+	for _, setting := range settings {
+		if _, err := git(root, "config", "--local", setting[0], setting[1]); err != nil {
+			return nil, fmt.Errorf("failed to set %s: %w", setting[0], err)
+		}
+	}
+
+	result := &SetupResult{RepositoryRoot: root, Attributes: filepath.Join(root, ".gitattributes")}
+	result.Added, err = addAttributes(result.Attributes, options.Driver, options.Patterns)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// addAttributes appends the attribute lines for the patterns that are missing.
+func addAttributes(path, driver string, patterns []string) ([]string, error) {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	present := make(map[string]bool)
+	for _, line := range strings.Split(string(existing), "\n") {
+		present[strings.Join(strings.Fields(line), " ")] = true
+	}
+
+	var added []string
+	var buf bytes.Buffer
+	if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	for _, pattern := range patterns {
+		line := fmt.Sprintf("%s filter=%s diff=%s", pattern, driver, driver)
+		if present[line] {
+			continue
+		}
+		present[line] = true
+		added = append(added, line)
+		buf.WriteString(line + "\n")
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return added, nil
+}
+
+// git runs a git command in dir and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%w: %s", err, message)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// shellJoin quotes the arguments for the shell git runs filter commands with.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+./:,@") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
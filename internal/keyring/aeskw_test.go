@@ -0,0 +1,116 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test vectors of RFC 3394 section 4.
+var aesKWVectors = []struct {
+	name    string
+	kek     string
+	key     string
+	wrapped string
+}{
+	{
+		"128-bit key with 128-bit KEK",
+		"000102030405060708090A0B0C0D0E0F",
+		"00112233445566778899AABBCCDDEEFF",
+		"1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+	},
+	{
+		"128-bit key with 192-bit KEK",
+		"000102030405060708090A0B0C0D0E0F1011121314151617",
+		"00112233445566778899AABBCCDDEEFF",
+		"96778B25AE6CA435F92B5B97C050AED2468AB8A17AD84E5D",
+	},
+	{
+		"128-bit key with 256-bit KEK",
+		"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+		"00112233445566778899AABBCCDDEEFF",
+		"64E8C3F9CE0F5BA263E9777905818A2A93C8191E7D6E8AE7",
+	},
+	{
+		"192-bit key with 192-bit KEK",
+		"000102030405060708090A0B0C0D0E0F1011121314151617",
+		"00112233445566778899AABBCCDDEEFF0001020304050607",
+		"031D33264E15D33268F24EC260743EDCE1C6C7DDEE725A936BA814915C6762D2",
+	},
+	{
+		"192-bit key with 256-bit KEK",
+		"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+		"00112233445566778899AABBCCDDEEFF0001020304050607",
+		"A8F9BC1612C68B3FF6E6F4FBE30E71E4769C8B80A32CB8958CD5D17D6B254DA1",
+	},
+	{
+		"256-bit key with 256-bit KEK",
+		"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+		"00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+		"28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+	},
+}
+
+func TestAESKeyWrap(t *testing.T) {
+	for _, tt := range aesKWVectors {
+		t.Run(tt.name, func(t *testing.T) {
+			kek, key, wrapped := unhex(t, tt.kek), unhex(t, tt.key), unhex(t, tt.wrapped)
+
+			got, err := aesKeyWrap(kek, key)
+			if err != nil {
+				t.Fatalf("aesKeyWrap: %v", err)
+			}
+			if !bytes.Equal(got, wrapped) {
+				t.Errorf("aesKeyWrap = %X, want %X", got, wrapped)
+			}
+
+			got, err = aesKeyUnwrap(kek, wrapped)
+			if err != nil {
+				t.Fatalf("aesKeyUnwrap: %v", err)
+			}
+			if !bytes.Equal(got, key) {
+				t.Errorf("aesKeyUnwrap = %X, want %X", got, key)
+			}
+		})
+	}
+}
+
+func TestAESKeyUnwrapIntegrity(t *testing.T) {
+	tt := aesKWVectors[2]
+	kek, wrapped := unhex(t, tt.kek), unhex(t, tt.wrapped)
+
+	tampered := append([]byte(nil), wrapped...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := aesKeyUnwrap(kek, tampered); err == nil {
+		t.Error("aesKeyUnwrap accepted a modified key")
+	}
+
+	otherKEK := append([]byte(nil), kek...)
+	otherKEK[0] ^= 1
+	if _, err := aesKeyUnwrap(otherKEK, wrapped); err == nil {
+		t.Error("aesKeyUnwrap accepted a different KEK")
+	}
+}
+
+func TestAESKeyWrapInvalidLength(t *testing.T) {
+	kek := make([]byte, 32)
+	for _, n := range []int{0, 8, 20} {
+		if _, err := aesKeyWrap(kek, make([]byte, n)); err == nil {
+			t.Errorf("aesKeyWrap of %d bytes succeeded, want an error", n)
+		}
+	}
+	for _, n := range []int{16, 25} {
+		if _, err := aesKeyUnwrap(kek, make([]byte, n)); err == nil {
+			t.Errorf("aesKeyUnwrap of %d bytes succeeded, want an error", n)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Package keyring implements envelope encryption: random data encryption keys (DEKs)
+// are wrapped with a key encryption key (KEK) derived from the FIDO2 secret and kept
+// in a small JSON keyring file. Data is encrypted with the DEKs, so rotating the
+// FIDO2 credential or salt only means rewrapping the DEKs, not re-encrypting the data.
+//
+// Every wrapped key records the relying party, credential and salt of the secret its
+// KEK was derived from, so it can be unwrapped without further options.
+package keyring
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Schema identifies keyring files.
+const Schema = "fido2-hmac-deriver/keyring"
+
+// SchemaVersion is the version of the keyring file format.
+const SchemaVersion = 1
+
+// DefaultKeyLength is the length of a generated DEK in bytes.
+const DefaultKeyLength = 32
+
+// kekInfo is the HKDF info parameter of the KEK.
+const kekInfo = "fido2-hmac-deriver:keyring:v1:kek"
+
+// Algorithm selects how DEKs are wrapped.
+type Algorithm string
+
+const (
+	// AlgorithmAESKW is AES-256 key wrap (RFC 3394). It needs no nonce, but only
+	// wraps keys of at least 16 bytes in multiples of 8.
+	AlgorithmAESKW Algorithm = "aes-kw"
+
+	// AlgorithmXChaCha20Poly1305 is XChaCha20-Poly1305 with a random nonce and the
+	// key name as additional data, so a wrapped key cannot be moved to another name.
+	AlgorithmXChaCha20Poly1305 Algorithm = "xchacha20-poly1305"
+)
+
+// Source identifies the secret a KEK was derived from.
+type Source struct {
+	RelyingPartyID string `json:"rp_id"`
+	CredentialID   []byte `json:"credential_id"`
+	AAGUID         []byte `json:"aaguid,omitempty"`
+	Salt           []byte `json:"salt"`
+}
+
+// SourceOf returns the source of the secret in a derivation result.
+func SourceOf(result *types.HMACResult) Source {
+	source := Source{
+		RelyingPartyID: result.RelyingParty,
+		CredentialID:   result.CredentialID,
+		Salt:           result.Salt,
+	}
+	if result.Device != nil {
+		source.AAGUID = result.Device.AAGUID
+	}
+	return source
+}
+
+// Equal reports whether two sources yield the same secret.
+func (s Source) Equal(other Source) bool {
+	return s.RelyingPartyID == other.RelyingPartyID &&
+		bytes.Equal(s.CredentialID, other.CredentialID) &&
+		bytes.Equal(s.Salt, other.Salt)
+}
+
+// WrappedKey is a DEK wrapped with a KEK.
+type WrappedKey struct {
+	Name      string    `json:"name"`
+	Algorithm Algorithm `json:"algorithm"`
+	Length    int       `json:"length"`
+	Wrapped   []byte    `json:"wrapped"`
+	Nonce     []byte    `json:"nonce,omitempty"`
+	Source    Source    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+	WrappedAt time.Time `json:"wrapped_at"`
+}
+
+// Keyring is the contents of a keyring file.
+type Keyring struct {
+	Schema  string        `json:"schema"`
+	Version int           `json:"version"`
+	Keys    []*WrappedKey `json:"keys"`
+}
+
+// New returns an empty keyring.
+func New() *Keyring {
+	return &Keyring{Schema: Schema, Version: SchemaVersion}
+}
+
+// DefaultPath returns the default keyring file in the given store directory.
+func DefaultPath(storeDir string) string {
+	return filepath.Join(storeDir, "keyring.json")
+}
+
+// Load reads a keyring file. A missing file yields an empty keyring.
+func Load(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+
+	var keyring Keyring
+	if err := json.Unmarshal(data, &keyring); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %w", path, err)
+	}
+	if keyring.Schema != Schema {
+		return nil, fmt.Errorf("%s is not a keyring file", path)
+	}
+	if keyring.Version != SchemaVersion {
+		return nil, fmt.Errorf("unsupported keyring version %d (expected %d)", keyring.Version, SchemaVersion)
+	}
+	return &keyring, nil
+}
+
+// Save writes the keyring file atomically, readable only by its owner.
+func (k *Keyring) Save(path string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create keyring directory: %w", err)
+	}
+	if err := store.WriteFileAtomic(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	return nil
+}
+
+// Find returns the key with the given name, or nil if there is none.
+func (k *Keyring) Find(name string) *WrappedKey {
+	for _, key := range k.Keys {
+		if key.Name == name {
+			return key
+		}
+	}
+	return nil
+}
+
+// Add adds a wrapped key. Names must be unique.
+func (k *Keyring) Add(key *WrappedKey) error {
+	if key.Name == "" {
+		return errors.New("key name cannot be empty")
+	}
+	if k.Find(key.Name) != nil {
+		return fmt.Errorf("the keyring already holds a key named '%s'", key.Name)
+	}
+	k.Keys = append(k.Keys, key)
+	return nil
+}
+
+// Remove removes the key with the given name and reports whether it existed.
+func (k *Keyring) Remove(name string) bool {
+	for i, key := range k.Keys {
+		if key.Name == name {
+			k.Keys = append(k.Keys[:i], k.Keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAlgorithm returns an error for unknown wrapping algorithms.
+func CheckAlgorithm(algorithm Algorithm) error {
+	switch algorithm {
+	case AlgorithmAESKW, AlgorithmXChaCha20Poly1305:
+		return nil
+	default:
+		return fmt.Errorf("unknown wrapping algorithm '%s' (expected %s or %s)", algorithm, AlgorithmAESKW, AlgorithmXChaCha20Poly1305)
+	}
+}
+
+// CheckKeyLength returns an error if keys of the given length cannot be wrapped with the algorithm.
+func CheckKeyLength(algorithm Algorithm, length int) error {
+	if length <= 0 {
+		return fmt.Errorf("key length must be positive, got %d", length)
+	}
+	if algorithm == AlgorithmAESKW && (length < 16 || length%8 != 0) {
+		return fmt.Errorf("%s needs a key of at least 16 bytes in multiples of 8, got %d", AlgorithmAESKW, length)
+	}
+	return nil
+}
+
+// DeriveKEK derives the key encryption key from an HMAC secret with HKDF.
+func DeriveKEK(secret []byte) ([]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot derive a KEK from an empty secret")
+	}
+	return hkdf.Key(sha256.New, secret, nil, kekInfo, 32)
+}
+
+// GenerateKey returns a random DEK of the given length.
+func GenerateKey(length int) ([]byte, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("key length must be positive, got %d", length)
+	}
+	key := make([]byte, length)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// Wrap wraps a DEK with the KEK derived from the source's secret.
+//
+// Parameters:
+//   - name: The name of the key, bound to it by XChaCha20-Poly1305
+//   - algorithm: The wrapping algorithm
+//   - dek: The data encryption key to wrap
+//   - kek: The key encryption key (see DeriveKEK)
+//   - source: The secret the KEK was derived from
+//
+// Returns:
+//   - The wrapped key
+//   - An error if the algorithm is unknown or cannot wrap a key of this length
+func Wrap(name string, algorithm Algorithm, dek, kek []byte, source Source) (*WrappedKey, error) {
+	key := &WrappedKey{Name: name, Algorithm: algorithm, CreatedAt: time.Now().UTC()}
+	if err := key.wrap(dek, kek, source); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Rewrap wraps the DEK again with a new KEK, e.g. after rotating the credential or salt.
+func (w *WrappedKey) Rewrap(dek, kek []byte, source Source) error {
+	return w.wrap(dek, kek, source)
+}
+
+// wrap sets the wrapped key, nonce and source.
+func (w *WrappedKey) wrap(dek, kek []byte, source Source) error {
+	switch w.Algorithm {
+	case AlgorithmAESKW:
+		wrapped, err := aesKeyWrap(kek, dek)
+		if err != nil {
+			return err
+		}
+		w.Wrapped, w.Nonce = wrapped, nil
+	case AlgorithmXChaCha20Poly1305:
+		aead, err := chacha20poly1305.NewX(kek)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		w.Wrapped, w.Nonce = aead.Seal(nil, nonce, dek, []byte(w.Name)), nonce
+	default:
+		return CheckAlgorithm(w.Algorithm)
+	}
+
+	w.Length = len(dek)
+	w.Source = source
+	w.WrappedAt = time.Now().UTC()
+	return nil
+}
+
+// Unwrap returns the DEK, or an error if the KEK is wrong or the key was modified.
+func (w *WrappedKey) Unwrap(kek []byte) ([]byte, error) {
+	var dek []byte
+	var err error
+	switch w.Algorithm {
+	case AlgorithmAESKW:
+		dek, err = aesKeyUnwrap(kek, w.Wrapped)
+	case AlgorithmXChaCha20Poly1305:
+		// Open panics on a nonce of the wrong size, which a modified file may hold
+		if len(w.Nonce) != chacha20poly1305.NonceSizeX {
+			return nil, fmt.Errorf("failed to unwrap key '%s': its nonce has %d bytes instead of %d, the file has been modified",
+				w.Name, len(w.Nonce), chacha20poly1305.NonceSizeX)
+		}
+		var aead cipher.AEAD
+		if aead, err = chacha20poly1305.NewX(kek); err == nil {
+			dek, err = aead.Open(nil, w.Nonce, w.Wrapped, []byte(w.Name))
+		}
+	default:
+		return nil, CheckAlgorithm(w.Algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key '%s': it was wrapped with a different secret or has been modified", w.Name)
+	}
+	return dek, nil
+}
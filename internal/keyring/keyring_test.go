@@ -0,0 +1,80 @@
+package keyring
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrapUnwrap(t *testing.T) {
+	kek, err := DeriveKEK(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("DeriveKEK: %v", err)
+	}
+	otherKEK, err := DeriveKEK(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatalf("DeriveKEK: %v", err)
+	}
+	dek := bytes.Repeat([]byte{0x42}, DefaultKeyLength)
+
+	for _, algorithm := range []Algorithm{AlgorithmAESKW, AlgorithmXChaCha20Poly1305} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			key, err := Wrap("db", algorithm, dek, kek, Source{RelyingPartyID: "e2e-git"})
+			if err != nil {
+				t.Fatalf("Wrap: %v", err)
+			}
+			got, err := key.Unwrap(kek)
+			if err != nil {
+				t.Fatalf("Unwrap: %v", err)
+			}
+			if !bytes.Equal(got, dek) {
+				t.Errorf("Unwrap = %x, want %x", got, dek)
+			}
+
+			if _, err := key.Unwrap(otherKEK); err == nil {
+				t.Error("Unwrap with another KEK succeeded")
+			}
+			modified := *key
+			modified.Wrapped = append([]byte(nil), key.Wrapped...)
+			modified.Wrapped[0] ^= 1
+			if _, err := modified.Unwrap(kek); err == nil {
+				t.Error("Unwrap of a modified key succeeded")
+			}
+		})
+	}
+}
+
+func TestUnwrapRejectsModifiedNonce(t *testing.T) {
+	kek, err := DeriveKEK(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("DeriveKEK: %v", err)
+	}
+	key, err := Wrap("db", AlgorithmXChaCha20Poly1305, make([]byte, DefaultKeyLength), kek, Source{})
+	if err != nil {
+		t.Fatalf("Wrap: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		nonce []byte
+	}{
+		{"missing", nil},
+		{"short", key.Nonce[:12]},
+		{"long", append(append([]byte(nil), key.Nonce...), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modified := *key
+			modified.Nonce = tt.nonce
+			if _, err := modified.Unwrap(kek); err == nil {
+				t.Error("Unwrap succeeded, want an error")
+			}
+		})
+	}
+
+	// The name is bound to the key, so it cannot be moved to another name
+	renamed := *key
+	renamed.Name = "other"
+	if _, err := renamed.Unwrap(kek); err == nil {
+		t.Error("Unwrap of a renamed key succeeded")
+	}
+}
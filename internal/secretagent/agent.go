@@ -0,0 +1,374 @@
+// Package secretagent implements a daemon caching the HMAC secret, so that commands
+// run while it is unlocked need neither the PIN nor a touch. The secret is kept in
+// locked memory and forgotten after an idle timeout or a maximum lifetime, whichever
+// comes first, or when the agent is locked.
+//
+// Clients talk to the agent over a Unix socket, one JSON request and response per
+// connection. The agent only answers processes of its own user, checked with the
+// peer credentials of the connection in addition to the socket permissions.
+package secretagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/unixsocket"
+)
+
+// SocketEnvironment is the environment variable overriding the default socket path.
+const SocketEnvironment = "FIDO2_HMAC_DERIVER_AGENT_SOCK"
+
+// Request operations.
+const (
+	OpSecret = "secret" // Return the secret if it matches the query
+	OpLoad   = "load"   // Store a secret, replacing the current one
+	OpStatus = "status" // Describe the agent
+	OpLock   = "lock"   // Forget the secret
+	OpStop   = "stop"   // Forget the secret and exit
+)
+
+// requestTimeout bounds how long a connection may take, so a stuck client cannot block the agent.
+const requestTimeout = 10 * time.Second
+
+// Query selects the secret a command needs. A secret derived with a known credential
+// and salt matches on those; otherwise the derivation options have to be equal to
+// those the cached secret was derived with.
+type Query struct {
+	RelyingPartyID string `json:"relying_party_id"`
+
+	// Derivation with the stored credential
+	SaltMode       types.SaltMode `json:"salt_mode,omitempty"`
+	SaltContext    string         `json:"salt_context,omitempty"`
+	LegacySaltPath string         `json:"legacy_salt_path,omitempty"`
+	SaltGeneration int            `json:"salt_generation,omitempty"`
+	DevicePath     string         `json:"device_path,omitempty"` // Empty matches any device
+
+	// Derivation with a known credential and salt, e.g. from a file header
+	CredentialID []byte `json:"credential_id,omitempty"`
+	Salt         []byte `json:"salt,omitempty"`
+}
+
+// request is a message from a client.
+type request struct {
+	Op          string            `json:"op"`
+	Query       *Query            `json:"query,omitempty"`
+	Result      *types.HMACResult `json:"result,omitempty"`
+	IdleTimeout time.Duration     `json:"idle_timeout,omitempty"`
+	Lifetime    time.Duration     `json:"lifetime,omitempty"`
+}
+
+// response is the agent's answer. Result is nil if no cached secret matches.
+type response struct {
+	Error  string             `json:"error,omitempty"`
+	Result *types.HMACResult  `json:"result,omitempty"`
+	Status *types.AgentStatus `json:"status,omitempty"`
+}
+
+// DefaultSocketPath returns the socket given by SocketEnvironment, or agent.sock in
+// the runtime directory (see unixsocket.RuntimePath).
+func DefaultSocketPath() string {
+	if path := os.Getenv(SocketEnvironment); path != "" {
+		return path
+	}
+	return unixsocket.RuntimePath("agent.sock")
+}
+
+// Server is the agent holding the secret.
+type Server struct {
+	mu       sync.Mutex
+	secret   []byte            // Locked memory holding the secret, nil while locked
+	result   *types.HMACResult // Result the secret was derived with, without the secrets
+	query    Query             // Options the secret was derived with
+	idle     time.Duration
+	lifetime time.Duration
+	loadedAt time.Time
+	lastUsed time.Time
+	timer    *time.Timer
+
+	listener net.Listener
+}
+
+// NewServer creates a locked agent serving on the listener.
+func NewServer(listener net.Listener) (*Server, error) {
+	if err := hardenProcess(); err != nil {
+		return nil, fmt.Errorf("failed to protect the agent's memory: %w", err)
+	}
+	return &Server{listener: listener}, nil
+}
+
+// Serve answers requests until the agent is stopped or the listener is closed.
+// The secret is forgotten when it returns.
+func (s *Server) Serve() error {
+	defer s.lock()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the request of one connection.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	var resp response
+	if err := unixsocket.CheckPeer(conn); err != nil {
+		resp.Error = err.Error()
+		json.NewEncoder(conn).Encode(&resp)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("malformed request: %v", err)
+		json.NewEncoder(conn).Encode(&resp)
+		return
+	}
+
+	switch req.Op {
+	case OpSecret:
+		if req.Query == nil {
+			resp.Error = "missing query"
+			break
+		}
+		resp.Result = s.match(req.Query)
+	case OpLoad:
+		if err := s.load(req.Result, req.Query, req.IdleTimeout, req.Lifetime); err != nil {
+			resp.Error = err.Error()
+		}
+	case OpStatus:
+		resp.Status = s.status()
+	case OpLock:
+		s.lock()
+	case OpStop:
+		s.lock()
+	default:
+		resp.Error = fmt.Sprintf("unknown operation '%s'", req.Op)
+	}
+	json.NewEncoder(conn).Encode(&resp)
+	if resp.Result != nil {
+		clear(resp.Result.Secret)
+	}
+
+	// Serve returns once the listener is closed, so the client is answered first
+	if req.Op == OpStop {
+		s.listener.Close()
+	}
+}
+
+// load stores a secret in locked memory, replacing the current one.
+func (s *Server) load(result *types.HMACResult, query *Query, idle, lifetime time.Duration) error {
+	if result == nil || query == nil || len(result.Secret) == 0 {
+		return errors.New("missing secret")
+	}
+	if idle <= 0 || lifetime <= 0 {
+		return errors.New("the idle timeout and the lifetime must be positive")
+	}
+	defer clear(result.Secret)
+
+	secret, err := lockedBytes(len(result.Secret))
+	if err != nil {
+		return fmt.Errorf("failed to lock memory for the secret: %w", err)
+	}
+	copy(secret, result.Secret)
+
+	cached := *result
+	cached.Secret = nil
+	cached.NextSecret, cached.NextSalt, cached.Subkeys, cached.NextSubkeys = nil, nil, nil, nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockLocked()
+	s.secret = secret
+	s.result = &cached
+	s.query = *query
+	s.idle, s.lifetime = idle, lifetime
+	s.loadedAt = time.Now()
+	s.lastUsed = s.loadedAt
+	s.schedule()
+	return nil
+}
+
+// match returns a copy of the cached result with the secret if it matches the query.
+func (s *Server) match(query *Query) *types.HMACResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secret == nil || query.RelyingPartyID != s.result.RelyingParty {
+		return nil
+	}
+
+	if query.CredentialID != nil {
+		if !bytes.Equal(query.CredentialID, s.result.CredentialID) || !bytes.Equal(query.Salt, s.result.Salt) {
+			return nil
+		}
+	} else {
+		cached := s.query
+		if query.SaltMode != cached.SaltMode || query.SaltContext != cached.SaltContext ||
+			query.LegacySaltPath != cached.LegacySaltPath || query.SaltGeneration != cached.SaltGeneration {
+			return nil
+		}
+		if query.DevicePath != "" && (s.result.Device == nil || query.DevicePath != s.result.Device.Path) {
+			return nil
+		}
+	}
+
+	s.lastUsed = time.Now()
+	s.schedule()
+	result := *s.result
+	result.Secret = append([]byte(nil), s.secret...)
+	return &result
+}
+
+// status describes the agent.
+func (s *Server) status() *types.AgentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &types.AgentStatus{PID: os.Getpid(), Locked: s.secret == nil}
+	if s.secret != nil {
+		status.RelyingPartyID = s.result.RelyingParty
+		status.CredentialID = s.result.CredentialID
+		if s.result.Device != nil {
+			status.Device = s.result.Device.Name
+		}
+		status.LoadedAt = s.loadedAt
+		status.ExpiresAt = s.loadedAt.Add(s.lifetime)
+		status.IdleExpiresAt = s.lastUsed.Add(s.idle)
+	}
+	return status
+}
+
+// schedule locks the agent at the end of the idle timeout or the lifetime, whichever
+// comes first. The caller holds s.mu.
+func (s *Server) schedule() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(time.Until(s.deadline()), s.expire)
+}
+
+// deadline returns when the secret is forgotten unless it is used. The caller holds s.mu.
+func (s *Server) deadline() time.Time {
+	deadline := s.lastUsed.Add(s.idle)
+	if end := s.loadedAt.Add(s.lifetime); end.Before(deadline) {
+		deadline = end
+	}
+	return deadline
+}
+
+// expire forgets the secret if its deadline has passed. A timer may fire after the
+// secret was used or replaced, so the deadline is checked again.
+func (s *Server) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secret != nil && !time.Now().Before(s.deadline()) {
+		s.lockLocked()
+	}
+}
+
+// lock forgets the secret.
+func (s *Server) lock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockLocked()
+}
+
+// lockLocked forgets the secret. The caller holds s.mu.
+func (s *Server) lockLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.secret != nil {
+		unlockBytes(s.secret)
+		s.secret = nil
+	}
+	s.result = nil
+	s.query = Query{}
+}
+
+// Secret returns the cached secret matching the query, or nil if the agent is locked
+// or holds another secret. It fails if no agent listens on the socket.
+func Secret(socket string, query *Query) (*types.HMACResult, error) {
+	resp, err := call(socket, &request{Op: OpSecret, Query: query})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
+
+// Load stores the secret in the agent, replacing the one it holds. The agent forgets
+// it after the idle timeout without requests, or after the lifetime.
+func Load(socket string, result *types.HMACResult, query *Query, idle, lifetime time.Duration) error {
+	_, err := call(socket, &request{Op: OpLoad, Result: result, Query: query, IdleTimeout: idle, Lifetime: lifetime})
+	return err
+}
+
+// GetStatus describes the agent listening on the socket.
+func GetStatus(socket string) (*types.AgentStatus, error) {
+	resp, err := call(socket, &request{Op: OpStatus})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, errors.New("the agent sent no status")
+	}
+	return resp.Status, nil
+}
+
+// Lock makes the agent forget the secret.
+func Lock(socket string) error {
+	_, err := call(socket, &request{Op: OpLock})
+	return err
+}
+
+// Stop makes the agent forget the secret and exit.
+func Stop(socket string) error {
+	_, err := call(socket, &request{Op: OpStop})
+	return err
+}
+
+// IsNotRunning reports whether an error means that no agent listens on the socket.
+func IsNotRunning(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// call sends a request to the agent and returns its response. The request may
+// carry the secret and the response decides which secret is used, so the process
+// listening on the socket has to run as the same user.
+func call(socket string, req *request) (*response, error) {
+	conn, err := net.DialTimeout("unix", socket, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := unixsocket.CheckPeer(conn); err != nil {
+		return nil, fmt.Errorf("not talking to the agent on %s: %w", socket, err)
+	}
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request to the agent: %w", err)
+	}
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read the agent's response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("agent: %s", resp.Error)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,169 @@
+//go:build linux
+
+package secretagent
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fido2-hmac-deriver/internal/types"
+	"fido2-hmac-deriver/internal/unixsocket"
+)
+
+var (
+	testSecret       = bytes.Repeat([]byte{0x5e}, 32)
+	testSalt         = bytes.Repeat([]byte{0x5a}, 32)
+	testCredentialID = []byte("credential")
+)
+
+// startAgent serves a locked agent on a socket in a fresh directory and returns the
+// socket path. The agent is stopped at the end of the test.
+func startAgent(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "run", "agent.sock")
+	listener, err := unixsocket.Listen(socket)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server, err := NewServer(listener)
+	if err != nil {
+		listener.Close()
+		t.Fatalf("NewServer: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	t.Cleanup(func() {
+		listener.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return socket
+}
+
+// load caches the test secret, derived with the default options on virtual:0.
+func load(t *testing.T, socket string, idle, lifetime time.Duration) {
+	t.Helper()
+	result := &types.HMACResult{
+		Secret:       append([]byte(nil), testSecret...),
+		Salt:         testSalt,
+		CredentialID: testCredentialID,
+		Device:       &types.DeviceInfo{Path: "virtual:0", Name: "Virtual"},
+		RelyingParty: "e2e-git",
+	}
+	query := &Query{RelyingPartyID: "e2e-git", SaltMode: types.SaltModeIdentity, DevicePath: "virtual:0"}
+	if err := Load(socket, result, query, idle, lifetime); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+}
+
+func TestSecretMatchesQuery(t *testing.T) {
+	socket := startAgent(t)
+	load(t, socket, time.Minute, time.Hour)
+
+	tests := []struct {
+		name  string
+		query Query
+		match bool
+	}{
+		{"same options", Query{RelyingPartyID: "e2e-git", SaltMode: types.SaltModeIdentity}, true},
+		{"same device", Query{RelyingPartyID: "e2e-git", SaltMode: types.SaltModeIdentity, DevicePath: "virtual:0"}, true},
+		{"other device", Query{RelyingPartyID: "e2e-git", SaltMode: types.SaltModeIdentity, DevicePath: "virtual:1"}, false},
+		{"other relying party", Query{RelyingPartyID: "backup", SaltMode: types.SaltModeIdentity}, false},
+		{"other salt mode", Query{RelyingPartyID: "e2e-git", SaltMode: types.SaltModeContext, SaltContext: "laptop"}, false},
+		{"other generation", Query{RelyingPartyID: "e2e-git", SaltMode: types.SaltModeIdentity, SaltGeneration: 1}, false},
+		{"credential and salt", Query{RelyingPartyID: "e2e-git", CredentialID: testCredentialID, Salt: testSalt}, true},
+		{"other salt", Query{RelyingPartyID: "e2e-git", CredentialID: testCredentialID, Salt: testSecret}, false},
+		{"other credential", Query{RelyingPartyID: "e2e-git", CredentialID: []byte("other"), Salt: testSalt}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Secret(socket, &tt.query)
+			if err != nil {
+				t.Fatalf("Secret: %v", err)
+			}
+			if !tt.match {
+				if result != nil {
+					t.Errorf("Secret returned the cached secret for a query that does not match")
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Secret returned nothing for a matching query")
+			}
+			if !bytes.Equal(result.Secret, testSecret) || !bytes.Equal(result.CredentialID, testCredentialID) {
+				t.Errorf("Secret = %x of credential %q, want the cached secret", result.Secret, result.CredentialID)
+			}
+		})
+	}
+}
+
+func TestLockForgetsSecret(t *testing.T) {
+	socket := startAgent(t)
+	status, err := GetStatus(socket)
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	if !status.Locked {
+		t.Error("a new agent is not locked")
+	}
+
+	load(t, socket, time.Minute, time.Hour)
+	if status, err = GetStatus(socket); err != nil || status.Locked || status.RelyingPartyID != "e2e-git" {
+		t.Fatalf("GetStatus after Load = %+v, %v", status, err)
+	}
+
+	if err := Lock(socket); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	query := &Query{RelyingPartyID: "e2e-git", SaltMode: types.SaltModeIdentity}
+	if result, err := Secret(socket, query); err != nil || result != nil {
+		t.Errorf("Secret after Lock = %v, %v, want nothing", result, err)
+	}
+}
+
+func TestSecretExpires(t *testing.T) {
+	tests := []struct {
+		name     string
+		idle     time.Duration
+		lifetime time.Duration
+	}{
+		{"idle timeout", 20 * time.Millisecond, time.Hour},
+		{"lifetime", time.Hour, 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := startAgent(t)
+			load(t, socket, tt.idle, tt.lifetime)
+			time.Sleep(60 * time.Millisecond)
+
+			query := &Query{RelyingPartyID: "e2e-git", SaltMode: types.SaltModeIdentity}
+			if result, err := Secret(socket, query); err != nil || result != nil {
+				t.Errorf("Secret after expiry = %v, %v, want nothing", result, err)
+			}
+		})
+	}
+}
+
+func TestLoadRequiresTimeouts(t *testing.T) {
+	socket := startAgent(t)
+	result := &types.HMACResult{Secret: append([]byte(nil), testSecret...), RelyingParty: "e2e-git"}
+	if err := Load(socket, result, &Query{RelyingPartyID: "e2e-git"}, 0, time.Hour); err == nil {
+		t.Error("Load without an idle timeout succeeded")
+	}
+	if err := Load(socket, &types.HMACResult{RelyingParty: "e2e-git"}, &Query{RelyingPartyID: "e2e-git"}, time.Minute, time.Hour); err == nil {
+		t.Error("Load without a secret succeeded")
+	}
+}
+
+func TestStop(t *testing.T) {
+	socket := startAgent(t)
+	if err := Stop(socket); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if _, err := GetStatus(socket); !IsNotRunning(err) {
+		t.Errorf("GetStatus after Stop = %v, want an agent that is not running", err)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package secretagent
+
+import "golang.org/x/sys/unix"
+
+// hardenProcess keeps the agent out of core dumps and prevents other processes of
+// the user from attaching to it with ptrace and reading its memory.
+func hardenProcess() error {
+	return unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0)
+}
+
+// lockedBytes allocates memory outside the Go heap that is never swapped out.
+func lockedBytes(size int) ([]byte, error) {
+	b, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Mlock(b); err != nil {
+		unix.Munmap(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// unlockBytes overwrites and releases memory allocated by lockedBytes.
+func unlockBytes(b []byte) {
+	clear(b)
+	unix.Munlock(b)
+	unix.Munmap(b)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package secretagent
+
+import "errors"
+
+// errUnsupported reports that the agent cannot protect the secret on this platform.
+var errUnsupported = errors.New("the agent is only supported on Linux")
+
+func hardenProcess() error {
+	return errUnsupported
+}
+
+func lockedBytes(size int) ([]byte, error) {
+	return nil, errUnsupported
+}
+
+func unlockBytes(b []byte) {
+	clear(b)
+}
@@ -0,0 +1,137 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8): a secret is split
+// into n shares so that any k of them recover it, while fewer reveal nothing about it.
+// Every byte of the secret is shared with its own random polynomial of degree k-1.
+//
+// The field uses the AES polynomial x^8 + x^4 + x^3 + x + 1. Arithmetic avoids
+// lookup tables and branches on secret data.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// MaxShares is the largest number of shares, one per nonzero field element.
+const MaxShares = 255
+
+// Share is one share of a secret: the evaluations of the polynomials at X.
+type Share struct {
+	X byte   // Nonzero evaluation point
+	Y []byte // One value per byte of the secret
+}
+
+// Bytes encodes the share as X followed by Y.
+func (s Share) Bytes() []byte {
+	return append([]byte{s.X}, s.Y...)
+}
+
+// ParseShare decodes a share encoded by Bytes.
+func ParseShare(data []byte) (Share, error) {
+	if len(data) < 2 || data[0] == 0 {
+		return Share{}, errors.New("invalid share encoding")
+	}
+	return Share{X: data[0], Y: append([]byte(nil), data[1:]...)}, nil
+}
+
+// Split splits a secret into n shares, any k of which recover it.
+// The shares have the evaluation points 1 to n.
+func Split(secret []byte, n, k int) ([]Share, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if k < 2 || k > n || n > MaxShares {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares (need 2 <= threshold <= shares <= %d)", k, n, MaxShares)
+	}
+
+	// coefficients[i*(k-1):(i+1)*(k-1)] are the random coefficients of byte i
+	coefficients := make([]byte, len(secret)*(k-1))
+	if _, err := rand.Read(coefficients); err != nil {
+		return nil, fmt.Errorf("failed to generate polynomials: %w", err)
+	}
+
+	shares := make([]Share, n)
+	for s := range shares {
+		x := byte(s + 1)
+		y := make([]byte, len(secret))
+		for i, constant := range secret {
+			// Horner's scheme from the highest coefficient down to the secret byte
+			poly := coefficients[i*(k-1) : (i+1)*(k-1)]
+			var value byte
+			for j := len(poly) - 1; j >= 0; j-- {
+				value = mul(value, x) ^ poly[j]
+			}
+			y[i] = mul(value, x) ^ constant
+		}
+		shares[s] = Share{X: x, Y: y}
+	}
+	return shares, nil
+}
+
+// Combine recovers the secret from at least k shares. With fewer shares, or shares
+// of different secrets, the result is a wrong secret rather than an error.
+func Combine(shares []Share) ([]byte, error) {
+	return Interpolate(shares, 0)
+}
+
+// Interpolate evaluates the polynomials defined by the shares at x. At 0 this is
+// the secret; at an unused nonzero point it is a new share of the same secret.
+func Interpolate(shares []Share, x byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+	length := len(shares[0].Y)
+	for i, share := range shares {
+		if share.X == 0 {
+			return nil, errors.New("invalid share with evaluation point 0")
+		}
+		if len(share.Y) != length || length == 0 {
+			return nil, errors.New("shares have different lengths")
+		}
+		for _, other := range shares[:i] {
+			if other.X == share.X {
+				return nil, fmt.Errorf("duplicate share %d", share.X)
+			}
+		}
+	}
+
+	result := make([]byte, length)
+	for i, share := range shares {
+		// Lagrange basis polynomial of share i at x; subtraction is XOR in GF(2^8)
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = mul(basis, mul(x^other.X, inverse(share.X^other.X)))
+			}
+		}
+		for b := range result {
+			result[b] ^= mul(share.Y[b], basis)
+		}
+	}
+	return result, nil
+}
+
+// mul multiplies two field elements in constant time.
+func mul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = a<<1 ^ 0x1b&carry
+		b >>= 1
+	}
+	return product
+}
+
+// inverse returns the multiplicative inverse of a nonzero element as a^254.
+func inverse(a byte) byte {
+	result := byte(1)
+	power := a
+	for exponent := 254; exponent > 0; exponent >>= 1 {
+		if exponent&1 == 1 {
+			result = mul(result, power)
+		}
+		power = mul(power, power)
+	}
+	return result
+}
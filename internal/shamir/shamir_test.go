@@ -0,0 +1,155 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple 0123")
+
+	tests := []struct {
+		name    string
+		n, k    int
+		indices []int // Shares passed to Combine
+	}{
+		{"2 of 2", 2, 2, []int{0, 1}},
+		{"2 of 3, first and last", 3, 2, []int{0, 2}},
+		{"3 of 5, unordered", 5, 3, []int{4, 1, 2}},
+		{"3 of 5, more than needed", 5, 3, []int{0, 1, 2, 3, 4}},
+		{"255 of 255", MaxShares, MaxShares, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares, err := Split(secret, tt.n, tt.k)
+			if err != nil {
+				t.Fatalf("Split: %v", err)
+			}
+			if len(shares) != tt.n {
+				t.Fatalf("got %d shares, want %d", len(shares), tt.n)
+			}
+
+			selected := shares
+			if tt.indices != nil {
+				selected = nil
+				for _, i := range tt.indices {
+					selected = append(selected, shares[i])
+				}
+			}
+			got, err := Combine(selected)
+			if err != nil {
+				t.Fatalf("Combine: %v", err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Errorf("Combine = %x, want %x", got, secret)
+			}
+		})
+	}
+}
+
+func TestCombineBelowThreshold(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x42}, 32)
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	got, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatalf("Combine: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("two shares of a 3 of 5 split recovered the secret")
+	}
+}
+
+func TestInterpolateNewShare(t *testing.T) {
+	secret := []byte("vault master key")
+	shares, err := Split(secret, 3, 2)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+
+	y, err := Interpolate(shares[:2], 200)
+	if err != nil {
+		t.Fatalf("Interpolate: %v", err)
+	}
+	got, err := Combine([]Share{shares[2], {X: 200, Y: y}})
+	if err != nil {
+		t.Fatalf("Combine: %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Errorf("Combine with the new share = %q, want %q", got, secret)
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret []byte
+		n, k   int
+	}{
+		{"empty secret", nil, 3, 2},
+		{"threshold 1", []byte{1}, 3, 1},
+		{"threshold above shares", []byte{1}, 2, 3},
+		{"too many shares", []byte{1}, MaxShares + 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Split(tt.secret, tt.n, tt.k); err == nil {
+				t.Error("Split succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		shares []Share
+	}{
+		{"one share", []Share{{X: 1, Y: []byte{1}}}},
+		{"point zero", []Share{{X: 0, Y: []byte{1}}, {X: 1, Y: []byte{2}}}},
+		{"different lengths", []Share{{X: 1, Y: []byte{1}}, {X: 2, Y: []byte{2, 3}}}},
+		{"duplicate point", []Share{{X: 1, Y: []byte{1}}, {X: 1, Y: []byte{2}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Combine(tt.shares); err == nil {
+				t.Error("Combine succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestShareEncoding(t *testing.T) {
+	share := Share{X: 7, Y: []byte{1, 2, 3}}
+	parsed, err := ParseShare(share.Bytes())
+	if err != nil {
+		t.Fatalf("ParseShare: %v", err)
+	}
+	if parsed.X != share.X || !bytes.Equal(parsed.Y, share.Y) {
+		t.Errorf("ParseShare = %+v, want %+v", parsed, share)
+	}
+
+	for _, data := range [][]byte{nil, {1}, {0, 1}} {
+		if _, err := ParseShare(data); err == nil {
+			t.Errorf("ParseShare(%x) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestFieldArithmetic(t *testing.T) {
+	// 0x53 * 0xca = 0x01 in the AES field (FIPS 197 section 4.2)
+	if got := mul(0x53, 0xca); got != 0x01 {
+		t.Errorf("mul(0x53, 0xca) = %#x, want 0x01", got)
+	}
+	if got := mul(0x57, 0x83); got != 0xc1 {
+		t.Errorf("mul(0x57, 0x83) = %#x, want 0xc1", got)
+	}
+	for a := 1; a < 256; a++ {
+		if got := mul(byte(a), inverse(byte(a))); got != 1 {
+			t.Fatalf("%#x * inverse(%#x) = %#x, want 1", a, a, got)
+		}
+	}
+}
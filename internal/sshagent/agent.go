@@ -0,0 +1,253 @@
+// Package sshagent implements an ssh-agent holding SSH keys derived from the FIDO2
+// secret in memory. Keys cannot be added by clients, so the agent only ever signs
+// with derived keys, optionally after the user confirmed each signature.
+package sshagent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ConfirmFunc asks the user whether the key with the given comment and fingerprint
+// may sign. It is called for one signature at a time.
+type ConfirmFunc func(comment, fingerprint string) bool
+
+// Agent is an ssh-agent serving derived keys. It implements agent.ExtendedAgent.
+type Agent struct {
+	mu         sync.Mutex
+	keys       []*key
+	locked     bool
+	passphrase []byte
+
+	confirmMu sync.Mutex  // Serializes confirmation prompts
+	confirm   ConfirmFunc // nil signs without confirmation
+}
+
+// key is a key held by the agent.
+type key struct {
+	privateKey  ed25519.PrivateKey
+	signer      ssh.Signer
+	comment     string
+	fingerprint string
+	expires     time.Time // Zero if the key does not expire
+}
+
+// New creates an agent without keys. If confirm is not nil, every signature has to
+// be confirmed with it.
+func New(confirm ConfirmFunc) *Agent {
+	return &Agent{confirm: confirm}
+}
+
+// AddKey adds a derived key. A positive lifetime removes the key once it has passed.
+func (a *Agent) AddKey(privateKey ed25519.PrivateKey, comment string, lifetime time.Duration) error {
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return err
+	}
+	k := &key{
+		privateKey:  privateKey,
+		signer:      signer,
+		comment:     comment,
+		fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+	}
+	if lifetime > 0 {
+		k.expires = time.Now().Add(lifetime)
+		time.AfterFunc(lifetime, a.expire)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = append(a.keys, k)
+	return nil
+}
+
+// List returns the public keys, or none while the agent is locked.
+func (a *Agent) List() ([]*agent.Key, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.removeExpired()
+	if a.locked {
+		return nil, nil
+	}
+
+	keys := make([]*agent.Key, 0, len(a.keys))
+	for _, k := range a.keys {
+		publicKey := k.signer.PublicKey()
+		keys = append(keys, &agent.Key{Format: publicKey.Type(), Blob: publicKey.Marshal(), Comment: k.comment})
+	}
+	return keys, nil
+}
+
+// Sign signs the data with the key, after the user confirmed it if required.
+func (a *Agent) Sign(publicKey ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(publicKey, data, 0)
+}
+
+// SignWithFlags signs like Sign. The flags only select RSA signature algorithms,
+// so they do not apply to the Ed25519 keys of the agent.
+func (a *Agent) SignWithFlags(publicKey ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if a.confirm != nil {
+		a.mu.Lock()
+		k, err := a.find(publicKey)
+		a.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		a.confirmMu.Lock()
+		confirmed := a.confirm(k.comment, k.fingerprint)
+		a.confirmMu.Unlock()
+		if !confirmed {
+			return nil, errors.New("signature declined by the user")
+		}
+	}
+
+	// The key may have expired or been removed while the user was asked
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k, err := a.find(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return k.signer.Sign(rand.Reader, data)
+}
+
+// find returns the key with the public key, failing while the agent is locked.
+// The caller holds a.mu.
+func (a *Agent) find(publicKey ssh.PublicKey) (*key, error) {
+	a.removeExpired()
+	if a.locked {
+		return nil, errors.New("agent is locked")
+	}
+
+	wanted := publicKey.Marshal()
+	for _, k := range a.keys {
+		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			return k, nil
+		}
+	}
+	return nil, errors.New("key not found")
+}
+
+// Add refuses to add keys: the agent only holds keys derived from the secret.
+func (a *Agent) Add(agent.AddedKey) error {
+	return errors.New("this agent only holds keys derived from the FIDO2 secret")
+}
+
+// Remove removes the key with the public key.
+func (a *Agent) Remove(publicKey ssh.PublicKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errors.New("agent is locked")
+	}
+
+	wanted := publicKey.Marshal()
+	for i, k := range a.keys {
+		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			a.remove(i)
+			return nil
+		}
+	}
+	return errors.New("key not found")
+}
+
+// RemoveAll removes all keys.
+func (a *Agent) RemoveAll() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errors.New("agent is locked")
+	}
+	for len(a.keys) > 0 {
+		a.remove(len(a.keys) - 1)
+	}
+	return nil
+}
+
+// Lock locks the agent with a passphrase, as ssh-add -x does.
+func (a *Agent) Lock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errors.New("agent is already locked")
+	}
+	a.locked = true
+	a.passphrase = append([]byte(nil), passphrase...)
+	return nil
+}
+
+// Unlock unlocks the agent with the passphrase it was locked with.
+func (a *Agent) Unlock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.locked {
+		return errors.New("agent is not locked")
+	}
+	if subtle.ConstantTimeCompare(passphrase, a.passphrase) != 1 {
+		return errors.New("incorrect passphrase")
+	}
+	a.locked = false
+	a.passphrase = nil
+	return nil
+}
+
+// Signers is not supported: signatures go through Sign, which asks for confirmation.
+func (a *Agent) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("signers are not exported by this agent")
+}
+
+// Extension reports that no extensions are supported.
+func (a *Agent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// expire removes the keys whose lifetime has passed.
+func (a *Agent) expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.removeExpired()
+}
+
+// removeExpired removes the keys whose lifetime has passed. The caller holds a.mu.
+func (a *Agent) removeExpired() {
+	now := time.Now()
+	for i := len(a.keys) - 1; i >= 0; i-- {
+		if expires := a.keys[i].expires; !expires.IsZero() && !now.Before(expires) {
+			a.remove(i)
+		}
+	}
+}
+
+// remove removes the key at index i and overwrites its private key. The caller holds a.mu.
+func (a *Agent) remove(i int) {
+	clear(a.keys[i].privateKey)
+	a.keys = append(a.keys[:i], a.keys[i+1:]...)
+}
+
+// Serve accepts connections on the listener and serves the agent protocol on each,
+// until the listener is closed.
+func Serve(listener net.Listener, a *Agent) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(a, conn)
+		}()
+	}
+}
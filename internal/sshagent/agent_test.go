@@ -0,0 +1,171 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newTestKey returns a key generated from a fixed seed.
+func newTestKey(fill byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{fill}, ed25519.SeedSize))
+}
+
+// newClient serves the agent on one end of a pipe and returns a client for the other,
+// so requests go through the ssh-agent protocol.
+func newClient(t *testing.T, a *Agent) agent.ExtendedAgent {
+	t.Helper()
+	server, client := net.Pipe()
+	go agent.ServeAgent(a, server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return agent.NewClient(client)
+}
+
+func publicKey(t *testing.T, privateKey ed25519.PrivateKey) ssh.PublicKey {
+	t.Helper()
+	key, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestListAndSign(t *testing.T) {
+	a := New(nil)
+	if err := a.AddKey(newTestKey(1), "derived", 0); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	client := newClient(t, a)
+
+	keys, err := client.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := publicKey(t, newTestKey(1))
+	if len(keys) != 1 || !bytes.Equal(keys[0].Blob, want.Marshal()) || keys[0].Comment != "derived" {
+		t.Fatalf("List = %v, want the derived key", keys)
+	}
+
+	data := []byte("session data")
+	signature, err := client.Sign(want, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := want.Verify(data, signature); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+
+	if _, err := client.Sign(publicKey(t, newTestKey(2)), data); err == nil {
+		t.Error("Sign with an unknown key succeeded")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	var asked []string
+	confirmed := false
+	a := New(func(comment, fingerprint string) bool {
+		asked = append(asked, comment+" "+fingerprint)
+		return confirmed
+	})
+	if err := a.AddKey(newTestKey(1), "derived", 0); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	client := newClient(t, a)
+	key := publicKey(t, newTestKey(1))
+
+	if _, err := client.Sign(key, []byte("data")); err == nil {
+		t.Error("Sign succeeded although the user declined")
+	}
+	confirmed = true
+	if _, err := client.Sign(key, []byte("data")); err != nil {
+		t.Errorf("Sign after confirmation: %v", err)
+	}
+	if want := "derived " + ssh.FingerprintSHA256(key); len(asked) != 2 || asked[0] != want {
+		t.Errorf("asked %q, want %q twice", asked, want)
+	}
+}
+
+func TestRefusesForeignKeys(t *testing.T) {
+	client := newClient(t, New(nil))
+	if err := client.Add(agent.AddedKey{PrivateKey: newTestKey(1)}); err == nil {
+		t.Error("Add of a key from the client succeeded")
+	}
+	if keys, err := client.List(); err != nil || len(keys) != 0 {
+		t.Errorf("List = %v, %v, want no keys", keys, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	a := New(nil)
+	if err := a.AddKey(newTestKey(1), "derived", 0); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	client := newClient(t, a)
+	key := publicKey(t, newTestKey(1))
+
+	if err := client.Lock([]byte("passphrase")); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if keys, err := client.List(); err != nil || len(keys) != 0 {
+		t.Errorf("List while locked = %v, %v, want no keys", keys, err)
+	}
+	if _, err := client.Sign(key, []byte("data")); err == nil {
+		t.Error("Sign while locked succeeded")
+	}
+	if err := client.Unlock([]byte("wrong")); err == nil {
+		t.Error("Unlock with a wrong passphrase succeeded")
+	}
+	if err := client.Unlock([]byte("passphrase")); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, err := client.Sign(key, []byte("data")); err != nil {
+		t.Errorf("Sign after unlocking: %v", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	a := New(nil)
+	privateKey := newTestKey(1)
+	if err := a.AddKey(privateKey, "derived", 0); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	client := newClient(t, a)
+
+	if err := client.Remove(publicKey(t, newTestKey(1))); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if keys, err := client.List(); err != nil || len(keys) != 0 {
+		t.Errorf("List after Remove = %v, %v, want no keys", keys, err)
+	}
+	if !bytes.Equal(privateKey, make([]byte, len(privateKey))) {
+		t.Error("the private key of a removed key was not overwritten")
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	a := New(nil)
+	if err := a.AddKey(newTestKey(1), "short-lived", 20*time.Millisecond); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	if err := a.AddKey(newTestKey(2), "permanent", 0); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	client := newClient(t, a)
+
+	time.Sleep(50 * time.Millisecond)
+	keys, err := client.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "permanent" {
+		t.Errorf("List = %v, want only the permanent key", keys)
+	}
+}
@@ -0,0 +1,76 @@
+// Package sshkey derives Ed25519 SSH keys from the FIDO2 secret and encodes them in
+// the OpenSSH formats, so a lost key can be regenerated from the authenticator alone.
+//
+// The key seed is derived from the secret with HKDF and a label, so the same
+// credential, salt and label always yield the same key, and different labels yield
+// independent keys.
+package sshkey
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultLabel is the label of the key derived when none is given.
+const DefaultLabel = "ssh"
+
+// seedInfo prefixes the label in the HKDF info parameter of the key seed.
+const seedInfo = "fido2-hmac-deriver:ssh:v1:ed25519:"
+
+// Derive derives the Ed25519 key with the given label from an HMAC secret.
+func Derive(secret []byte, label string) (ed25519.PrivateKey, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot derive an SSH key from an empty secret")
+	}
+	if label == "" {
+		return nil, errors.New("the SSH key label must not be empty")
+	}
+	seed, err := hkdf.Key(sha256.New, secret, nil, seedInfo+label, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// DefaultComment returns the comment of keys derived with the given label.
+func DefaultComment(label string) string {
+	return "fido2-hmac-deriver:" + label
+}
+
+// MarshalPrivateKey encodes the key as an unencrypted OpenSSH private key file.
+// The file embeds a random check value, so encodings of the same key differ.
+func MarshalPrivateKey(key ed25519.PrivateKey, comment string) ([]byte, error) {
+	block, err := ssh.MarshalPrivateKey(key, comment)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// AuthorizedKey returns the public key as an authorized_keys line, without newline.
+func AuthorizedKey(key ed25519.PrivateKey, comment string) (string, error) {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(publicKey)), "\n")
+	if comment != "" {
+		line += " " + comment
+	}
+	return line, nil
+}
+
+// Fingerprint returns the SHA256 fingerprint of the public key, as shown by ssh-keygen -l.
+func Fingerprint(key ed25519.PrivateKey) (string, error) {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(publicKey), nil
+}
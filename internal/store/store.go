@@ -0,0 +1,283 @@
+// Package store persists credential records on disk.
+// Records live under $XDG_DATA_HOME/fido2-hmac-deriver/credentials, grouped by
+// authenticator AAGUID and relying party, one JSON file per credential:
+//
+//	credentials/<aaguid>/<relying party>/<credential fingerprint>.json
+//
+// Directories are created with 0700 and files with 0600 permissions. Files are
+// written atomically, so an interrupted write never leaves a truncated record.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"fido2-hmac-deriver/internal/types"
+)
+
+// recordVersion is the version of the on-disk record format.
+const recordVersion = 1
+
+// Store implements the CredentialStore interface using JSON files.
+type Store struct {
+	dir string // Root directory holding the credential records
+}
+
+// New creates a store rooted at the given directory.
+// The directory is created on the first write.
+func New(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// DefaultDir returns the default store directory following the XDG base directory
+// specification: $XDG_DATA_HOME/fido2-hmac-deriver, falling back to ~/.local/share.
+func DefaultDir() (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to determine home directory: %w", err)
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "fido2-hmac-deriver"), nil
+}
+
+// Dir returns the root directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// record is the on-disk representation of a CredentialRecord.
+type record struct {
+	Version          int               `json:"version"`
+	CredentialID     []byte            `json:"credential_id"`
+	AAGUID           string            `json:"aaguid"`
+	RelyingPartyID   string            `json:"rp_id"`
+	RelyingPartyName string            `json:"rp_name,omitempty"`
+	UserName         string            `json:"user_name,omitempty"`
+	UserDisplayName  string            `json:"user_display_name,omitempty"`
+	Algorithm        string            `json:"algorithm"`
+	SaltMode         types.SaltMode    `json:"salt_mode"`
+	DeviceName       string            `json:"device_name,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+	CheckValues      map[string][]byte `json:"check_values,omitempty"`
+}
+
+// Find returns all records for the given authenticator model and relying party,
+// oldest first.
+func (s *Store) Find(aaguid []byte, rpID string) ([]*types.CredentialRecord, error) {
+	return s.readDir(filepath.Join(s.dir, "credentials", hex.EncodeToString(aaguid), escape(rpID)))
+}
+
+// List returns all stored records, oldest first.
+func (s *Store) List() ([]*types.CredentialRecord, error) {
+	root := filepath.Join(s.dir, "credentials")
+	devices, err := os.ReadDir(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential store %s: %w", root, err)
+	}
+
+	var records []*types.CredentialRecord
+	for _, device := range devices {
+		if !device.IsDir() {
+			continue
+		}
+		rps, err := os.ReadDir(filepath.Join(root, device.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credential store: %w", err)
+		}
+		for _, rp := range rps {
+			if !rp.IsDir() {
+				continue
+			}
+			found, err := s.readDir(filepath.Join(root, device.Name(), rp.Name()))
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, found...)
+		}
+	}
+
+	sortRecords(records)
+	return records, nil
+}
+
+// Save creates or replaces the record for its credential ID.
+func (s *Store) Save(r *types.CredentialRecord) error {
+	if len(r.CredentialID) == 0 || r.RelyingPartyID == "" {
+		return errors.New("credential record requires a credential ID and relying party")
+	}
+
+	path := s.path(r)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create credential store directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(&record{
+		Version:          recordVersion,
+		CredentialID:     r.CredentialID,
+		AAGUID:           hex.EncodeToString(r.AAGUID),
+		RelyingPartyID:   r.RelyingPartyID,
+		RelyingPartyName: r.RelyingPartyName,
+		UserName:         r.UserName,
+		UserDisplayName:  r.UserDisplayName,
+		Algorithm:        r.Algorithm,
+		SaltMode:         r.SaltMode,
+		DeviceName:       r.DeviceName,
+		CreatedAt:        r.CreatedAt.UTC(),
+		CheckValues:      r.CheckValues,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode credential record: %w", err)
+	}
+
+	if err := WriteFileAtomic(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to save credential record: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the record for its credential ID.
+func (s *Store) Delete(r *types.CredentialRecord) error {
+	err := os.Remove(s.path(r))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("credential record %s does not exist", Fingerprint(r.CredentialID))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete credential record: %w", err)
+	}
+	return nil
+}
+
+// path returns the file path of a record.
+func (s *Store) path(r *types.CredentialRecord) string {
+	return filepath.Join(s.dir, "credentials", hex.EncodeToString(r.AAGUID), escape(r.RelyingPartyID),
+		Fingerprint(r.CredentialID)+".json")
+}
+
+// readDir reads all records in a relying party directory.
+func (s *Store) readDir(dir string) ([]*types.CredentialRecord, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential store %s: %w", dir, err)
+	}
+
+	var records []*types.CredentialRecord
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		r, err := readRecord(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+
+	sortRecords(records)
+	return records, nil
+}
+
+// readRecord reads and decodes a single record file.
+func readRecord(path string) (*types.CredentialRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential record: %w", err)
+	}
+
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("failed to parse credential record %s: %w", path, err)
+	}
+	if r.Version != recordVersion {
+		return nil, fmt.Errorf("credential record %s has unsupported version %d", path, r.Version)
+	}
+	aaguid, err := hex.DecodeString(r.AAGUID)
+	if err != nil {
+		return nil, fmt.Errorf("credential record %s has an invalid AAGUID: %w", path, err)
+	}
+
+	return &types.CredentialRecord{
+		CredentialID:     r.CredentialID,
+		AAGUID:           aaguid,
+		RelyingPartyID:   r.RelyingPartyID,
+		RelyingPartyName: r.RelyingPartyName,
+		UserName:         r.UserName,
+		UserDisplayName:  r.UserDisplayName,
+		Algorithm:        r.Algorithm,
+		SaltMode:         r.SaltMode,
+		DeviceName:       r.DeviceName,
+		CreatedAt:        r.CreatedAt,
+		CheckValues:      r.CheckValues,
+	}, nil
+}
+
+// Fingerprint returns a short, filename-safe identifier for a credential ID.
+func Fingerprint(credentialID []byte) string {
+	hash := sha256.Sum256(credentialID)
+	return hex.EncodeToString(hash[:8])
+}
+
+// escape makes a relying party ID safe to use as a directory name.
+func escape(rpID string) string {
+	return url.PathEscape(rpID)
+}
+
+func sortRecords(records []*types.CredentialRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+}
+
+// WriteFileAtomic writes data to a temporary file in the target directory and
+// renames it into place, so readers never observe a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return WriteAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteAtomic is like WriteFileAtomic, but streams the contents from write.
+// If write fails, the target file is left untouched.
+func WriteAtomic(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fido2-hmac-deriver/internal/types"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "record.json")
+
+	for _, data := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(data), 0600); err != nil {
+			t.Fatalf("WriteFileAtomic: %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("file holds %q, want %q", got, data)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("file mode = %o, want 600", perm)
+		}
+	}
+	assertOnlyFile(t, dir, "record.json")
+}
+
+func TestWriteAtomicKeepsFileOnError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "record.json")
+	if err := WriteFileAtomic(path, []byte("original"), 0600); err != nil {
+		t.Fatalf("WriteFileAtomic: %v", err)
+	}
+
+	failure := errors.New("write failed")
+	err := WriteAtomic(path, 0600, func(w io.Writer) error {
+		if _, err := w.Write([]byte("partial")); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("WriteAtomic = %v, want %v", err, failure)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "original" {
+		t.Errorf("file holds %q after a failed write, want the original contents", got)
+	}
+	assertOnlyFile(t, dir, "record.json")
+}
+
+func TestWriteAtomicMissingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "record.json")
+	if err := WriteFileAtomic(path, []byte("data"), 0600); err == nil {
+		t.Error("WriteFileAtomic into a missing directory succeeded")
+	}
+}
+
+func TestSaveFindDelete(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	older := &types.CredentialRecord{
+		CredentialID:   []byte{1, 2, 3},
+		AAGUID:         []byte{0xaa, 0xbb},
+		RelyingPartyID: "fido2-hmac-deriver",
+		Algorithm:      "es256",
+		SaltMode:       types.SaltModeContext,
+		DeviceName:     "Test Key",
+		CreatedAt:      created,
+	}
+	newer := &types.CredentialRecord{
+		CredentialID:   []byte{4, 5, 6},
+		AAGUID:         []byte{0xaa, 0xbb},
+		RelyingPartyID: "fido2-hmac-deriver",
+		Algorithm:      "es256",
+		CreatedAt:      created.Add(time.Hour),
+	}
+	for _, r := range []*types.CredentialRecord{newer, older} {
+		if err := s.Save(r); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	info, err := os.Stat(s.path(older))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("record file mode = %o, want 600", perm)
+	}
+	info, err = os.Stat(filepath.Dir(s.path(older)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("record directory mode = %o, want 700", perm)
+	}
+
+	found, err := s.Find(older.AAGUID, older.RelyingPartyID)
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if len(found) != 2 || !bytes.Equal(found[0].CredentialID, older.CredentialID) || !bytes.Equal(found[1].CredentialID, newer.CredentialID) {
+		t.Fatalf("Find = %v, want the two records oldest first", found)
+	}
+	if got := found[0]; got.DeviceName != older.DeviceName || got.SaltMode != older.SaltMode || !got.CreatedAt.Equal(created) {
+		t.Errorf("Find returned %+v, want %+v", got, older)
+	}
+	if other, err := s.Find([]byte{0xcc}, older.RelyingPartyID); err != nil || len(other) != 0 {
+		t.Errorf("Find for another authenticator = %v, %v, want no records", other, err)
+	}
+
+	if err := s.Delete(older); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete(older); err == nil {
+		t.Error("Delete of a deleted record succeeded")
+	}
+	all, err := s.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(all) != 1 || !bytes.Equal(all[0].CredentialID, newer.CredentialID) {
+		t.Errorf("List = %v, want only the newer record", all)
+	}
+}
+
+func TestSaveRequiresCredentialAndRelyingParty(t *testing.T) {
+	s := New(t.TempDir())
+	if err := s.Save(&types.CredentialRecord{RelyingPartyID: "fido2-hmac-deriver"}); err == nil {
+		t.Error("Save accepted a record without credential ID")
+	}
+	if err := s.Save(&types.CredentialRecord{CredentialID: []byte{1}}); err == nil {
+		t.Error("Save accepted a record without relying party")
+	}
+}
+
+// assertOnlyFile fails unless name is the only entry of dir, e.g. no temporary
+// file was left behind.
+func assertOnlyFile(t *testing.T, dir, name string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory holds %v, want only %s", names, name)
+	}
+}
@@ -0,0 +1,124 @@
+package types
+
+// AuthenticatorInfo holds the authenticatorGetInfo response of a device.
+// Fields a backend cannot query are left at their zero value.
+type AuthenticatorInfo struct {
+	Versions           []string        // Supported protocol versions (e.g., "FIDO_2_0", "FIDO_2_1")
+	Extensions         []string        // Supported extensions (e.g., "hmac-secret")
+	AAGUID             []byte          // Authenticator model identifier
+	Options            map[string]bool // Option IDs and their values (e.g., "rk", "clientPin")
+	PINProtocols       []byte          // Supported PIN/UV auth protocol versions
+	MaxCredentialCount int             // Maximum number of resident credentials (0 if unknown)
+	MinPINLength       int             // Minimum PIN length in code points (0 if unknown)
+	FirmwareVersion    string          // Firmware version (empty if unknown)
+}
+
+// RelyingParty identifies the relying party a credential belongs to.
+type RelyingParty struct {
+	ID   string // Relying party identifier (e.g., "e2e-git")
+	Name string // Human-readable relying party name
+}
+
+// User identifies the user account a credential belongs to.
+type User struct {
+	ID          []byte // Opaque user handle
+	Name        string // User name
+	DisplayName string // Human-readable display name
+}
+
+// MakeCredentialRequest holds the parameters for creating a new credential.
+type MakeCredentialRequest struct {
+	ClientDataHash []byte       // SHA-256 hash of the client data
+	RelyingParty   RelyingParty // Relying party the credential is created for
+	User           User         // User account the credential is created for
+	PIN            string       // Device PIN (empty to skip user verification)
+	ResidentKey    bool         // Store the credential on the device (discoverable credential)
+	HMACSecret     bool         // Enable the hmac-secret extension for the credential
+}
+
+// Attestation is the result of a successful credential creation.
+type Attestation struct {
+	CredentialID []byte // Identifier of the new credential
+	PublicKey    []byte // Public key of the new credential
+	AuthData     []byte // Authenticator data
+	Format       string // Attestation statement format
+}
+
+// AssertionRequest holds the parameters for an assertion.
+type AssertionRequest struct {
+	RelyingPartyID string   // Relying party to assert for
+	ClientDataHash []byte   // SHA-256 hash of the client data
+	AllowList      [][]byte // Credentials that may be used (empty for resident credentials)
+	PIN            string   // Device PIN (empty to skip user verification)
+	UserPresence   bool     // Require the user to touch the device
+	HMACSalt       []byte   // One or two concatenated 32-byte hmac-secret salts (nil to skip the extension)
+}
+
+// Assertion is the result of a successful assertion.
+type Assertion struct {
+	CredentialID []byte // Credential that produced the assertion
+	AuthData     []byte // Authenticator data
+	Signature    []byte // Signature over the authenticator data and client data hash
+	HMACSecret   []byte // Output of the hmac-secret extension, one 32-byte output per salt
+	User         User   // User of the credential (resident credentials only)
+}
+
+// DeviceCredential is a resident credential stored on an authenticator.
+type DeviceCredential struct {
+	ID   []byte // Credential identifier
+	User User   // User account the credential belongs to
+}
+
+// Authenticator defines the operations supported on an opened FIDO2 authenticator.
+// Each device backend provides its own implementation, which keeps the rest of the
+// application independent of any particular FIDO2 library.
+type Authenticator interface {
+	// Info returns the authenticatorGetInfo response of the device.
+	Info() (*AuthenticatorInfo, error)
+
+	// PINRetries returns the number of PIN attempts left before the device locks.
+	PINRetries() (int, error)
+
+	// UVRetries returns the number of built-in user verification attempts left,
+	// e.g. fingerprint matches, before only the PIN is accepted.
+	UVRetries() (int, error)
+
+	// SetPIN sets the initial PIN, or changes it if oldPIN is not empty.
+	SetPIN(pin, oldPIN string) error
+
+	// MakeCredential creates a new ES256 credential on the device.
+	MakeCredential(req *MakeCredentialRequest) (*Attestation, error)
+
+	// Assertion performs an assertion with one of the allowed credentials.
+	Assertion(req *AssertionRequest) (*Assertion, error)
+
+	// RelyingParties lists the relying parties with resident credentials on the device.
+	RelyingParties(pin string) ([]*RelyingParty, error)
+
+	// Credentials lists the resident credentials of a relying party.
+	Credentials(rpID string, pin string) ([]*DeviceCredential, error)
+
+	// DeleteCredential removes a resident credential from the device.
+	DeleteCredential(credentialID []byte, pin string) error
+
+	// UpdateUser replaces the user name and display name of a resident credential.
+	// The user ID has to be the one the credential was created with.
+	UpdateUser(credentialID []byte, user User, pin string) error
+
+	// CanUpdateUser reports whether the backend implements UpdateUser.
+	CanUpdateUser() bool
+}
+
+// Backend defines how FIDO2 devices are discovered and opened.
+// Backends are selected at runtime, e.g. libfido2 for physical devices or the
+// virtual authenticator for testing.
+type Backend interface {
+	// Name returns the identifier used to select the backend (e.g., "libfido2").
+	Name() string
+
+	// ListDevices discovers the devices available through this backend.
+	ListDevices() ([]*DeviceInfo, error)
+
+	// Open returns an Authenticator for the device at the given path.
+	Open(path string) (Authenticator, error)
+}
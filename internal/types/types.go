@@ -4,8 +4,6 @@ package types
 
 import (
 	"time"
-
-	"github.com/keys-pub/go-libfido2"
 )
 
 // DeviceInfo represents information about a FIDO2 device.
@@ -15,6 +13,41 @@ type DeviceInfo struct {
 	Manufacturer string // Device manufacturer (e.g., "Yubico")
 	Path         string // System path to the device (e.g., "/dev/hidraw0")
 	Index        int    // Position in the device list (for user selection)
+	AAGUID       []byte // Authenticator model identifier, populated once the device has been queried
+}
+
+// DeviceCapabilities describes what a device supports, as reported by the
+// authenticatorGetInfo command and the PIN retry counter.
+// Values the backend cannot query are left at their zero value, or -1 for the retry counters.
+type DeviceCapabilities struct {
+	Versions           []string        // Supported protocol versions (e.g., "FIDO_2_0", "FIDO_2_1")
+	Extensions         []string        // Supported extensions (e.g., "hmac-secret")
+	AAGUID             []byte          // Authenticator model identifier
+	Options            map[string]bool // Options as reported by the device (see Option)
+	PINProtocols       []byte          // Supported PIN/UV auth protocol versions
+	MaxCredentialCount int             // Maximum number of resident credentials (0 if unknown)
+	MinPINLength       int             // Minimum PIN length in code points (0 if unknown)
+	FirmwareVersion    string          // Firmware version (empty if unknown)
+	PINRetries         int             // PIN attempts left before the device locks (-1 if unknown)
+	UVRetries          int             // Built-in user verification attempts left (-1 if unknown)
+}
+
+// Option returns the value of an authenticatorGetInfo option and whether the device reported it.
+// CTAP gives absent options a meaning of their own: "up" defaults to true, while an absent
+// "clientPin" or "uv" means the device does not support the feature at all.
+func (c *DeviceCapabilities) Option(name string) (value bool, reported bool) {
+	value, reported = c.Options[name]
+	return value, reported
+}
+
+// HasExtension reports whether the device supports the given extension.
+func (c *DeviceCapabilities) HasExtension(name string) bool {
+	for _, extension := range c.Extensions {
+		if extension == name {
+			return true
+		}
+	}
+	return false
 }
 
 // HMACResult contains all the information from a successful HMAC secret derivation.
@@ -26,8 +59,106 @@ type HMACResult struct {
 	Device       *DeviceInfo // Information about the device used
 	Timestamp    time.Time   // When the derivation was performed
 	RelyingParty string      // The relying party identifier used
+	SaltMode     SaltMode    // Which inputs were used to build the salt
+	Subkeys      []Subkey    // Subkeys derived from the secret, in the requested order
+
+	// Key rotation: the secret of the next salt generation, derived in the same assertion
+	SaltGeneration int      // Salt generation of Secret (0 is the original salt)
+	NextSecret     []byte   // Secret of generation SaltGeneration+1 (nil unless requested)
+	NextSalt       []byte   // Salt of generation SaltGeneration+1 (nil unless requested)
+	NextSubkeys    []Subkey // Subkeys derived from NextSecret, with the same requests as Subkeys
 }
 
+// SubkeyHash selects the hash function HKDF uses to derive a subkey.
+type SubkeyHash string
+
+const (
+	SubkeyHashSHA256 SubkeyHash = "sha256" // HKDF-SHA256 (default)
+	SubkeyHashSHA512 SubkeyHash = "sha512" // HKDF-SHA512
+)
+
+// SubkeyRequest describes a subkey to derive from the HMAC secret.
+// The label is used as the HKDF info parameter, so different labels yield
+// independent keys and the same label always yields the same key.
+type SubkeyRequest struct {
+	Label  string     // Caller-supplied context label (e.g., "git-crypt")
+	Length int        // Length of the subkey in bytes
+	Hash   SubkeyHash // Hash function for HKDF
+}
+
+// Subkey is a key derived from the HMAC secret with HKDF.
+type Subkey struct {
+	Label string     // Context label the key was derived with
+	Hash  SubkeyHash // Hash function used for HKDF
+	Key   []byte     // The derived key
+}
+
+// OutputFormat selects how results are written.
+type OutputFormat string
+
+const (
+	// OutputText writes results as formatted, human-readable text.
+	OutputText OutputFormat = "text"
+
+	// OutputJSON writes results as a versioned JSON document.
+	OutputJSON OutputFormat = "json"
+
+	// OutputYAML writes results as a versioned YAML document with the same schema as OutputJSON.
+	OutputYAML OutputFormat = "yaml"
+
+	// OutputKey writes only the secret as a single encoded line.
+	OutputKey OutputFormat = "key"
+
+	// OutputRaw writes exactly the bytes of the secret, without encoding or newline.
+	OutputRaw OutputFormat = "raw"
+
+	// OutputAge writes an age identity file with the X25519 identity derived from the secret.
+	OutputAge OutputFormat = "age"
+
+	// OutputAgePlugin writes an age identity file with a plugin identity, which references
+	// the credential and salt instead of containing the identity.
+	OutputAgePlugin OutputFormat = "age-plugin"
+)
+
+// Encoding selects how binary values are encoded in structured output.
+type Encoding string
+
+const (
+	EncodingBase64    Encoding = "base64"    // Standard base64 with padding (RFC 4648 section 4)
+	EncodingBase64URL Encoding = "base64url" // URL-safe base64 without padding (RFC 4648 section 5)
+	EncodingHex       Encoding = "hex"       // Lowercase hexadecimal
+)
+
+// OutputOptions controls how results are written.
+type OutputOptions struct {
+	Format         OutputFormat        // Output format
+	Encoding       Encoding            // Encoding of all binary fields without an override
+	FieldEncodings map[string]Encoding // Per-field encoding overrides, keyed by field name (e.g., "secret")
+}
+
+// SaltMode selects which inputs are hashed into the deterministic salt.
+// The salt must not depend on anything that can change between runs with the
+// same authenticator, otherwise the derived secret silently changes as well.
+type SaltMode string
+
+const (
+	// SaltModeAuto picks the salt mode from the configuration and the stored credential:
+	// a context label if one was supplied, the legacy path-based salt for credentials
+	// created by earlier releases, and the device identity otherwise.
+	SaltModeAuto SaltMode = ""
+
+	// SaltModeIdentity hashes the authenticator AAGUID and the credential ID.
+	// Both stay the same regardless of which USB port the device is plugged into.
+	SaltModeIdentity SaltMode = "identity"
+
+	// SaltModeContext hashes an explicit, user-supplied context label.
+	SaltModeContext SaltMode = "context"
+
+	// SaltModeLegacyPath hashes the system device path, as earlier releases did.
+	// It is only kept so that secrets derived by those releases can be reproduced.
+	SaltModeLegacyPath SaltMode = "legacy-path"
+)
+
 // Configuration holds application settings and constants.
 type Configuration struct {
 	RelyingPartyID   string // Identifier for this application (e.g., "e2e-git")
@@ -36,6 +167,95 @@ type Configuration struct {
 	UserName         string // Username for FIDO2 operations
 	UserDisplayName  string // Display name for FIDO2 operations
 	SaltSize         int    // Size of the salt in bytes (typically 32)
+
+	SaltMode       SaltMode // Which inputs to hash into the salt (see SaltMode)
+	SaltContext    string   // User-supplied label for SaltModeContext
+	LegacySaltPath string   // Device path to hash for SaltModeLegacyPath (defaults to the current path)
+
+	SaltGeneration   int  // Key rotation generation hashed into the salt (0 keeps the original salt)
+	DeriveNextSecret bool // Also derive the secret of the next generation in the same assertion
+
+	DiscoverCredentials bool // Look up the resident credential on the device if the store has none for it
+}
+
+// CredentialRecord describes a credential created by this application.
+// Records are kept per authenticator model (AAGUID) and relying party, so
+// credentials of different devices and applications never get mixed up.
+type CredentialRecord struct {
+	CredentialID     []byte    // FIDO2 credential identifier
+	AAGUID           []byte    // Authenticator model identifier of the device holding the credential
+	RelyingPartyID   string    // Relying party the credential was created for
+	RelyingPartyName string    // Human-readable relying party name
+	UserName         string    // User name the credential was created for
+	UserDisplayName  string    // User display name the credential was created for
+	Algorithm        string    // Credential algorithm (e.g., "es256")
+	SaltMode         SaltMode  // Salt mode used with this credential
+	DeviceName       string    // Product name of the device at creation time
+	CreatedAt        time.Time // When the credential was created
+
+	// CheckValues holds a short MAC of every secret derived with this credential,
+	// keyed by the fingerprint of the salt it was derived with. They allow checking
+	// a secret without the device and never reveal the secret itself.
+	CheckValues map[string][]byte
+}
+
+// ResidentCredential is a resident credential found on a device.
+type ResidentCredential struct {
+	RelyingParty RelyingParty      // Relying party the credential belongs to
+	ID           []byte            // Credential identifier
+	User         User              // User account the credential belongs to
+	Record       *CredentialRecord // Stored record of the credential, nil if the store does not know it
+	UsedBy       []string          // Vault slots and keyring keys wrapped with a secret of the credential
+}
+
+// VaultSlot describes an authenticator enrolled in a vault.
+type VaultSlot struct {
+	Label          string    // Label of the slot, e.g. the device name
+	RelyingPartyID string    // Relying party of the credential
+	CredentialID   []byte    // Credential the master key is wrapped for
+	AAGUID         []byte    // Authenticator model holding the credential
+	AddedAt        time.Time // When the master key was wrapped for the authenticator
+}
+
+// AgeIdentity is an age identity derived from the HMAC secret.
+type AgeIdentity struct {
+	Identity  string    // AGE-SECRET-KEY-1... or AGE-PLUGIN-FIDO2HMAC-1... identity
+	Recipient string    // Recipient files are encrypted to
+	Created   time.Time // When the identity was derived
+}
+
+// SSHKey is an SSH key derived from the HMAC secret.
+type SSHKey struct {
+	PrivateKey    []byte // OpenSSH private key file
+	AuthorizedKey string // Public key as an authorized_keys line
+	Fingerprint   string // SHA256 fingerprint of the public key
+}
+
+// AgentStatus describes the agent caching the secret.
+type AgentStatus struct {
+	PID            int       // Process of the agent
+	Locked         bool      // Whether the agent holds no secret
+	RelyingPartyID string    // Relying party of the cached secret
+	CredentialID   []byte    // Credential the cached secret was derived with
+	Device         string    // Name of the device the secret was derived with
+	LoadedAt       time.Time // When the secret was cached
+	ExpiresAt      time.Time // End of the maximum lifetime
+	IdleExpiresAt  time.Time // End of the idle timeout, unless the secret is used before
+}
+
+// CredentialStore defines the interface for persisting credential records.
+type CredentialStore interface {
+	// Find returns all records for the given authenticator model and relying party.
+	Find(aaguid []byte, rpID string) ([]*CredentialRecord, error)
+
+	// List returns all stored records.
+	List() ([]*CredentialRecord, error)
+
+	// Save creates or replaces the record for its credential ID.
+	Save(record *CredentialRecord) error
+
+	// Delete removes the record for its credential ID.
+	Delete(record *CredentialRecord) error
 }
 
 // DeviceManager defines the interface for discovering and selecting FIDO2 devices.
@@ -57,16 +277,66 @@ type DeviceManager interface {
 	// ValidateDevice checks if a device is still accessible and functional.
 	// Returns an error if the device is no longer accessible.
 	ValidateDevice(device *DeviceInfo) error
+
+	// GetDeviceCapabilities queries what a device supports.
+	// Returns the capabilities reported by the device or an error if it cannot be queried.
+	GetDeviceCapabilities(device *DeviceInfo) (*DeviceCapabilities, error)
+
+	// CheckDeviceSupport verifies that a device supports the features this application needs,
+	// most importantly the hmac-secret extension. Returns an error describing what is missing.
+	CheckDeviceSupport(device *DeviceInfo) error
+
+	// SetPIN sets the initial PIN of a device, or changes it if oldPIN is not empty.
+	SetPIN(device *DeviceInfo, pin, oldPIN string) error
+
+	// ResidentCredentials lists the resident credentials of all relying parties on a
+	// device with credential management. Their Record is left nil.
+	ResidentCredentials(device *DeviceInfo, pin string) ([]*ResidentCredential, error)
+
+	// DeleteResidentCredential removes a resident credential from a device.
+	DeleteResidentCredential(device *DeviceInfo, credentialID []byte, pin string) error
+
+	// UpdateResidentUser replaces the user name and display name of a resident credential.
+	UpdateResidentUser(device *DeviceInfo, credentialID []byte, user User, pin string) error
+
+	// CheckResidentUserUpdate returns an error unless the device and the backend can
+	// update the user of a resident credential. It does not need the PIN.
+	CheckResidentUserUpdate(device *DeviceInfo) error
 }
 
 // CryptoProvider defines the interface for FIDO2 cryptographic operations.
 // This interface handles the actual HMAC secret derivation using FIDO2 devices.
 type CryptoProvider interface {
-	// DeriveHMACSecret performs the complete HMAC secret derivation process.
-	// This includes creating a credential, prompting for PIN, and deriving the secret.
+	// EnrollCredential creates a new credential with the HMAC secret extension on the
+	// device, derives its first secret and stores the credential with a check value.
+	// An existing credential for the device is only replaced if replace is set.
+	// Returns an HMACResult for the first secret or an error.
+	EnrollCredential(device *DeviceInfo, pin string, config *Configuration, replace bool) (*HMACResult, error)
+
+	// DeriveHMACSecret derives the HMAC secret from the stored credential of the device.
+	// It never creates a credential; an error is returned if none is enrolled.
 	// Returns an HMACResult with all derivation details or an error.
 	DeriveHMACSecret(device *DeviceInfo, pin string, config *Configuration) (*HMACResult, error)
 
+	// DeriveHMACSecretWithSalt derives the HMAC secret of the given credential for an
+	// explicit salt, e.g. one recorded with encrypted data, ignoring the salt options.
+	// Returns an HMACResult or an error if the device does not hold the credential.
+	DeriveHMACSecretWithSalt(device *DeviceInfo, pin string, config *Configuration, credentialID, salt []byte) (*HMACResult, error)
+
+	// FindCredential checks silently, without PIN or touch, which of the given
+	// credentials of the configured relying party the device holds.
+	// Returns the credential ID, nil if the device holds none of them, or an error.
+	FindCredential(device *DeviceInfo, config *Configuration, credentialIDs [][]byte) ([]byte, error)
+
+	// DeriveSubkeys derives domain-separated subkeys from an HMAC secret with HKDF,
+	// so one touch can produce several independent keys.
+	// Returns the subkeys in the order of the requests or an error if a request is invalid.
+	DeriveSubkeys(secret []byte, requests []SubkeyRequest) ([]Subkey, error)
+
+	// VerifySecret checks a secret against the check values of the stored credentials.
+	// Returns the credential the secret was derived from, or an error if none matches.
+	VerifySecret(secret []byte, config *Configuration) (*CredentialRecord, error)
+
 	// ValidateConfiguration checks if the provided configuration is valid.
 	// Returns an error if the configuration is invalid.
 	ValidateConfiguration(config *Configuration) error
@@ -75,14 +345,21 @@ type CryptoProvider interface {
 // UIProvider defines the interface for user interaction and output formatting.
 // This interface handles all user input/output, making the application's UI
 // easily customizable and testable.
+//
+// Implementations keep results (Output* methods, DisplayResults, reports) apart from
+// diagnostics (progress, prompts, errors), so results can be piped into other tools.
 type UIProvider interface {
 	// DisplayWelcome shows the application header and welcome message.
 	DisplayWelcome()
 
 	// DisplayDevices shows a formatted list of available FIDO2 devices.
 	// Takes a slice of DeviceInfo and presents them in a user-friendly format.
+	// The list is shown as part of the device selection prompt.
 	DisplayDevices(devices []*DeviceInfo)
 
+	// OutputDevices writes the formatted list of devices as a result.
+	OutputDevices(devices []*DeviceInfo)
+
 	// GetUserSelection prompts the user to select a device from the list.
 	// Takes the maximum valid selection number and returns the user's choice.
 	GetUserSelection(maxChoice int) (int, error)
@@ -91,10 +368,6 @@ type UIProvider interface {
 	// The PIN input should be hidden from the terminal for security.
 	GetPIN(prompt string) string
 
-	// GetPINFromEnvironment retrieves the PIN from the specified environment variable.
-	// Returns the PIN value or an error if the environment variable is not set or empty.
-	GetPINFromEnvironment(envVarName string) (string, error)
-
 	// DisplayProgress shows a progress message during long-running operations.
 	DisplayProgress(message string)
 
@@ -112,8 +385,63 @@ type UIProvider interface {
 	// DisplayInfo shows informational messages.
 	DisplayInfo(message string)
 
+	// DisplayWarning shows warning messages that need user attention.
+	DisplayWarning(message string)
+
+	// DisplayCapabilities shows what the given device supports.
+	DisplayCapabilities(device *DeviceInfo, capabilities *DeviceCapabilities)
+
+	// DisplayResidentCredentials shows the resident credentials of a device grouped by
+	// relying party, marking those of the given relying party the store does not know.
+	DisplayResidentCredentials(device *DeviceInfo, credentials []*ResidentCredential, relyingPartyID string)
+
+	// DisplayPINStatus shows whether the device has a PIN, its minimum length and
+	// the PIN and user verification attempts left.
+	DisplayPINStatus(device *DeviceInfo, capabilities *DeviceCapabilities)
+
+	// DisplayCredentials shows a formatted list of stored credential records.
+	DisplayCredentials(records []*CredentialRecord)
+
+	// DisplayVault shows the authenticators enrolled in a vault and, for a
+	// threshold vault, how many of them are needed to unlock it.
+	DisplayVault(path string, threshold int, slots []*VaultSlot)
+
+	// DisplayShareProgress shows how many of the shares needed to unlock a threshold
+	// vault have been collected, and the label of the authenticator of the last one.
+	DisplayShareProgress(collected, threshold int, label string)
+
+	// ConfirmAction asks the user to confirm an action.
+	// Returns true if the user confirms, false otherwise.
+	ConfirmAction(prompt string) bool
+
 	// OutputKeyOnly outputs just the derived key to stdout for scripting purposes.
 	OutputKeyOnly(result *HMACResult)
+
+	// OutputResult writes the derivation result in the given format: a structured
+	// document (JSON or YAML), the secret as one encoded line, or the raw secret bytes.
+	// Returns an error if the options are invalid or the document cannot be written.
+	OutputResult(result *HMACResult, options *OutputOptions) error
+
+	// OutputKeys writes keys that are not part of a derivation result, one encoded
+	// line per key or the raw key bytes, as selected by the options' format.
+	// Returns an error for other formats or if the keys cannot be written.
+	OutputKeys(keys [][]byte, options *OutputOptions) error
+
+	// OutputAgeIdentity writes an age identity file, with the recipient in a comment
+	// as written by age-keygen, and shows the recipient as a diagnostic.
+	OutputAgeIdentity(identity *AgeIdentity) error
+
+	// OutputSSHKey writes the OpenSSH private key file, or only the authorized_keys
+	// line if publicOnly is set, and shows the fingerprint as a diagnostic.
+	OutputSSHKey(key *SSHKey, publicOnly bool) error
+
+	// OutputEnvironment writes a shell command exporting the environment variable,
+	// for use with eval, as ssh-agent does.
+	OutputEnvironment(name, value string)
+
+	// DisplayAgentStatus shows whether the agent on the socket holds a secret, and
+	// until when.
+	DisplayAgentStatus(socket string, status *AgentStatus)
 }
 
 // DefaultConfiguration returns the default application configuration.
@@ -126,23 +454,7 @@ func DefaultConfiguration() *Configuration {
 		UserName:         "hmac-user",
 		UserDisplayName:  "HMAC Secret User",
 		SaltSize:         32, // 256 bit
-	}
-}
-
-// LibFIDO2Device wraps the libfido2.DeviceLocation for easier testing and abstraction.
-// This allows us to work with device information without directly depending on
-// the libfido2 library throughout the codebase.
-type LibFIDO2Device struct {
-	*libfido2.DeviceLocation
-}
 
-// ToDeviceInfo converts a LibFIDO2Device to our internal DeviceInfo structure.
-// This provides a clean separation between external library types and our internal types.
-func (d *LibFIDO2Device) ToDeviceInfo(index int) *DeviceInfo {
-	return &DeviceInfo{
-		Name:         d.Product,
-		Manufacturer: d.Manufacturer,
-		Path:         d.Path,
-		Index:        index,
+		DiscoverCredentials: true,
 	}
 }
@@ -8,11 +8,14 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"fido2-hmac-deriver/internal/store"
 	"fido2-hmac-deriver/internal/types"
 
 	"github.com/fatih/color"
@@ -22,7 +25,16 @@ import (
 // Display implements the UIProvider interface with beautiful colored output.
 // It provides a rich user experience with progress indicators, colored text,
 // and well-formatted output.
+//
+// Output is split into two streams: results (derived keys, reports) go to stdout,
+// while diagnostics (progress, prompts, errors) go to stderr, so stdout can be
+// piped into other tools. Quiet mode suppresses the diagnostics except for
+// prompts and errors.
 type Display struct {
+	out   io.Writer // Result stream
+	diag  io.Writer // Diagnostic stream
+	quiet bool      // Suppress progress and informational diagnostics
+
 	// Color functions for different types of output
 	header    *color.Color
 	success   *color.Color
@@ -37,6 +49,8 @@ type Display struct {
 // The color scheme is designed to be readable and professional.
 func NewDisplay() *Display {
 	return &Display{
+		out:       os.Stdout,
+		diag:      os.Stderr,
 		header:    color.New(color.FgCyan, color.Bold),
 		success:   color.New(color.FgGreen, color.Bold),
 		error:     color.New(color.FgRed, color.Bold),
@@ -47,47 +61,379 @@ func NewDisplay() *Display {
 	}
 }
 
+// SetQuiet enables or disables quiet mode. In quiet mode only results, prompts
+// and errors are written.
+func (d *Display) SetQuiet(quiet bool) {
+	d.quiet = quiet
+}
+
+// diagnostic returns the writer for diagnostics that quiet mode suppresses.
+func (d *Display) diagnostic() io.Writer {
+	if d.quiet {
+		return io.Discard
+	}
+	return d.diag
+}
+
 // DisplayWelcome shows the application header and welcome message.
 // Simple and professional without fancy ASCII art.
 func (d *Display) DisplayWelcome() {
-	d.header.Println("FIDO2 HMAC Secret Deriver")
-	d.header.Println("=========================")
-	fmt.Println()
-	d.info.Println("Deriving cryptographic secrets using FIDO2/CTAP devices.")
-	d.subtle.Println("Ensure your FIDO2 device is connected via USB.")
-	fmt.Println()
+	w := d.diagnostic()
+	d.header.Fprintln(w, "FIDO2 HMAC Secret Deriver")
+	d.header.Fprintln(w, "=========================")
+	fmt.Fprintln(w)
+	d.info.Fprintln(w, "Deriving cryptographic secrets using FIDO2/CTAP devices.")
+	d.subtle.Fprintln(w, "Ensure your FIDO2 device is connected via USB.")
+	fmt.Fprintln(w)
 }
 
 // DisplayDevices shows a formatted list of available FIDO2 devices.
-// Each device is displayed with an index, name, manufacturer, and path.
+// The list is part of the device selection prompt, so it goes to the diagnostic stream.
 func (d *Display) DisplayDevices(devices []*types.DeviceInfo) {
-	d.header.Println("Available FIDO2 Devices:")
-	d.header.Println("========================")
-	fmt.Println()
+	d.writeDevices(d.diag, devices)
+}
+
+// OutputDevices writes the formatted list of devices to the result stream.
+func (d *Display) OutputDevices(devices []*types.DeviceInfo) {
+	d.writeDevices(d.out, devices)
+}
+
+// writeDevices writes the device list.
+// Each device is displayed with an index, name, manufacturer, and path.
+func (d *Display) writeDevices(w io.Writer, devices []*types.DeviceInfo) {
+	d.header.Fprintln(w, "Available FIDO2 Devices:")
+	d.header.Fprintln(w, "========================")
+	fmt.Fprintln(w)
 
 	for _, device := range devices {
 		// Create a formatted device entry
-		d.highlight.Printf("[%d] ", device.Index)
-		d.success.Printf("%s", device.Name)
+		d.highlight.Fprintf(w, "[%d] ", device.Index)
+		d.success.Fprintf(w, "%s", device.Name)
 
 		if device.Manufacturer != "" && device.Manufacturer != device.Name {
-			d.info.Printf(" by %s", device.Manufacturer)
+			d.info.Fprintf(w, " by %s", device.Manufacturer)
+		}
+
+		fmt.Fprintln(w)
+		d.subtle.Fprintf(w, "    Path: %s", device.Path)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w)
+	}
+}
+
+// capabilityOptions lists the authenticatorGetInfo options shown by DisplayCapabilities,
+// with a description and the meaning of the option being absent from the response.
+var capabilityOptions = []struct {
+	name        string
+	description string
+	absent      string
+}{
+	{"rk", "Resident keys", "not supported"},
+	{"up", "User presence", "yes (default)"},
+	{"uv", "Built-in user verification", "not supported"},
+	{"clientPin", "Client PIN set", "PIN not supported"},
+	{"credMgmt", "Credential management", "not supported"},
+	{"bioEnroll", "Fingerprint enrollment", "not supported"},
+	{"alwaysUv", "Always require user verification", "no"},
+	{"plat", "Platform authenticator", "no"},
+}
+
+// DisplayCapabilities shows what the given device supports.
+// Values the backend cannot query are shown as unknown, and absent options are
+// explained according to their CTAP default.
+func (d *Display) DisplayCapabilities(device *types.DeviceInfo, capabilities *types.DeviceCapabilities) {
+	w := d.out
+	d.header.Fprintln(w, "Device Capabilities:")
+	d.header.Fprintln(w, "====================")
+	fmt.Fprintln(w)
+
+	d.highlight.Fprintln(w, "Device Information:")
+	fmt.Fprintf(w, "   Name: %s\n", device.Name)
+	fmt.Fprintf(w, "   Manufacturer: %s\n", device.Manufacturer)
+	fmt.Fprintf(w, "   Path: %s\n", device.Path)
+	fmt.Fprintln(w)
+
+	d.highlight.Fprintln(w, "Authenticator:")
+	fmt.Fprintf(w, "   AAGUID:          %s\n", hex.EncodeToString(capabilities.AAGUID))
+	fmt.Fprintf(w, "   Versions:        %s\n", joinOrNone(capabilities.Versions))
+	fmt.Fprintf(w, "   Firmware:        %s\n", orUnknown(capabilities.FirmwareVersion))
+	fmt.Fprintf(w, "   Extensions:      %s\n", joinOrNone(capabilities.Extensions))
+	protocols := make([]string, len(capabilities.PINProtocols))
+	for i, protocol := range capabilities.PINProtocols {
+		protocols[i] = strconv.Itoa(int(protocol))
+	}
+	fmt.Fprintf(w, "   PIN Protocols:   %s\n", joinOrNone(protocols))
+	fmt.Fprintf(w, "   Max Credentials: %s\n", positiveOrUnreported(capabilities.MaxCredentialCount))
+	fmt.Fprintf(w, "   Min PIN Length:  %s\n", positiveOrUnreported(capabilities.MinPINLength))
+	fmt.Fprintf(w, "   PIN Retries:     %s\n", pinRetries(capabilities))
+	fmt.Fprintf(w, "   UV Retries:      %s\n", uvRetries(capabilities))
+	fmt.Fprintln(w)
+
+	d.highlight.Fprintln(w, "Options:")
+	shown := make(map[string]bool)
+	for _, option := range capabilityOptions {
+		shown[option.name] = true
+		value, reported := capabilities.Option(option.name)
+		switch {
+		case !reported:
+			d.subtle.Fprintf(w, "   %-10s %-34s %s\n", option.name, option.description, option.absent)
+		case value:
+			d.success.Fprintf(w, "   %-10s %-34s yes\n", option.name, option.description)
+		default:
+			fmt.Fprintf(w, "   %-10s %-34s no\n", option.name, option.description)
+		}
+	}
+
+	// Any further options the device reported, e.g. vendor or preview options
+	var others []string
+	for name := range capabilities.Options {
+		if !shown[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		fmt.Fprintf(w, "   %-10s %-34s %t\n", name, "", capabilities.Options[name])
+	}
+	fmt.Fprintln(w)
+
+	d.highlight.Fprintln(w, "Requirements:")
+	if capabilities.HasExtension("hmac-secret") {
+		d.success.Fprintln(w, "   [+] hmac-secret extension supported")
+	} else {
+		d.error.Fprintln(w, "   [!] hmac-secret extension missing, this device cannot be used")
+	}
+	if value, _ := capabilities.Option("rk"); value {
+		d.success.Fprintln(w, "   [+] resident keys supported")
+	} else {
+		d.warning.Fprintln(w, "   [!] resident keys not supported, enrollment will fail")
+	}
+	fmt.Fprintln(w)
+}
+
+// joinOrNone joins a list for display, or returns "none" for an empty list.
+func joinOrNone(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
+
+// orUnknown returns the value, or "unknown" if it is empty.
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// notReported describes a value the backend did not obtain from the device.
+const notReported = "not reported by this backend"
+
+// positiveOrUnreported formats a count that is zero when the backend did not report it.
+func positiveOrUnreported(value int) string {
+	if value <= 0 {
+		return notReported
+	}
+	return strconv.Itoa(value)
+}
+
+// pinRetries describes the PIN attempts left.
+func pinRetries(capabilities *types.DeviceCapabilities) string {
+	if pinSet, _ := capabilities.Option("clientPin"); !pinSet {
+		return "no PIN set"
+	}
+	return retriesOrUnknown(capabilities.PINRetries)
+}
+
+// uvRetries describes the built-in user verification attempts left.
+func uvRetries(capabilities *types.DeviceCapabilities) string {
+	if _, hasUV := capabilities.Option("uv"); !hasUV {
+		return "no built-in user verification"
+	}
+	if capabilities.UVRetries < 0 {
+		return notReported
+	}
+	return strconv.Itoa(capabilities.UVRetries)
+}
+
+// retriesOrUnknown formats a retry counter, which is negative if unknown.
+func retriesOrUnknown(retries int) string {
+	if retries < 0 {
+		return "unknown"
+	}
+	return strconv.Itoa(retries)
+}
+
+// DisplayPINStatus shows whether the device has a PIN, its minimum length and the
+// PIN and user verification attempts left.
+func (d *Display) DisplayPINStatus(device *types.DeviceInfo, capabilities *types.DeviceCapabilities) {
+	w := d.out
+	d.header.Fprintln(w, "PIN Status:")
+	d.header.Fprintln(w, "===========")
+	fmt.Fprintf(w, "Device: %s (%s)\n", device.Name, device.Path)
+	fmt.Fprintln(w)
+
+	pinSet, reported := capabilities.Option("clientPin")
+	switch {
+	case !reported:
+		fmt.Fprintf(w, "   PIN:             not supported\n")
+	case pinSet:
+		d.success.Fprintf(w, "   PIN:             set\n")
+	default:
+		d.warning.Fprintf(w, "   PIN:             not set\n")
+	}
+	fmt.Fprintf(w, "   Min PIN Length:  %s\n", positiveOrUnreported(capabilities.MinPINLength))
+	fmt.Fprintf(w, "   PIN Retries:     %s\n", pinRetries(capabilities))
+	fmt.Fprintf(w, "   UV Retries:      %s\n", uvRetries(capabilities))
+}
+
+// DisplayCredentials shows a formatted list of stored credential records.
+// Each record is identified by its fingerprint, which the credentials command accepts.
+func (d *Display) DisplayCredentials(records []*types.CredentialRecord) {
+	w := d.out
+	d.header.Fprintln(w, "Stored Credentials:")
+	d.header.Fprintln(w, "===================")
+	fmt.Fprintln(w)
+
+	if len(records) == 0 {
+		d.subtle.Fprintln(w, "No credentials stored. Run 'fido2-hmac-deriver enroll' to create one.")
+		fmt.Fprintln(w)
+		return
+	}
+
+	for _, record := range records {
+		d.highlight.Fprintf(w, "%s ", store.Fingerprint(record.CredentialID))
+		d.success.Fprintf(w, "%s", record.RelyingPartyID)
+		if record.DeviceName != "" {
+			d.info.Fprintf(w, " on %s", record.DeviceName)
 		}
+		fmt.Fprintln(w)
+		d.subtle.Fprintf(w, "    AAGUID: %s\n", hex.EncodeToString(record.AAGUID))
+		d.subtle.Fprintf(w, "    User: %s, Algorithm: %s, Salt mode: %s\n", record.UserName, record.Algorithm, record.SaltMode)
+		d.subtle.Fprintf(w, "    Created: %s, Check values: %d\n", record.CreatedAt.Local().Format(time.RFC3339), len(record.CheckValues))
+		fmt.Fprintln(w)
+	}
+}
 
-		fmt.Println()
-		d.subtle.Printf("    Path: %s", device.Path)
-		fmt.Println()
-		fmt.Println()
+// DisplayResidentCredentials shows the resident credentials of a device grouped by
+// relying party. Credentials of the given relying party are marked as stored or as
+// unknown to the store; those of other relying parties belong to other applications.
+func (d *Display) DisplayResidentCredentials(device *types.DeviceInfo, credentials []*types.ResidentCredential, relyingPartyID string) {
+	w := d.out
+	d.header.Fprintln(w, "Resident Credentials:")
+	d.header.Fprintln(w, "=====================")
+	d.subtle.Fprintf(w, "%s (%s)\n", device.Name, device.Path)
+	fmt.Fprintln(w)
+
+	if len(credentials) == 0 {
+		d.subtle.Fprintln(w, "No resident credentials on the device.")
+		fmt.Fprintln(w)
+		return
+	}
+
+	for i, credential := range credentials {
+		rp := credential.RelyingParty
+		if i == 0 || rp.ID != credentials[i-1].RelyingParty.ID {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			d.success.Fprintf(w, "%s", rp.ID)
+			if rp.Name != "" && rp.Name != rp.ID {
+				d.info.Fprintf(w, " (%s)", rp.Name)
+			}
+			fmt.Fprintln(w)
+		}
+
+		d.highlight.Fprintf(w, "  %s ", store.Fingerprint(credential.ID))
+		switch {
+		case rp.ID != relyingPartyID:
+			d.subtle.Fprint(w, "other application")
+		case credential.Record != nil:
+			d.success.Fprint(w, "stored")
+		default:
+			d.warning.Fprint(w, "not in the store")
+		}
+		fmt.Fprintln(w)
+		d.subtle.Fprintf(w, "    User: %s", orUnknown(credential.User.Name))
+		if credential.User.DisplayName != "" {
+			d.subtle.Fprintf(w, ", Display name: %s", credential.User.DisplayName)
+		}
+		fmt.Fprintln(w)
+		if len(credential.UsedBy) > 0 {
+			d.info.Fprintf(w, "    Used by: %s\n", strings.Join(credential.UsedBy, ", "))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// DisplayVault shows the authenticators enrolled in a vault by label.
+func (d *Display) DisplayVault(path string, threshold int, slots []*types.VaultSlot) {
+	w := d.out
+	d.header.Fprintln(w, "Vault Authenticators:")
+	d.header.Fprintln(w, "=====================")
+	d.subtle.Fprintf(w, "%s\n", path)
+	if threshold > 0 {
+		d.info.Fprintf(w, "Unlocking takes %d of the %d authenticators\n", threshold, len(slots))
+	} else {
+		d.info.Fprintf(w, "Any of the %d authenticators unlocks the vault\n", len(slots))
+	}
+	fmt.Fprintln(w)
+
+	for _, slot := range slots {
+		d.highlight.Fprintf(w, "%s ", slot.Label)
+		d.success.Fprintf(w, "%s", slot.RelyingPartyID)
+		d.info.Fprintf(w, " credential %s", store.Fingerprint(slot.CredentialID))
+		fmt.Fprintln(w)
+		d.subtle.Fprintf(w, "    AAGUID: %s\n", hex.EncodeToString(slot.AAGUID))
+		d.subtle.Fprintf(w, "    Added: %s\n", slot.AddedAt.Local().Format(time.RFC3339))
+		fmt.Fprintln(w)
+	}
+}
+
+// DisplayAgentStatus shows whether the agent holds a secret and when it forgets it.
+func (d *Display) DisplayAgentStatus(socket string, status *types.AgentStatus) {
+	w := d.out
+	d.header.Fprintln(w, "Secret Agent:")
+	d.header.Fprintln(w, "=============")
+	d.subtle.Fprintf(w, "%s (process %d)\n", socket, status.PID)
+	if status.Locked {
+		d.warning.Fprintln(w, "Locked, no secret cached")
+		return
+	}
+
+	d.success.Fprintf(w, "Unlocked: %s", status.RelyingPartyID)
+	d.info.Fprintf(w, " credential %s", store.Fingerprint(status.CredentialID))
+	fmt.Fprintln(w)
+	d.subtle.Fprintf(w, "    Device: %s\n", status.Device)
+	d.subtle.Fprintf(w, "    Cached: %s\n", status.LoadedAt.Local().Format(time.RFC3339))
+	d.subtle.Fprintf(w, "    Forgotten when idle at: %s\n", status.IdleExpiresAt.Local().Format(time.RFC3339))
+	d.subtle.Fprintf(w, "    Forgotten at the latest: %s\n", status.ExpiresAt.Local().Format(time.RFC3339))
+}
+
+// DisplayShareProgress shows the shares collected for a threshold vault as a row of
+// boxes, followed by the authenticator that provided the last share.
+func (d *Display) DisplayShareProgress(collected, threshold int, label string) {
+	w := d.diagnostic()
+	d.highlight.Fprintf(w, "[%s%s] ", strings.Repeat("■", collected), strings.Repeat("□", threshold-collected))
+	switch {
+	case label == "":
+		d.info.Fprintf(w, "%d of %d shares collected, each needs a touch on a different authenticator\n", collected, threshold)
+	case collected < threshold:
+		d.success.Fprintf(w, "Share %d of %d collected from '%s', %d more needed\n", collected, threshold, label, threshold-collected)
+	default:
+		d.success.Fprintf(w, "Share %d of %d collected from '%s', all shares collected\n", collected, threshold, label)
 	}
 }
 
 // GetUserSelection prompts the user to select a device from the list.
 // It validates the input and returns the user's choice.
 func (d *Display) GetUserSelection(maxChoice int) (int, error) {
+	w := d.diag
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
-		d.info.Printf("Please select a device [1-%d]: ", maxChoice)
+		d.info.Fprintf(w, "Please select a device [1-%d]: ", maxChoice)
 
 		input, err := reader.ReadString('\n')
 		if err != nil {
@@ -96,18 +442,18 @@ func (d *Display) GetUserSelection(maxChoice int) (int, error) {
 
 		input = strings.TrimSpace(input)
 		if input == "" {
-			d.warning.Println("Please enter a number.")
+			d.warning.Fprintln(w, "Please enter a number.")
 			continue
 		}
 
 		choice, err := strconv.Atoi(input)
 		if err != nil {
-			d.warning.Printf("'%s' is not a valid number. Please try again.\n", input)
+			d.warning.Fprintf(w, "'%s' is not a valid number. Please try again.\n", input)
 			continue
 		}
 
 		if choice < 1 || choice > maxChoice {
-			d.warning.Printf("Please enter a number between 1 and %d.\n", maxChoice)
+			d.warning.Fprintf(w, "Please enter a number between 1 and %d.\n", maxChoice)
 			continue
 		}
 
@@ -118,119 +464,129 @@ func (d *Display) GetUserSelection(maxChoice int) (int, error) {
 // GetPIN prompts the user to enter their FIDO2 device PIN securely.
 // The PIN input is hidden from the terminal for security.
 func (d *Display) GetPIN(prompt string) string {
-	d.info.Print(prompt)
+	w := d.diag
+	d.info.Fprint(w, prompt)
 	pinBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Println() // Add newline after hidden input
+	fmt.Fprintln(w) // Add newline after hidden input
 
 	if err != nil {
-		d.error.Printf("Failed to read PIN: %v\n", err)
+		d.error.Fprintf(w, "Failed to read PIN: %v\n", err)
 		return ""
 	}
 
 	return strings.TrimSpace(string(pinBytes))
 }
 
-// GetPINFromEnvironment retrieves the PIN from the specified environment variable.
-// Returns the PIN value or an error if the environment variable is not set or empty.
-func (d *Display) GetPINFromEnvironment(envVarName string) (string, error) {
-	if envVarName == "" {
-		return "", fmt.Errorf("environment variable name cannot be empty")
-	}
-
-	pin := os.Getenv(envVarName)
-	if pin == "" {
-		return "", fmt.Errorf("environment variable '%s' is not set or is empty\n\nPlease set the environment variable:\n"+
-			"  export %s=\"your_pin_here\"\n"+
-			"Or run without --pin-environment-variable to enter PIN interactively", envVarName, envVarName)
-	}
-
-	pin = strings.TrimSpace(pin)
-	if pin == "" {
-		return "", fmt.Errorf("environment variable '%s' contains only whitespace", envVarName)
-	}
-
-	d.success.Printf("PIN retrieved from environment variable '%s'\n", envVarName)
-	return pin, nil
-}
-
 // DisplayProgress shows a progress message during long-running operations.
 // This helps users understand what the application is doing.
 func (d *Display) DisplayProgress(message string) {
-	d.info.Printf("[~] %s\n", message)
+	d.info.Fprintf(d.diagnostic(), "[~] %s\n", message)
 }
 
 // DisplayResults shows the final HMAC derivation results in a beautiful format.
 // This includes the secret in multiple encodings and all relevant metadata.
 func (d *Display) DisplayResults(result *types.HMACResult) {
-	fmt.Println()
-	d.header.Println("HMAC Secret Derivation Complete!")
-	d.header.Println("=================================")
-	fmt.Println()
+	w := d.out
+	fmt.Fprintln(w)
+	d.header.Fprintln(w, "HMAC Secret Derivation Complete!")
+	d.header.Fprintln(w, "=================================")
+	fmt.Fprintln(w)
 
 	// Device Information
-	d.highlight.Println("Device Information:")
-	fmt.Printf("   Name: %s\n", result.Device.Name)
-	fmt.Printf("   Manufacturer: %s\n", result.Device.Manufacturer)
-	fmt.Printf("   Path: %s\n", result.Device.Path)
-	fmt.Println()
+	d.highlight.Fprintln(w, "Device Information:")
+	fmt.Fprintf(w, "   Name: %s\n", result.Device.Name)
+	fmt.Fprintf(w, "   Manufacturer: %s\n", result.Device.Manufacturer)
+	fmt.Fprintf(w, "   Path: %s\n", result.Device.Path)
+	fmt.Fprintln(w)
 
 	// Operation Details
-	d.highlight.Println("Operation Details:")
-	fmt.Printf("   Relying Party: %s\n", result.RelyingParty)
-	fmt.Printf("   Timestamp: %s\n", result.Timestamp.Format(time.RFC3339))
-	fmt.Printf("   Duration: %s\n", time.Since(result.Timestamp).Truncate(time.Millisecond))
-	fmt.Println()
+	d.highlight.Fprintln(w, "Operation Details:")
+	fmt.Fprintf(w, "   Relying Party: %s\n", result.RelyingParty)
+	fmt.Fprintf(w, "   Timestamp: %s\n", result.Timestamp.Format(time.RFC3339))
+	fmt.Fprintf(w, "   Duration: %s\n", time.Since(result.Timestamp).Truncate(time.Millisecond))
+	fmt.Fprintln(w)
 
 	// Secret Information
-	d.highlight.Println("Derived Secret:")
-	d.success.Printf("   Base64: %s\n", base64.StdEncoding.EncodeToString(result.Secret))
-	fmt.Printf("   Hex:    %s\n", hex.EncodeToString(result.Secret))
-	fmt.Printf("   Length: %d bytes (%d bit)\n", len(result.Secret), len(result.Secret)*8)
-	fmt.Println()
+	d.highlight.Fprintln(w, "Derived Secret:")
+	d.success.Fprintf(w, "   Base64: %s\n", base64.StdEncoding.EncodeToString(result.Secret))
+	fmt.Fprintf(w, "   Hex:    %s\n", hex.EncodeToString(result.Secret))
+	fmt.Fprintf(w, "   Length: %d bytes (%d bit)\n", len(result.Secret), len(result.Secret)*8)
+	fmt.Fprintln(w)
 
 	// Salt Information
-	d.highlight.Println("Salt Used:")
-	fmt.Printf("   Base64: %s\n", base64.StdEncoding.EncodeToString(result.Salt))
-	fmt.Printf("   Hex:    %s\n", hex.EncodeToString(result.Salt))
-	fmt.Printf("   Length: %d bytes\n", len(result.Salt))
-	fmt.Println()
+	if result.SaltGeneration > 0 {
+		d.highlight.Fprintf(w, "Salt Used (generation %d):\n", result.SaltGeneration)
+	} else {
+		d.highlight.Fprintln(w, "Salt Used:")
+	}
+	fmt.Fprintf(w, "   Base64: %s\n", base64.StdEncoding.EncodeToString(result.Salt))
+	fmt.Fprintf(w, "   Hex:    %s\n", hex.EncodeToString(result.Salt))
+	fmt.Fprintf(w, "   Length: %d bytes\n", len(result.Salt))
+	fmt.Fprintln(w)
 
 	// Credential Information
-	d.highlight.Println("Credential Information:")
-	fmt.Printf("   ID (Base64): %s\n", base64.StdEncoding.EncodeToString(result.CredentialID))
-	fmt.Printf("   ID (Hex):    %s\n", hex.EncodeToString(result.CredentialID))
-	fmt.Printf("   Length:      %d bytes\n", len(result.CredentialID))
-	fmt.Println()
+	d.highlight.Fprintln(w, "Credential Information:")
+	fmt.Fprintf(w, "   ID (Base64): %s\n", base64.StdEncoding.EncodeToString(result.CredentialID))
+	fmt.Fprintf(w, "   ID (Hex):    %s\n", hex.EncodeToString(result.CredentialID))
+	fmt.Fprintf(w, "   Length:      %d bytes\n", len(result.CredentialID))
+	fmt.Fprintln(w)
+
+	// Subkeys
+	d.writeSubkeys(w, "Subkeys (HKDF):", result.Subkeys)
+
+	// Next generation for key rotation
+	if result.NextSecret != nil {
+		d.highlight.Fprintf(w, "Next Secret (salt generation %d):\n", result.SaltGeneration+1)
+		d.success.Fprintf(w, "   Base64: %s\n", base64.StdEncoding.EncodeToString(result.NextSecret))
+		fmt.Fprintf(w, "   Hex:    %s\n", hex.EncodeToString(result.NextSecret))
+		fmt.Fprintf(w, "   Salt:   %s\n", hex.EncodeToString(result.NextSalt))
+		fmt.Fprintln(w)
+		d.writeSubkeys(w, "Next Subkeys (HKDF):", result.NextSubkeys)
+	}
 
 	// Security Information
-	d.highlight.Println("Security Information:")
+	d.highlight.Fprintln(w, "Security Information:")
 	secretFingerprint := d.calculateFingerprint(result.Secret)
 	saltFingerprint := d.calculateFingerprint(result.Salt)
 	credFingerprint := d.calculateFingerprint(result.CredentialID)
 
-	fmt.Printf("   Secret Fingerprint:     %s\n", secretFingerprint)
-	fmt.Printf("   Salt Fingerprint:       %s\n", saltFingerprint)
-	fmt.Printf("   Credential Fingerprint: %s\n", credFingerprint)
-	fmt.Println()
+	fmt.Fprintf(w, "   Secret Fingerprint:     %s\n", secretFingerprint)
+	fmt.Fprintf(w, "   Salt Fingerprint:       %s\n", saltFingerprint)
+	fmt.Fprintf(w, "   Credential Fingerprint: %s\n", credFingerprint)
+	fmt.Fprintln(w)
 
 	// Usage Notes
-	d.info.Println("Usage Notes:")
-	d.subtle.Println("   - The derived secret is unique to this device and salt combination")
-	d.subtle.Println("   - Store the salt securely if you need to reproduce this secret")
-	d.subtle.Println("   - The credential is stored on your FIDO2 device")
-	d.subtle.Println("   - This secret can be used for encryption, authentication, or key derivation")
-	fmt.Println()
+	d.info.Fprintln(w, "Usage Notes:")
+	d.subtle.Fprintln(w, "   - The derived secret is unique to this device and salt combination")
+	d.subtle.Fprintln(w, "   - Store the salt securely if you need to reproduce this secret")
+	d.subtle.Fprintln(w, "   - The credential is stored on your FIDO2 device")
+	d.subtle.Fprintln(w, "   - This secret can be used for encryption, authentication, or key derivation")
+	fmt.Fprintln(w)
+}
+
+// writeSubkeys writes a titled list of subkeys, or nothing if there are none.
+func (d *Display) writeSubkeys(w io.Writer, title string, subkeys []types.Subkey) {
+	if len(subkeys) == 0 {
+		return
+	}
+	d.highlight.Fprintln(w, title)
+	for _, subkey := range subkeys {
+		fmt.Fprintf(w, "   %s (%s, %d bytes):\n", subkey.Label, subkey.Hash, len(subkey.Key))
+		d.success.Fprintf(w, "      Base64: %s\n", base64.StdEncoding.EncodeToString(subkey.Key))
+		fmt.Fprintf(w, "      Hex:    %s\n", hex.EncodeToString(subkey.Key))
+	}
+	fmt.Fprintln(w)
 }
 
 // DisplayError shows error messages in a user-friendly format.
 // It provides helpful suggestions when possible.
 func (d *Display) DisplayError(err error) {
-	d.error.Printf("[!] %v\n", err)
+	d.error.Fprintf(d.diag, "[!] %v\n", err)
 }
 
 // DisplaySuccess shows success messages with appropriate formatting.
 func (d *Display) DisplaySuccess(message string) {
-	d.success.Printf("[+] %s\n", message)
+	d.success.Fprintf(d.diagnostic(), "[+] %s\n", message)
 }
 
 // calculateFingerprint creates a short fingerprint for data identification.
@@ -250,32 +606,35 @@ func (d *Display) calculateFingerprint(data []byte) string {
 
 // DisplaySeparator shows a visual separator for organizing output.
 func (d *Display) DisplaySeparator() {
-	d.subtle.Println("----------------------------------------------------------------")
+	d.subtle.Fprintln(d.diagnostic(), "----------------------------------------------------------------")
 }
 
 // DisplayStep shows a numbered step in a process.
 // This helps users follow along with multi-step operations.
 func (d *Display) DisplayStep(step int, total int, description string) {
-	d.highlight.Printf("Step %d/%d: ", step, total)
-	d.info.Printf("%s\n", description)
+	w := d.diagnostic()
+	d.highlight.Fprintf(w, "Step %d/%d: ", step, total)
+	d.info.Fprintf(w, "%s\n", description)
 }
 
 // DisplayWarning shows warning messages that need user attention.
+// Warnings are shown in quiet mode as well.
 func (d *Display) DisplayWarning(message string) {
-	d.warning.Printf("[!] %s\n", message)
+	d.warning.Fprintf(d.diag, "[!] %s\n", message)
 }
 
 // DisplayInfo shows informational messages.
 func (d *Display) DisplayInfo(message string) {
-	d.info.Printf("[~] %s\n", message)
+	d.info.Fprintf(d.diagnostic(), "[~] %s\n", message)
 }
 
 // ConfirmAction asks the user to confirm an action.
 // Returns true if the user confirms, false otherwise.
 func (d *Display) ConfirmAction(prompt string) bool {
+	w := d.diag
 	reader := bufio.NewReader(os.Stdin)
 
-	d.warning.Printf("%s [y/N]: ", prompt)
+	d.warning.Fprintf(w, "%s [y/N]: ", prompt)
 
 	input, err := reader.ReadString('\n')
 	if err != nil {
@@ -289,7 +648,8 @@ func (d *Display) ConfirmAction(prompt string) bool {
 // OutputKeyOnly outputs just the derived key to stdout for scripting purposes.
 // This outputs the key in base64 format to stdout, suitable for piping to other tools.
 func (d *Display) OutputKeyOnly(result *types.HMACResult) {
-	fmt.Println("----- BEGIN DERIVED KEY -----")
-	fmt.Println(base64.StdEncoding.EncodeToString(result.Secret))
-	fmt.Println("----- END DERIVED KEY -----")
+	w := d.out
+	fmt.Fprintln(w, "----- BEGIN DERIVED KEY -----")
+	fmt.Fprintln(w, base64.StdEncoding.EncodeToString(result.Secret))
+	fmt.Fprintln(w, "----- END DERIVED KEY -----")
 }
@@ -0,0 +1,446 @@
+package ui
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+
+	"golang.org/x/term"
+)
+
+// ResultSchema identifies the document written for derivation results.
+const ResultSchema = "fido2-hmac-deriver/derive-result"
+
+// ResultSchemaVersion is the version of the derivation result document.
+// It changes whenever a field is removed, renamed or changes its meaning;
+// new fields may be added without changing the version.
+const ResultSchemaVersion = 1
+
+// binaryFields lists the fields whose encoding can be selected individually.
+var binaryFields = []string{"secret", "salt", "credential_id", "aaguid", "subkeys", "next_secret", "next_salt"}
+
+// binaryValue is an encoded binary field. The encoding is part of the document,
+// so consumers never have to guess how to decode a value.
+type binaryValue struct {
+	Encoding types.Encoding `json:"encoding"`
+	Value    string         `json:"value"`
+	Length   int            `json:"length"` // Length of the decoded value in bytes
+}
+
+// resultDocument is the versioned document written for a derivation result.
+type resultDocument struct {
+	Schema       string              `json:"schema"`
+	Version      int                 `json:"version"`
+	Secret       binaryValue         `json:"secret"`
+	Salt         binaryValue         `json:"salt"`
+	SaltMode     types.SaltMode      `json:"salt_mode"`
+	CredentialID binaryValue         `json:"credential_id"`
+	RelyingParty string              `json:"relying_party"`
+	Timestamp    string              `json:"timestamp"` // RFC 3339
+	Device       deviceDocument      `json:"device"`
+	Fingerprints fingerprintDocument `json:"fingerprints"`
+	Subkeys      []subkeyDocument    `json:"subkeys,omitempty"`
+
+	SaltGeneration int              `json:"salt_generation"`
+	NextSecret     *binaryValue     `json:"next_secret,omitempty"`
+	NextSalt       *binaryValue     `json:"next_salt,omitempty"`
+	NextSubkeys    []subkeyDocument `json:"next_subkeys,omitempty"`
+}
+
+// subkeyDocument describes a subkey derived with HKDF.
+type subkeyDocument struct {
+	Label string           `json:"label"`
+	Hash  types.SubkeyHash `json:"hash"`
+	Key   binaryValue      `json:"key"`
+}
+
+// deviceDocument describes the device a result was derived with.
+type deviceDocument struct {
+	Name         string      `json:"name"`
+	Manufacturer string      `json:"manufacturer"`
+	Path         string      `json:"path"`
+	AAGUID       binaryValue `json:"aaguid"`
+}
+
+// fingerprintDocument holds short identifiers of the result values: the hex-encoded
+// first 8 bytes of their SHA-256 hash. The credential fingerprint is the one
+// accepted by the credentials command.
+type fingerprintDocument struct {
+	Secret     string `json:"secret"`
+	Salt       string `json:"salt"`
+	Credential string `json:"credential"`
+}
+
+// ParseOutputOptions validates the output flags and turns them into OutputOptions.
+//
+// Parameters:
+//   - format: The output format (text, json, yaml, key or raw)
+//   - encoding: The default encoding of binary fields (base64, base64url or hex)
+//   - fieldEncodings: Comma-separated per-field overrides (e.g., "secret=hex,credential_id=base64url")
+//
+// Returns:
+//   - The parsed OutputOptions
+//   - An error if a format, encoding or field name is unknown
+func ParseOutputOptions(format, encoding, fieldEncodings string) (*types.OutputOptions, error) {
+	options := &types.OutputOptions{
+		Format:         types.OutputFormat(format),
+		Encoding:       types.Encoding(encoding),
+		FieldEncodings: make(map[string]types.Encoding),
+	}
+
+	switch options.Format {
+	case types.OutputText, types.OutputJSON, types.OutputYAML, types.OutputKey, types.OutputRaw,
+		types.OutputAge, types.OutputAgePlugin:
+	default:
+		return nil, fmt.Errorf("unknown output format '%s' (expected %s, %s, %s, %s, %s, %s or %s)", format,
+			types.OutputText, types.OutputJSON, types.OutputYAML, types.OutputKey, types.OutputRaw,
+			types.OutputAge, types.OutputAgePlugin)
+	}
+
+	if err := checkEncoding(options.Encoding); err != nil {
+		return nil, err
+	}
+
+	for _, override := range strings.Split(fieldEncodings, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		field, fieldEncoding, ok := strings.Cut(override, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid field encoding '%s' (expected field=encoding, e.g. secret=hex)", override)
+		}
+		if !isBinaryField(field) {
+			return nil, fmt.Errorf("unknown field '%s' (expected one of %s)", field, strings.Join(binaryFields, ", "))
+		}
+		if err := checkEncoding(types.Encoding(fieldEncoding)); err != nil {
+			return nil, err
+		}
+		options.FieldEncodings[field] = types.Encoding(fieldEncoding)
+	}
+
+	return options, nil
+}
+
+// OutputResult writes the derivation result to the result stream.
+// The key and raw formats write the keys in order: the secret, or its subkeys if
+// any were derived, followed by the next secret or its subkeys during rotation.
+// The key format writes one encoded line per key, the raw format the key bytes
+// concatenated, and refuses to write binary data to a terminal.
+func (d *Display) OutputResult(result *types.HMACResult, options *types.OutputOptions) error {
+	switch options.Format {
+	case types.OutputKey, types.OutputRaw:
+		return d.writeKeys(outputKeys(result), options)
+	default:
+		return writeDocument(d.out, newResultDocument(result, options), options.Format)
+	}
+}
+
+// OutputKeys writes keys that are not part of a derivation result, such as unwrapped
+// data encryption keys, in the key or raw format (see OutputResult).
+func (d *Display) OutputKeys(keys [][]byte, options *types.OutputOptions) error {
+	outputs := make([]outputKey, len(keys))
+	for i, key := range keys {
+		outputs[i] = outputKey{field: "key", data: key}
+	}
+	return d.writeKeys(outputs, options)
+}
+
+// OutputAgeIdentity writes an age identity file to the result stream, in the layout
+// of age-keygen, and shows the recipient on the diagnostic stream.
+func (d *Display) OutputAgeIdentity(identity *types.AgeIdentity) error {
+	_, err := fmt.Fprintf(d.out, "# created: %s\n# public key: %s\n%s\n",
+		identity.Created.Format(time.RFC3339), identity.Recipient, identity.Identity)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(d.diagnostic(), "Public key: %s\n", identity.Recipient)
+	return nil
+}
+
+// OutputSSHKey writes the OpenSSH private key file or the authorized_keys line to the
+// result stream, and shows the fingerprint and public key on the diagnostic stream.
+func (d *Display) OutputSSHKey(key *types.SSHKey, publicOnly bool) error {
+	if publicOnly {
+		if _, err := fmt.Fprintln(d.out, key.AuthorizedKey); err != nil {
+			return err
+		}
+	} else if _, err := d.out.Write(key.PrivateKey); err != nil {
+		return err
+	}
+	fmt.Fprintf(d.diagnostic(), "Fingerprint: %s\n", key.Fingerprint)
+	if !publicOnly {
+		fmt.Fprintf(d.diagnostic(), "Public key: %s\n", key.AuthorizedKey)
+	}
+	return nil
+}
+
+// OutputEnvironment writes a Bourne shell command exporting the environment variable
+// to the result stream.
+func (d *Display) OutputEnvironment(name, value string) {
+	fmt.Fprintf(d.out, "%s=%s; export %s;\n", name, shellQuote(value), name)
+}
+
+// shellQuote quotes a value for the Bourne shell unless it only has safe characters.
+func shellQuote(value string) string {
+	unsafe := func(r rune) bool {
+		return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._-+:@%=,", r)
+	}
+	if value != "" && strings.IndexFunc(value, unsafe) < 0 {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// writeKeys writes keys in the key or raw format.
+func (d *Display) writeKeys(keys []outputKey, options *types.OutputOptions) error {
+	switch options.Format {
+	case types.OutputKey:
+		for _, key := range keys {
+			if _, err := fmt.Fprintln(d.out, encodeField(key.field, key.data, options).Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case types.OutputRaw:
+		if f, ok := d.out.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+			return fmt.Errorf("refusing to write the raw key to a terminal, redirect stdout or use --output=key")
+		}
+		for _, key := range keys {
+			if _, err := d.out.Write(key.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("keys cannot be written in the %s format (expected %s or %s)", options.Format, types.OutputKey, types.OutputRaw)
+	}
+}
+
+// outputKey is a key written by the key and raw formats, with the field that selects its encoding.
+type outputKey struct {
+	field string
+	data  []byte
+}
+
+// outputKeys lists the keys written by the key and raw formats, in order.
+func outputKeys(result *types.HMACResult) []outputKey {
+	var keys []outputKey
+	add := func(secret []byte, subkeys []types.Subkey, field string) {
+		if len(subkeys) == 0 {
+			keys = append(keys, outputKey{field: field, data: secret})
+			return
+		}
+		for _, subkey := range subkeys {
+			keys = append(keys, outputKey{field: "subkeys", data: subkey.Key})
+		}
+	}
+
+	add(result.Secret, result.Subkeys, "secret")
+	if result.NextSecret != nil {
+		add(result.NextSecret, result.NextSubkeys, "next_secret")
+	}
+	return keys
+}
+
+// newResultDocument builds the document for a derivation result.
+func newResultDocument(result *types.HMACResult, options *types.OutputOptions) *resultDocument {
+	device := result.Device
+	if device == nil {
+		device = &types.DeviceInfo{}
+	}
+
+	document := &resultDocument{
+		Schema:       ResultSchema,
+		Version:      ResultSchemaVersion,
+		Secret:       encodeField("secret", result.Secret, options),
+		Salt:         encodeField("salt", result.Salt, options),
+		SaltMode:     result.SaltMode,
+		CredentialID: encodeField("credential_id", result.CredentialID, options),
+		RelyingParty: result.RelyingParty,
+		Timestamp:    result.Timestamp.Format(time.RFC3339),
+		Device: deviceDocument{
+			Name:         device.Name,
+			Manufacturer: device.Manufacturer,
+			Path:         device.Path,
+			AAGUID:       encodeField("aaguid", device.AAGUID, options),
+		},
+		Fingerprints: fingerprintDocument{
+			Secret:     store.Fingerprint(result.Secret),
+			Salt:       store.Fingerprint(result.Salt),
+			Credential: store.Fingerprint(result.CredentialID),
+		},
+		Subkeys:        subkeyDocuments(result.Subkeys, options),
+		SaltGeneration: result.SaltGeneration,
+		NextSubkeys:    subkeyDocuments(result.NextSubkeys, options),
+	}
+
+	if result.NextSecret != nil {
+		nextSecret := encodeField("next_secret", result.NextSecret, options)
+		nextSalt := encodeField("next_salt", result.NextSalt, options)
+		document.NextSecret = &nextSecret
+		document.NextSalt = &nextSalt
+	}
+	return document
+}
+
+// subkeyDocuments builds the documents for a list of subkeys.
+func subkeyDocuments(subkeys []types.Subkey, options *types.OutputOptions) []subkeyDocument {
+	var documents []subkeyDocument
+	for _, subkey := range subkeys {
+		documents = append(documents, subkeyDocument{
+			Label: subkey.Label,
+			Hash:  subkey.Hash,
+			Key:   encodeField("subkeys", subkey.Key, options),
+		})
+	}
+	return documents
+}
+
+// encodeField encodes a binary field with its override or the default encoding.
+func encodeField(field string, data []byte, options *types.OutputOptions) binaryValue {
+	encoding := options.Encoding
+	if override, ok := options.FieldEncodings[field]; ok {
+		encoding = override
+	}
+	return binaryValue{Encoding: encoding, Value: encodeBytes(data, encoding), Length: len(data)}
+}
+
+// encodeBytes encodes data with the given encoding.
+func encodeBytes(data []byte, encoding types.Encoding) string {
+	switch encoding {
+	case types.EncodingHex:
+		return hex.EncodeToString(data)
+	case types.EncodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString(data)
+	default:
+		return base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+// DecodeBytes decodes data written with the given encoding, the inverse of the
+// encoding of binary fields in key output.
+func DecodeBytes(data string, encoding types.Encoding) ([]byte, error) {
+	switch encoding {
+	case types.EncodingHex:
+		return hex.DecodeString(data)
+	case types.EncodingBase64URL:
+		return base64.RawURLEncoding.DecodeString(data)
+	case types.EncodingBase64:
+		return base64.StdEncoding.DecodeString(data)
+	default:
+		return nil, checkEncoding(encoding)
+	}
+}
+
+// checkEncoding returns an error for unknown encodings.
+func checkEncoding(encoding types.Encoding) error {
+	switch encoding {
+	case types.EncodingBase64, types.EncodingBase64URL, types.EncodingHex:
+		return nil
+	default:
+		return fmt.Errorf("unknown encoding '%s' (expected %s, %s or %s)",
+			encoding, types.EncodingBase64, types.EncodingBase64URL, types.EncodingHex)
+	}
+}
+
+// isBinaryField reports whether the encoding of a field can be selected.
+func isBinaryField(field string) bool {
+	for _, name := range binaryFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDocument writes a document in the given structured format.
+func writeDocument(w io.Writer, document any, format types.OutputFormat) error {
+	switch format {
+	case types.OutputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(document)
+	case types.OutputYAML:
+		return writeYAML(w, reflect.ValueOf(document), 0)
+	default:
+		return fmt.Errorf("output format '%s' is not a structured format", format)
+	}
+}
+
+// writeYAML writes a struct as a YAML mapping, using the json tags as keys so
+// that both formats share one schema. Only the kinds used by the documents in this
+// file are supported: nested structs (also behind pointers), slices of structs,
+// strings, integers and booleans. Strings are written as double-quoted scalars with JSON escaping,
+// which YAML accepts unchanged.
+func writeYAML(w io.Writer, v reflect.Value, indent int) error {
+	for v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("cannot write %s as a YAML mapping", v.Kind())
+	}
+
+	prefix := strings.Repeat("  ", indent)
+	for i := 0; i < v.NumField(); i++ {
+		key, tagOptions, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		field := v.Field(i)
+		if tagOptions == "omitempty" && field.IsZero() {
+			continue
+		}
+
+		for field.Kind() == reflect.Pointer && !field.IsNil() {
+			field = field.Elem()
+		}
+
+		switch field.Kind() {
+		case reflect.Struct:
+			if _, err := fmt.Fprintf(w, "%s%s:\n", prefix, key); err != nil {
+				return err
+			}
+			if err := writeYAML(w, field, indent+1); err != nil {
+				return err
+			}
+		case reflect.Slice:
+			if _, err := fmt.Fprintf(w, "%s%s:\n", prefix, key); err != nil {
+				return err
+			}
+			for j := 0; j < field.Len(); j++ {
+				// Write the item one level deeper and turn its first indentation into the "- " marker
+				var item strings.Builder
+				if err := writeYAML(&item, field.Index(j), indent+2); err != nil {
+					return err
+				}
+				text := item.String()
+				text = prefix + "  - " + text[len(prefix)+4:]
+				if _, err := io.WriteString(w, text); err != nil {
+					return err
+				}
+			}
+		case reflect.String:
+			quoted, err := json.Marshal(field.String())
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "%s%s: %s\n", prefix, key, quoted); err != nil {
+				return err
+			}
+		case reflect.Int, reflect.Int64, reflect.Bool:
+			if _, err := fmt.Fprintf(w, "%s%s: %v\n", prefix, key, field.Interface()); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot write field %s of kind %s as YAML", key, field.Kind())
+		}
+	}
+	return nil
+}
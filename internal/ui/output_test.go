@@ -0,0 +1,226 @@
+package ui
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fido2-hmac-deriver/internal/types"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// sequence returns length bytes counting up from start.
+func sequence(start byte, length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = start + byte(i)
+	}
+	return data
+}
+
+// testResult returns a derivation result with fixed values, with the subkeys and
+// the next generation if rotation is set.
+func testResult(rotation bool) *types.HMACResult {
+	result := &types.HMACResult{
+		Secret:       sequence(0x00, 32),
+		Salt:         sequence(0x40, 32),
+		CredentialID: sequence(0x80, 16),
+		Device: &types.DeviceInfo{
+			Name:         "Virtual FIDO2 Authenticator",
+			Manufacturer: "fido2-hmac-deriver",
+			Path:         "virtual:0",
+			AAGUID:       sequence(0xf0, 16),
+		},
+		Timestamp:    time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		RelyingParty: "fido2-hmac-deriver",
+		SaltMode:     types.SaltModeContext,
+	}
+	if rotation {
+		result.Subkeys = []types.Subkey{
+			{Label: "disk", Hash: types.SubkeyHashSHA256, Key: sequence(0x10, 32)},
+			{Label: "backup \"offsite\"", Hash: types.SubkeyHashSHA512, Key: sequence(0x20, 16)},
+		}
+		result.SaltGeneration = 1
+		result.NextSecret = sequence(0x60, 32)
+		result.NextSalt = sequence(0xa0, 32)
+		result.NextSubkeys = []types.Subkey{
+			{Label: "disk", Hash: types.SubkeyHashSHA256, Key: sequence(0xc0, 32)},
+			{Label: "backup \"offsite\"", Hash: types.SubkeyHashSHA512, Key: sequence(0xe0, 16)},
+		}
+	}
+	return result
+}
+
+// testDisplay returns a display writing results to out and discarding diagnostics.
+func testDisplay(out io.Writer) *Display {
+	d := NewDisplay()
+	d.out, d.diag = out, io.Discard
+	return d
+}
+
+// checkGolden compares output with testdata/<name>.golden, or rewrites the file
+// with -update.
+func checkGolden(t *testing.T, name string, output []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the tests with -update to create it)", err)
+	}
+	if !bytes.Equal(output, want) {
+		t.Errorf("output differs from %s:\n%s\nwant:\n%s", path, output, want)
+	}
+}
+
+// The output formats are an interface to scripts, so any change to them must be
+// deliberate: update the golden files with 'go test ./internal/ui -update'.
+func TestOutputResultGolden(t *testing.T) {
+	tests := []struct {
+		name           string
+		format         string
+		encoding       string
+		fieldEncodings string
+		rotation       bool
+	}{
+		{name: "json", format: "json", encoding: "base64"},
+		{name: "json-rotation", format: "json", encoding: "hex", rotation: true},
+		{name: "yaml", format: "yaml", encoding: "base64", fieldEncodings: "secret=hex,credential_id=base64url"},
+		{name: "yaml-rotation", format: "yaml", encoding: "base64url", rotation: true},
+		{name: "key", format: "key", encoding: "base64"},
+		{name: "key-rotation", format: "key", encoding: "hex", fieldEncodings: "next_secret=base64", rotation: true},
+		{name: "raw", format: "raw", encoding: "base64"},
+		{name: "raw-rotation", format: "raw", encoding: "base64", rotation: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := ParseOutputOptions(tt.format, tt.encoding, tt.fieldEncodings)
+			if err != nil {
+				t.Fatalf("ParseOutputOptions: %v", err)
+			}
+			var out bytes.Buffer
+			if err := testDisplay(&out).OutputResult(testResult(tt.rotation), options); err != nil {
+				t.Fatalf("OutputResult: %v", err)
+			}
+			checkGolden(t, tt.name, out.Bytes())
+		})
+	}
+}
+
+func TestOutputKeys(t *testing.T) {
+	keys := [][]byte{sequence(0x00, 16), sequence(0x10, 16)}
+	tests := []struct {
+		format   string
+		encoding string
+		want     string
+	}{
+		{"key", "hex", "000102030405060708090a0b0c0d0e0f\n101112131415161718191a1b1c1d1e1f\n"},
+		{"key", "base64url", "AAECAwQFBgcICQoLDA0ODw\nEBESExQVFhcYGRobHB0eHw\n"},
+		{"raw", "base64", string(sequence(0x00, 32))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"-"+tt.encoding, func(t *testing.T) {
+			options, err := ParseOutputOptions(tt.format, tt.encoding, "")
+			if err != nil {
+				t.Fatalf("ParseOutputOptions: %v", err)
+			}
+			var out bytes.Buffer
+			if err := testDisplay(&out).OutputKeys(keys, options); err != nil {
+				t.Fatalf("OutputKeys: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("OutputKeys wrote %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+
+	options, err := ParseOutputOptions("json", "base64", "")
+	if err != nil {
+		t.Fatalf("ParseOutputOptions: %v", err)
+	}
+	if err := testDisplay(io.Discard).OutputKeys(keys, options); err == nil {
+		t.Error("OutputKeys wrote keys as JSON")
+	}
+}
+
+func TestOutputAgeIdentity(t *testing.T) {
+	var out bytes.Buffer
+	err := testDisplay(&out).OutputAgeIdentity(&types.AgeIdentity{
+		Identity:  "AGE-SECRET-KEY-1QQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQS7FVQ3",
+		Recipient: "age1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq",
+		Created:   time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("OutputAgeIdentity: %v", err)
+	}
+	checkGolden(t, "age", out.Bytes())
+}
+
+func TestOutputEnvironment(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"/run/user/1000/agent.sock", "SSH_AUTH_SOCK=/run/user/1000/agent.sock; export SSH_AUTH_SOCK;\n"},
+		{"/tmp/my agent", "SSH_AUTH_SOCK='/tmp/my agent'; export SSH_AUTH_SOCK;\n"},
+		{"it's", "SSH_AUTH_SOCK='it'\\''s'; export SSH_AUTH_SOCK;\n"},
+		{"", "SSH_AUTH_SOCK=''; export SSH_AUTH_SOCK;\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		testDisplay(&out).OutputEnvironment("SSH_AUTH_SOCK", tt.value)
+		if out.String() != tt.want {
+			t.Errorf("OutputEnvironment(%q) = %q, want %q", tt.value, out.String(), tt.want)
+		}
+	}
+}
+
+func TestParseOutputOptionsRejectsUnknownValues(t *testing.T) {
+	tests := []struct {
+		format         string
+		encoding       string
+		fieldEncodings string
+		want           string
+	}{
+		{"xml", "base64", "", "unknown output format 'xml'"},
+		{"json", "base32", "", "unknown encoding 'base32'"},
+		{"json", "base64", "secret", "invalid field encoding 'secret'"},
+		{"json", "base64", "pin=hex", "unknown field 'pin'"},
+		{"json", "base64", "secret=base32", "unknown encoding 'base32'"},
+	}
+	for _, tt := range tests {
+		_, err := ParseOutputOptions(tt.format, tt.encoding, tt.fieldEncodings)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseOutputOptions(%q, %q, %q) = %v, want an error containing %q",
+				tt.format, tt.encoding, tt.fieldEncodings, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeBytes(t *testing.T) {
+	data := sequence(0xf8, 8)
+	for _, encoding := range []types.Encoding{types.EncodingBase64, types.EncodingBase64URL, types.EncodingHex} {
+		decoded, err := DecodeBytes(encodeBytes(data, encoding), encoding)
+		if err != nil {
+			t.Fatalf("DecodeBytes(%s): %v", encoding, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("DecodeBytes(%s) = %x, want %x", encoding, decoded, data)
+		}
+	}
+	if _, err := DecodeBytes("AAAA", "base32"); err == nil {
+		t.Error("DecodeBytes accepted an unknown encoding")
+	}
+}
@@ -0,0 +1,204 @@
+package ui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ErrPINCanceled reports that the user canceled the PIN entry.
+var ErrPINCanceled = errors.New("PIN entry canceled")
+
+// gpgErrCanceled and gpgErrFullyCanceled are the libgpg-error codes pinentry
+// reports when the user cancels the dialog, in the low 16 bits of the error.
+const (
+	gpgErrCanceled      = 99
+	gpgErrFullyCanceled = 198
+)
+
+// pinentryTitle is the window title of the pinentry dialog.
+const pinentryTitle = "fido2-hmac-deriver"
+
+// runPinentry asks for the PIN with a pinentry program, e.g. pinentry-gnome3 or
+// pinentry-curses, speaking the Assuan protocol on its stdin and stdout. The PIN
+// never passes through the environment or the command line.
+func runPinentry(program, description string, stderr io.Writer) (string, error) {
+	if program == "" {
+		return "", fmt.Errorf("pinentry program cannot be empty")
+	}
+
+	cmd := exec.Command(program)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start pinentry: %w", err)
+	}
+
+	conn := &assuanConn{w: stdin, r: bufio.NewReader(stdout)}
+	pin, err := conn.getPIN(description)
+	stdin.Close()
+	cmd.Wait() // The PIN is all that matters, however the program exits
+	if err != nil {
+		return "", err
+	}
+
+	pin = strings.TrimSpace(pin)
+	if pin == "" {
+		return "", errors.New("pinentry returned an empty PIN")
+	}
+	return pin, nil
+}
+
+// assuanConn is the client side of an Assuan connection to a pinentry program.
+type assuanConn struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// getPIN configures the dialog and asks for the PIN.
+func (c *assuanConn) getPIN(description string) (string, error) {
+	// The server greets with OK once it is ready
+	if _, err := c.response(); err != nil {
+		return "", fmt.Errorf("pinentry did not start: %w", err)
+	}
+
+	// Curses pinentries need the terminal; unknown options are not fatal
+	for _, option := range terminalOptions() {
+		c.command("OPTION " + option)
+	}
+
+	commands := []string{
+		"SETTITLE " + assuanEscape(pinentryTitle),
+		"SETDESC " + assuanEscape(description),
+		"SETPROMPT " + assuanEscape("PIN:"),
+	}
+	for _, command := range commands {
+		if _, err := c.command(command); err != nil {
+			return "", fmt.Errorf("pinentry: %w", err)
+		}
+	}
+
+	pin, err := c.command("GETPIN")
+	if err != nil {
+		if errors.Is(err, ErrPINCanceled) {
+			return "", err
+		}
+		return "", fmt.Errorf("pinentry: %w", err)
+	}
+	c.command("BYE")
+	return pin, nil
+}
+
+// command sends a command and returns the data of its response.
+func (c *assuanConn) command(command string) (string, error) {
+	if _, err := io.WriteString(c.w, command+"\n"); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+// response reads the lines of a response up to OK or ERR, and returns the data
+// lines decoded and joined.
+func (c *assuanConn) response() (string, error) {
+	var data strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return "", errors.New("pinentry closed the connection")
+			}
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "D "):
+			data.WriteString(assuanUnescape(line[2:]))
+		case strings.HasPrefix(line, "ERR "):
+			return "", assuanError(line[4:])
+		case strings.HasPrefix(line, "INQUIRE "):
+			// No inquiries are expected, so answer them without data
+			if _, err := io.WriteString(c.w, "CAN\n"); err != nil {
+				return "", err
+			}
+		default:
+			// Status lines (S) and comments (#) carry nothing needed here
+		}
+	}
+}
+
+// assuanError converts the text of an ERR line, a libgpg-error code and a
+// description, to an error.
+func assuanError(text string) error {
+	codeText, description, _ := strings.Cut(text, " ")
+	code, err := strconv.ParseUint(codeText, 10, 32)
+	if err == nil {
+		if c := code & 0xffff; c == gpgErrCanceled || c == gpgErrFullyCanceled {
+			return ErrPINCanceled
+		}
+	}
+	return fmt.Errorf("%s (error %s)", assuanUnescape(description), codeText)
+}
+
+// terminalOptions returns the options telling a terminal-based pinentry where to
+// draw, as gpg-agent does: the terminal from $GPG_TTY or stdin, and its type.
+func terminalOptions() []string {
+	var options []string
+	tty := os.Getenv("GPG_TTY")
+	if tty == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		tty, _ = os.Readlink("/proc/self/fd/0")
+	}
+	if tty != "" {
+		options = append(options, "ttyname="+assuanEscape(tty))
+	}
+	if termType := os.Getenv("TERM"); termType != "" {
+		options = append(options, "ttytype="+assuanEscape(termType))
+	}
+	return options
+}
+
+// assuanEscape percent-encodes the characters Assuan lines cannot carry.
+func assuanEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '%', '\r', '\n':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// assuanUnescape decodes the percent escapes of Assuan data and error lines.
+func assuanUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
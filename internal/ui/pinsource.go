@@ -0,0 +1,171 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxPINBytes bounds how much is read from a PIN source. CTAP2 PINs have at most
+// 63 bytes, so anything longer is not a PIN.
+const maxPINBytes = 256
+
+// PINSource supplies the device PIN without prompting on the terminal.
+type PINSource interface {
+	// ReadPIN returns the PIN without surrounding whitespace. The description says
+	// what the PIN is needed for; sources asking the user show it.
+	ReadPIN(description string) (string, error)
+
+	// String describes where the PIN comes from, for messages.
+	String() string
+}
+
+// EnvironmentPIN reads the PIN from the environment variable with the given name.
+type EnvironmentPIN string
+
+// ReadPIN returns the value of the environment variable.
+func (e EnvironmentPIN) ReadPIN(string) (string, error) {
+	name := string(e)
+	if name == "" {
+		return "", fmt.Errorf("environment variable name cannot be empty")
+	}
+
+	pin := os.Getenv(name)
+	if pin == "" {
+		return "", fmt.Errorf("environment variable '%s' is not set or is empty\n\nPlease set the environment variable:\n"+
+			"  export %s=\"your_pin_here\"\n"+
+			"Or run without --pin-environment-variable to enter PIN interactively", name, name)
+	}
+
+	pin = strings.TrimSpace(pin)
+	if pin == "" {
+		return "", fmt.Errorf("environment variable '%s' contains only whitespace", name)
+	}
+	return pin, nil
+}
+
+func (e EnvironmentPIN) String() string {
+	return fmt.Sprintf("environment variable '%s'", string(e))
+}
+
+// FilePIN reads the PIN from the first line of the file at the given path, e.g. a
+// credential passed by systemd or a secret mounted by CI. Files other users can read
+// are refused.
+type FilePIN string
+
+// ReadPIN returns the first line of the file.
+func (f FilePIN) ReadPIN(string) (string, error) {
+	path := string(f)
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0044 != 0 {
+		return "", fmt.Errorf("%s is readable by other users (mode %04o), restrict it with 'chmod go-rwx %s'", path, perm, path)
+	}
+	return readPINLine(file, path)
+}
+
+func (f FilePIN) String() string {
+	return fmt.Sprintf("file %s", string(f))
+}
+
+// FDPIN reads the PIN from the first line of the open file descriptor, e.g. a pipe
+// set up by the caller. The descriptor can only be read once, so the PIN is kept for
+// later reads.
+type FDPIN struct {
+	FD int
+
+	pin  string
+	err  error
+	read bool
+}
+
+// ReadPIN reads the first line of the file descriptor, or returns the PIN read before.
+// Stdin is read through os.Stdin, so it stays open for the data that follows the PIN;
+// other descriptors are closed after reading.
+func (f *FDPIN) ReadPIN(string) (string, error) {
+	if !f.read {
+		f.read = true
+		if f.FD == 0 {
+			f.pin, f.err = readPINLine(os.Stdin, f.String())
+		} else if file := os.NewFile(uintptr(f.FD), f.String()); file == nil {
+			f.err = fmt.Errorf("invalid file descriptor %d", f.FD)
+		} else {
+			f.pin, f.err = readPINLine(file, f.String())
+			file.Close()
+		}
+	}
+	return f.pin, f.err
+}
+
+func (f *FDPIN) String() string {
+	if f.FD == 0 {
+		return "stdin"
+	}
+	return fmt.Sprintf("file descriptor %d", f.FD)
+}
+
+// NewStdinPIN returns a source reading the PIN from the first line of stdin.
+func NewStdinPIN() *FDPIN {
+	return &FDPIN{FD: 0}
+}
+
+// PinentryPIN asks for the PIN with a pinentry program speaking the Assuan protocol.
+type PinentryPIN struct {
+	Program string
+	Stderr  io.Writer // Receives the program's diagnostics
+}
+
+// ReadPIN shows the description in the pinentry dialog and returns the entered PIN.
+// It returns ErrPINCanceled if the user canceled the dialog.
+func (p *PinentryPIN) ReadPIN(description string) (string, error) {
+	return runPinentry(p.Program, description, p.Stderr)
+}
+
+func (p *PinentryPIN) String() string {
+	return fmt.Sprintf("pinentry program %s", p.Program)
+}
+
+// readPINLine reads the first line from r, byte by byte so that nothing after it is
+// consumed, and returns it without surrounding whitespace.
+func readPINLine(r io.Reader, name string) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) <= maxPINBytes {
+		n, err := r.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read the PIN from %s: %w", name, err)
+		}
+	}
+	if len(line) > maxPINBytes {
+		return "", fmt.Errorf("the first line of %s is too long for a PIN", name)
+	}
+
+	pin := strings.TrimSpace(string(line))
+	if pin == "" {
+		return "", fmt.Errorf("%s does not contain a PIN", name)
+	}
+	return pin, nil
+}
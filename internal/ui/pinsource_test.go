@@ -0,0 +1,89 @@
+//go:build unix
+
+package ui
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// pipe returns the read end of a pipe holding data.
+func pipe(t *testing.T, data string) *os.File {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// dup returns a duplicate of the file's descriptor, for a source that closes it.
+func dup(t *testing.T, f *os.File) int {
+	t.Helper()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestFDPIN(t *testing.T) {
+	source := &FDPIN{FD: dup(t, pipe(t, "123456\n"))}
+	for i := 0; i < 2; i++ {
+		pin, err := source.ReadPIN("")
+		if err != nil {
+			t.Fatalf("ReadPIN: %v", err)
+		}
+		if pin != "123456" {
+			t.Errorf("ReadPIN = %q, want 123456", pin)
+		}
+	}
+}
+
+func TestStdinPINKeepsStdinOpen(t *testing.T) {
+	stdin := os.Stdin
+	os.Stdin = pipe(t, "123456\nfile contents")
+	defer func() { os.Stdin = stdin }()
+
+	pin, err := NewStdinPIN().ReadPIN("")
+	if err != nil {
+		t.Fatalf("ReadPIN: %v", err)
+	}
+	if pin != "123456" {
+		t.Errorf("ReadPIN = %q, want 123456", pin)
+	}
+
+	rest, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		t.Fatalf("reading stdin after the PIN: %v", err)
+	}
+	if string(rest) != "file contents" {
+		t.Errorf("stdin after the PIN = %q, want the data that followed it", rest)
+	}
+}
+
+func TestFDPINErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"blank line", " \nmore"},
+		{"too long", string(make([]byte, maxPINBytes+2))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &FDPIN{FD: dup(t, pipe(t, tt.data))}
+			if _, err := source.ReadPIN(""); err == nil {
+				t.Error("ReadPIN succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package unixsocket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// CheckPeer returns an error unless the process on the other end of the connection
+// runs as the same user as this one.
+func CheckPeer(conn net.Conn) error {
+	return checkPeerUID(conn, os.Getuid())
+}
+
+// checkPeerUID returns an error unless the process on the other end of the connection
+// runs as the user with the given ID.
+func checkPeerUID(conn net.Conn, uid int) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("not a Unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return err
+	}
+	if credErr != nil {
+		return fmt.Errorf("failed to read peer credentials: %w", credErr)
+	}
+	if int(cred.Uid) != uid {
+		return fmt.Errorf("refusing connection with user %d", cred.Uid)
+	}
+	return nil
+}
+
+// checkOwner returns an error unless the file is owned by the user.
+func checkOwner(path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("cannot determine the owner of %s", path)
+	}
+	if int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by user %d, not by the current user", path, stat.Uid)
+	}
+	return nil
+}
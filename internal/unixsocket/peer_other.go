@@ -0,0 +1,20 @@
+//go:build !linux
+
+package unixsocket
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// errUnsupported reports that the peer of a socket cannot be checked on this platform.
+var errUnsupported = errors.New("socket peer credentials are only supported on Linux")
+
+func CheckPeer(conn net.Conn) error {
+	return errUnsupported
+}
+
+func checkOwner(path string, info os.FileInfo) error {
+	return errUnsupported
+}
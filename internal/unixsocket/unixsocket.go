@@ -0,0 +1,74 @@
+// Package unixsocket creates the Unix sockets the agents listen on.
+package unixsocket
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// RuntimePath returns the path of the named socket in $XDG_RUNTIME_DIR/fido2-hmac-deriver,
+// or in a per-user directory in the temporary directory if XDG_RUNTIME_DIR is not set.
+func RuntimePath(name string) string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "fido2-hmac-deriver", name)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("fido2-hmac-deriver-%d", os.Getuid()), name)
+}
+
+// Listen creates the Unix socket at path, in a directory only the user can access.
+// A socket left behind by an agent that is no longer running is replaced.
+func Listen(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if err := checkDirectory(dir); err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// checkDirectory returns an error unless dir is a directory, not a symbolic link,
+// that belongs to the user and that only the user can access. The default directory
+// in the temporary directory has a predictable name, so another user may have
+// created it first to listen in place of the agent.
+func checkDirectory(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	if err := checkOwner(dir, info); err != nil {
+		return fmt.Errorf("refusing socket directory: %w", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		return fmt.Errorf("socket directory %s has mode %04o, restrict it with 'chmod 700 %s'", dir, perm, dir)
+	}
+	return nil
+}
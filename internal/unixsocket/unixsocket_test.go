@@ -0,0 +1,119 @@
+//go:build linux
+
+package unixsocket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// listen creates a socket in a fresh directory and returns its path.
+func listen(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "run", "agent.sock")
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener, path
+}
+
+// connect dials the socket and returns both ends of the connection.
+func connect(t *testing.T, listener net.Listener, path string) (server, client net.Conn) {
+	t.Helper()
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func TestListenPermissions(t *testing.T) {
+	_, path := listen(t)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket has mode %04o, want 0600", perm)
+	}
+	info, err = os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("socket directory has mode %04o, want 0700", perm)
+	}
+
+	if _, err := Listen(path); err == nil {
+		t.Error("a second agent could listen on the socket")
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	listener, path := listen(t)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen on a stale socket: %v", err)
+	}
+	listener.Close()
+}
+
+func TestListenRejectsUnsafeDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "run")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(filepath.Join(dir, "agent.sock")); err == nil {
+		t.Error("Listen accepted a directory other users can access")
+	}
+
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(filepath.Join(link, "agent.sock")); err == nil {
+		t.Error("Listen accepted a symbolic link as directory")
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	listener, path := listen(t)
+	server, client := connect(t, listener, path)
+
+	// Both ends run as the current user
+	if err := CheckPeer(server); err != nil {
+		t.Errorf("CheckPeer on the server side: %v", err)
+	}
+	if err := CheckPeer(client); err != nil {
+		t.Errorf("CheckPeer on the client side: %v", err)
+	}
+
+	// A peer running as another user is refused
+	if err := checkPeerUID(server, os.Getuid()+1); err == nil {
+		t.Error("checkPeerUID accepted a peer of another user")
+	}
+
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	if err := CheckPeer(pipe); err == nil {
+		t.Error("CheckPeer accepted a connection that is not a Unix socket")
+	}
+}
@@ -0,0 +1,290 @@
+// Package vault lets several authenticators unlock the same data. A vault holds a
+// random master key, wrapped once for every enrolled authenticator with a key derived
+// from its FIDO2 secret (see package keyring), so any of them can unlock it and
+// losing one device does not lose the master key.
+//
+// A threshold vault instead splits the master key with Shamir's scheme and wraps one
+// share per authenticator, so unlocking it takes a given number of them.
+package vault
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"fido2-hmac-deriver/internal/keyring"
+	"fido2-hmac-deriver/internal/shamir"
+	"fido2-hmac-deriver/internal/store"
+	"fido2-hmac-deriver/internal/types"
+)
+
+// Schema identifies vault files.
+const Schema = "fido2-hmac-deriver/vault"
+
+// SchemaVersion is the version of the vault file format.
+const SchemaVersion = 1
+
+// MasterKeyLength is the length of the master key in bytes.
+const MasterKeyLength = 32
+
+// slotAlgorithm wraps the master key in every slot.
+const slotAlgorithm = keyring.AlgorithmXChaCha20Poly1305
+
+// checkInfo is the HMAC message of the master key's check value.
+const checkInfo = "fido2-hmac-deriver:vault:v1:check"
+
+// Vault is the contents of a vault file. Every slot holds the master key, or a share
+// of it in a threshold vault, wrapped for one authenticator; the slot name is its label.
+type Vault struct {
+	Schema    string    `json:"schema"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Threshold is the number of authenticators needed to unlock a threshold vault,
+	// or 0 if any single authenticator unlocks the vault.
+	Threshold int `json:"threshold,omitempty"`
+
+	// NextShare is the evaluation point of the next share of a threshold vault.
+	// Points are never reused, so a new share never equals a revoked one.
+	NextShare int `json:"next_share,omitempty"`
+
+	// Check is a MAC of the master key, which detects shares of another vault.
+	Check []byte `json:"check,omitempty"`
+
+	Slots []*keyring.WrappedKey `json:"slots"`
+}
+
+// DefaultPath returns the default vault file in the given store directory.
+func DefaultPath(storeDir string) string {
+	return filepath.Join(storeDir, "vault.json")
+}
+
+// New creates an empty vault and its random master key.
+func New() (*Vault, []byte, error) {
+	masterKey, err := keyring.GenerateKey(MasterKeyLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Vault{Schema: Schema, Version: SchemaVersion, CreatedAt: time.Now().UTC()}, masterKey, nil
+}
+
+// NewThreshold creates an empty threshold vault and splits a random master key into
+// the given number of shares, any threshold of which unlock the vault. The shares
+// are returned encoded, to be added to the vault with Add.
+func NewThreshold(threshold, count int) (*Vault, [][]byte, error) {
+	masterKey, err := keyring.GenerateKey(MasterKeyLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	shares, err := shamir.Split(masterKey, count, threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encoded := make([][]byte, len(shares))
+	for i, share := range shares {
+		encoded[i] = share.Bytes()
+	}
+	return &Vault{
+		Schema:    Schema,
+		Version:   SchemaVersion,
+		CreatedAt: time.Now().UTC(),
+		Threshold: threshold,
+		NextShare: count + 1,
+		Check:     checkValue(masterKey),
+	}, encoded, nil
+}
+
+// Load reads a vault file.
+func Load(path string) (*Vault, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no vault at %s, create one with 'fido2-hmac-deriver vault create'", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault: %w", err)
+	}
+
+	var vault Vault
+	if err := json.Unmarshal(data, &vault); err != nil {
+		return nil, fmt.Errorf("failed to parse vault %s: %w", path, err)
+	}
+	if vault.Schema != Schema {
+		return nil, fmt.Errorf("%s is not a vault file", path)
+	}
+	if vault.Version != SchemaVersion {
+		return nil, fmt.Errorf("unsupported vault version %d (expected %d)", vault.Version, SchemaVersion)
+	}
+	if len(vault.Slots) == 0 {
+		return nil, fmt.Errorf("the vault %s has no enrolled authenticators", path)
+	}
+	if vault.Threshold == 1 || vault.Threshold > len(vault.Slots) {
+		return nil, fmt.Errorf("invalid threshold %d for %d authenticators in %s", vault.Threshold, len(vault.Slots), path)
+	}
+	return &vault, nil
+}
+
+// Save writes the vault file atomically, readable only by its owner.
+func (v *Vault) Save(path string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create vault directory: %w", err)
+	}
+	if err := store.WriteFileAtomic(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write vault: %w", err)
+	}
+	return nil
+}
+
+// IsThreshold reports whether unlocking the vault takes several authenticators.
+func (v *Vault) IsThreshold() bool {
+	return v.Threshold > 0
+}
+
+// Add wraps the master key, or a share of it, for an authenticator and adds its slot.
+//
+// Parameters:
+//   - label: The unique label of the slot, e.g. the device name
+//   - key: The master key, or an encoded share for a threshold vault
+//   - kek: The key encryption key derived from the authenticator's secret (see keyring.DeriveKEK)
+//   - source: The secret the KEK was derived from
+func (v *Vault) Add(label string, key, kek []byte, source keyring.Source) error {
+	if label == "" {
+		return errors.New("slot label cannot be empty")
+	}
+	if v.Find(label) != nil {
+		return fmt.Errorf("the vault already has an authenticator labeled '%s'", label)
+	}
+	if slot := v.FindCredential(source.CredentialID); slot != nil {
+		return fmt.Errorf("credential %s is already enrolled in the vault as '%s'", store.Fingerprint(source.CredentialID), slot.Name)
+	}
+
+	slot, err := keyring.Wrap(label, slotAlgorithm, key, kek, source)
+	if err != nil {
+		return err
+	}
+	v.Slots = append(v.Slots, slot)
+	return nil
+}
+
+// Find returns the slot with the given label, or nil if there is none.
+func (v *Vault) Find(label string) *keyring.WrappedKey {
+	for _, slot := range v.Slots {
+		if slot.Name == label {
+			return slot
+		}
+	}
+	return nil
+}
+
+// FindCredential returns the slot of the given credential, or nil if there is none.
+func (v *Vault) FindCredential(credentialID []byte) *keyring.WrappedKey {
+	for _, slot := range v.Slots {
+		if bytes.Equal(slot.Source.CredentialID, credentialID) {
+			return slot
+		}
+	}
+	return nil
+}
+
+// Remove removes the slot with the given label. Slots are only removed while enough
+// remain to unlock the vault.
+func (v *Vault) Remove(label string) error {
+	for i, slot := range v.Slots {
+		if slot.Name != label {
+			continue
+		}
+		if len(v.Slots) == 1 {
+			return fmt.Errorf("'%s' is the only authenticator of the vault, removing it would lose the master key", label)
+		}
+		if len(v.Slots) == v.Threshold {
+			return fmt.Errorf("the vault needs %d authenticators to unlock, removing '%s' would lose the master key", v.Threshold, label)
+		}
+		v.Slots = append(v.Slots[:i], v.Slots[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("the vault has no authenticator labeled '%s'", label)
+}
+
+// Combine recovers the master key of a threshold vault from the unwrapped shares of
+// Threshold distinct slots.
+func (v *Vault) Combine(shares [][]byte) ([]byte, error) {
+	parsed, err := parseShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := shamir.Combine(parsed)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(checkValue(masterKey), v.Check) {
+		return nil, errors.New("the shares do not recover the master key of this vault")
+	}
+	return masterKey, nil
+}
+
+// NewShare computes a share for an additional authenticator from the unwrapped
+// shares of Threshold distinct slots.
+func (v *Vault) NewShare(shares [][]byte) ([]byte, error) {
+	if _, err := v.Combine(shares); err != nil {
+		return nil, err
+	}
+	if v.NextShare < 1 || v.NextShare > shamir.MaxShares {
+		return nil, fmt.Errorf("the vault has used all %d shares", shamir.MaxShares)
+	}
+
+	parsed, err := parseShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	x := byte(v.NextShare)
+	y, err := shamir.Interpolate(parsed, x)
+	if err != nil {
+		return nil, err
+	}
+	v.NextShare++
+	return shamir.Share{X: x, Y: y}.Bytes(), nil
+}
+
+// parseShares decodes shares encoded by shamir.Share.Bytes.
+func parseShares(shares [][]byte) ([]shamir.Share, error) {
+	parsed := make([]shamir.Share, len(shares))
+	for i, share := range shares {
+		var err error
+		if parsed[i], err = shamir.ParseShare(share); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+// checkValue returns the MAC of a master key stored in the vault.
+func checkValue(masterKey []byte) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(checkInfo))
+	return mac.Sum(nil)[:16]
+}
+
+// Describe returns the slots for display.
+func (v *Vault) Describe() []*types.VaultSlot {
+	slots := make([]*types.VaultSlot, len(v.Slots))
+	for i, slot := range v.Slots {
+		slots[i] = &types.VaultSlot{
+			Label:          slot.Name,
+			RelyingPartyID: slot.Source.RelyingPartyID,
+			CredentialID:   slot.Source.CredentialID,
+			AAGUID:         slot.Source.AAGUID,
+			AddedAt:        slot.WrappedAt,
+		}
+	}
+	return slots
+}
@@ -0,0 +1,319 @@
+package vault
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fido2-hmac-deriver/internal/keyring"
+)
+
+// authenticator stands in for an enrolled authenticator: its KEK and the source of
+// the secret it was derived from.
+type authenticator struct {
+	kek    []byte
+	source keyring.Source
+}
+
+func newAuthenticator(t *testing.T, id byte) authenticator {
+	t.Helper()
+	kek, err := keyring.DeriveKEK(bytes.Repeat([]byte{id}, 32))
+	if err != nil {
+		t.Fatalf("DeriveKEK: %v", err)
+	}
+	return authenticator{kek: kek, source: keyring.Source{
+		RelyingPartyID: "fido2-hmac-deriver",
+		CredentialID:   []byte{id, id, id, id},
+		Salt:           bytes.Repeat([]byte{0x5a}, 32),
+	}}
+}
+
+func TestVaultRoundTrip(t *testing.T) {
+	v, masterKey, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if len(masterKey) != MasterKeyLength {
+		t.Fatalf("master key is %d bytes, want %d", len(masterKey), MasterKeyLength)
+	}
+	if v.IsThreshold() {
+		t.Fatal("New created a threshold vault")
+	}
+
+	authenticators := map[string]authenticator{
+		"yubikey": newAuthenticator(t, 1),
+		"backup":  newAuthenticator(t, 2),
+	}
+	for _, label := range []string{"yubikey", "backup"} {
+		a := authenticators[label]
+		if err := v.Add(label, masterKey, a.kek, a.source); err != nil {
+			t.Fatalf("Add(%s): %v", label, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "vault", "vault.json")
+	if err := v.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("vault file mode = %o, want 600", perm)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for label, a := range authenticators {
+		slot := loaded.FindCredential(a.source.CredentialID)
+		if slot == nil || slot.Name != label {
+			t.Fatalf("FindCredential(%x) = %v, want slot %s", a.source.CredentialID, slot, label)
+		}
+		got, err := slot.Unwrap(a.kek)
+		if err != nil {
+			t.Fatalf("Unwrap(%s): %v", label, err)
+		}
+		if !bytes.Equal(got, masterKey) {
+			t.Errorf("slot %s unwraps %x, want %x", label, got, masterKey)
+		}
+	}
+
+	if _, err := loaded.Find("yubikey").Unwrap(authenticators["backup"].kek); err == nil {
+		t.Error("a slot unwrapped with the KEK of another authenticator")
+	}
+}
+
+func TestAddRejectsDuplicates(t *testing.T) {
+	v, masterKey, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	a, b := newAuthenticator(t, 1), newAuthenticator(t, 2)
+	if err := v.Add("yubikey", masterKey, a.kek, a.source); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		label string
+		auth  authenticator
+		want  string
+	}{
+		{"empty label", "", b, "cannot be empty"},
+		{"same label", "yubikey", b, "already has an authenticator labeled 'yubikey'"},
+		{"same credential", "backup", a, "already enrolled in the vault as 'yubikey'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := v.Add(test.label, masterKey, test.auth.kek, test.auth.source)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Add = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+	if len(v.Slots) != 1 {
+		t.Errorf("vault has %d slots after rejected adds, want 1", len(v.Slots))
+	}
+}
+
+func TestRemove(t *testing.T) {
+	v, masterKey, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	a, b := newAuthenticator(t, 1), newAuthenticator(t, 2)
+	if err := v.Add("yubikey", masterKey, a.kek, a.source); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := v.Add("backup", masterKey, b.kek, b.source); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	if err := v.Remove("missing"); err == nil || !strings.Contains(err.Error(), "no authenticator labeled 'missing'") {
+		t.Errorf("Remove(missing) = %v, want an unknown label error", err)
+	}
+	if err := v.Remove("yubikey"); err != nil {
+		t.Fatalf("Remove(yubikey): %v", err)
+	}
+	if v.Find("yubikey") != nil || v.Find("backup") == nil {
+		t.Fatalf("slots after Remove(yubikey) = %v, want only backup", v.Describe())
+	}
+	if err := v.Remove("backup"); err == nil || !strings.Contains(err.Error(), "only authenticator") {
+		t.Errorf("Remove(backup) = %v, want the last slot to be kept", err)
+	}
+	if len(v.Slots) != 1 {
+		t.Errorf("vault has %d slots, want 1", len(v.Slots))
+	}
+}
+
+func TestLoadRejectsInvalidVaults(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"other schema", `{"schema":"other","version":1,"slots":[{}]}`, "not a vault file"},
+		{"other version", `{"schema":"fido2-hmac-deriver/vault","version":2,"slots":[{}]}`, "unsupported vault version 2"},
+		{"no slots", `{"schema":"fido2-hmac-deriver/vault","version":1,"slots":[]}`, "no enrolled authenticators"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "vault.json")
+			if err := os.WriteFile(path, []byte(test.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(path); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Load = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "vault.json")); err == nil || !strings.Contains(err.Error(), "vault create") {
+		t.Errorf("Load of a missing file = %v, want a hint to create the vault", err)
+	}
+}
+
+func TestThresholdVault(t *testing.T) {
+	v, shares, err := NewThreshold(2, 3)
+	if err != nil {
+		t.Fatalf("NewThreshold: %v", err)
+	}
+	if !v.IsThreshold() || len(shares) != 3 {
+		t.Fatalf("NewThreshold(2, 3) = threshold %d with %d shares", v.Threshold, len(shares))
+	}
+	labels := []string{"yubikey", "backup", "safe"}
+	authenticators := make([]authenticator, len(labels))
+	for i, label := range labels {
+		authenticators[i] = newAuthenticator(t, byte(i+1))
+		if err := v.Add(label, shares[i], authenticators[i].kek, authenticators[i].source); err != nil {
+			t.Fatalf("Add(%s): %v", label, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "vault.json")
+	if err := v.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	v, err = Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	unwrapped := make([][]byte, len(labels))
+	for i, label := range labels {
+		if unwrapped[i], err = v.Find(label).Unwrap(authenticators[i].kek); err != nil {
+			t.Fatalf("Unwrap(%s): %v", label, err)
+		}
+	}
+
+	// Any two shares recover the same master key, one does not
+	masterKey, err := v.Combine(unwrapped[:2])
+	if err != nil {
+		t.Fatalf("Combine: %v", err)
+	}
+	for _, pair := range [][2]int{{0, 2}, {1, 2}, {2, 0}} {
+		got, err := v.Combine([][]byte{unwrapped[pair[0]], unwrapped[pair[1]]})
+		if err != nil {
+			t.Fatalf("Combine(%v): %v", pair, err)
+		}
+		if !bytes.Equal(got, masterKey) {
+			t.Errorf("Combine(%v) = %x, want %x", pair, got, masterKey)
+		}
+	}
+	if _, err := v.Combine(unwrapped[:1]); err == nil {
+		t.Error("Combine of a single share succeeded")
+	}
+
+	// A new share recovers the master key with any existing one
+	share, err := v.NewShare(unwrapped[1:])
+	if err != nil {
+		t.Fatalf("NewShare: %v", err)
+	}
+	if v.NextShare != 5 {
+		t.Errorf("NextShare = %d after a new share, want 5", v.NextShare)
+	}
+	got, err := v.Combine([][]byte{unwrapped[0], share})
+	if err != nil {
+		t.Fatalf("Combine with the new share: %v", err)
+	}
+	if !bytes.Equal(got, masterKey) {
+		t.Errorf("Combine with the new share = %x, want %x", got, masterKey)
+	}
+}
+
+func TestThresholdRejectsForeignShares(t *testing.T) {
+	v, shares, err := NewThreshold(2, 2)
+	if err != nil {
+		t.Fatalf("NewThreshold: %v", err)
+	}
+	_, other, err := NewThreshold(2, 2)
+	if err != nil {
+		t.Fatalf("NewThreshold: %v", err)
+	}
+
+	if _, err := v.Combine(other); err == nil || !strings.Contains(err.Error(), "do not recover") {
+		t.Errorf("Combine of another vault's shares = %v, want them rejected", err)
+	}
+	if _, err := v.Combine([][]byte{shares[0], other[1]}); err == nil {
+		t.Error("Combine of mixed shares succeeded")
+	}
+	if _, err := v.NewShare(other); err == nil {
+		t.Error("NewShare from another vault's shares succeeded")
+	}
+}
+
+func TestThresholdRemove(t *testing.T) {
+	v, shares, err := NewThreshold(2, 3)
+	if err != nil {
+		t.Fatalf("NewThreshold: %v", err)
+	}
+	for i, label := range []string{"yubikey", "backup", "safe"} {
+		a := newAuthenticator(t, byte(i+1))
+		if err := v.Add(label, shares[i], a.kek, a.source); err != nil {
+			t.Fatalf("Add(%s): %v", label, err)
+		}
+	}
+
+	if err := v.Remove("safe"); err != nil {
+		t.Fatalf("Remove(safe): %v", err)
+	}
+	for _, label := range []string{"yubikey", "backup"} {
+		if err := v.Remove(label); err == nil || !strings.Contains(err.Error(), "needs 2 authenticators") {
+			t.Errorf("Remove(%s) = %v, want it refused below the threshold", label, err)
+		}
+	}
+	if len(v.Slots) != 2 {
+		t.Errorf("vault has %d slots, want 2", len(v.Slots))
+	}
+}
+
+func TestLoadRejectsInvalidThresholds(t *testing.T) {
+	slot := func(name string) *keyring.WrappedKey { return &keyring.WrappedKey{Name: name} }
+	tests := []struct {
+		name      string
+		threshold int
+		slots     int
+	}{
+		{"threshold of one", 1, 2},
+		{"more than the slots", 3, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := &Vault{Schema: Schema, Version: SchemaVersion, Threshold: test.threshold}
+			for i := 0; i < test.slots; i++ {
+				v.Slots = append(v.Slots, slot(string(rune('a'+i))))
+			}
+			path := filepath.Join(t.TempDir(), "vault.json")
+			if err := v.Save(path); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "invalid threshold") {
+				t.Errorf("Load = %v, want an invalid threshold error", err)
+			}
+		})
+	}
+}
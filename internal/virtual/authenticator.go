@@ -0,0 +1,556 @@
+// Package virtual implements a software CTAP2 authenticator.
+// It behaves like a physical FIDO2 device (credential creation, assertions with
+// the hmac-secret extension, PIN protocol one, resident keys and user presence)
+// so the complete derivation workflow can run without hardware, e.g. in CI.
+//
+// All key material is derived from a seed, which makes derivations fully
+// deterministic: the same seed and the same sequence of operations always
+// produce the same credentials and the same HMAC secrets.
+package virtual
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// Errors returned by the virtual authenticator. They mirror the CTAP2 status codes
+// a physical device would report in the same situation.
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrOperationDenied    = errors.New("operation denied")
+	ErrPinInvalid         = errors.New("pin invalid")
+	ErrPinBlocked         = errors.New("pin blocked")
+	ErrPinAuthInvalid     = errors.New("pin auth invalid")
+	ErrPinAuthBlocked     = errors.New("pin auth blocked")
+	ErrPinNotSet          = errors.New("pin not set")
+	ErrPinRequired        = errors.New("pin required")
+	ErrPinPolicyViolation = errors.New("pin policy violation")
+	ErrUnsupportedAlg     = errors.New("unsupported algorithm")
+	ErrMissingParameter   = errors.New("missing parameter")
+	ErrInvalidParameter   = errors.New("invalid parameter")
+	ErrInvalidLength      = errors.New("invalid length")
+)
+
+const (
+	// AlgorithmES256 is the COSE identifier for ECDSA with P-256 and SHA-256,
+	// the only credential algorithm the virtual authenticator supports.
+	AlgorithmES256 = -7
+
+	maxPINRetries         = 8
+	maxConsecutiveFailure = 3
+	minPINLength          = 4
+	maxPINLength          = 63
+	maxCredentialCount    = 25
+	firmwareVersion       = 0x00010000
+
+	credentialIDVersion = 0x02
+	credentialIDLength  = 1 + 1 + 16 + 16
+
+	// credentialOptionHMACSecret is set in the options byte of the credential ID
+	// when the credential was created with the hmac-secret extension.
+	credentialOptionHMACSecret = 0x01
+)
+
+// DefaultAAGUID identifies the virtual authenticator model.
+var DefaultAAGUID = []byte{
+	0x66, 0x69, 0x64, 0x6f, 0x32, 0x2d, 0x68, 0x6d,
+	0x61, 0x63, 0x2d, 0x76, 0x69, 0x72, 0x74, 0x00,
+}
+
+// RelyingParty identifies the relying party a credential belongs to.
+type RelyingParty struct {
+	ID   string
+	Name string
+}
+
+// User identifies the user account a credential belongs to.
+type User struct {
+	ID          []byte
+	Name        string
+	DisplayName string
+}
+
+// Info is the virtual equivalent of the authenticatorGetInfo response.
+type Info struct {
+	Versions           []string
+	Extensions         []string
+	AAGUID             []byte
+	Options            map[string]bool
+	PINProtocols       []byte
+	MaxCredentialCount int
+	MinPINLength       int
+	FirmwareVersion    int
+}
+
+// Attestation is the result of a successful MakeCredential operation.
+type Attestation struct {
+	ClientDataHash []byte
+	AuthData       []byte
+	CredentialID   []byte
+	PubKey         []byte // Uncompressed P-256 point without the 0x04 prefix (x || y)
+	Format         string
+}
+
+// Assertion is the result of a successful GetAssertion operation.
+type Assertion struct {
+	AuthData     []byte
+	Sig          []byte
+	CredentialID []byte
+	User         User
+	HMACSecret   []byte // Encrypted hmac-secret output (see HMACSecretInput)
+}
+
+// MakeCredentialRequest holds the parameters of authenticatorMakeCredential.
+type MakeCredentialRequest struct {
+	ClientDataHash    []byte
+	RP                RelyingParty
+	User              User
+	Algorithm         int
+	ResidentKey       bool
+	HMACSecret        bool
+	PinUvAuthParam    []byte
+	PinUvAuthProtocol int
+}
+
+// HMACSecretInput is the hmac-secret extension input of authenticatorGetAssertion.
+// The salts are encrypted with the shared secret from the PIN protocol key agreement.
+type HMACSecretInput struct {
+	KeyAgreement *ecdh.PublicKey
+	SaltEnc      []byte
+	SaltAuth     []byte
+}
+
+// GetAssertionRequest holds the parameters of authenticatorGetAssertion.
+// An empty AllowList selects the resident credentials of the relying party.
+type GetAssertionRequest struct {
+	RPID              string
+	ClientDataHash    []byte
+	AllowList         [][]byte
+	UserPresence      bool
+	PinUvAuthParam    []byte
+	PinUvAuthProtocol int
+	HMACSecret        *HMACSecretInput
+}
+
+// Options configures a virtual authenticator.
+type Options struct {
+	Seed      []byte                 // Master seed all key material is derived from (required)
+	AAGUID    []byte                 // Authenticator model identifier (defaults to DefaultAAGUID)
+	PIN       string                 // Initial PIN, applied only if the state has no PIN yet
+	StatePath string                 // Optional file persisting PIN and resident credentials
+	Presence  func(rpID string) bool // Simulates the user touching the device; nil always approves
+	Logf      func(string, ...any)   // Optional debug logger
+}
+
+// Authenticator is a software CTAP2 authenticator.
+// It is safe for concurrent use.
+type Authenticator struct {
+	mu sync.Mutex
+
+	seed      []byte
+	aaguid    []byte
+	statePath string
+	presence  func(rpID string) bool
+	logf      func(string, ...any)
+
+	state state
+
+	keyAgreement        *ecdh.PrivateKey
+	pinToken            []byte
+	consecutiveFailures int
+}
+
+// New creates a virtual authenticator from the given options.
+// If a state file is configured and exists, the PIN, retry counter and resident
+// credentials are restored from it.
+func New(opts Options) (*Authenticator, error) {
+	if len(opts.Seed) == 0 {
+		return nil, errors.New("virtual authenticator seed cannot be empty")
+	}
+
+	a := &Authenticator{
+		seed:      append([]byte(nil), opts.Seed...),
+		aaguid:    opts.AAGUID,
+		statePath: opts.StatePath,
+		presence:  opts.Presence,
+		logf:      opts.Logf,
+		state:     state{PINRetries: maxPINRetries},
+	}
+	if len(a.aaguid) == 0 {
+		a.aaguid = DefaultAAGUID
+	}
+	if a.logf == nil {
+		a.logf = func(string, ...any) {}
+	}
+
+	if err := a.loadState(); err != nil {
+		return nil, err
+	}
+
+	if opts.PIN != "" && len(a.state.PINHash) == 0 {
+		if err := validatePIN(opts.PIN); err != nil {
+			return nil, err
+		}
+		a.state.PINHash = pinHash(opts.PIN)
+		a.state.PINRetries = maxPINRetries
+		if err := a.saveState(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.regenerateSession(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// PowerCycle simulates unplugging and reconnecting the device.
+// This clears the PIN token and the consecutive PIN failure counter.
+func (a *Authenticator) PowerCycle() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.consecutiveFailures = 0
+	return a.regenerateSession()
+}
+
+// GetInfo reports the capabilities of the virtual authenticator.
+func (a *Authenticator) GetInfo() *Info {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return &Info{
+		Versions:   []string{"FIDO_2_0", "FIDO_2_1"},
+		Extensions: []string{"hmac-secret"},
+		AAGUID:     append([]byte(nil), a.aaguid...),
+		Options: map[string]bool{
+			"rk":        true,
+			"up":        true,
+			"plat":      false,
+			"clientPin": len(a.state.PINHash) > 0,
+			"credMgmt":  true,
+		},
+		PINProtocols:       []byte{1},
+		MaxCredentialCount: maxCredentialCount,
+		MinPINLength:       minPINLength,
+		FirmwareVersion:    firmwareVersion,
+	}
+}
+
+// MakeCredential creates a new ES256 credential (authenticatorMakeCredential).
+// Once a PIN is set, a valid pinUvAuthParam is required.
+func (a *Authenticator) MakeCredential(req *MakeCredentialRequest) (*Attestation, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if req.RP.ID == "" || len(req.ClientDataHash) != sha256.Size {
+		return nil, ErrMissingParameter
+	}
+	if req.Algorithm != AlgorithmES256 {
+		return nil, ErrUnsupportedAlg
+	}
+	uv, err := a.verifyPinUvAuth(req.PinUvAuthParam, req.PinUvAuthProtocol, req.ClientDataHash, true)
+	if err != nil {
+		return nil, err
+	}
+	if req.ResidentKey && len(a.state.Resident) >= maxCredentialCount {
+		return nil, fmt.Errorf("%w: credential storage is full", ErrOperationDenied)
+	}
+	if err := a.requirePresence(req.RP.ID); err != nil {
+		return nil, err
+	}
+
+	a.state.Counter++
+	options := byte(0)
+	if req.HMACSecret {
+		options |= credentialOptionHMACSecret
+	}
+	credentialID := a.newCredentialID(req.RP.ID, options, a.state.Counter)
+	key, err := a.credentialKey(credentialID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ResidentKey {
+		// A relying party holds at most one resident credential per user ID
+		a.removeResident(func(r *residentCredential) bool {
+			return r.RPID == req.RP.ID && bytes.Equal(r.UserID, req.User.ID)
+		})
+		a.state.Resident = append(a.state.Resident, &residentCredential{
+			ID:              credentialID,
+			RPID:            req.RP.ID,
+			RPName:          req.RP.Name,
+			UserID:          req.User.ID,
+			UserName:        req.User.Name,
+			UserDisplayName: req.User.DisplayName,
+			HMACSecret:      req.HMACSecret,
+		})
+	}
+	if err := a.saveState(); err != nil {
+		return nil, err
+	}
+
+	pub := key.PublicKey
+	pubKey := append(pad32(pub.X), pad32(pub.Y)...)
+
+	flags := byte(flagUserPresent | flagAttestedData)
+	if uv {
+		flags |= flagUserVerified
+	}
+	authData := a.authData(req.RP.ID, flags, a.state.Counter)
+	authData = append(authData, a.aaguid...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(credentialID)))
+	authData = append(authData, credentialID...)
+	authData = append(authData, encodeCOSEKey(pub.X, pub.Y)...)
+
+	a.logf("virtual: created credential %x for %s (resident=%t)", credentialID[:8], req.RP.ID, req.ResidentKey)
+
+	return &Attestation{
+		ClientDataHash: append([]byte(nil), req.ClientDataHash...),
+		AuthData:       authData,
+		CredentialID:   credentialID,
+		PubKey:         pubKey,
+		Format:         "none",
+	}, nil
+}
+
+// GetAssertion signs the client data hash with a credential of the relying party
+// (authenticatorGetAssertion) and evaluates the hmac-secret extension if requested.
+func (a *Authenticator) GetAssertion(req *GetAssertionRequest) (*Assertion, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if req.RPID == "" || len(req.ClientDataHash) != sha256.Size {
+		return nil, ErrMissingParameter
+	}
+	uv, err := a.verifyPinUvAuth(req.PinUvAuthParam, req.PinUvAuthProtocol, req.ClientDataHash, false)
+	if err != nil {
+		return nil, err
+	}
+
+	credentialID, user, err := a.selectCredential(req.RPID, req.AllowList)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0)
+	if req.UserPresence {
+		if err := a.requirePresence(req.RPID); err != nil {
+			return nil, err
+		}
+		flags |= flagUserPresent
+	}
+	if uv {
+		flags |= flagUserVerified
+	}
+
+	a.state.Counter++
+	if err := a.saveState(); err != nil {
+		return nil, err
+	}
+
+	assertion := &Assertion{
+		CredentialID: credentialID,
+		User:         user,
+	}
+
+	// Like a physical device, the extension is ignored for credentials created without it
+	if req.HMACSecret != nil && credentialID[1]&credentialOptionHMACSecret != 0 {
+		output, err := a.hmacSecret(credentialID, uv, req.HMACSecret)
+		if err != nil {
+			return nil, err
+		}
+		assertion.HMACSecret = output
+		flags |= flagExtensionData
+	}
+
+	assertion.AuthData = a.authData(req.RPID, flags, a.state.Counter)
+
+	key, err := a.credentialKey(credentialID)
+	if err != nil {
+		return nil, err
+	}
+	signed := append(append([]byte(nil), assertion.AuthData...), req.ClientDataHash...)
+	digest := sha256.Sum256(signed)
+	assertion.Sig, err = ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign assertion: %w", err)
+	}
+
+	a.logf("virtual: asserted credential %x for %s", credentialID[:8], req.RPID)
+	return assertion, nil
+}
+
+// selectCredential picks the credential for an assertion.
+// With an allow list, the first entry created by this authenticator for the relying
+// party is used; without one, the most recently created resident credential is used.
+func (a *Authenticator) selectCredential(rpID string, allowList [][]byte) ([]byte, User, error) {
+	if len(allowList) == 0 {
+		for i := len(a.state.Resident) - 1; i >= 0; i-- {
+			r := a.state.Resident[i]
+			if r.RPID == rpID {
+				return r.ID, User{ID: r.UserID, Name: r.UserName, DisplayName: r.UserDisplayName}, nil
+			}
+		}
+		return nil, User{}, ErrNoCredentials
+	}
+
+	for _, credentialID := range allowList {
+		if !a.ownsCredential(rpID, credentialID) {
+			continue
+		}
+		user := User{}
+		if r := a.findResident(credentialID); r != nil {
+			user = User{ID: r.UserID, Name: r.UserName, DisplayName: r.UserDisplayName}
+		}
+		return credentialID, user, nil
+	}
+	return nil, User{}, ErrNoCredentials
+}
+
+// requirePresence asks the presence callback to simulate a touch.
+func (a *Authenticator) requirePresence(rpID string) error {
+	if a.presence != nil && !a.presence(rpID) {
+		return fmt.Errorf("%w: user presence was not confirmed", ErrOperationDenied)
+	}
+	return nil
+}
+
+// newCredentialID creates a credential ID that binds the credential to the relying party.
+// The ID embeds the credential options, a nonce and a MAC over the relying party ID hash
+// and both, so the authenticator can recognise its own non-resident credentials and the
+// extensions they were created with without storing them.
+func (a *Authenticator) newCredentialID(rpID string, options byte, counter uint32) []byte {
+	nonce := a.derive("credential-nonce", binary.BigEndian.AppendUint32(nil, counter))[:16]
+
+	credentialID := make([]byte, 0, credentialIDLength)
+	credentialID = append(credentialID, credentialIDVersion, options)
+	credentialID = append(credentialID, nonce...)
+	credentialID = append(credentialID, a.credentialTag(rpID, credentialID[1:])...)
+	return credentialID
+}
+
+// ownsCredential reports whether the credential ID was created by this authenticator
+// for the given relying party.
+func (a *Authenticator) ownsCredential(rpID string, credentialID []byte) bool {
+	if len(credentialID) != credentialIDLength || credentialID[0] != credentialIDVersion {
+		return false
+	}
+	return hmac.Equal(credentialID[18:], a.credentialTag(rpID, credentialID[1:18]))
+}
+
+// credentialTag computes the MAC that binds the options and nonce of a credential ID
+// to the relying party.
+func (a *Authenticator) credentialTag(rpID string, optionsAndNonce []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	return a.derive("credential-tag", append(rpIDHash[:], optionsAndNonce...))[:16]
+}
+
+// credentialKey derives the ES256 signing key of a credential.
+func (a *Authenticator) credentialKey(credentialID []byte) (*ecdsa.PrivateKey, error) {
+	for counter := byte(0); counter < 255; counter++ {
+		scalar := a.derive("credential-key", append(append([]byte(nil), credentialID...), counter))
+		priv, err := ecdh.P256().NewPrivateKey(scalar)
+		if err != nil {
+			// The scalar is out of range for P-256, which is extremely unlikely; try the next one
+			continue
+		}
+		pub := priv.PublicKey().Bytes()
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(pub[1:33]),
+				Y:     new(big.Int).SetBytes(pub[33:65]),
+			},
+			D: new(big.Int).SetBytes(scalar),
+		}, nil
+	}
+	return nil, errors.New("failed to derive credential key")
+}
+
+// hmacSecret evaluates the hmac-secret extension.
+// The output is HMAC-SHA-256(CredRandom, salt) for each of the one or two salts,
+// where CredRandom differs depending on whether the user was verified.
+func (a *Authenticator) hmacSecret(credentialID []byte, uv bool, input *HMACSecretInput) ([]byte, error) {
+	if input.KeyAgreement == nil || len(input.SaltEnc) == 0 || len(input.SaltAuth) == 0 {
+		return nil, ErrMissingParameter
+	}
+	shared, err := a.sharedSecret(input.KeyAgreement)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(authenticate(shared, input.SaltEnc), input.SaltAuth) {
+		return nil, ErrPinAuthInvalid
+	}
+	salts, err := decrypt(shared, input.SaltEnc)
+	if err != nil {
+		return nil, err
+	}
+	if len(salts) != 32 && len(salts) != 64 {
+		return nil, ErrInvalidLength
+	}
+
+	label := "cred-random-without-uv"
+	if uv {
+		label = "cred-random-with-uv"
+	}
+	credRandom := a.derive(label, credentialID)
+
+	output := make([]byte, 0, len(salts))
+	for i := 0; i < len(salts); i += 32 {
+		mac := hmac.New(sha256.New, credRandom)
+		mac.Write(salts[i : i+32])
+		output = mac.Sum(output)
+	}
+	return encrypt(shared, output)
+}
+
+// derive computes HMAC-SHA-256(seed, label || data), the root of all key material.
+func (a *Authenticator) derive(label string, data []byte) []byte {
+	mac := hmac.New(sha256.New, a.seed)
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+const (
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedData  = 0x40
+	flagExtensionData = 0x80
+)
+
+// authData builds the fixed part of the authenticator data:
+// rpIdHash (32) || flags (1) || signCount (4).
+func (a *Authenticator) authData(rpID string, flags byte, counter uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	return binary.BigEndian.AppendUint32(data, counter)
+}
+
+// pad32 encodes a big integer as a 32 byte big-endian value.
+func pad32(n *big.Int) []byte {
+	out := make([]byte, 32)
+	return n.FillBytes(out)
+}
+
+// encodeCOSEKey encodes a P-256 public key as a CBOR COSE_Key map:
+// {1: 2 (EC2), 3: -7 (ES256), -1: 1 (P-256), -2: x, -3: y}
+func encodeCOSEKey(x, y *big.Int) []byte {
+	key := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}
+	key = append(key, pad32(x)...)
+	key = append(key, 0x22, 0x58, 0x20)
+	return append(key, pad32(y)...)
+}
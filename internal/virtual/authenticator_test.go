@@ -0,0 +1,229 @@
+package virtual
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+const testPIN = "123456"
+
+var (
+	testRP   = RelyingParty{ID: "e2e-git", Name: "E2E Git"}
+	testUser = User{ID: []byte("hmac-user"), Name: "user"}
+	testHash = sha256.Sum256([]byte("client data"))
+	testSalt = bytes.Repeat([]byte{0x11}, 32)
+)
+
+// newTestClient creates a client for an authenticator with the given seed and the test PIN.
+func newTestClient(t *testing.T, seed string, opts ...func(*Options)) *Client {
+	t.Helper()
+	options := Options{Seed: []byte(seed), PIN: testPIN}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	auth, err := New(options)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return NewClient(auth)
+}
+
+// makeCredential creates a non-resident credential with the hmac-secret extension.
+func makeCredential(t *testing.T, c *Client) []byte {
+	t.Helper()
+	attestation, err := c.MakeCredential(testHash[:], testRP, testUser, testPIN, false, true)
+	if err != nil {
+		t.Fatalf("MakeCredential: %v", err)
+	}
+	return attestation.CredentialID
+}
+
+// The virtual authenticator derives everything from its seed, so the outputs are
+// fixed. A change here breaks the secrets of every setup using the virtual backend.
+func TestHMACSecretIsStable(t *testing.T) {
+	tests := []struct {
+		name   string
+		seed   string
+		pin    string
+		salt   []byte
+		secret string
+	}{
+		{
+			"default seed with PIN", "fido2-hmac-deriver", testPIN, testSalt,
+			"f5e4ffd68787188baa35d24578224a30f3c3070b470825a29e6971f7560b5f63",
+		},
+		{
+			"default seed without PIN", "fido2-hmac-deriver", "", testSalt,
+			"1b3fe8ab73a1a83feb9ecea1c2b5a152d7ab1799dfe2219e5c97bffd4bdede42",
+		},
+		{
+			"other seed", "ci", testPIN, testSalt,
+			"30dc522bfd53823b5d119abf01b67a0301b1325c8a82aafa1d4d2fd98b53e4aa",
+		},
+		{
+			"two salts", "ci", testPIN, append(bytes.Repeat([]byte{0x11}, 32), bytes.Repeat([]byte{0x22}, 32)...),
+			"30dc522bfd53823b5d119abf01b67a0301b1325c8a82aafa1d4d2fd98b53e4aa" +
+				"ccd0ae52418168c4ebaa80a5d4bf0af5a8c2a1124511d8c8b0e3d8a670307145",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, tt.seed)
+			credentialID := makeCredential(t, c)
+			assertion, err := c.Assertion(testRP.ID, testHash[:], [][]byte{credentialID}, tt.pin, tt.salt)
+			if err != nil {
+				t.Fatalf("Assertion: %v", err)
+			}
+			if got := hex.EncodeToString(assertion.HMACSecret); got != tt.secret {
+				t.Errorf("hmac-secret output %s, want %s", got, tt.secret)
+			}
+		})
+	}
+}
+
+func TestHMACSecretDependsOnCredentialAndVerification(t *testing.T) {
+	c := newTestClient(t, "fido2-hmac-deriver")
+	first := makeCredential(t, c)
+	second := makeCredential(t, c)
+	if bytes.Equal(first, second) {
+		t.Fatal("two credentials have the same ID")
+	}
+
+	outputs := make(map[string]string)
+	for name, call := range map[string]struct {
+		credentialID []byte
+		pin          string
+	}{
+		"first with PIN":     {first, testPIN},
+		"first without PIN":  {first, ""},
+		"second with PIN":    {second, testPIN},
+		"second without PIN": {second, ""},
+	} {
+		assertion, err := c.Assertion(testRP.ID, testHash[:], [][]byte{call.credentialID}, call.pin, testSalt)
+		if err != nil {
+			t.Fatalf("%s: Assertion: %v", name, err)
+		}
+		output := hex.EncodeToString(assertion.HMACSecret)
+		if other, ok := outputs[output]; ok {
+			t.Errorf("%s and %s yield the same output", name, other)
+		}
+		outputs[output] = name
+	}
+}
+
+func TestHMACSecretRequiresExtension(t *testing.T) {
+	c := newTestClient(t, "fido2-hmac-deriver")
+	attestation, err := c.MakeCredential(testHash[:], testRP, testUser, testPIN, false, false)
+	if err != nil {
+		t.Fatalf("MakeCredential: %v", err)
+	}
+
+	assertion, err := c.Assertion(testRP.ID, testHash[:], [][]byte{attestation.CredentialID}, testPIN, testSalt)
+	if err != nil {
+		t.Fatalf("Assertion: %v", err)
+	}
+	if assertion.HMACSecret != nil {
+		t.Errorf("credential without hmac-secret returned output %x", assertion.HMACSecret)
+	}
+	if assertion.AuthData[32]&flagExtensionData != 0 {
+		t.Error("extension data flag set without extension output")
+	}
+
+	// The options are bound to the credential ID, so they cannot be switched on
+	forged := append([]byte(nil), attestation.CredentialID...)
+	forged[1] |= credentialOptionHMACSecret
+	if _, err := c.Assertion(testRP.ID, testHash[:], [][]byte{forged}, testPIN, testSalt); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Assertion with forged options = %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestCredentialsAreBoundToAuthenticatorAndRP(t *testing.T) {
+	c := newTestClient(t, "fido2-hmac-deriver")
+	credentialID := makeCredential(t, c)
+
+	if _, err := c.Assertion("other-rp", testHash[:], [][]byte{credentialID}, testPIN, testSalt); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Assertion for another relying party = %v, want ErrNoCredentials", err)
+	}
+
+	other := newTestClient(t, "other seed")
+	if _, err := other.Assertion(testRP.ID, testHash[:], [][]byte{credentialID}, testPIN, testSalt); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Assertion on another authenticator = %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestResidentCredentials(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	withState := func(o *Options) { o.StatePath = statePath }
+
+	c := newTestClient(t, "fido2-hmac-deriver", withState)
+	attestation, err := c.MakeCredential(testHash[:], testRP, testUser, testPIN, true, true)
+	if err != nil {
+		t.Fatalf("MakeCredential: %v", err)
+	}
+
+	// A new authenticator restores the resident credential from the state file
+	c = newTestClient(t, "fido2-hmac-deriver", withState)
+	assertion, err := c.Assertion(testRP.ID, testHash[:], nil, testPIN, testSalt)
+	if err != nil {
+		t.Fatalf("Assertion without allow list: %v", err)
+	}
+	if !bytes.Equal(assertion.CredentialID, attestation.CredentialID) || !bytes.Equal(assertion.User.ID, testUser.ID) {
+		t.Errorf("discovered credential %x of user %q, want %x of %q",
+			assertion.CredentialID, assertion.User.ID, attestation.CredentialID, testUser.ID)
+	}
+
+	credentials, err := c.Credentials(testRP.ID, testPIN)
+	if err != nil {
+		t.Fatalf("Credentials: %v", err)
+	}
+	if len(credentials) != 1 {
+		t.Fatalf("got %d resident credentials, want 1", len(credentials))
+	}
+
+	if err := c.DeleteCredential(attestation.CredentialID, testPIN); err != nil {
+		t.Fatalf("DeleteCredential: %v", err)
+	}
+	if _, err := c.Assertion(testRP.ID, testHash[:], nil, testPIN, testSalt); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Assertion after deletion = %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestPINRetries(t *testing.T) {
+	c := newTestClient(t, "fido2-hmac-deriver")
+	credentialID := makeCredential(t, c)
+
+	for i, want := range []error{ErrPinInvalid, ErrPinInvalid, ErrPinAuthBlocked, ErrPinAuthBlocked} {
+		_, err := c.Assertion(testRP.ID, testHash[:], [][]byte{credentialID}, "000000", testSalt)
+		if !errors.Is(err, want) {
+			t.Fatalf("attempt %d: %v, want %v", i+1, err, want)
+		}
+	}
+	if got := c.RetryCount(); got != maxPINRetries-maxConsecutiveFailure {
+		t.Errorf("RetryCount = %d, want %d", got, maxPINRetries-maxConsecutiveFailure)
+	}
+
+	// A power cycle allows further attempts, and the correct PIN restores the retries
+	if err := c.auth.PowerCycle(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Assertion(testRP.ID, testHash[:], [][]byte{credentialID}, testPIN, testSalt); err != nil {
+		t.Fatalf("Assertion with the correct PIN: %v", err)
+	}
+	if got := c.RetryCount(); got != maxPINRetries {
+		t.Errorf("RetryCount = %d, want %d", got, maxPINRetries)
+	}
+}
+
+func TestUserPresence(t *testing.T) {
+	c := newTestClient(t, "fido2-hmac-deriver", func(o *Options) {
+		o.Presence = func(string) bool { return false }
+	})
+	if _, err := c.MakeCredential(testHash[:], testRP, testUser, testPIN, false, true); !errors.Is(err, ErrOperationDenied) {
+		t.Errorf("MakeCredential without presence = %v, want ErrOperationDenied", err)
+	}
+}
@@ -0,0 +1,170 @@
+package virtual
+
+import (
+	"fmt"
+	"strconv"
+
+	"fido2-hmac-deriver/internal/types"
+)
+
+const (
+	// BackendName is the identifier used to select the virtual backend.
+	BackendName = "virtual"
+
+	// DevicePath is the device path reported for the virtual authenticator.
+	DevicePath = "virtual:0"
+)
+
+// Backend implements the types.Backend interface for the virtual authenticator.
+// It reports exactly one device, so the usual selection flow works unchanged.
+type Backend struct {
+	auth *Authenticator
+}
+
+// NewBackend creates a backend exposing the given virtual authenticator.
+func NewBackend(auth *Authenticator) *Backend {
+	return &Backend{auth: auth}
+}
+
+// Name returns the identifier of this backend.
+func (b *Backend) Name() string {
+	return BackendName
+}
+
+// ListDevices returns the virtual authenticator as the only available device.
+func (b *Backend) ListDevices() ([]*types.DeviceInfo, error) {
+	return []*types.DeviceInfo{{
+		Name:         "Virtual Authenticator",
+		Manufacturer: "fido2-hmac-deriver",
+		Path:         DevicePath,
+		Index:        1,
+	}}, nil
+}
+
+// Open returns an Authenticator for the virtual device.
+func (b *Backend) Open(path string) (types.Authenticator, error) {
+	if path != DevicePath {
+		return nil, fmt.Errorf("device %s is not the virtual authenticator", path)
+	}
+	return &backendAuthenticator{client: NewClient(b.auth)}, nil
+}
+
+// backendAuthenticator adapts the virtual client to the types.Authenticator interface.
+type backendAuthenticator struct {
+	client *Client
+}
+
+// Info returns the authenticatorGetInfo response of the virtual device.
+func (a *backendAuthenticator) Info() (*types.AuthenticatorInfo, error) {
+	info := a.client.Info()
+	return &types.AuthenticatorInfo{
+		Versions:           info.Versions,
+		Extensions:         info.Extensions,
+		AAGUID:             info.AAGUID,
+		Options:            info.Options,
+		PINProtocols:       info.PINProtocols,
+		MaxCredentialCount: info.MaxCredentialCount,
+		MinPINLength:       info.MinPINLength,
+		FirmwareVersion:    strconv.Itoa(info.FirmwareVersion),
+	}, nil
+}
+
+// PINRetries returns the number of PIN attempts left on the virtual device.
+func (a *backendAuthenticator) PINRetries() (int, error) {
+	return a.client.RetryCount(), nil
+}
+
+// UVRetries fails: the virtual device has no built-in user verification.
+func (a *backendAuthenticator) UVRetries() (int, error) {
+	return 0, fmt.Errorf("%w: the virtual authenticator has no built-in user verification", ErrOperationDenied)
+}
+
+// SetPIN sets the initial PIN of the virtual device, or changes it if oldPIN is not empty.
+func (a *backendAuthenticator) SetPIN(pin, oldPIN string) error {
+	return a.client.SetPIN(pin, oldPIN)
+}
+
+// MakeCredential creates a new ES256 credential on the virtual device.
+func (a *backendAuthenticator) MakeCredential(req *types.MakeCredentialRequest) (*types.Attestation, error) {
+	attestation, err := a.client.MakeCredential(
+		req.ClientDataHash,
+		RelyingParty{ID: req.RelyingParty.ID, Name: req.RelyingParty.Name},
+		User{ID: req.User.ID, Name: req.User.Name, DisplayName: req.User.DisplayName},
+		req.PIN,
+		req.ResidentKey,
+		req.HMACSecret,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Attestation{
+		CredentialID: attestation.CredentialID,
+		PublicKey:    attestation.PubKey,
+		AuthData:     attestation.AuthData,
+		Format:       attestation.Format,
+	}, nil
+}
+
+// Assertion performs an assertion on the virtual device.
+func (a *backendAuthenticator) Assertion(req *types.AssertionRequest) (*types.Assertion, error) {
+	assertion, err := a.client.Assertion(req.RelyingPartyID, req.ClientDataHash, req.AllowList, req.PIN, req.HMACSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Assertion{
+		CredentialID: assertion.CredentialID,
+		AuthData:     assertion.AuthData,
+		Signature:    assertion.Sig,
+		HMACSecret:   assertion.HMACSecret,
+		User:         toUser(assertion.User),
+	}, nil
+}
+
+// RelyingParties lists the relying parties with resident credentials.
+func (a *backendAuthenticator) RelyingParties(pin string) ([]*types.RelyingParty, error) {
+	rps, err := a.client.RelyingParties(pin)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*types.RelyingParty, len(rps))
+	for i, rp := range rps {
+		result[i] = &types.RelyingParty{ID: rp.ID, Name: rp.Name}
+	}
+	return result, nil
+}
+
+// Credentials lists the resident credentials of a relying party.
+func (a *backendAuthenticator) Credentials(rpID string, pin string) ([]*types.DeviceCredential, error) {
+	credentials, err := a.client.Credentials(rpID, pin)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*types.DeviceCredential, len(credentials))
+	for i, credential := range credentials {
+		result[i] = &types.DeviceCredential{ID: credential.ID, User: toUser(credential.User)}
+	}
+	return result, nil
+}
+
+// DeleteCredential removes a resident credential from the virtual device.
+func (a *backendAuthenticator) DeleteCredential(credentialID []byte, pin string) error {
+	return a.client.DeleteCredential(credentialID, pin)
+}
+
+// UpdateUser replaces the user name and display name of a resident credential.
+func (a *backendAuthenticator) UpdateUser(credentialID []byte, user types.User, pin string) error {
+	return a.client.UpdateUser(credentialID, User{ID: user.ID, Name: user.Name, DisplayName: user.DisplayName}, pin)
+}
+
+// CanUpdateUser reports that UpdateUser is implemented.
+func (a *backendAuthenticator) CanUpdateUser() bool {
+	return true
+}
+
+func toUser(user User) types.User {
+	return types.User{ID: user.ID, Name: user.Name, DisplayName: user.DisplayName}
+}
@@ -0,0 +1,213 @@
+package virtual
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Client is the platform side of the virtual authenticator.
+// It performs the PIN protocol and hmac-secret encryption on behalf of the
+// caller, the same way libfido2 does for a physical device, so callers only
+// deal with plain PINs and salts.
+type Client struct {
+	auth *Authenticator
+}
+
+// NewClient creates a client talking to the given virtual authenticator.
+func NewClient(auth *Authenticator) *Client {
+	return &Client{auth: auth}
+}
+
+// Info returns the authenticatorGetInfo response.
+func (c *Client) Info() *Info {
+	return c.auth.GetInfo()
+}
+
+// RetryCount returns the number of PIN attempts left.
+func (c *Client) RetryCount() int {
+	return c.auth.GetRetries()
+}
+
+// SetPIN sets the initial PIN, or changes it if old is not empty.
+func (c *Client) SetPIN(pin string, old string) error {
+	platformKey, shared, err := c.keyAgreement()
+	if err != nil {
+		return err
+	}
+
+	padded := make([]byte, 64)
+	if len(pin) > len(padded) {
+		return ErrPinPolicyViolation
+	}
+	copy(padded, pin)
+	newPINEnc, err := encrypt(shared, padded)
+	if err != nil {
+		return err
+	}
+
+	if old == "" {
+		return c.auth.SetPIN(platformKey.PublicKey(), newPINEnc, authenticate(shared, newPINEnc))
+	}
+
+	pinHashEnc, err := encrypt(shared, pinHash(old))
+	if err != nil {
+		return err
+	}
+	pinAuth := authenticate(shared, append(append([]byte(nil), newPINEnc...), pinHashEnc...))
+	return c.auth.ChangePIN(platformKey.PublicKey(), pinHashEnc, newPINEnc, pinAuth)
+}
+
+// MakeCredential creates an ES256 credential, optionally resident and with the
+// hmac-secret extension enabled. An empty PIN skips user verification.
+func (c *Client) MakeCredential(clientDataHash []byte, rp RelyingParty, user User, pin string, residentKey, hmacSecret bool) (*Attestation, error) {
+	req := &MakeCredentialRequest{
+		ClientDataHash: clientDataHash,
+		RP:             rp,
+		User:           user,
+		Algorithm:      AlgorithmES256,
+		ResidentKey:    residentKey,
+		HMACSecret:     hmacSecret,
+	}
+	if pin != "" {
+		token, err := c.pinToken(pin)
+		if err != nil {
+			return nil, err
+		}
+		req.PinUvAuthParam = authenticate(token, clientDataHash)
+		req.PinUvAuthProtocol = 1
+	}
+	return c.auth.MakeCredential(req)
+}
+
+// Assertion performs an assertion with user presence for one of the allowed
+// credentials, or a resident credential if the allow list is empty.
+// A 32 or 64 byte salt requests one or two hmac-secret outputs, which are
+// returned decrypted in Assertion.HMACSecret.
+func (c *Client) Assertion(rpID string, clientDataHash []byte, allowList [][]byte, pin string, salt []byte) (*Assertion, error) {
+	req := &GetAssertionRequest{
+		RPID:           rpID,
+		ClientDataHash: clientDataHash,
+		AllowList:      allowList,
+		UserPresence:   true,
+	}
+	if pin != "" {
+		token, err := c.pinToken(pin)
+		if err != nil {
+			return nil, err
+		}
+		req.PinUvAuthParam = authenticate(token, clientDataHash)
+		req.PinUvAuthProtocol = 1
+	}
+
+	var shared []byte
+	if salt != nil {
+		platformKey, secret, err := c.keyAgreement()
+		if err != nil {
+			return nil, err
+		}
+		saltEnc, err := encrypt(secret, salt)
+		if err != nil {
+			return nil, fmt.Errorf("%w: hmac-secret salt must be 32 or 64 bytes", err)
+		}
+		shared = secret
+		req.HMACSecret = &HMACSecretInput{
+			KeyAgreement: platformKey.PublicKey(),
+			SaltEnc:      saltEnc,
+			SaltAuth:     authenticate(secret, saltEnc),
+		}
+	}
+
+	assertion, err := c.auth.GetAssertion(req)
+	if err != nil {
+		return nil, err
+	}
+	if shared != nil && assertion.HMACSecret != nil {
+		assertion.HMACSecret, err = decrypt(shared, assertion.HMACSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return assertion, nil
+}
+
+// RelyingParties lists the relying parties with resident credentials.
+func (c *Client) RelyingParties(pin string) ([]RelyingParty, error) {
+	param, err := c.credMgmtParam(pin, []byte{credMgmtEnumerateRPs})
+	if err != nil {
+		return nil, err
+	}
+	return c.auth.EnumerateRPs(param)
+}
+
+// Credentials lists the resident credentials of a relying party.
+func (c *Client) Credentials(rpID string, pin string) ([]*ResidentCredential, error) {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	param, err := c.credMgmtParam(pin, append([]byte{credMgmtEnumerateCredentials}, rpIDHash[:]...))
+	if err != nil {
+		return nil, err
+	}
+	return c.auth.EnumerateCredentials(rpID, param)
+}
+
+// DeleteCredential removes a resident credential.
+func (c *Client) DeleteCredential(credentialID []byte, pin string) error {
+	param, err := c.credMgmtParam(pin, append([]byte{credMgmtDeleteCredential}, credentialID...))
+	if err != nil {
+		return err
+	}
+	return c.auth.DeleteCredential(credentialID, param)
+}
+
+// UpdateUser replaces the user name and display name of a resident credential.
+func (c *Client) UpdateUser(credentialID []byte, user User, pin string) error {
+	param, err := c.credMgmtParam(pin, updateUserMessage(credentialID, user))
+	if err != nil {
+		return err
+	}
+	return c.auth.UpdateUserInformation(credentialID, user, param)
+}
+
+// credMgmtParam computes the pinUvAuthParam for a credential management subcommand.
+func (c *Client) credMgmtParam(pin string, message []byte) ([]byte, error) {
+	if pin == "" {
+		return nil, ErrPinRequired
+	}
+	token, err := c.pinToken(pin)
+	if err != nil {
+		return nil, err
+	}
+	return authenticate(token, message), nil
+}
+
+// pinToken obtains a PIN token by proving knowledge of the PIN.
+func (c *Client) pinToken(pin string) ([]byte, error) {
+	platformKey, shared, err := c.keyAgreement()
+	if err != nil {
+		return nil, err
+	}
+	pinHashEnc, err := encrypt(shared, pinHash(pin))
+	if err != nil {
+		return nil, err
+	}
+	tokenEnc, err := c.auth.GetPINToken(platformKey.PublicKey(), pinHashEnc)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(shared, tokenEnc)
+}
+
+// keyAgreement generates an ephemeral platform key and derives the shared secret
+// with the authenticator's key agreement key.
+func (c *Client) keyAgreement() (*ecdh.PrivateKey, []byte, error) {
+	platformKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate platform key: %w", err)
+	}
+	shared, err := sharedSecret(platformKey, c.auth.GetKeyAgreement())
+	if err != nil {
+		return nil, nil, err
+	}
+	return platformKey, shared, nil
+}
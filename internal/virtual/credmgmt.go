@@ -0,0 +1,138 @@
+package virtual
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// This file implements the CTAP 2.1 authenticatorCredentialManagement command.
+// Every subcommand requires a pinUvAuthParam computed over the subcommand
+// identifier followed by its parameters.
+
+const (
+	credMgmtEnumerateRPs         = 0x02
+	credMgmtEnumerateCredentials = 0x04
+	credMgmtDeleteCredential     = 0x06
+	credMgmtUpdateUserInfo       = 0x07
+)
+
+// ResidentCredential describes a discoverable credential stored on the authenticator.
+type ResidentCredential struct {
+	ID   []byte
+	RP   RelyingParty
+	User User
+}
+
+// EnumerateRPs lists the relying parties with resident credentials.
+func (a *Authenticator) EnumerateRPs(pinUvAuthParam []byte) ([]RelyingParty, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.verifyCredMgmt(pinUvAuthParam, []byte{credMgmtEnumerateRPs}); err != nil {
+		return nil, err
+	}
+
+	var rps []RelyingParty
+	seen := make(map[string]bool)
+	for _, r := range a.state.Resident {
+		if seen[r.RPID] {
+			continue
+		}
+		seen[r.RPID] = true
+		rps = append(rps, RelyingParty{ID: r.RPID, Name: r.RPName})
+	}
+	return rps, nil
+}
+
+// EnumerateCredentials lists the resident credentials of a relying party.
+func (a *Authenticator) EnumerateCredentials(rpID string, pinUvAuthParam []byte) ([]*ResidentCredential, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if err := a.verifyCredMgmt(pinUvAuthParam, append([]byte{credMgmtEnumerateCredentials}, rpIDHash[:]...)); err != nil {
+		return nil, err
+	}
+
+	var credentials []*ResidentCredential
+	for _, r := range a.state.Resident {
+		if r.RPID != rpID {
+			continue
+		}
+		credentials = append(credentials, r.toResidentCredential())
+	}
+	if len(credentials) == 0 {
+		return nil, ErrNoCredentials
+	}
+	return credentials, nil
+}
+
+// DeleteCredential removes a resident credential.
+func (a *Authenticator) DeleteCredential(credentialID []byte, pinUvAuthParam []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.verifyCredMgmt(pinUvAuthParam, append([]byte{credMgmtDeleteCredential}, credentialID...)); err != nil {
+		return err
+	}
+
+	removed := a.removeResident(func(r *residentCredential) bool {
+		return bytes.Equal(r.ID, credentialID)
+	})
+	if removed == 0 {
+		return ErrNoCredentials
+	}
+	return a.saveState()
+}
+
+// UpdateUserInformation replaces the user name and display name of a resident
+// credential. The user ID cannot change.
+func (a *Authenticator) UpdateUserInformation(credentialID []byte, user User, pinUvAuthParam []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.verifyCredMgmt(pinUvAuthParam, updateUserMessage(credentialID, user)); err != nil {
+		return err
+	}
+
+	r := a.findResident(credentialID)
+	if r == nil {
+		return ErrNoCredentials
+	}
+	if !bytes.Equal(r.UserID, user.ID) {
+		return ErrInvalidParameter
+	}
+	r.UserName = user.Name
+	r.UserDisplayName = user.DisplayName
+	return a.saveState()
+}
+
+// updateUserMessage returns the message authenticated for updateUserInformation:
+// the subcommand, the credential ID and the length-prefixed user fields.
+func updateUserMessage(credentialID []byte, user User) []byte {
+	message := append([]byte{credMgmtUpdateUserInfo}, credentialID...)
+	for _, field := range [][]byte{user.ID, []byte(user.Name), []byte(user.DisplayName)} {
+		message = binary.BigEndian.AppendUint16(message, uint16(len(field)))
+		message = append(message, field...)
+	}
+	return message
+}
+
+// verifyCredMgmt checks the pinUvAuthParam of a credential management subcommand.
+// Credential management is only available once a PIN has been set.
+func (a *Authenticator) verifyCredMgmt(pinUvAuthParam, message []byte) error {
+	if len(a.state.PINHash) == 0 {
+		return ErrPinNotSet
+	}
+	_, err := a.verifyPinUvAuth(pinUvAuthParam, 1, message, true)
+	return err
+}
+
+func (r *residentCredential) toResidentCredential() *ResidentCredential {
+	return &ResidentCredential{
+		ID:   append([]byte(nil), r.ID...),
+		RP:   RelyingParty{ID: r.RPID, Name: r.RPName},
+		User: User{ID: r.UserID, Name: r.UserName, DisplayName: r.UserDisplayName},
+	}
+}
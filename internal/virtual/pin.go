@@ -0,0 +1,270 @@
+package virtual
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// This file implements the authenticator side of the CTAP2 clientPIN command
+// using PIN/UV auth protocol one (ECDH P-256, AES-256-CBC, HMAC-SHA-256).
+
+// GetRetries returns the number of PIN attempts left before the PIN is blocked.
+func (a *Authenticator) GetRetries() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.state.PINRetries
+}
+
+// GetKeyAgreement returns the authenticator's current key agreement public key.
+func (a *Authenticator) GetKeyAgreement() *ecdh.PublicKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.keyAgreement.PublicKey()
+}
+
+// SetPIN sets the initial PIN.
+// newPINEnc is the 64 byte zero-padded PIN encrypted with the shared secret,
+// pinAuth is LEFT(HMAC-SHA-256(sharedSecret, newPINEnc), 16).
+func (a *Authenticator) SetPIN(platformKey *ecdh.PublicKey, newPINEnc, pinAuth []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.state.PINHash) > 0 {
+		return fmt.Errorf("%w: a PIN is already set", ErrOperationDenied)
+	}
+	shared, err := a.sharedSecret(platformKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(authenticate(shared, newPINEnc), pinAuth) {
+		return ErrPinAuthInvalid
+	}
+	newPIN, err := decryptPIN(shared, newPINEnc)
+	if err != nil {
+		return err
+	}
+
+	a.state.PINHash = pinHash(newPIN)
+	a.state.PINRetries = maxPINRetries
+	return a.saveState()
+}
+
+// ChangePIN replaces the current PIN.
+// pinHashEnc is LEFT(SHA-256(currentPIN), 16) encrypted with the shared secret,
+// pinAuth is LEFT(HMAC-SHA-256(sharedSecret, newPINEnc || pinHashEnc), 16).
+func (a *Authenticator) ChangePIN(platformKey *ecdh.PublicKey, pinHashEnc, newPINEnc, pinAuth []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.state.PINHash) == 0 {
+		return ErrPinNotSet
+	}
+	shared, err := a.sharedSecret(platformKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(authenticate(shared, append(append([]byte(nil), newPINEnc...), pinHashEnc...)), pinAuth) {
+		return ErrPinAuthInvalid
+	}
+	if err := a.checkPINHash(shared, pinHashEnc); err != nil {
+		return err
+	}
+	newPIN, err := decryptPIN(shared, newPINEnc)
+	if err != nil {
+		return err
+	}
+
+	a.state.PINHash = pinHash(newPIN)
+	if err := a.regenerateSession(); err != nil {
+		return err
+	}
+	return a.saveState()
+}
+
+// GetPINToken verifies the PIN and returns the PIN token encrypted with the shared secret.
+// pinHashEnc is LEFT(SHA-256(PIN), 16) encrypted with the shared secret.
+func (a *Authenticator) GetPINToken(platformKey *ecdh.PublicKey, pinHashEnc []byte) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.state.PINHash) == 0 {
+		return nil, ErrPinNotSet
+	}
+	shared, err := a.sharedSecret(platformKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkPINHash(shared, pinHashEnc); err != nil {
+		return nil, err
+	}
+	return encrypt(shared, a.pinToken)
+}
+
+// checkPINHash compares an encrypted PIN hash against the stored one and keeps
+// track of the retry counters like a physical authenticator does: every attempt
+// costs a retry, a correct PIN restores them, and three consecutive failures
+// require a power cycle.
+func (a *Authenticator) checkPINHash(shared, pinHashEnc []byte) error {
+	if a.state.PINRetries <= 0 {
+		return ErrPinBlocked
+	}
+	if a.consecutiveFailures >= maxConsecutiveFailure {
+		return ErrPinAuthBlocked
+	}
+
+	a.state.PINRetries--
+	if err := a.saveState(); err != nil {
+		return err
+	}
+
+	hash, err := decrypt(shared, pinHashEnc)
+	if err != nil || !hmac.Equal(hash, a.state.PINHash) {
+		a.consecutiveFailures++
+		if err := a.regenerateSession(); err != nil {
+			return err
+		}
+		switch {
+		case a.state.PINRetries <= 0:
+			return ErrPinBlocked
+		case a.consecutiveFailures >= maxConsecutiveFailure:
+			return ErrPinAuthBlocked
+		default:
+			return ErrPinInvalid
+		}
+	}
+
+	a.state.PINRetries = maxPINRetries
+	a.consecutiveFailures = 0
+	return a.saveState()
+}
+
+// verifyPinUvAuth checks the pinUvAuthParam of a request.
+// It returns whether the user was verified. Without a configured PIN no
+// verification is possible; with a PIN, required operations must carry one.
+func (a *Authenticator) verifyPinUvAuth(param []byte, protocol int, clientDataHash []byte, required bool) (bool, error) {
+	if len(a.state.PINHash) == 0 {
+		if len(param) > 0 {
+			return false, ErrPinNotSet
+		}
+		return false, nil
+	}
+	if len(param) == 0 {
+		if required {
+			return false, ErrPinRequired
+		}
+		return false, nil
+	}
+	if protocol != 1 {
+		return false, fmt.Errorf("%w: unsupported PIN protocol %d", ErrMissingParameter, protocol)
+	}
+	if !hmac.Equal(authenticate(a.pinToken, clientDataHash), param) {
+		return false, ErrPinAuthInvalid
+	}
+	return true, nil
+}
+
+// regenerateSession creates a fresh key agreement key and PIN token,
+// invalidating any previously issued token.
+func (a *Authenticator) regenerateSession() error {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key agreement key: %w", err)
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("failed to generate PIN token: %w", err)
+	}
+	a.keyAgreement = key
+	a.pinToken = token
+	return nil
+}
+
+// sharedSecret computes SHA-256 of the ECDH shared point's x-coordinate.
+func (a *Authenticator) sharedSecret(platformKey *ecdh.PublicKey) ([]byte, error) {
+	if platformKey == nil {
+		return nil, ErrMissingParameter
+	}
+	return sharedSecret(a.keyAgreement, platformKey)
+}
+
+func sharedSecret(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) ([]byte, error) {
+	z, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %w", err)
+	}
+	hash := sha256.Sum256(z)
+	return hash[:], nil
+}
+
+// pinHash returns LEFT(SHA-256(pin), 16).
+func pinHash(pin string) []byte {
+	hash := sha256.Sum256([]byte(pin))
+	return hash[:16]
+}
+
+// validatePIN enforces the PIN length policy.
+func validatePIN(pin string) error {
+	if len([]rune(pin)) < minPINLength || len(pin) > maxPINLength {
+		return fmt.Errorf("%w: PIN must be %d to %d characters", ErrPinPolicyViolation, minPINLength, maxPINLength)
+	}
+	return nil
+}
+
+// decryptPIN decrypts a zero-padded PIN block and validates the PIN.
+func decryptPIN(shared, newPINEnc []byte) (string, error) {
+	if len(newPINEnc) != 64 {
+		return "", ErrInvalidLength
+	}
+	padded, err := decrypt(shared, newPINEnc)
+	if err != nil {
+		return "", err
+	}
+	pin := string(bytes.TrimRight(padded, "\x00"))
+	if err := validatePIN(pin); err != nil {
+		return "", err
+	}
+	return pin, nil
+}
+
+// authenticate returns LEFT(HMAC-SHA-256(key, message), 16).
+func authenticate(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)[:16]
+}
+
+// encrypt performs AES-256-CBC with an all-zero IV, as PIN protocol one specifies.
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	if len(plaintext)%aes.BlockSize != 0 {
+		return nil, ErrInvalidLength
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(out, plaintext)
+	return out, nil
+}
+
+// decrypt reverses encrypt.
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrInvalidLength
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(out, ciphertext)
+	return out, nil
+}
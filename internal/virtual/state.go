@@ -0,0 +1,103 @@
+package virtual
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// state is the persistent part of the virtual authenticator.
+// Non-resident credentials are not stored: their keys are derived from the
+// seed and the credential ID alone.
+type state struct {
+	PINHash    []byte                `json:"pin_hash,omitempty"`
+	PINRetries int                   `json:"pin_retries"`
+	Counter    uint32                `json:"counter"`
+	Resident   []*residentCredential `json:"resident,omitempty"`
+}
+
+// residentCredential is a discoverable credential stored on the authenticator.
+type residentCredential struct {
+	ID              []byte `json:"id"`
+	RPID            string `json:"rp_id"`
+	RPName          string `json:"rp_name,omitempty"`
+	UserID          []byte `json:"user_id"`
+	UserName        string `json:"user_name,omitempty"`
+	UserDisplayName string `json:"user_display_name,omitempty"`
+	HMACSecret      bool   `json:"hmac_secret"`
+}
+
+// loadState restores the state from the state file, if one is configured and exists.
+func (a *Authenticator) loadState() error {
+	if a.statePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(a.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read virtual authenticator state: %w", err)
+	}
+	if err := json.Unmarshal(data, &a.state); err != nil {
+		return fmt.Errorf("failed to parse virtual authenticator state %s: %w", a.statePath, err)
+	}
+	return nil
+}
+
+// saveState writes the state file atomically, if one is configured.
+func (a *Authenticator) saveState() error {
+	if a.statePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&a.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode virtual authenticator state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.statePath), ".virtual-state-*")
+	if err != nil {
+		return fmt.Errorf("failed to write virtual authenticator state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write virtual authenticator state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write virtual authenticator state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), a.statePath); err != nil {
+		return fmt.Errorf("failed to write virtual authenticator state: %w", err)
+	}
+	return nil
+}
+
+// findResident returns the resident credential with the given ID, or nil.
+func (a *Authenticator) findResident(credentialID []byte) *residentCredential {
+	for _, r := range a.state.Resident {
+		if bytes.Equal(r.ID, credentialID) {
+			return r
+		}
+	}
+	return nil
+}
+
+// removeResident drops all resident credentials matching the predicate.
+func (a *Authenticator) removeResident(match func(*residentCredential) bool) int {
+	kept := a.state.Resident[:0]
+	removed := 0
+	for _, r := range a.state.Resident {
+		if match(r) {
+			removed++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	a.state.Resident = kept
+	return removed
+}
@@ -12,7 +12,10 @@
 //
 // Usage:
 //
-//	go run main.go
+//	fido2-hmac-deriver enroll    # create a credential once
+//	fido2-hmac-deriver derive    # derive the secret (the default command)
+//
+// Run "fido2-hmac-deriver help" for the list of commands.
 //
 // Requirements:
 //   - A FIDO2 compatible device (YubiKey, SoloKey, etc.)
@@ -21,142 +24,257 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"fido2-hmac-deriver/internal/agekey"
+	"fido2-hmac-deriver/internal/backend/libfido2"
 	"fido2-hmac-deriver/internal/crypto"
 	"fido2-hmac-deriver/internal/device"
 	"fido2-hmac-deriver/internal/types"
 	"fido2-hmac-deriver/internal/ui"
+	"fido2-hmac-deriver/internal/virtual"
 )
 
 // Application represents the main application with all its dependencies.
 // This structure follows dependency injection principles for better testability.
 type Application struct {
-	ui             types.UIProvider     // User interface provider
-	deviceMgr      types.DeviceManager  // Device discovery and selection
-	cryptoProvider types.CryptoProvider // HMAC secret derivation
-	config         *types.Configuration // Application configuration
-	keyOnly        bool                 // Output only the key to stdout
-	fidoDevice     string               // Specific FIDO device path (optional)
-	pinEnvVar      string               // Environment variable name for PIN (optional)
-}
-
-func NewApplication() *Application {
-	uiProvider := ui.NewDisplay()
-	deviceManager := device.NewManager(uiProvider)
-	cryptoProvider := crypto.NewProvider(uiProvider)
+	ui             types.UIProvider      // User interface provider
+	deviceMgr      types.DeviceManager   // Device discovery and selection
+	cryptoProvider types.CryptoProvider  // HMAC secret derivation
+	credentials    types.CredentialStore // Stored credential records
+	config         *types.Configuration  // Application configuration
+	fidoDevice     string                // Specific FIDO device path (optional)
+	pinSource      ui.PINSource          // Source of the PIN instead of the terminal (optional)
+	agentSocket    string                // Socket of the agent caching the secret (empty to not use it)
+}
+
+// NewApplication creates the application from the UI provider, device backend and credential store.
+func NewApplication(uiProvider types.UIProvider, backend types.Backend, credentials types.CredentialStore) *Application {
+	deviceManager := device.NewManager(uiProvider, backend)
+	cryptoProvider := crypto.NewProvider(uiProvider, backend, credentials)
 	config := types.DefaultConfiguration()
 
 	return &Application{
 		ui:             uiProvider,
 		deviceMgr:      deviceManager,
 		cryptoProvider: cryptoProvider,
+		credentials:    credentials,
 		config:         config,
 	}
 }
 
-// Run executes the main application workflow.
-// This is the primary entry point that orchestrates the entire process.
-func (app *Application) Run() error {
-	app.ui.DisplayWelcome()
+// newBackend creates the device backend selected on the command line.
+// The virtual backend is configured from the given options; the others ignore them.
+func newBackend(name string, virtualOpts virtual.Options) (types.Backend, error) {
+	switch name {
+	case libfido2.Name:
+		return libfido2.New(), nil
+	case virtual.BackendName:
+		auth, err := virtual.New(virtualOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create virtual authenticator: %w", err)
+		}
+		return virtual.NewBackend(auth), nil
+	default:
+		return nil, fmt.Errorf("unknown backend '%s' (expected %s or %s)", name, libfido2.Name, virtual.BackendName)
+	}
+}
+
+// selectDevice discovers the connected devices and selects one, either by the
+// path given with --fido-device or interactively, and checks that it is accessible.
+func (app *Application) selectDevice() (*types.DeviceInfo, error) {
+	return app.selectDeviceAt(app.fidoDevice)
+}
 
+// selectDeviceAt selects the device with the given path, or interactively if the
+// path is empty, and checks that it is accessible.
+func (app *Application) selectDeviceAt(path string) (*types.DeviceInfo, error) {
 	app.ui.DisplayProgress("Searching for FIDO2 devices...")
 	devices, err := app.deviceMgr.ListDevices()
 	if err != nil {
-		app.ui.DisplayError(err)
-		return fmt.Errorf("device discovery failed: %w", err)
+		return nil, fmt.Errorf("device discovery failed: %w", err)
 	}
 
 	app.ui.DisplaySuccess(fmt.Sprintf("Found %d FIDO2 device(s)", len(devices)))
 
 	// Device selection: use specified device path or interactive selection
 	var selectedDevice *types.DeviceInfo
-	if app.fidoDevice != "" {
+	if path != "" {
 		// Non-interactive mode: select device by path
-		selectedDevice, err = app.deviceMgr.SelectDeviceByPath(devices, app.fidoDevice)
+		selectedDevice, err = app.deviceMgr.SelectDeviceByPath(devices, path)
 		if err != nil {
-			app.ui.DisplayError(err)
-			return fmt.Errorf("device selection by path failed: %w", err)
+			return nil, fmt.Errorf("device selection by path failed: %w", err)
 		}
 	} else {
 		// Interactive mode: let user select device
 		selectedDevice, err = app.deviceMgr.SelectDevice(devices)
 		if err != nil {
-			app.ui.DisplayError(err)
-			return fmt.Errorf("device selection failed: %w", err)
+			return nil, fmt.Errorf("device selection failed: %w", err)
 		}
 	}
 
 	app.ui.DisplayProgress("Validating device accessibility...")
 	if err := app.deviceMgr.ValidateDevice(selectedDevice); err != nil {
-		app.ui.DisplayError(err)
-		return fmt.Errorf("device validation failed: %w", err)
+		return nil, fmt.Errorf("device validation failed: %w", err)
 	}
 
-	// PIN retrieval: use environment variable or interactive input
-	var pin string
-	if app.pinEnvVar != "" {
-		// Non-interactive mode: get PIN from environment variable
-		pin, err = app.ui.GetPINFromEnvironment(app.pinEnvVar)
+	return selectedDevice, nil
+}
+
+// checkDevice runs the pre-flight check, so devices lacking hmac-secret are
+// rejected before the user is asked for the PIN.
+func (app *Application) checkDevice(device *types.DeviceInfo) error {
+	app.ui.DisplayProgress("Checking device capabilities...")
+	if err := app.deviceMgr.CheckDeviceSupport(device); err != nil {
+		return fmt.Errorf("device check failed: %w", err)
+	}
+	return nil
+}
+
+// readPIN reads the device PIN from the source selected with the PIN flags, or
+// prompts for it interactively.
+func (app *Application) readPIN() (string, error) {
+	if app.pinSource != nil {
+		// Non-interactive mode: get PIN from the environment, a file or a pinentry program
+		pin, err := app.pinSource.ReadPIN("Please enter the PIN of your FIDO2 device.")
 		if err != nil {
-			app.ui.DisplayError(err)
-			return fmt.Errorf("PIN retrieval from environment failed: %w", err)
-		}
-	} else {
-		// Interactive mode: prompt user for PIN
-		pin = app.ui.GetPIN("Enter your FIDO2 device PIN: ")
-		if pin == "" {
-			app.ui.DisplayError(fmt.Errorf("PIN is required for FIDO2 operations"))
-			return fmt.Errorf("no PIN provided")
+			return "", fmt.Errorf("PIN retrieval from %s failed: %w", app.pinSource, err)
 		}
+		app.ui.DisplayProgress(fmt.Sprintf("PIN read from %s", app.pinSource))
+		return pin, nil
 	}
 
+	// Interactive mode: prompt user for PIN
+	pin := app.ui.GetPIN("Enter your FIDO2 device PIN: ")
+	if pin == "" {
+		return "", errors.New("no PIN provided, a PIN is required for FIDO2 operations")
+	}
+	return pin, nil
+}
+
+// validateConfiguration checks the configuration before any device operation.
+func (app *Application) validateConfiguration() error {
 	app.ui.DisplayProgress("Validating configuration...")
 	if err := app.cryptoProvider.ValidateConfiguration(app.config); err != nil {
-		app.ui.DisplayError(err)
 		return fmt.Errorf("configuration validation failed: %w", err)
 	}
+	return nil
+}
 
-	app.ui.DisplayInfo("Starting HMAC secret derivation process...")
-	app.ui.DisplayInfo("You will need to touch your FIDO2 device when it blinks")
+// deriveSecret selects the device, reads the PIN and derives the HMAC secret with the
+// stored credential, for commands that use the secret instead of showing it. A
+// matching secret cached by the agent is returned without touching the device.
+func (app *Application) deriveSecret() (*types.HMACResult, error) {
+	if result := app.cachedSecret(app.configQuery(app.fidoDevice)); result != nil {
+		return result, nil
+	}
+	return app.deriveSecretAt(app.fidoDevice)
+}
 
-	result, err := app.cryptoProvider.DeriveHMACSecret(selectedDevice, pin, app.config)
+// deriveSecretAt derives the HMAC secret like deriveSecret, with the device at the
+// given path or an interactively selected one if the path is empty. It never uses
+// the agent, whose secret may come from another device, so that enrolling a device
+// gets the secret of that device.
+func (app *Application) deriveSecretAt(path string) (*types.HMACResult, error) {
+	selectedDevice, err := app.selectDeviceAt(path)
 	if err != nil {
-		app.ui.DisplayError(err)
-		return fmt.Errorf("HMAC secret derivation failed: %w", err)
+		return nil, err
 	}
+	return app.deriveSecretOn(selectedDevice, nil, nil)
+}
 
-	if app.keyOnly {
-		app.ui.OutputKeyOnly(result)
-	} else {
-		app.ui.DisplayResults(result)
+// deriveSecretOn checks the device, reads the PIN and derives the HMAC secret with
+// the stored credential, or with the given credential and salt if credentialID is
+// not nil.
+func (app *Application) deriveSecretOn(device *types.DeviceInfo, credentialID, salt []byte) (*types.HMACResult, error) {
+	session, err := app.openDevice(device)
+	if err != nil {
+		return nil, err
 	}
+	if credentialID == nil {
+		return session.derive(app.config)
+	}
+	return session.deriveWithSalt(app.config, credentialID, salt)
+}
 
-	return nil
+// deviceSession is a checked device with its PIN, on which several secrets can be
+// derived with a single PIN entry.
+type deviceSession struct {
+	app    *Application
+	device *types.DeviceInfo
+	pin    string
 }
 
-func main() {
-	// Parse CLI flags
-	keyOnly := flag.Bool("key-only", false, "Output only the derived key to stdout (useful for scripting)")
-	fidoDevice := flag.String("fido-device", "", "Specify FIDO device path (e.g., /dev/hidraw10) to skip device selection")
-	pinEnvVar := flag.String("pin-environment-variable", "", "Environment variable name containing the PIN (for non-interactive mode)")
-	flag.Parse()
-
-	// Create the application instance
-	app := NewApplication()
-	app.keyOnly = *keyOnly
-	app.fidoDevice = *fidoDevice
-	app.pinEnvVar = *pinEnvVar
-
-	// Run the application and handle any errors
-	if err := app.Run(); err != nil {
-		app.ui.DisplayError(err)
-		os.Exit(1)
+// openDevice checks the device, reads the PIN and validates the configuration,
+// the steps before any operation with a credential.
+func (app *Application) openDevice(device *types.DeviceInfo) (*deviceSession, error) {
+	if err := app.checkDevice(device); err != nil {
+		return nil, err
+	}
+
+	pin, err := app.readPIN()
+	if err != nil {
+		return nil, err
 	}
 
-	// Success - exit with code 0 (this is implicit, but explicit for clarity)
+	if err := app.validateConfiguration(); err != nil {
+		return nil, err
+	}
+	return &deviceSession{app: app, device: device, pin: pin}, nil
 }
 
-func init() {}
+// derive derives the HMAC secret with the stored credential of the configured
+// relying party.
+func (s *deviceSession) derive(config *types.Configuration) (*types.HMACResult, error) {
+	result, err := s.app.cryptoProvider.DeriveHMACSecret(s.device, s.pin, config)
+	if err != nil {
+		return nil, fmt.Errorf("HMAC secret derivation failed: %w", err)
+	}
+	return result, nil
+}
+
+// deriveWithSalt derives the HMAC secret with the given credential and salt, such
+// as those recorded in the header of an encrypted file.
+func (s *deviceSession) deriveWithSalt(config *types.Configuration, credentialID, salt []byte) (*types.HMACResult, error) {
+	result, err := s.app.cryptoProvider.DeriveHMACSecretWithSalt(s.device, s.pin, config, credentialID, salt)
+	if err != nil {
+		return nil, fmt.Errorf("HMAC secret derivation failed: %w", err)
+	}
+	return result, nil
+}
+
+func main() {
+	// The first argument selects the command; derive is the default so that
+	// invocations with flags only keep working as before
+	args := os.Args[1:]
+	name := defaultCommand
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == agekey.PluginBinary {
+		// age runs plugins by their binary name, so a link with that name serves the protocol
+		name = "age-plugin"
+	} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Error: unknown command '%s'\n\n", name)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	if err := cmd.run(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		ui.NewDisplay().DisplayError(err)
+		os.Exit(1)
+	}
+}
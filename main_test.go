@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runCommand runs a command of the CLI in-process and returns what it wrote to stdout.
+func runCommand(t *testing.T, name string, args ...string) (string, error) {
+	t.Helper()
+	cmd := findCommand(name)
+	if cmd == nil {
+		t.Fatalf("unknown command %s", name)
+	}
+
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = stdout }()
+
+	runErr := cmd.run(args)
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), runErr
+}
+
+// virtualFlags returns the flags selecting a virtual authenticator and credential
+// store kept in dir, with the PIN read from the environment.
+func virtualFlags(t *testing.T, dir, seed string) []string {
+	t.Helper()
+	t.Setenv("TEST_FIDO_PIN", "123456")
+	return []string{
+		"--backend=virtual",
+		"--virtual-seed=" + seed,
+		"--virtual-state=" + filepath.Join(dir, "virtual.json"),
+		"--virtual-pin=123456",
+		"--fido-device=virtual:0",
+		"--store-dir=" + filepath.Join(dir, "store"),
+		"--pin-environment-variable=TEST_FIDO_PIN",
+		"--no-agent",
+		"--quiet",
+	}
+}
+
+// deriveResult is the part of the JSON output of derive the tests check.
+type deriveResult struct {
+	Secret     struct{ Value string } `json:"secret"`
+	NextSecret struct{ Value string } `json:"next_secret"`
+	Subkeys    []struct {
+		Label string
+		Key   struct{ Value string }
+	} `json:"subkeys"`
+}
+
+// The virtual authenticator derives all key material from its seed, so enrolling
+// and deriving with the same flags must always yield the same secrets. A change here
+// breaks the secrets of every setup using the virtual backend.
+func TestDeriveVirtualIsStable(t *testing.T) {
+	tests := []struct {
+		name       string
+		seed       string
+		flags      []string
+		secret     string
+		nextSecret string
+		subkey     string
+	}{
+		{
+			name:   "default seed",
+			seed:   "fido2-hmac-deriver",
+			secret: "e0e52ac90214c7a6d805140a1d9abbbeb4960f3b2a9f0c062a150872939de111",
+		},
+		{
+			name:   "other seed",
+			seed:   "ci",
+			secret: "f1e4ef02b02722cd1e0224211e3c7f80c4f488ede457224700d63876f5a61bbb",
+		},
+		{
+			name:   "context salt",
+			seed:   "fido2-hmac-deriver",
+			flags:  []string{"--salt-mode=context", "--salt-context=laptop"},
+			secret: "b36a47b2292314784ee9214b0931090455eeeaf4b6fc3265cbd2b96c61901151",
+		},
+		{
+			name:   "second generation",
+			seed:   "fido2-hmac-deriver",
+			flags:  []string{"--salt-generation=1"},
+			secret: "232220291fa85861c91855fd96f00bab2718dfc3a7db0975cb3bdabe26e7e30f",
+		},
+		{
+			name:       "with next generation",
+			seed:       "fido2-hmac-deriver",
+			flags:      []string{"--with-next"},
+			secret:     "e0e52ac90214c7a6d805140a1d9abbbeb4960f3b2a9f0c062a150872939de111",
+			nextSecret: "232220291fa85861c91855fd96f00bab2718dfc3a7db0975cb3bdabe26e7e30f",
+		},
+		{
+			name:   "subkey",
+			seed:   "fido2-hmac-deriver",
+			flags:  []string{"--derive-subkey=app"},
+			secret: "e0e52ac90214c7a6d805140a1d9abbbeb4960f3b2a9f0c062a150872939de111",
+			subkey: "ec6b243c2181c09bfc27cd2d294d283bede32a1f40ba938b307ebe6f168b9ab5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			flags := virtualFlags(t, dir, tt.seed)
+			var saltFlags []string
+			for _, flag := range tt.flags {
+				if strings.HasPrefix(flag, "--salt-") {
+					saltFlags = append(saltFlags, flag)
+				}
+			}
+			if _, err := runCommand(t, "enroll", append(flags, saltFlags...)...); err != nil {
+				t.Fatalf("enroll: %v", err)
+			}
+
+			args := append(append(flags, tt.flags...), "--output=json", "--encoding=hex")
+			out, err := runCommand(t, "derive", args...)
+			if err != nil {
+				t.Fatalf("derive: %v", err)
+			}
+			var result deriveResult
+			if err := json.Unmarshal([]byte(out), &result); err != nil {
+				t.Fatalf("failed to parse derive output %q: %v", out, err)
+			}
+
+			if result.Secret.Value != tt.secret {
+				t.Errorf("secret %s, want %s", result.Secret.Value, tt.secret)
+			}
+			if result.NextSecret.Value != tt.nextSecret {
+				t.Errorf("next secret %s, want %s", result.NextSecret.Value, tt.nextSecret)
+			}
+			subkey := ""
+			if len(result.Subkeys) > 0 {
+				subkey = result.Subkeys[0].Key.Value
+			}
+			if subkey != tt.subkey {
+				t.Errorf("subkey %s, want %s", subkey, tt.subkey)
+			}
+
+			// The secret verifies without the device, given the same salt options
+			verify := []string{"--store-dir=" + filepath.Join(dir, "store"), "--quiet", "--encoding=hex", "--secret=" + result.Secret.Value}
+			if _, err := runCommand(t, "verify", append(verify, saltFlags...)...); err != nil {
+				t.Errorf("verify: %v", err)
+			}
+		})
+	}
+}
+
+// A vault created for an authenticator unlocks with it, always to the same master
+// key, and keeps its only authenticator.
+func TestVault(t *testing.T) {
+	dir := t.TempDir()
+	flags := virtualFlags(t, dir, "fido2-hmac-deriver")
+	if _, err := runCommand(t, "enroll", flags...); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	vault := func(args ...string) []string {
+		return append(append(append([]string(nil), flags...), "--vault="+filepath.Join(dir, "vault.json")), args...)
+	}
+
+	if _, err := runCommand(t, "vault", vault("create", "--label=laptop")...); err != nil {
+		t.Fatalf("vault create: %v", err)
+	}
+	if _, err := runCommand(t, "vault", vault("create")...); err == nil {
+		t.Error("vault create replaced an existing vault")
+	}
+
+	unlock := vault("unlock", "--encoding=hex")
+	masterKey, err := runCommand(t, "vault", unlock...)
+	if err != nil {
+		t.Fatalf("vault unlock: %v", err)
+	}
+	if len(strings.TrimSpace(masterKey)) != 64 {
+		t.Fatalf("vault unlock wrote %q, want a hex encoded 32-byte key", masterKey)
+	}
+	again, err := runCommand(t, "vault", unlock...)
+	if err != nil {
+		t.Fatalf("vault unlock: %v", err)
+	}
+	if again != masterKey {
+		t.Errorf("second unlock wrote %q, want %q", again, masterKey)
+	}
+
+	// Another authenticator is not enrolled in the vault
+	other := virtualFlags(t, t.TempDir(), "ci")
+	other = append(other, "--store-dir="+filepath.Join(dir, "store"), "--vault="+filepath.Join(dir, "vault.json"))
+	if _, err := runCommand(t, "vault", append(other, "unlock")...); err == nil ||
+		!strings.Contains(err.Error(), "not enrolled in the vault") {
+		t.Errorf("vault unlock with an authenticator that is not enrolled = %v, want it refused", err)
+	}
+
+	_, err = runCommand(t, "vault", vault("revoke", "--yes", "phone", "laptop", "desktop")...)
+	if err == nil || !strings.Contains(err.Error(), "no authenticator labeled 'phone', 'desktop'") {
+		t.Errorf("vault revoke of unknown labels = %v, want all of them reported", err)
+	}
+	if _, err := runCommand(t, "vault", vault("revoke", "--yes", "laptop")...); err == nil ||
+		!strings.Contains(err.Error(), "only authenticator") {
+		t.Errorf("vault revoke of the only authenticator = %v, want it refused", err)
+	}
+	if _, err := runCommand(t, "vault", unlock...); err != nil {
+		t.Errorf("vault unlock after the refused revoke: %v", err)
+	}
+}
+
+// verify only takes the salt inputs it rebuilds the salt from, and the encodings
+// of the output options.
+func TestVerifyFlags(t *testing.T) {
+	store := "--store-dir=" + t.TempDir()
+	if _, err := runCommand(t, "verify", store, "--no-discover", "--secret=AAAA"); err == nil {
+		t.Error("verify accepted --no-discover")
+	}
+	if _, err := runCommand(t, "verify", store, "--encoding=base32", "--secret=AAAA"); err == nil ||
+		!strings.Contains(err.Error(), "unknown encoding 'base32'") {
+		t.Errorf("verify with an unknown encoding = %v, want it rejected", err)
+	}
+	if _, err := runCommand(t, "verify", store, "--encoding=base64url", "--secret=AA+A"); err == nil ||
+		!strings.Contains(err.Error(), "failed to decode secret as base64url") {
+		t.Errorf("verify of an invalid base64url secret = %v, want a decoding error", err)
+	}
+}
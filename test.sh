@@ -37,6 +37,17 @@ echo ""
 # Array to store derived keys
 declare -a keys
 
+# Derivation requires an enrolled credential, enroll one unless the device already has it
+echo "Ensuring a credential is enrolled..."
+enroll_output=$(PIN="$PIN" "$BINARY" enroll --fido-device="$DEVICE_PATH" --pin-environment-variable=PIN 2>&1)
+if [ $? -ne 0 ] && ! echo "$enroll_output" | grep -q "already enrolled"; then
+    echo "  Error: Enrollment failed"
+    echo "  Full output:"
+    echo "$enroll_output"
+    exit 1
+fi
+echo ""
+
 echo "Running non-interactive key derivation tests..."
 echo ""
 